@@ -1,7 +1,5 @@
 import sqlite3
 import pandas as pd
-import requests
-import time
 
 db_path = "node_filter.db"
 table_name = "node_info"
@@ -9,36 +7,16 @@ domain_col = "domain"
 asn_col = "asn"
 cloud_provider_col = "cloud_provider"
 
-ASRANK_API_URL = "https://api.asrank.caida.org/v2/graphql"
-
-
-def get_as_rank(asn):
-    query = (
-        """
-    {
-      asn(asn: "%s") {
-        asn
-        rank
-        asnName
-      }
-    }
-    """
-        % asn
-    )
-
-    try:
-        response = requests.post(ASRANK_API_URL, json={"query": query})
-        if response.status_code == 200:
-            data = response.json()
-            if data.get("data", {}).get("asn"):
-                return {
-                    "rank": data["data"]["asn"].get("rank", 0),
-                    "name": data["data"]["asn"].get("asnName", "Unknown")
-                }
-        return {"rank": 999999, "name": "Unknown"}
-    except Exception as e:
-        print(f"Error fetching rank for ASN {asn}: {str(e)}")
-        return {"rank": 999999, "name": "Unknown"}
+# AS ranks and names come from the as_facts table enrich_as fills from local
+# CAIDA datasets, for the same run node_info shows
+facts_table = "as_facts"
+active_run = """
+    COALESCE(
+        (SELECT MAX(id) FROM runs WHERE finished_at IS NULL),
+        (SELECT id FROM runs WHERE pinned = 1 LIMIT 1),
+        (SELECT MAX(id) FROM runs WHERE finished_at IS NOT NULL))
+"""
+NO_RANK = 999999
 
 
 conn = sqlite3.connect(db_path)
@@ -59,22 +37,16 @@ query = f"""
 
 df = pd.read_sql_query(query, conn)
 
-print("\nFetching AS ranks and names from CAIDA ASRank API...")
-ranks = {}
-names = {}
-
-for i, row in enumerate(df.itertuples()):
-    asn = str(row.asn)
-    if asn not in ranks:
-        result = get_as_rank(asn)
-        ranks[asn] = result["rank"]
-        names[asn] = result["name"]
-        if i % 10 == 0 and i > 0:
-            print(f"Processed {i} ASNs...")
-            time.sleep(1)
+facts = pd.read_sql_query(
+    f"SELECT asn, rank, name FROM {facts_table} WHERE run_id = {active_run}", conn
+)
+if facts.empty:
+    print("No AS facts for the active run, run enrich_as first; ASes are left unranked")
+ranks = dict(zip(facts["asn"], facts["rank"]))
+names = dict(zip(facts["asn"], facts["name"]))
 
-df["as_rank"] = df["asn"].astype(str).map(ranks)
-df["as_name"] = df["asn"].astype(str).map(names)
+df["as_rank"] = df["asn"].map(ranks).fillna(NO_RANK).astype(int)
+df["as_name"] = df["asn"].map(names).fillna("Unknown")
 
 df = df[["as_rank", "asn", "as_name", "is_cloud", "instance_count"]]
 
@@ -2,6 +2,7 @@ import sqlite3
 import pandas as pd
 
 db_path = "node_filter.db"
+# node_info is a view of the collect_data results of the active crawl run
 table_name = "node_info"
 domain_col = "domain"
 cloud_provider_col = "cloud_provider"
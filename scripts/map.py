@@ -5,6 +5,7 @@ import matplotlib.pyplot as plt
 
 
 db_path = "node_filter.db"
+# node_info is a view of the collect_data results of the active crawl run
 table_name = "node_info"
 domain_col = "domain"
 country_code_col = "country_code"
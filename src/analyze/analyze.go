@@ -0,0 +1,243 @@
+package analyze
+
+import (
+	"encoding/csv"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+
+	"github.com/kothavade/mastodon-paper/config"
+	"github.com/kothavade/mastodon-paper/filter"
+	"github.com/kothavade/mastodon-paper/storage"
+)
+
+// Options controls what Analyze computes
+type Options struct {
+	// Dir is the directory the CSV files are written to
+	Dir string
+	// Samples is the number of source nodes path lengths and betweenness
+	// are estimated from, 0 for every node
+	Samples int
+	// Seed seeds the choice of source nodes
+	Seed uint64
+	// Directed follows peer edges only in the direction they were reported
+	// when measuring paths
+	Directed bool
+	// Reciprocal keeps only edges whose peer also reports the instance
+	Reciprocal bool
+	// AllPeers keeps every reported peer instead of only peers running supported software
+	AllPeers bool
+	// NullGraphs is the number of random graphs of every null model to
+	// compare the peer graph with, 0 to skip the comparison
+	NullGraphs int
+}
+
+// Analyze loads the peer graph of a run and writes its path lengths, degree
+// distribution, clustering, PageRank and betweenness to CSV files in
+// opts.Dir, compared with null models if opts.NullGraphs is set. An id of 0
+// uses the baseline run.
+func Analyze(cfg *config.Config, id int64, opts Options) error {
+	store, err := storage.Open(cfg.Paths.DB)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	run, err := store.RunOrBaseline(id)
+	if err != nil {
+		return err
+	}
+
+	edgeFilter := storage.EdgeFilter{Reciprocal: opts.Reciprocal}
+	if !opts.AllPeers {
+		edgeFilter.PeerSoftware = filter.SupportedSoftware()
+	}
+	g, err := Load(store, run.ID, edgeFilter)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Loaded run %d: %d nodes, %d peer edges\n", run.ID, g.Nodes(), g.Edges())
+
+	if err := os.MkdirAll(opts.Dir, 0o755); err != nil {
+		return err
+	}
+	workers := runtime.GOMAXPROCS(0)
+
+	pathOpts := PathOptions{
+		Samples:     opts.Samples,
+		Seed:        opts.Seed,
+		Directed:    opts.Directed,
+		Betweenness: true,
+		Workers:     workers,
+		Progress: func(done, total int) {
+			if done%100 == 0 || done == total {
+				fmt.Printf("Searched %d/%d sources\n", done, total)
+			}
+		},
+	}
+	paths := ShortestPaths(g, pathOpts)
+	clustering := Clustering(g, workers)
+	pageRank := PageRank(g)
+	observed := newMetrics(g, paths, clustering)
+
+	err = writeCSV(filepath.Join(opts.Dir, "average_path_length.csv"), [][]string{
+		{"estimatedAvgPathLength", "minPathLength", "maxPathLength", "stdDevPathLength", "pairsConsidered"},
+		{float(paths.Mean), strconv.Itoa(paths.Min), strconv.Itoa(paths.Max), float(paths.StdDev), strconv.FormatInt(paths.Pairs, 10)},
+	})
+	if err != nil {
+		return err
+	}
+
+	rows := [][]string{{"length", "pairs"}}
+	for d, count := range paths.Lengths {
+		if count > 0 {
+			rows = append(rows, []string{strconv.Itoa(d), strconv.FormatInt(count, 10)})
+		}
+	}
+	if err := writeCSV(filepath.Join(opts.Dir, "path_length_distribution.csv"), rows); err != nil {
+		return err
+	}
+
+	rows = [][]string{{"degree", "in", "out", "total"}}
+	for _, c := range DegreeDistribution(g) {
+		rows = append(rows, []string{strconv.Itoa(c.Degree), strconv.Itoa(c.In), strconv.Itoa(c.Out), strconv.Itoa(c.Total)})
+	}
+	if err := writeCSV(filepath.Join(opts.Dir, "degree_distribution.csv"), rows); err != nil {
+		return err
+	}
+
+	nodes := make([]int, g.Nodes())
+	for v := range nodes {
+		nodes[v] = v
+	}
+	// Most peered first, as in most-peered-instances.csv
+	slices.SortStableFunc(nodes, func(a, b int) int {
+		return g.InDegree(b) - g.InDegree(a)
+	})
+	rows = [][]string{{"domain", "in_degree", "out_degree", "degree", "clustering", "pagerank", "betweenness"}}
+	for _, v := range nodes {
+		rows = append(rows, []string{
+			g.Name(v),
+			strconv.Itoa(g.InDegree(v)),
+			strconv.Itoa(g.OutDegree(v)),
+			strconv.Itoa(g.Degree(v)),
+			float(clustering.Local[v]),
+			float(pageRank[v]),
+			float(paths.Betweenness[v]),
+		})
+	}
+	if err := writeCSV(filepath.Join(opts.Dir, "centrality.csv"), rows); err != nil {
+		return err
+	}
+
+	summary := [][]string{
+		{"metric", "value"},
+		{"run", strconv.FormatInt(run.ID, 10)},
+		{"nodes", strconv.Itoa(g.Nodes())},
+		{"edges", strconv.Itoa(g.Edges())},
+		{"undirected_edges", strconv.Itoa(g.UndirectedEdges())},
+		{"components", strconv.Itoa(observed.Components)},
+		{"largest_component", strconv.Itoa(observed.LargestComponent)},
+		{"path_sources", strconv.Itoa(paths.Sources)},
+		{"path_exact", strconv.FormatBool(paths.Exact)},
+		{"directed", strconv.FormatBool(opts.Directed)},
+		{"average_path_length", float(paths.Mean)},
+		{"diameter", strconv.Itoa(paths.Max)},
+		{"average_clustering", float(clustering.Average)},
+		{"transitivity", float(clustering.Transitivity)},
+		{"triangles", strconv.FormatInt(clustering.Triangles, 10)},
+	}
+	if err := writeCSV(filepath.Join(opts.Dir, "summary.csv"), summary); err != nil {
+		return err
+	}
+
+	diameter := "Diameter"
+	if !paths.Exact {
+		diameter = "Diameter (lower bound)"
+	}
+	fmt.Printf("Average path length: %.3f (std dev %.3f, %d pairs from %d sources)\n", paths.Mean, paths.StdDev, paths.Pairs, paths.Sources)
+	fmt.Printf("%s: %d\n", diameter, paths.Max)
+	fmt.Printf("Components: %d, largest %d nodes\n", observed.Components, observed.LargestComponent)
+	fmt.Printf("Average clustering: %.4f, transitivity %.4f\n", clustering.Average, clustering.Transitivity)
+
+	if opts.NullGraphs > 0 {
+		if err := writeNullModels(g, observed, opts, pathOpts); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("Wrote analysis of run %d to %s\n", run.ID, opts.Dir)
+	return nil
+}
+
+// writeNullModels compares the peer graph with random graphs, writing
+// null_models.csv and printing the metrics side by side
+func writeNullModels(g *Graph, observed Metrics, opts Options, pathOpts PathOptions) error {
+	results := CompareNullModels(g, observed, NullOptions{
+		Graphs: opts.NullGraphs,
+		Seed:   opts.Seed,
+		Paths:  pathOpts,
+		Progress: func(model string, done, total int) {
+			fmt.Printf("Measured %d/%d %s graphs\n", done, total, model)
+		},
+	})
+
+	rows := [][]string{{"metric", "observed", "model", "graphs", "mean", "std_dev", "ci_low", "ci_high", "z_score"}}
+	for _, r := range results {
+		rows = append(rows, []string{
+			r.Metric, float(r.Observed), r.Model, strconv.Itoa(len(r.Values)),
+			float(r.Mean), float(r.StdDev), float(r.Low), float(r.High), float(r.Z),
+		})
+	}
+	if err := writeCSV(filepath.Join(opts.Dir, "null_models.csv"), rows); err != nil {
+		return err
+	}
+
+	fmt.Printf("\n%-22s %12s  %-32s %-32s\n", "METRIC", "OBSERVED", ModelErdosRenyi+" (95% CI)", ModelConfiguration+" (95% CI)")
+	for i, metric := range metrics {
+		er, conf := results[i], results[len(metrics)+i]
+		fmt.Printf("%-22s %12s  %-32s %-32s\n", metric.name, short(er.Observed), interval(er), interval(conf))
+	}
+	fmt.Println()
+	return nil
+}
+
+// interval formats the mean and confidence interval of a null model's metric
+func interval(c NullComparison) string {
+	return fmt.Sprintf("%s [%s, %s]", short(c.Mean), short(c.Low), short(c.High))
+}
+
+// short formats a statistic for the terminal, whole numbers in full
+func short(f float64) string {
+	if f == math.Trunc(f) && math.Abs(f) < 1e15 {
+		return strconv.FormatFloat(f, 'f', 0, 64)
+	}
+	return strconv.FormatFloat(f, 'g', 4, 64)
+}
+
+// float formats a statistic to 10 significant digits, hiding the rounding
+// differences of summing in parallel. NaN is written as an empty field.
+func float(f float64) string {
+	if math.IsNaN(f) {
+		return ""
+	}
+	return strconv.FormatFloat(f, 'g', 10, 64)
+}
+
+// writeCSV writes rows to path
+func writeCSV(path string, rows [][]string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", path, err)
+	}
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	if err := w.WriteAll(rows); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return f.Close()
+}
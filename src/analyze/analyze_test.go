@@ -0,0 +1,185 @@
+package analyze
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/kothavade/mastodon-paper/fedtest"
+	"github.com/kothavade/mastodon-paper/filter"
+	"github.com/kothavade/mastodon-paper/process"
+)
+
+// build returns the graph with the given edges, each "from to"
+func build(edges ...[2]string) *Graph {
+	b := NewBuilder()
+	for _, e := range edges {
+		b.AddEdge(e[0], e[1])
+	}
+	return b.Graph()
+}
+
+// node returns the number of the node named domain
+func node(t *testing.T, g *Graph, domain string) int {
+	t.Helper()
+	for v := range g.Nodes() {
+		if g.Name(v) == domain {
+			return v
+		}
+	}
+	t.Fatalf("no node %s", domain)
+	return -1
+}
+
+func near(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func TestBuilder(t *testing.T) {
+	g := build([2]string{"a", "b"}, [2]string{"a", "b"}, [2]string{"b", "a"}, [2]string{"b", "b"}, [2]string{"b", "c"})
+	if g.Nodes() != 3 || g.Edges() != 3 || g.UndirectedEdges() != 2 {
+		t.Fatalf("got %d nodes, %d edges, %d undirected edges, want 3, 3 and 2", g.Nodes(), g.Edges(), g.UndirectedEdges())
+	}
+	b := node(t, g, "b")
+	if g.OutDegree(b) != 2 || g.InDegree(b) != 1 || g.Degree(b) != 2 {
+		t.Errorf("b has out %d, in %d, degree %d, want 2, 1 and 2", g.OutDegree(b), g.InDegree(b), g.Degree(b))
+	}
+}
+
+func TestShortestPaths(t *testing.T) {
+	// a - b - c - d, reported in one direction only
+	g := build([2]string{"a", "b"}, [2]string{"b", "c"}, [2]string{"c", "d"})
+
+	stats := ShortestPaths(g, PathOptions{Workers: 2, Betweenness: true})
+	if !stats.Exact || stats.Pairs != 6 || stats.Min != 1 || stats.Max != 3 || !near(stats.Mean, 10.0/6) {
+		t.Errorf("got %+v, want 6 pairs from 1 to 3 long with mean 10/6", stats)
+	}
+	if want := []int64{0, 3, 2, 1}; !slices.Equal(stats.Lengths, want) {
+		t.Errorf("got lengths %v, want %v", stats.Lengths, want)
+	}
+	for domain, want := range map[string]float64{"a": 0, "b": 2.0 / 3, "c": 2.0 / 3, "d": 0} {
+		if got := stats.Betweenness[node(t, g, domain)]; !near(got, want) {
+			t.Errorf("betweenness of %s is %v, want %v", domain, got, want)
+		}
+	}
+
+	directed := ShortestPaths(g, PathOptions{Directed: true, Workers: 2})
+	if directed.Pairs != 6 || directed.Max != 3 {
+		t.Errorf("directed: got %d pairs up to %d long, want 6 up to 3", directed.Pairs, directed.Max)
+	}
+	reversed := build([2]string{"b", "a"}, [2]string{"b", "c"}, [2]string{"c", "d"})
+	if got := ShortestPaths(reversed, PathOptions{Directed: true}).Pairs; got != 4 {
+		t.Errorf("directed with a unreachable: got %d pairs, want 4", got)
+	}
+
+	sampled := ShortestPaths(g, PathOptions{Samples: 2, Seed: 7, Workers: 2})
+	if sampled.Exact || sampled.Sources != 2 {
+		t.Errorf("sampled: got %d sources, exact %v, want 2 sources", sampled.Sources, sampled.Exact)
+	}
+	if again := ShortestPaths(g, PathOptions{Samples: 2, Seed: 7}); !slices.Equal(again.Lengths, sampled.Lengths) {
+		t.Errorf("the same seed gave lengths %v and %v", sampled.Lengths, again.Lengths)
+	}
+}
+
+func TestBetweennessStar(t *testing.T) {
+	g := build([2]string{"a", "hub"}, [2]string{"b", "hub"}, [2]string{"c", "hub"}, [2]string{"d", "hub"})
+	stats := ShortestPaths(g, PathOptions{Betweenness: true})
+	if got := stats.Betweenness[node(t, g, "hub")]; !near(got, 1) {
+		t.Errorf("betweenness of the hub is %v, want 1", got)
+	}
+	if stats.Mean != 1.6 || stats.Pairs != 10 {
+		t.Errorf("got mean %v over %d pairs, want 1.6 over 10", stats.Mean, stats.Pairs)
+	}
+}
+
+func TestClustering(t *testing.T) {
+	// A triangle a, b, c with d hanging off a
+	g := build([2]string{"a", "b"}, [2]string{"b", "c"}, [2]string{"c", "a"}, [2]string{"d", "a"})
+	want := map[string]float64{"a": 1.0 / 3, "b": 1, "c": 1, "d": 0}
+
+	for name, count := range map[string]func(*Graph, int) []int64{
+		"bitset":  trianglesBitset,
+		"forward": trianglesForward,
+	} {
+		triangles := count(g, 2)
+		for domain, n := range map[string]int64{"a": 1, "b": 1, "c": 1, "d": 0} {
+			if got := triangles[node(t, g, domain)]; got != n {
+				t.Errorf("%s: %s is in %d triangles, want %d", name, domain, got, n)
+			}
+		}
+	}
+
+	stats := Clustering(g, 2)
+	for domain, c := range want {
+		if got := stats.Local[node(t, g, domain)]; !near(got, c) {
+			t.Errorf("clustering of %s is %v, want %v", domain, got, c)
+		}
+	}
+	if !near(stats.Average, 7.0/12) || !near(stats.Transitivity, 0.6) || stats.Triangles != 1 {
+		t.Errorf("got average %v, transitivity %v, %d triangles, want 7/12, 0.6 and 1", stats.Average, stats.Transitivity, stats.Triangles)
+	}
+}
+
+func TestPageRank(t *testing.T) {
+	g := build([2]string{"a", "hub"}, [2]string{"b", "hub"}, [2]string{"c", "hub"}, [2]string{"hub", "a"})
+	rank := PageRank(g)
+
+	var sum float64
+	for _, r := range rank {
+		sum += r
+	}
+	if !near(sum, 1) {
+		t.Errorf("ranks sum to %v, want 1", sum)
+	}
+	hub := node(t, g, "hub")
+	for v, r := range rank {
+		if v != hub && r >= rank[hub] {
+			t.Errorf("%s ranks %v, not below the hub's %v", g.Name(v), r, rank[hub])
+		}
+	}
+}
+
+func TestDegreeDistribution(t *testing.T) {
+	g := build([2]string{"a", "hub"}, [2]string{"b", "hub"}, [2]string{"hub", "a"})
+	got := DegreeDistribution(g)
+	want := []DegreeCount{
+		{Degree: 0, In: 1, Out: 0, Total: 0},
+		{Degree: 1, In: 1, Out: 3, Total: 2},
+		{Degree: 2, In: 1, Out: 0, Total: 1},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("got %+v, want %+v", got[i], want[i])
+		}
+	}
+}
+
+func TestAnalyze(t *testing.T) {
+	instances := fedtest.Standard()
+	fedtest.Start(t, instances...)
+	cfg := fedtest.Config(t)
+	fedtest.WriteJSON(t, cfg.Paths.Nodes, fedtest.Domains(instances))
+	if err := filter.FilterNodes(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := process.ProcessNodes(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	if err := Analyze(cfg, 1, Options{Dir: dir, AllPeers: true, NullGraphs: 3, Seed: 1}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"average_path_length", "path_length_distribution", "degree_distribution", "centrality", "summary", "null_models"} {
+		got, err := os.ReadFile(filepath.Join(dir, name+".csv"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fedtest.Golden(t, name, string(got))
+	}
+}
@@ -0,0 +1,55 @@
+package analyze
+
+import "math"
+
+// Significance returns the disparity filter p-value of every edge, in the
+// order of w's rows (Serrano, Boguñá and Vespignani, 2009). From one end of
+// degree k and strength s, an edge of weight x has p-value (1-x/s)^(k-1),
+// the chance that a uniformly random split of s gives it as much. An edge is
+// as significant as it is for the end it matters most to; the edges of
+// nodes with one edge are never significant from that end.
+func Significance(w *Weighted) []float64 {
+	n := w.Nodes()
+	strength := make([]float64, n)
+	for v := range n {
+		strength[v] = w.Strength(v)
+	}
+	from := func(v int32, x float64) float64 {
+		k := w.adj.degree(v)
+		if k < 2 || strength[v] <= 0 {
+			return 1
+		}
+		return math.Pow(1-x/strength[v], float64(k-1))
+	}
+
+	alpha := make([]float64, len(w.adj.adj))
+	for v := range n {
+		for j, u := range w.adj.neighbors(int32(v)) {
+			i := w.adj.offsets[v] + int64(j)
+			alpha[i] = min(from(int32(v), w.weights[i]), from(u, w.weights[i]))
+		}
+	}
+	return alpha
+}
+
+// Backbone returns the edges of w whose disparity filter p-value is below
+// alpha, with the nodes of w, and the p-values of the kept edges in the order
+// of the backbone's rows. An alpha of 1 or more keeps every edge.
+func Backbone(w *Weighted, alpha float64) (*Weighted, []float64) {
+	significance := Significance(w)
+	n := w.Nodes()
+	backbone := &Weighted{names: w.names, adj: adjacency{offsets: make([]int64, n+1)}}
+	var kept []float64
+	for v := range n {
+		for j, u := range w.adj.neighbors(int32(v)) {
+			i := w.adj.offsets[v] + int64(j)
+			if significance[i] < alpha || alpha >= 1 {
+				backbone.adj.adj = append(backbone.adj.adj, u)
+				backbone.weights = append(backbone.weights, w.weights[i])
+				kept = append(kept, significance[i])
+			}
+		}
+		backbone.adj.offsets[v+1] = int64(len(backbone.adj.adj))
+	}
+	return backbone, kept
+}
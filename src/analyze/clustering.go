@@ -0,0 +1,210 @@
+package analyze
+
+import (
+	"math/bits"
+	"sync"
+)
+
+// maxBitsetNodes is the largest graph whose triangles are counted with one
+// bitset row per node, n²/8 bytes in total
+const maxBitsetNodes = 1 << 15
+
+// ClusteringStats describes how often the neighbours of a node are
+// neighbours of each other, ignoring edge direction
+type ClusteringStats struct {
+	// Local is the clustering coefficient of every node, 0 for nodes with
+	// fewer than two neighbours
+	Local []float64
+	// Average is the mean of Local over every node
+	Average float64
+	// Transitivity is three times the number of triangles divided by the
+	// number of connected triples
+	Transitivity float64
+	// Triangles is the number of triangles in the graph
+	Triangles int64
+}
+
+// Clustering counts the triangles every node is part of
+func Clustering(g *Graph, workers int) ClusteringStats {
+	var triangles []int64
+	if g.Nodes() <= maxBitsetNodes {
+		triangles = trianglesBitset(g, max(workers, 1))
+	} else {
+		triangles = trianglesForward(g, max(workers, 1))
+	}
+
+	n := g.Nodes()
+	stats := ClusteringStats{Local: make([]float64, n)}
+	var corners, triples int64
+	for v := range n {
+		d := int64(g.Degree(v))
+		if d < 2 {
+			continue
+		}
+		stats.Local[v] = float64(2*triangles[v]) / float64(d*(d-1))
+		stats.Average += stats.Local[v]
+		corners += triangles[v]
+		triples += d * (d - 1) / 2
+	}
+	if n > 0 {
+		stats.Average /= float64(n)
+	}
+	if triples > 0 {
+		stats.Transitivity = float64(corners) / float64(triples)
+	}
+	stats.Triangles = corners / 3
+	return stats
+}
+
+// trianglesBitset counts the triangles of every node from the neighbours it
+// shares with each of its neighbours
+func trianglesBitset(g *Graph, workers int) []int64 {
+	common := commonNeighborsBitset(g, workers)
+	triangles := make([]int64, g.Nodes())
+	for v := range triangles {
+		var count int64
+		for _, c := range common[g.und.offsets[v]:g.und.offsets[v+1]] {
+			count += int64(c)
+		}
+		// Each triangle through v was found from both of its other corners
+		triangles[v] = count / 2
+	}
+	return triangles
+}
+
+// commonNeighbors returns the number of neighbours both ends of every edge
+// share, ignoring direction, in the order of the edges in g.und
+func commonNeighbors(g *Graph, workers int) []int32 {
+	if g.Nodes() <= maxBitsetNodes {
+		return commonNeighborsBitset(g, workers)
+	}
+	common := make([]int32, len(g.und.adj))
+	parallel(g.Nodes(), workers, func(v int) {
+		row := g.und.neighbors(int32(v))
+		for i, u := range row {
+			common[g.und.offsets[v]+int64(i)] = int32(intersect(row, g.und.neighbors(u)))
+		}
+	})
+	return common
+}
+
+// commonNeighborsBitset is commonNeighbors intersecting neighbour bitsets.
+// Fast on the dense graphs peer lists make, but needs n² bits.
+func commonNeighborsBitset(g *Graph, workers int) []int32 {
+	n := g.Nodes()
+	words := (n + 63) / 64
+	rows := make([]uint64, n*words)
+	for v := range n {
+		row := rows[v*words : (v+1)*words]
+		for _, u := range g.und.neighbors(int32(v)) {
+			row[u/64] |= 1 << (u % 64)
+		}
+	}
+
+	common := make([]int32, len(g.und.adj))
+	parallel(n, workers, func(v int) {
+		row := rows[v*words : (v+1)*words]
+		for i, u := range g.und.neighbors(int32(v)) {
+			other := rows[int(u)*words : (int(u)+1)*words]
+			count := 0
+			for j, w := range row {
+				count += bits.OnesCount64(w & other[j])
+			}
+			common[g.und.offsets[v]+int64(i)] = int32(count)
+		}
+	})
+	return common
+}
+
+// intersect returns the number of values two sorted slices share
+func intersect(a, b []int32) int {
+	count := 0
+	for len(a) > 0 && len(b) > 0 {
+		switch {
+		case a[0] < b[0]:
+			a = a[1:]
+		case a[0] > b[0]:
+			b = b[1:]
+		default:
+			count++
+			a, b = a[1:], b[1:]
+		}
+	}
+	return count
+}
+
+// trianglesForward counts the triangles of every node by ranking nodes by
+// degree and finding each triangle once from its lowest ranked corner, for
+// graphs too large for trianglesBitset
+func trianglesForward(g *Graph, workers int) []int64 {
+	n := g.Nodes()
+	higher := func(u, v int32) bool {
+		du, dv := g.und.degree(u), g.und.degree(v)
+		return du > dv || du == dv && u > v
+	}
+
+	counts := make([][]int64, workers)
+	marks := make([][]int32, workers)
+	for i := range workers {
+		counts[i] = make([]int64, n)
+		marks[i] = make([]int32, n)
+		for v := range marks[i] {
+			marks[i][v] = -1
+		}
+	}
+	parallelWorker(n, workers, func(worker, v int) {
+		count, mark := counts[worker], marks[worker]
+		v32 := int32(v)
+		for _, u := range g.und.neighbors(v32) {
+			if higher(u, v32) {
+				mark[u] = v32
+			}
+		}
+		for _, u := range g.und.neighbors(v32) {
+			if !higher(u, v32) {
+				continue
+			}
+			for _, w := range g.und.neighbors(u) {
+				if higher(w, u) && mark[w] == v32 {
+					count[v]++
+					count[u]++
+					count[w]++
+				}
+			}
+		}
+	})
+
+	triangles := make([]int64, n)
+	for _, count := range counts {
+		for v, c := range count {
+			triangles[v] += c
+		}
+	}
+	return triangles
+}
+
+// parallel calls fn for every node, spread over workers goroutines
+func parallel(n, workers int, fn func(v int)) {
+	parallelWorker(n, workers, func(_, v int) { fn(v) })
+}
+
+// parallelWorker calls fn for every node with the number of the worker
+// goroutine calling it
+func parallelWorker(n, workers int, fn func(worker, v int)) {
+	var wg sync.WaitGroup
+	next := make(chan int, workers)
+	for i := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for v := range next {
+				fn(i, v)
+			}
+		}()
+	}
+	for v := range n {
+		next <- v
+	}
+	close(next)
+	wg.Wait()
+}
@@ -0,0 +1,208 @@
+package analyze
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/kothavade/mastodon-paper/config"
+	"github.com/kothavade/mastodon-paper/filter"
+	"github.com/kothavade/mastodon-paper/storage"
+)
+
+// CommunityOptions controls how Communities weighs the peer graph and
+// finds its communities
+type CommunityOptions struct {
+	// Dir is the directory the CSV files are written to
+	Dir string
+	// Weight is one of Weights
+	Weight string
+	// Alpha is the disparity filter p-value below which edges are kept in
+	// the backbone
+	Alpha float64
+	// Resolution scales the modularity expected at random; above 1 favours
+	// smaller communities
+	Resolution float64
+	// Seed seeds the order nodes are moved in
+	Seed uint64
+	// Reciprocal keeps only edges whose peer also reports the instance
+	Reciprocal bool
+	// AllPeers keeps every reported peer instead of only peers running supported software
+	AllPeers bool
+}
+
+// Communities loads the peer graph of a run, weighs its edges, keeps the
+// backbone of significant edges and finds its communities, writing every
+// instance's community, the backbone and a summary to CSV files in
+// opts.Dir. The peer graph itself is too close to complete for community
+// detection to find anything. An id of 0 uses the baseline run.
+func Communities(cfg *config.Config, id int64, opts CommunityOptions) error {
+	store, err := storage.Open(cfg.Paths.DB)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	run, err := store.RunOrBaseline(id)
+	if err != nil {
+		return err
+	}
+
+	edgeFilter := storage.EdgeFilter{Reciprocal: opts.Reciprocal}
+	if !opts.AllPeers {
+		edgeFilter.PeerSoftware = filter.SupportedSoftware()
+	}
+	g, err := Load(store, run.ID, edgeFilter)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Loaded run %d: %d nodes, %d peer edges\n", run.ID, g.Nodes(), g.Edges())
+
+	var locations []Location
+	if opts.Weight == WeightAffinity {
+		locations, err = loadLocations(store, run.ID, g)
+		if err != nil {
+			return err
+		}
+	}
+	weighted, err := Weigh(g, opts.Weight, locations, runtime.GOMAXPROCS(0))
+	if err != nil {
+		return err
+	}
+
+	backbone, significance := Backbone(weighted, opts.Alpha)
+	backboneNodes := 0
+	for v := range backbone.Nodes() {
+		if backbone.Degree(v) > 0 {
+			backboneNodes++
+		}
+	}
+	fmt.Printf("Backbone at alpha %g: %d of %d edges, %d nodes\n", opts.Alpha, backbone.Edges(), weighted.Edges(), backboneNodes)
+
+	if backbone.Edges() == 0 && weighted.Edges() > 0 {
+		fmt.Println("No edge is significant: the weights are too even for the disparity filter, try a larger -alpha")
+	}
+
+	partition := Louvain(backbone, opts.Resolution, opts.Seed)
+	// The communities' modularity over every weighted edge, not only the
+	// backbone, shows how much of the structure holds in the whole graph
+	weightedModularity := Modularity(weighted, partition.Community, opts.Resolution)
+
+	if err := os.MkdirAll(opts.Dir, 0o755); err != nil {
+		return err
+	}
+
+	rows := [][]string{{"domain", "community", "degree", "backbone_degree", "backbone_strength"}}
+	for v := range g.Nodes() {
+		community := ""
+		if c := partition.Community[v]; c >= 0 {
+			community = strconv.Itoa(c)
+		}
+		rows = append(rows, []string{
+			g.Name(v),
+			community,
+			strconv.Itoa(g.Degree(v)),
+			strconv.Itoa(backbone.Degree(v)),
+			float(backbone.Strength(v)),
+		})
+	}
+	if err := writeCSV(filepath.Join(opts.Dir, "communities.csv"), rows); err != nil {
+		return err
+	}
+
+	// Every backbone edge once, from its lower numbered end
+	rows = [][]string{{"domain", "peer", "weight", "alpha"}}
+	for v := range backbone.Nodes() {
+		weights := backbone.row(v)
+		for j, u := range backbone.adj.neighbors(int32(v)) {
+			if int(u) > v {
+				i := backbone.adj.offsets[v] + int64(j)
+				rows = append(rows, []string{g.Name(v), g.Name(int(u)), float(weights[j]), float(significance[i])})
+			}
+		}
+	}
+	if err := writeCSV(filepath.Join(opts.Dir, "backbone.csv"), rows); err != nil {
+		return err
+	}
+
+	summary := [][]string{
+		{"metric", "value"},
+		{"run", strconv.FormatInt(run.ID, 10)},
+		{"weight", opts.Weight},
+		{"alpha", float(opts.Alpha)},
+		{"resolution", float(opts.Resolution)},
+		{"seed", strconv.FormatUint(opts.Seed, 10)},
+		{"nodes", strconv.Itoa(g.Nodes())},
+		{"undirected_edges", strconv.Itoa(weighted.Edges())},
+		{"backbone_nodes", strconv.Itoa(backboneNodes)},
+		{"backbone_edges", strconv.Itoa(backbone.Edges())},
+		{"communities", strconv.Itoa(len(partition.Sizes))},
+		{"levels", strconv.Itoa(partition.Levels)},
+		{"modularity", float(partition.Modularity)},
+		{"weighted_modularity", float(weightedModularity)},
+	}
+	if err := writeCSV(filepath.Join(opts.Dir, "community_summary.csv"), summary); err != nil {
+		return err
+	}
+
+	fmt.Printf("Communities: %d, modularity %.4f on the backbone, %.4f on every %s-weighted edge\n",
+		len(partition.Sizes), partition.Modularity, weightedModularity, opts.Weight)
+	printCommunities(backbone, partition)
+	fmt.Printf("Wrote communities of run %d to %s\n", run.ID, opts.Dir)
+	return nil
+}
+
+// printCommunities prints the size and best connected members of the
+// largest communities
+func printCommunities(backbone *Weighted, partition Partition) {
+	const shown, members = 10, 3
+	top := make([][]int, min(shown, len(partition.Sizes)))
+	for v, c := range partition.Community {
+		if c >= 0 && c < len(top) {
+			top[c] = append(top[c], v)
+		}
+	}
+	for c, nodes := range top {
+		slices.SortStableFunc(nodes, func(a, b int) int {
+			return backbone.Degree(b) - backbone.Degree(a)
+		})
+		var names []string
+		for _, v := range nodes[:min(members, len(nodes))] {
+			names = append(names, backbone.Name(v))
+		}
+		fmt.Printf("  %3d  %6d instances  %s\n", c, partition.Sizes[c], strings.Join(names, ", "))
+	}
+	if len(partition.Sizes) > shown {
+		fmt.Printf("  ... %d more\n", len(partition.Sizes)-shown)
+	}
+}
+
+// loadLocations returns the country and AS every node of g is hosted in, as
+// far as the run geolocated it
+func loadLocations(store *storage.Store, runID int64, g *Graph) ([]Location, error) {
+	records, err := store.InstancesWithStatus(runID, storage.StageFilter, storage.StatusSuccess)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query instances: %w", err)
+	}
+	byDomain := map[string]Location{}
+	for _, r := range records {
+		var l Location
+		if r.CountryCode != nil {
+			l.Country = *r.CountryCode
+		}
+		if r.ASN != nil {
+			l.ASN = *r.ASN
+		}
+		byDomain[r.Domain] = l
+	}
+
+	locations := make([]Location, g.Nodes())
+	for v := range locations {
+		locations[v] = byDomain[g.Name(v)]
+	}
+	return locations, nil
+}
@@ -0,0 +1,146 @@
+package analyze
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kothavade/mastodon-paper/fedtest"
+	"github.com/kothavade/mastodon-paper/filter"
+	"github.com/kothavade/mastodon-paper/process"
+)
+
+// cliques returns two cliques of four nodes, a0..a3 and b0..b3, joined by
+// the edge a0 - b0
+func cliques() *Graph {
+	b := NewBuilder()
+	for _, group := range []string{"a", "b"} {
+		for i := range 4 {
+			for j := range i {
+				b.AddEdge(fmt.Sprintf("%s%d", group, i), fmt.Sprintf("%s%d", group, j))
+			}
+		}
+	}
+	b.AddEdge("a0", "b0")
+	return b.Graph()
+}
+
+func TestLouvain(t *testing.T) {
+	g := cliques()
+	w := ReciprocityWeights(g)
+	p := Louvain(w, 1, 1)
+	if len(p.Sizes) != 2 || p.Sizes[0] != 4 || p.Sizes[1] != 4 {
+		t.Fatalf("got communities of %v, want two of 4", p.Sizes)
+	}
+	for v := range g.Nodes() {
+		if same := p.Community[v] == p.Community[node(t, g, "a1")]; same != (g.Name(v)[0] == 'a') {
+			t.Errorf("%s is in community %d", g.Name(v), p.Community[v])
+		}
+	}
+	// Each clique holds 6 of the 13 edges and 13 of the 26 edge ends
+	if want := 2 * (6.0/13 - 0.25); !near(p.Modularity, want) {
+		t.Errorf("got modularity %v, want %v", p.Modularity, want)
+	}
+	if got := Modularity(w, make([]int, g.Nodes()), 1); !near(got, 0) {
+		t.Errorf("one community has modularity %v, want 0", got)
+	}
+}
+
+func TestSplitDisconnected(t *testing.T) {
+	g := build([2]string{"a", "b"}, [2]string{"c", "d"})
+	w := ReciprocityWeights(g)
+	split := splitDisconnected(w, make([]int, g.Nodes()))
+	if split[node(t, g, "a")] != split[node(t, g, "b")] || split[node(t, g, "a")] == split[node(t, g, "c")] {
+		t.Errorf("got %v, want a and b apart from c and d", split)
+	}
+}
+
+func TestWeights(t *testing.T) {
+	// a and b report each other; c reports a; a, b and c form a triangle
+	g := build([2]string{"a", "b"}, [2]string{"b", "a"}, [2]string{"c", "a"}, [2]string{"b", "c"}, [2]string{"c", "d"})
+	weight := func(w *Weighted, from, to string) float64 {
+		v, u := node(t, g, from), node(t, g, to)
+		for j, x := range w.adj.neighbors(int32(v)) {
+			if int(x) == u {
+				return w.row(v)[j]
+			}
+		}
+		t.Fatalf("no edge %s - %s", from, to)
+		return 0
+	}
+
+	reciprocity := ReciprocityWeights(g)
+	if weight(reciprocity, "a", "b") != 2 || weight(reciprocity, "b", "a") != 2 || weight(reciprocity, "a", "c") != 1 {
+		t.Errorf("reciprocity weights are wrong: %v", reciprocity.weights)
+	}
+
+	// a and b share c out of a, b and c; b and c share a out of a, b, c and d
+	jaccard := JaccardWeights(g, 2)
+	if !near(weight(jaccard, "a", "b"), 1.0/3) || !near(weight(jaccard, "c", "b"), 1.0/4) || weight(jaccard, "c", "d") != 0 {
+		t.Errorf("jaccard weights are wrong: %v", jaccard.weights)
+	}
+
+	locations := make([]Location, g.Nodes())
+	locations[node(t, g, "a")] = Location{Country: "DE", ASN: 24940}
+	locations[node(t, g, "b")] = Location{Country: "DE", ASN: 24940}
+	locations[node(t, g, "c")] = Location{Country: "DE", ASN: 16509}
+	affinity := AffinityWeights(g, locations)
+	if weight(affinity, "a", "b") != 3 || weight(affinity, "a", "c") != 2 || weight(affinity, "c", "d") != 1 {
+		t.Errorf("affinity weights are wrong: %v", affinity.weights)
+	}
+
+	if _, err := Weigh(g, "distance", nil, 1); err == nil {
+		t.Error("an unknown weight was accepted")
+	}
+}
+
+func TestBackbone(t *testing.T) {
+	// A hub with one heavy edge among five
+	g := build([2]string{"hub", "a"}, [2]string{"hub", "b"}, [2]string{"hub", "c"}, [2]string{"hub", "d"}, [2]string{"hub", "e"})
+	a := int32(node(t, g, "a"))
+	w := newWeighted(g, func(v, u int32, _ int64) float64 {
+		if v == a || u == a {
+			return 10
+		}
+		return 1
+	})
+
+	backbone, alpha := Backbone(w, 0.05)
+	if backbone.Edges() != 1 || backbone.Degree(int(a)) != 1 {
+		t.Fatalf("kept %d edges, want only hub - a", backbone.Edges())
+	}
+	// From the hub, (1 - 10/14)^4
+	if want := 0.0066638900458142; !near(alpha[0], want) {
+		t.Errorf("got p-value %v, want %v", alpha[0], want)
+	}
+	if all, _ := Backbone(w, 1); all.Edges() != 5 {
+		t.Errorf("alpha 1 kept %d edges, want 5", all.Edges())
+	}
+}
+
+func TestCommunities(t *testing.T) {
+	instances := fedtest.Standard()
+	fedtest.Start(t, instances...)
+	cfg := fedtest.Config(t)
+	fedtest.WriteJSON(t, cfg.Paths.Nodes, fedtest.Domains(instances))
+	if err := filter.FilterNodes(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := process.ProcessNodes(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	opts := CommunityOptions{Dir: dir, Weight: WeightReciprocity, Alpha: 1, Resolution: 1, Seed: 1, AllPeers: true}
+	if err := Communities(cfg, 1, opts); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"communities", "backbone", "community_summary"} {
+		got, err := os.ReadFile(filepath.Join(dir, name+".csv"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fedtest.Golden(t, name, string(got))
+	}
+}
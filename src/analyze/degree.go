@@ -0,0 +1,37 @@
+package analyze
+
+// DegreeCount is the number of nodes with a degree
+type DegreeCount struct {
+	Degree int
+	// In counts the nodes reported by Degree others
+	In int
+	// Out counts the nodes reporting Degree peers
+	Out int
+	// Total counts the nodes joined to Degree others in either direction
+	Total int
+}
+
+// DegreeDistribution returns how many nodes have every degree that at least
+// one node has, in any direction, ordered by degree
+func DegreeDistribution(g *Graph) []DegreeCount {
+	var counts []DegreeCount
+	count := func(d int) *DegreeCount {
+		for len(counts) <= d {
+			counts = append(counts, DegreeCount{Degree: len(counts)})
+		}
+		return &counts[d]
+	}
+	for v := range g.Nodes() {
+		count(g.InDegree(v)).In++
+		count(g.OutDegree(v)).Out++
+		count(g.Degree(v)).Total++
+	}
+
+	dist := counts[:0]
+	for _, c := range counts {
+		if c.In > 0 || c.Out > 0 || c.Total > 0 {
+			dist = append(dist, c)
+		}
+	}
+	return dist
+}
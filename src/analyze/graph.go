@@ -0,0 +1,214 @@
+// Package analyze computes network statistics of the peer graph in process:
+// path lengths, degree distributions, clustering, PageRank, betweenness and
+// communities.
+package analyze
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/kothavade/mastodon-paper/storage"
+)
+
+// Graph is an immutable peer graph. Nodes are numbered from 0 and their
+// edges are kept in compressed sparse rows, once following the reported
+// direction, once against it and once ignoring it.
+type Graph struct {
+	names []string
+	out   adjacency
+	in    adjacency
+	und   adjacency
+}
+
+// adjacency lists the neighbours of every node in one slice; the neighbours
+// of v are adj[offsets[v]:offsets[v+1]], sorted
+type adjacency struct {
+	offsets []int64
+	adj     []int32
+}
+
+func (a adjacency) neighbors(v int32) []int32 {
+	return a.adj[a.offsets[v]:a.offsets[v+1]]
+}
+
+func (a adjacency) degree(v int32) int {
+	return int(a.offsets[v+1] - a.offsets[v])
+}
+
+// Nodes returns the number of nodes
+func (g *Graph) Nodes() int {
+	return len(g.names)
+}
+
+// Edges returns the number of directed edges
+func (g *Graph) Edges() int {
+	return len(g.out.adj)
+}
+
+// UndirectedEdges returns the number of node pairs joined in either direction
+func (g *Graph) UndirectedEdges() int {
+	return len(g.und.adj) / 2
+}
+
+// Name returns the domain of node v
+func (g *Graph) Name(v int) string {
+	return g.names[v]
+}
+
+// OutDegree returns the number of peers node v reports
+func (g *Graph) OutDegree(v int) int {
+	return g.out.degree(int32(v))
+}
+
+// InDegree returns the number of nodes reporting node v as a peer
+func (g *Graph) InDegree(v int) int {
+	return g.in.degree(int32(v))
+}
+
+// Degree returns the number of nodes joined to node v in either direction
+func (g *Graph) Degree(v int) int {
+	return g.und.degree(int32(v))
+}
+
+// Builder collects the nodes and edges of a Graph
+type Builder struct {
+	names []string
+	index map[string]int32
+	edges [][2]int32
+}
+
+// NewBuilder returns an empty Builder
+func NewBuilder() *Builder {
+	return &Builder{index: map[string]int32{}}
+}
+
+// AddNode adds a node named domain if it doesn't exist yet and returns its number
+func (b *Builder) AddNode(domain string) int {
+	if v, ok := b.index[domain]; ok {
+		return int(v)
+	}
+	v := int32(len(b.names))
+	b.names = append(b.names, domain)
+	b.index[domain] = v
+	return int(v)
+}
+
+// AddEdge adds an edge from the node named domain to the node named peer,
+// adding the nodes as needed
+func (b *Builder) AddEdge(domain, peer string) {
+	b.AddEdgeIndex(b.AddNode(domain), b.AddNode(peer))
+}
+
+// AddEdgeIndex adds an edge between two nodes that were already added
+func (b *Builder) AddEdgeIndex(from, to int) {
+	b.edges = append(b.edges, [2]int32{int32(from), int32(to)})
+}
+
+// Graph returns the graph built so far. Self-loops and repeated edges are
+// dropped.
+func (b *Builder) Graph() *Graph {
+	return newGraph(slices.Clone(b.names), b.edges)
+}
+
+// newGraph returns the graph of the named nodes and the edges between them,
+// dropping self-loops and repeated edges
+func newGraph(names []string, edges [][2]int32) *Graph {
+	n := len(names)
+	each := func(add func(from, to int32)) {
+		for _, e := range edges {
+			if e[0] != e[1] {
+				add(e[0], e[1])
+			}
+		}
+	}
+	return &Graph{
+		names: names,
+		out:   newAdjacency(n, each),
+		in: newAdjacency(n, func(add func(from, to int32)) {
+			each(func(from, to int32) { add(to, from) })
+		}),
+		und: newAdjacency(n, func(add func(from, to int32)) {
+			each(func(from, to int32) {
+				add(from, to)
+				add(to, from)
+			})
+		}),
+	}
+}
+
+// newAdjacency builds the rows of n nodes from the edges each passes to add,
+// which it calls twice: once to size the rows and once to fill them
+func newAdjacency(n int, each func(add func(from, to int32))) adjacency {
+	offsets := make([]int64, n+1)
+	each(func(from, _ int32) { offsets[from+1]++ })
+	for v := range n {
+		offsets[v+1] += offsets[v]
+	}
+
+	adj := make([]int32, offsets[n])
+	next := slices.Clone(offsets[:n])
+	each(func(from, to int32) {
+		adj[next[from]] = to
+		next[from]++
+	})
+
+	// Sort every row and drop repeated edges, packing the rows together
+	end := int64(0)
+	for v := range n {
+		row := adj[offsets[v]:offsets[v+1]]
+		slices.Sort(row)
+		row = slices.Compact(row)
+		offsets[v] = end
+		end += int64(copy(adj[end:], row))
+	}
+	offsets[n] = end
+	return adjacency{offsets: offsets, adj: slices.Clip(adj[:end])}
+}
+
+// Load builds the peer graph of a run: every instance the filter stage found
+// and every edge that passes filter, with the peers it reaches
+func Load(store *storage.Store, runID int64, filter storage.EdgeFilter) (*Graph, error) {
+	b := NewBuilder()
+	domains, err := store.DomainsWithStatus(runID, storage.StageFilter, storage.StatusSuccess)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query instances: %w", err)
+	}
+	for _, domain := range domains {
+		b.AddNode(domain)
+	}
+
+	err = store.EachPeerEdge(runID, filter, func(domain, peer string) error {
+		b.AddEdge(domain, peer)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query peer edges: %w", err)
+	}
+	return b.Graph(), nil
+}
+
+// Components returns the number of connected components of the graph,
+// ignoring edge direction, and the number of nodes in the largest
+func (g *Graph) Components() (count, largest int) {
+	n := g.Nodes()
+	seen := make([]bool, n)
+	var queue []int32
+	for s := range n {
+		if seen[s] {
+			continue
+		}
+		count++
+		seen[s] = true
+		queue = append(queue[:0], int32(s))
+		for i := 0; i < len(queue); i++ {
+			for _, w := range g.und.neighbors(queue[i]) {
+				if !seen[w] {
+					seen[w] = true
+					queue = append(queue, w)
+				}
+			}
+		}
+		largest = max(largest, len(queue))
+	}
+	return count, largest
+}
@@ -0,0 +1,301 @@
+package analyze
+
+import (
+	"cmp"
+	"math/rand/v2"
+	"slices"
+)
+
+// Partition assigns the nodes of a weighted graph to communities
+type Partition struct {
+	// Community is the community of every node, numbered from 0 largest
+	// first, or -1 for nodes without edges
+	Community []int
+	// Sizes is the number of nodes in every community
+	Sizes []int
+	// Modularity is the modularity of the partition at the resolution it
+	// was found with
+	Modularity float64
+	// Levels is the number of times communities were merged into nodes
+	Levels int
+}
+
+// louvainLevel is a weighted graph whose nodes are communities of the level
+// below. self is the weight of the edges inside every node, counting both
+// directions.
+type louvainLevel struct {
+	adj     adjacency
+	weights []float64
+	self    []float64
+}
+
+// Louvain finds communities of high modularity (Blondel et al., 2008): it
+// moves nodes between the communities of their neighbours while that gains
+// modularity, merges every community into a node and repeats. Communities
+// the merges left disconnected are then split into their components, which
+// Leiden (Traag et al., 2019) guarantees and only raises modularity. A
+// resolution above 1 favours smaller communities. The same seed gives the
+// same communities.
+func Louvain(w *Weighted, resolution float64, seed uint64) Partition {
+	n := w.Nodes()
+	rng := rand.New(rand.NewPCG(seed, seed))
+	member := make([]int, n)
+	for v := range member {
+		member[v] = v
+	}
+
+	level := louvainLevel{adj: w.adj, weights: w.weights, self: make([]float64, n)}
+	levels := 0
+	for {
+		community, count, moved := level.move(resolution, rng)
+		if !moved {
+			break
+		}
+		for v := range member {
+			member[v] = community[member[v]]
+		}
+		level = level.aggregate(community, count)
+		levels++
+	}
+
+	split := splitDisconnected(w, member)
+	p := Partition{Community: split, Sizes: number(split, w), Levels: levels}
+	p.Modularity = Modularity(w, p.Community, resolution)
+	return p
+}
+
+// move moves every node, in random order, into the neighbouring community
+// that gains the most modularity until no move gains any, and returns the
+// community of every node numbered from 0, the number of communities and
+// whether any node moved
+func (l louvainLevel) move(resolution float64, rng *rand.Rand) ([]int, int, bool) {
+	n := len(l.self)
+	strength := make([]float64, n)
+	var total float64
+	for v := range n {
+		strength[v] = l.self[v]
+		for _, x := range l.weights[l.adj.offsets[v]:l.adj.offsets[v+1]] {
+			strength[v] += x
+		}
+		total += strength[v]
+	}
+
+	community := make([]int, n)
+	for v := range community {
+		community[v] = v
+	}
+	if total == 0 {
+		return community, n, false
+	}
+	sum := slices.Clone(strength)
+	order := rng.Perm(n)
+
+	// linked accumulates the weight from the moving node to every
+	// neighbouring community listed in neighbors
+	linked := make([]float64, n)
+	listed := make([]bool, n)
+	var neighbors []int
+	moved := false
+	for improved := true; improved; {
+		improved = false
+		for _, v := range order {
+			row := l.adj.neighbors(int32(v))
+			weights := l.weights[l.adj.offsets[v]:l.adj.offsets[v+1]]
+			for j, u := range row {
+				if int(u) == v {
+					continue
+				}
+				c := community[u]
+				if !listed[c] {
+					listed[c] = true
+					neighbors = append(neighbors, c)
+				}
+				linked[c] += weights[j]
+			}
+
+			// The gain of joining c is linked[c] - resolution·sum[c]·strength[v]/total,
+			// up to a factor the same for every community
+			own := community[v]
+			sum[own] -= strength[v]
+			best := own
+			bestGain := linked[own] - resolution*sum[own]*strength[v]/total
+			for _, c := range neighbors {
+				gain := linked[c] - resolution*sum[c]*strength[v]/total
+				if gain > bestGain+1e-12 {
+					best, bestGain = c, gain
+				}
+			}
+			sum[best] += strength[v]
+			community[v] = best
+			if best != own {
+				improved, moved = true, true
+			}
+
+			for _, c := range neighbors {
+				linked[c] = 0
+				listed[c] = false
+			}
+			neighbors = neighbors[:0]
+		}
+	}
+
+	// Number the communities that are left from 0
+	index := make([]int, n)
+	for c := range index {
+		index[c] = -1
+	}
+	count := 0
+	for v, c := range community {
+		if index[c] < 0 {
+			index[c] = count
+			count++
+		}
+		community[v] = index[c]
+	}
+	return community, count, moved
+}
+
+// aggregate returns the level whose nodes are the count communities of l
+func (l louvainLevel) aggregate(community []int, count int) louvainLevel {
+	members := make([][]int32, count)
+	for v, c := range community {
+		members[c] = append(members[c], int32(v))
+	}
+
+	next := louvainLevel{adj: adjacency{offsets: make([]int64, count+1)}, self: make([]float64, count)}
+	linked := make([]float64, count)
+	listed := make([]bool, count)
+	var neighbors []int
+	for c, nodes := range members {
+		for _, v := range nodes {
+			next.self[c] += l.self[v]
+			weights := l.weights[l.adj.offsets[v]:l.adj.offsets[v+1]]
+			for j, u := range l.adj.neighbors(v) {
+				d := community[u]
+				if d == c {
+					next.self[c] += weights[j]
+					continue
+				}
+				if !listed[d] {
+					listed[d] = true
+					neighbors = append(neighbors, d)
+				}
+				linked[d] += weights[j]
+			}
+		}
+		slices.Sort(neighbors)
+		for _, d := range neighbors {
+			next.adj.adj = append(next.adj.adj, int32(d))
+			next.weights = append(next.weights, linked[d])
+			linked[d] = 0
+			listed[d] = false
+		}
+		neighbors = neighbors[:0]
+		next.adj.offsets[c+1] = int64(len(next.adj.adj))
+	}
+	return next
+}
+
+// splitDisconnected gives every connected part of a community its own number
+func splitDisconnected(w *Weighted, community []int) []int {
+	split := make([]int, len(community))
+	for v := range split {
+		split[v] = -1
+	}
+	next := 0
+	var queue []int32
+	for s := range split {
+		if split[s] >= 0 {
+			continue
+		}
+		split[s] = next
+		queue = append(queue[:0], int32(s))
+		for i := 0; i < len(queue); i++ {
+			for _, u := range w.adj.neighbors(queue[i]) {
+				if split[u] < 0 && community[u] == community[s] {
+					split[u] = next
+					queue = append(queue, u)
+				}
+			}
+		}
+		next++
+	}
+	return split
+}
+
+// number renumbers communities from 0 by size, largest first and ties by
+// their first node, marks nodes without edges -1 and returns the sizes
+func number(community []int, w *Weighted) []int {
+	counts := map[int]int{}
+	first := map[int]int{}
+	for v, c := range community {
+		if w.Degree(v) == 0 {
+			continue
+		}
+		if _, ok := first[c]; !ok {
+			first[c] = v
+		}
+		counts[c]++
+	}
+
+	order := make([]int, 0, len(counts))
+	for c := range counts {
+		order = append(order, c)
+	}
+	slices.SortFunc(order, func(a, b int) int {
+		return cmp.Or(counts[b]-counts[a], first[a]-first[b])
+	})
+	index := map[int]int{}
+	sizes := make([]int, len(order))
+	for i, c := range order {
+		index[c] = i
+		sizes[i] = counts[c]
+	}
+	for v, c := range community {
+		if w.Degree(v) == 0 {
+			community[v] = -1
+		} else {
+			community[v] = index[c]
+		}
+	}
+	return sizes
+}
+
+// Modularity returns the modularity of a partition of w: the fraction of
+// edge weight inside communities minus resolution times the fraction
+// expected if edges were placed at random with the same strengths. Nodes in
+// community -1 are each a community of their own.
+func Modularity(w *Weighted, community []int, resolution float64) float64 {
+	n := len(community)
+	inside := make([]float64, n)
+	// Nodes alone in their community are summed after the communities
+	sum := make([]float64, 2*n)
+	var total float64
+	for v, c := range community {
+		s := w.Strength(v)
+		total += s
+		if c < 0 {
+			sum[n+v] += s
+			continue
+		}
+		sum[c] += s
+		weights := w.row(v)
+		for j, u := range w.adj.neighbors(int32(v)) {
+			if community[u] == c {
+				inside[c] += weights[j]
+			}
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+
+	var q float64
+	for _, x := range inside {
+		q += x / total
+	}
+	for _, s := range sum {
+		q -= resolution * (s / total) * (s / total)
+	}
+	return q
+}
@@ -0,0 +1,331 @@
+package analyze
+
+import (
+	"math"
+	"math/rand/v2"
+)
+
+// Null models the peer graph is compared against
+const (
+	ModelErdosRenyi    = "erdos_renyi"
+	ModelConfiguration = "configuration"
+)
+
+// swapsPerEdge is how many edge swaps per edge Rewire attempts, enough to
+// leave little of the original structure
+const swapsPerEdge = 10
+
+// Metrics are the statistics of a whole graph that are compared against
+// null models
+type Metrics struct {
+	AveragePathLength float64
+	PathLengthStdDev  float64
+	Diameter          int
+	AverageClustering float64
+	Transitivity      float64
+	Components        int
+	LargestComponent  int
+}
+
+// metrics lists the Metrics in the order they are reported
+var metrics = []struct {
+	name  string
+	value func(Metrics) float64
+}{
+	{"average_path_length", func(m Metrics) float64 { return m.AveragePathLength }},
+	{"path_length_std_dev", func(m Metrics) float64 { return m.PathLengthStdDev }},
+	{"diameter", func(m Metrics) float64 { return float64(m.Diameter) }},
+	{"average_clustering", func(m Metrics) float64 { return m.AverageClustering }},
+	{"transitivity", func(m Metrics) float64 { return m.Transitivity }},
+	{"components", func(m Metrics) float64 { return float64(m.Components) }},
+	{"largest_component", func(m Metrics) float64 { return float64(m.LargestComponent) }},
+}
+
+// newMetrics collects the Metrics of a graph from its statistics
+func newMetrics(g *Graph, paths PathStats, clustering ClusteringStats) Metrics {
+	components, largest := g.Components()
+	return Metrics{
+		AveragePathLength: paths.Mean,
+		PathLengthStdDev:  paths.StdDev,
+		Diameter:          paths.Max,
+		AverageClustering: clustering.Average,
+		Transitivity:      clustering.Transitivity,
+		Components:        components,
+		LargestComponent:  largest,
+	}
+}
+
+// measure computes the Metrics of a graph
+func measure(g *Graph, paths PathOptions) Metrics {
+	return newMetrics(g, ShortestPaths(g, paths), Clustering(g, paths.Workers))
+}
+
+// NullOptions controls how CompareNullModels generates random graphs
+type NullOptions struct {
+	// Graphs is the number of random graphs generated for every model
+	Graphs int
+	// Seed seeds the random graphs; the same seed gives the same graphs
+	Seed uint64
+	// Paths controls how path lengths are measured, as for the peer graph
+	Paths PathOptions
+	// Progress, if set, is called after every generated graph is measured
+	Progress func(model string, done, total int)
+}
+
+// NullComparison compares one metric of the peer graph with its values in
+// the random graphs of one null model
+type NullComparison struct {
+	Metric   string
+	Model    string
+	Observed float64
+	Values   []float64
+	Mean     float64
+	StdDev   float64
+	// Low and High bound the 95% confidence interval of the model's mean
+	Low, High float64
+	// Z is how many standard deviations Observed lies from Mean, NaN if the
+	// model's values don't vary
+	Z float64
+}
+
+// CompareNullModels generates opts.Graphs random graphs with the density of
+// g (Erdős–Rényi) and with its exact degrees (configuration model, by edge
+// swaps), and compares their metrics with the observed ones. Random graphs
+// ignore edge direction unless opts.Paths.Directed is set.
+func CompareNullModels(g *Graph, observed Metrics, opts NullOptions) []NullComparison {
+	paths := opts.Paths
+	paths.Betweenness = false
+	paths.Progress = nil
+
+	var results []NullComparison
+	for m, model := range []string{ModelErdosRenyi, ModelConfiguration} {
+		values := make([][]float64, len(metrics))
+		for i := range opts.Graphs {
+			rng := rand.New(rand.NewPCG(opts.Seed+uint64(i), uint64(m)))
+			var random *Graph
+			switch model {
+			case ModelErdosRenyi:
+				random = ErdosRenyi(g, paths.Directed, rng)
+			case ModelConfiguration:
+				random = Rewire(g, paths.Directed, rng)
+			}
+			sample := measure(random, paths)
+			for j, metric := range metrics {
+				values[j] = append(values[j], metric.value(sample))
+			}
+			if opts.Progress != nil {
+				opts.Progress(model, i+1, opts.Graphs)
+			}
+		}
+
+		for j, metric := range metrics {
+			results = append(results, compare(metric.name, model, metric.value(observed), values[j]))
+		}
+	}
+	return results
+}
+
+// compare summarises the values of a metric in a model's random graphs
+func compare(metric, model string, observed float64, values []float64) NullComparison {
+	c := NullComparison{Metric: metric, Model: model, Observed: observed, Values: values, Z: math.NaN()}
+	k := float64(len(values))
+	if len(values) == 0 {
+		c.Mean, c.StdDev, c.Low, c.High = math.NaN(), math.NaN(), math.NaN(), math.NaN()
+		return c
+	}
+	for _, v := range values {
+		c.Mean += v
+	}
+	c.Mean /= k
+	if len(values) > 1 {
+		for _, v := range values {
+			c.StdDev += (v - c.Mean) * (v - c.Mean)
+		}
+		c.StdDev = math.Sqrt(c.StdDev / (k - 1))
+	}
+	margin := tQuantile(len(values)-1) * c.StdDev / math.Sqrt(k)
+	c.Low, c.High = c.Mean-margin, c.Mean+margin
+	if c.StdDev > 0 {
+		c.Z = (observed - c.Mean) / c.StdDev
+	}
+	return c
+}
+
+// tQuantiles are the 97.5th percentiles of Student's t distribution with 1
+// to 30 degrees of freedom
+var tQuantiles = []float64{
+	12.706, 4.303, 3.182, 2.776, 2.571, 2.447, 2.365, 2.306, 2.262, 2.228,
+	2.201, 2.179, 2.160, 2.145, 2.131, 2.120, 2.110, 2.101, 2.093, 2.086,
+	2.080, 2.074, 2.069, 2.064, 2.060, 2.056, 2.052, 2.048, 2.045, 2.042,
+}
+
+// tQuantile returns the half-width of a 95% confidence interval in standard
+// errors for a mean of df+1 values
+func tQuantile(df int) float64 {
+	switch {
+	case df < 1:
+		return 0
+	case df <= len(tQuantiles):
+		return tQuantiles[df-1]
+	default:
+		return 1.96
+	}
+}
+
+// ErdosRenyi returns a G(n, p) random graph with the nodes of g in which every
+// pair of nodes is joined with the probability that makes its expected
+// density that of g. Undirected graphs match g's undirected edges.
+func ErdosRenyi(g *Graph, directed bool, rng *rand.Rand) *Graph {
+	n := int64(g.Nodes())
+	pairs, edges := n*(n-1)/2, int64(g.UndirectedEdges())
+	if directed {
+		pairs, edges = n*(n-1), int64(g.Edges())
+	}
+	if pairs == 0 {
+		return newGraph(g.names, nil)
+	}
+	p := float64(edges) / float64(pairs)
+
+	// Skip ahead to the next edge by a geometric number of pairs
+	// (Batagelj and Brandes, 2005) instead of drawing for every pair
+	var random [][2]int32
+	skip := func() int64 {
+		if p >= 1 {
+			return 0
+		}
+		return int64(math.Floor(math.Log(1-rng.Float64()) / math.Log(1-p)))
+	}
+	if p > 0 {
+		for k := skip(); k < pairs; k += 1 + skip() {
+			random = append(random, pairAt(k, n, directed))
+		}
+	}
+	return newGraph(g.names, random)
+}
+
+// pairAt returns the k-th of the n(n-1) ordered pairs of distinct nodes, or
+// of the n(n-1)/2 unordered pairs if not directed
+func pairAt(k, n int64, directed bool) [2]int32 {
+	if directed {
+		from, to := k/(n-1), k%(n-1)
+		if to >= from {
+			to++
+		}
+		return [2]int32{int32(from), int32(to)}
+	}
+	// Pairs are numbered row by row below the diagonal: (1,0), (2,0), (2,1), ...
+	row := int64((1 + math.Sqrt(float64(1+8*k))) / 2)
+	for row*(row-1)/2 > k {
+		row--
+	}
+	for (row+1)*row/2 <= k {
+		row++
+	}
+	return [2]int32{int32(row), int32(k - row*(row-1)/2)}
+}
+
+// Rewire returns a random graph with the nodes of g in which every node has
+// exactly the degree it has in g, made by repeatedly swapping the ends of two
+// random edges (Maslov and Sneppen, 2002). Directed graphs keep both in and
+// out degrees.
+func Rewire(g *Graph, directed bool, rng *rand.Rand) *Graph {
+	n := g.Nodes()
+	var edges [][2]int32
+	for v := range n {
+		for _, w := range g.out.neighbors(int32(v)) {
+			edges = append(edges, [2]int32{int32(v), w})
+		}
+	}
+	if !directed {
+		edges = edges[:0]
+		for v := range n {
+			for _, w := range g.und.neighbors(int32(v)) {
+				if int32(v) < w {
+					edges = append(edges, [2]int32{int32(v), w})
+				}
+			}
+		}
+	}
+	if len(edges) < 2 {
+		return newGraph(g.names, edges)
+	}
+
+	set := newEdgeSet(n)
+	for _, e := range edges {
+		set.add(e[0], e[1], directed)
+	}
+	for range swapsPerEdge * len(edges) {
+		i, j := rng.IntN(len(edges)), rng.IntN(len(edges))
+		a, b := edges[i][0], edges[i][1]
+		c, d := edges[j][0], edges[j][1]
+		if !directed && rng.IntN(2) == 1 {
+			c, d = d, c
+		}
+		// a→b, c→d becomes a→d, c→b
+		if i == j || a == d || c == b || set.has(a, d) || set.has(c, b) {
+			continue
+		}
+		set.remove(a, b, directed)
+		set.remove(c, d, directed)
+		set.add(a, d, directed)
+		set.add(c, b, directed)
+		edges[i] = [2]int32{a, d}
+		edges[j] = [2]int32{c, b}
+	}
+	return newGraph(g.names, edges)
+}
+
+// edgeSet records which pairs of nodes are joined, in a bitset for graphs
+// small enough and a map otherwise
+type edgeSet struct {
+	n    int64
+	bits []uint64
+	m    map[int64]struct{}
+}
+
+func newEdgeSet(n int) *edgeSet {
+	s := &edgeSet{n: int64(n)}
+	if n <= maxBitsetNodes {
+		s.bits = make([]uint64, (s.n*s.n+63)/64)
+	} else {
+		s.m = map[int64]struct{}{}
+	}
+	return s
+}
+
+func (s *edgeSet) has(from, to int32) bool {
+	k := int64(from)*s.n + int64(to)
+	if s.bits != nil {
+		return s.bits[k/64]&(1<<(k%64)) != 0
+	}
+	_, ok := s.m[k]
+	return ok
+}
+
+func (s *edgeSet) add(from, to int32, directed bool) {
+	s.set(int64(from)*s.n+int64(to), true)
+	if !directed {
+		s.set(int64(to)*s.n+int64(from), true)
+	}
+}
+
+func (s *edgeSet) remove(from, to int32, directed bool) {
+	s.set(int64(from)*s.n+int64(to), false)
+	if !directed {
+		s.set(int64(to)*s.n+int64(from), false)
+	}
+}
+
+// set records whether the pair numbered k is joined
+func (s *edgeSet) set(k int64, on bool) {
+	switch {
+	case s.bits != nil && on:
+		s.bits[k/64] |= 1 << (k % 64)
+	case s.bits != nil:
+		s.bits[k/64] &^= 1 << (k % 64)
+	case on:
+		s.m[k] = struct{}{}
+	default:
+		delete(s.m, k)
+	}
+}
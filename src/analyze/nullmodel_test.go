@@ -0,0 +1,122 @@
+package analyze
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"testing"
+)
+
+// randomGraph returns a directed graph of n nodes with roughly the given
+// share of pairs joined
+func randomGraph(n int, p float64, seed uint64) *Graph {
+	rng := rand.New(rand.NewPCG(seed, 0))
+	b := NewBuilder()
+	for v := range n {
+		b.AddNode(fmt.Sprintf("n%d.test", v))
+	}
+	for v := range n {
+		for w := range n {
+			// Skew the degrees so rewiring has something to keep
+			if rng.Float64() < p*float64(1+v%4) {
+				b.AddEdgeIndex(v, w)
+			}
+		}
+	}
+	return b.Graph()
+}
+
+func TestPairAt(t *testing.T) {
+	const n = 6
+	for _, directed := range []bool{false, true} {
+		pairs := int64(n * (n - 1))
+		if !directed {
+			pairs /= 2
+		}
+		seen := map[[2]int32]bool{}
+		for k := range pairs {
+			p := pairAt(k, n, directed)
+			if p[0] == p[1] || p[0] < 0 || p[1] < 0 || p[0] >= n || p[1] >= n || !directed && p[0] < p[1] || seen[p] {
+				t.Fatalf("directed %v: pair %d is %v", directed, k, p)
+			}
+			seen[p] = true
+		}
+	}
+}
+
+func TestErdosRenyi(t *testing.T) {
+	g := randomGraph(300, 0.02, 1)
+	for _, directed := range []bool{false, true} {
+		want, pairs := g.UndirectedEdges(), 300*299/2
+		if directed {
+			want, pairs = g.Edges(), 300*299
+		}
+		random := ErdosRenyi(g, directed, rand.New(rand.NewPCG(1, 2)))
+		got := random.UndirectedEdges()
+		if directed {
+			got = random.Edges()
+		}
+		// Within five standard deviations of the binomial edge count
+		p := float64(want) / float64(pairs)
+		if sd := math.Sqrt(float64(pairs) * p * (1 - p)); math.Abs(float64(got-want)) > 5*sd {
+			t.Errorf("directed %v: got %d edges, want about %d", directed, got, want)
+		}
+		again := ErdosRenyi(g, directed, rand.New(rand.NewPCG(1, 2)))
+		if again.Edges() != random.Edges() {
+			t.Errorf("directed %v: the same seed gave %d and %d edges", directed, random.Edges(), again.Edges())
+		}
+	}
+}
+
+func TestRewire(t *testing.T) {
+	g := randomGraph(100, 0.03, 3)
+	for _, directed := range []bool{false, true} {
+		random := Rewire(g, directed, rand.New(rand.NewPCG(4, 5)))
+		moved := 0
+		for v := range g.Nodes() {
+			if directed && (random.InDegree(v) != g.InDegree(v) || random.OutDegree(v) != g.OutDegree(v)) {
+				t.Fatalf("node %d has in %d, out %d, want %d and %d", v, random.InDegree(v), random.OutDegree(v), g.InDegree(v), g.OutDegree(v))
+			}
+			if !directed && random.Degree(v) != g.Degree(v) {
+				t.Fatalf("node %d has degree %d, want %d", v, random.Degree(v), g.Degree(v))
+			}
+			adj := g.und
+			if directed {
+				adj = g.out
+			}
+			for _, w := range adj.neighbors(int32(v)) {
+				if !random.hasEdge(int32(v), w, directed) {
+					moved++
+				}
+			}
+		}
+		if moved == 0 {
+			t.Errorf("directed %v: rewiring left every edge in place", directed)
+		}
+	}
+}
+
+// hasEdge reports whether g joins from to to
+func (g *Graph) hasEdge(from, to int32, directed bool) bool {
+	adj := g.und
+	if directed {
+		adj = g.out
+	}
+	for _, w := range adj.neighbors(from) {
+		if w == to {
+			return true
+		}
+	}
+	return false
+}
+
+func TestCompare(t *testing.T) {
+	c := compare("m", "model", 4, []float64{1, 2, 3})
+	margin := 4.303 / math.Sqrt(3)
+	if c.Mean != 2 || c.StdDev != 1 || !near(c.Low, 2-margin) || !near(c.High, 2+margin) || c.Z != 2 {
+		t.Errorf("got %+v", c)
+	}
+	if c := compare("m", "model", 4, []float64{2, 2}); !math.IsNaN(c.Z) || c.Low != 2 || c.High != 2 {
+		t.Errorf("constant values: got %+v, want no z-score and an empty interval", c)
+	}
+}
@@ -0,0 +1,50 @@
+package analyze
+
+import "math"
+
+// PageRank parameters, the defaults of NetworkX
+const (
+	damping       = 0.85
+	maxIterations = 100
+	tolerance     = 1e-6
+)
+
+// PageRank returns the PageRank of every node, following edges in the
+// direction they were reported so instances many others peer with rank
+// highest. The rank of nodes that report no peers is spread over every node.
+func PageRank(g *Graph) []float64 {
+	n := g.Nodes()
+	if n == 0 {
+		return nil
+	}
+	rank := make([]float64, n)
+	next := make([]float64, n)
+	for v := range rank {
+		rank[v] = 1 / float64(n)
+	}
+
+	for range maxIterations {
+		var dangling float64
+		for v := range n {
+			if g.out.degree(int32(v)) == 0 {
+				dangling += rank[v]
+			}
+		}
+		base := (1-damping)/float64(n) + damping*dangling/float64(n)
+
+		var change float64
+		for v := range n {
+			var sum float64
+			for _, u := range g.in.neighbors(int32(v)) {
+				sum += rank[u] / float64(g.out.degree(u))
+			}
+			next[v] = base + damping*sum
+			change += math.Abs(next[v] - rank[v])
+		}
+		rank, next = next, rank
+		if change < tolerance*float64(n) {
+			break
+		}
+	}
+	return rank
+}
@@ -0,0 +1,224 @@
+package analyze
+
+import (
+	"math"
+	"math/rand/v2"
+	"sync"
+)
+
+// PathOptions controls how ShortestPaths searches the graph
+type PathOptions struct {
+	// Samples is the number of random source nodes to search from; 0 or at
+	// least the number of nodes searches from every node for exact results
+	Samples int
+	// Seed seeds the choice of source nodes
+	Seed uint64
+	// Directed follows edges only in the direction they were reported
+	Directed bool
+	// Betweenness also estimates the betweenness of every node, which
+	// doubles the work of every search
+	Betweenness bool
+	// Workers is the number of sources searched at once
+	Workers int
+	// Progress, if set, is called after every finished source
+	Progress func(done, total int)
+}
+
+// PathStats describes the shortest paths between pairs of nodes
+type PathStats struct {
+	// Sources is the number of nodes searched from
+	Sources int
+	// Exact is set when every node was searched from
+	Exact bool
+	// Lengths counts the pairs at every distance; Lengths[0] is always 0.
+	// Unreachable pairs are not counted.
+	Lengths []int64
+	// Pairs is the number of reachable pairs considered. An exact search of
+	// an undirected graph counts every pair once.
+	Pairs  int64
+	Mean   float64
+	StdDev float64
+	Min    int
+	// Max is the diameter of the graph's components if Exact, and a lower
+	// bound on it otherwise
+	Max int
+	// Betweenness is the normalized betweenness centrality of every node,
+	// estimated from the sources if not Exact, if PathOptions.Betweenness
+	// was set
+	Betweenness []float64
+}
+
+// ShortestPaths runs a breadth-first search from every source and collects
+// the distribution of path lengths, and the betweenness of every node with
+// Brandes' algorithm
+func ShortestPaths(g *Graph, opts PathOptions) PathStats {
+	n := g.Nodes()
+	sources := make([]int32, n)
+	for v := range sources {
+		sources[v] = int32(v)
+	}
+	exact := opts.Samples <= 0 || opts.Samples >= n
+	if !exact {
+		rng := rand.New(rand.NewPCG(opts.Seed, opts.Seed))
+		rng.Shuffle(n, func(i, j int) { sources[i], sources[j] = sources[j], sources[i] })
+		sources = sources[:opts.Samples]
+	}
+
+	adj, pred := g.und, g.und
+	if opts.Directed {
+		adj, pred = g.out, g.in
+	}
+
+	workers := max(opts.Workers, 1)
+	next := make(chan int32)
+	results := make([]*brandes, workers)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	done := 0
+	for i := range workers {
+		b := newBrandes(n)
+		results[i] = b
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for s := range next {
+				b.search(s, adj, pred, opts.Betweenness)
+				if opts.Progress != nil {
+					mu.Lock()
+					done++
+					opts.Progress(done, len(sources))
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, s := range sources {
+		next <- s
+	}
+	close(next)
+	wg.Wait()
+
+	stats := PathStats{Sources: len(sources), Exact: exact}
+	if opts.Betweenness {
+		stats.Betweenness = make([]float64, n)
+	}
+	for _, b := range results {
+		for d, count := range b.lengths {
+			for len(stats.Lengths) <= d {
+				stats.Lengths = append(stats.Lengths, 0)
+			}
+			stats.Lengths[d] += count
+		}
+		for v := range stats.Betweenness {
+			stats.Betweenness[v] += b.centrality[v]
+		}
+	}
+
+	// Every unordered pair was reached once from each end
+	if exact && !opts.Directed {
+		for d := range stats.Lengths {
+			stats.Lengths[d] /= 2
+		}
+	}
+
+	if n > 2 {
+		scale := float64(n) / float64(len(sources)) / float64((n-1)*(n-2))
+		for v := range stats.Betweenness {
+			stats.Betweenness[v] *= scale
+		}
+	}
+
+	var sum, sumSquares float64
+	for d, count := range stats.Lengths {
+		if count == 0 {
+			continue
+		}
+		if stats.Pairs == 0 {
+			stats.Min = d
+		}
+		stats.Max = d
+		stats.Pairs += count
+		sum += float64(d) * float64(count)
+		sumSquares += float64(d) * float64(d) * float64(count)
+	}
+	if stats.Pairs > 0 {
+		stats.Mean = sum / float64(stats.Pairs)
+	}
+	if stats.Pairs > 1 {
+		variance := (sumSquares - sum*stats.Mean) / float64(stats.Pairs-1)
+		stats.StdDev = math.Sqrt(max(variance, 0))
+	}
+	return stats
+}
+
+// brandes holds one worker's search state and the totals of its sources
+type brandes struct {
+	dist  []int32
+	sigma []float64
+	delta []float64
+	order []int32
+
+	lengths    []int64
+	centrality []float64
+}
+
+func newBrandes(n int) *brandes {
+	b := &brandes{
+		dist:       make([]int32, n),
+		sigma:      make([]float64, n),
+		delta:      make([]float64, n),
+		order:      make([]int32, 0, n),
+		centrality: make([]float64, n),
+	}
+	for v := range b.dist {
+		b.dist[v] = -1
+	}
+	return b
+}
+
+// search runs a breadth-first search from s following adj, counting the
+// distance of every node it reaches and, if betweenness is set, adding the
+// dependency of s on every node to its betweenness. pred lists the edges of
+// adj reversed.
+func (b *brandes) search(s int32, adj, pred adjacency, betweenness bool) {
+	b.order = append(b.order[:0], s)
+	b.dist[s] = 0
+	b.sigma[s] = 1
+	for i := 0; i < len(b.order); i++ {
+		v := b.order[i]
+		for _, w := range adj.neighbors(v) {
+			if b.dist[w] < 0 {
+				b.dist[w] = b.dist[v] + 1
+				b.order = append(b.order, w)
+			}
+			if betweenness && b.dist[w] == b.dist[v]+1 {
+				b.sigma[w] += b.sigma[v]
+			}
+		}
+	}
+
+	for _, w := range b.order[1:] {
+		d := int(b.dist[w])
+		for len(b.lengths) <= d {
+			b.lengths = append(b.lengths, 0)
+		}
+		b.lengths[d]++
+	}
+
+	for i := len(b.order) - 1; betweenness && i > 0; i-- {
+		w := b.order[i]
+		coeff := (1 + b.delta[w]) / b.sigma[w]
+		for _, v := range pred.neighbors(w) {
+			if b.dist[v] == b.dist[w]-1 {
+				b.delta[v] += b.sigma[v] * coeff
+			}
+		}
+		b.centrality[w] += b.delta[w]
+	}
+
+	for _, v := range b.order {
+		b.dist[v] = -1
+		b.sigma[v] = 0
+		b.delta[v] = 0
+	}
+}
@@ -0,0 +1,139 @@
+package analyze
+
+import (
+	"fmt"
+	"slices"
+)
+
+// Edge weightings of the peer graph for community detection
+const (
+	// WeightReciprocity weighs edges reported by both ends 2 and others 1
+	WeightReciprocity = "reciprocity"
+	// WeightJaccard weighs edges by the Jaccard similarity of the
+	// neighbourhoods of their ends
+	WeightJaccard = "jaccard"
+	// WeightAffinity weighs edges 1, plus 1 if both ends are hosted in the
+	// same country and 1 if they are hosted in the same AS
+	WeightAffinity = "affinity"
+)
+
+// Weights lists the supported edge weightings
+var Weights = []string{WeightReciprocity, WeightJaccard, WeightAffinity}
+
+// Weighted is an undirected graph with a weight on every edge. Every edge
+// is kept in the rows of both its ends with the same weight.
+type Weighted struct {
+	names   []string
+	adj     adjacency
+	weights []float64
+}
+
+// Nodes returns the number of nodes
+func (w *Weighted) Nodes() int {
+	return len(w.names)
+}
+
+// Edges returns the number of undirected edges
+func (w *Weighted) Edges() int {
+	return len(w.adj.adj) / 2
+}
+
+// Name returns the domain of node v
+func (w *Weighted) Name(v int) string {
+	return w.names[v]
+}
+
+// Degree returns the number of edges of node v
+func (w *Weighted) Degree(v int) int {
+	return w.adj.degree(int32(v))
+}
+
+// Strength returns the total weight of the edges of node v
+func (w *Weighted) Strength(v int) float64 {
+	var s float64
+	for _, weight := range w.row(v) {
+		s += weight
+	}
+	return s
+}
+
+// row returns the weights of the edges of node v, in the order of its
+// neighbours
+func (w *Weighted) row(v int) []float64 {
+	return w.weights[w.adj.offsets[v]:w.adj.offsets[v+1]]
+}
+
+// newWeighted weighs the undirected edges of g with weight, which is given
+// both ends of an edge and its position in g.und
+func newWeighted(g *Graph, weight func(v, u int32, i int64) float64) *Weighted {
+	w := &Weighted{names: g.names, adj: g.und, weights: make([]float64, len(g.und.adj))}
+	for v := range g.Nodes() {
+		for j, u := range g.und.neighbors(int32(v)) {
+			i := g.und.offsets[v] + int64(j)
+			w.weights[i] = weight(int32(v), u, i)
+		}
+	}
+	return w
+}
+
+// Location is where an instance is hosted; empty fields are unknown and
+// never match
+type Location struct {
+	Country string
+	ASN     int64
+}
+
+// Weigh weighs the edges of g with one of Weights. locations, indexed by
+// node, are only needed for WeightAffinity.
+func Weigh(g *Graph, weight string, locations []Location, workers int) (*Weighted, error) {
+	switch weight {
+	case WeightReciprocity:
+		return ReciprocityWeights(g), nil
+	case WeightJaccard:
+		return JaccardWeights(g, workers), nil
+	case WeightAffinity:
+		return AffinityWeights(g, locations), nil
+	default:
+		return nil, fmt.Errorf("unknown weight %q, expected one of %v", weight, Weights)
+	}
+}
+
+// ReciprocityWeights weighs every edge 2 if both ends report each other as
+// peers and 1 otherwise
+func ReciprocityWeights(g *Graph) *Weighted {
+	return newWeighted(g, func(v, u int32, _ int64) float64 {
+		_, out := slices.BinarySearch(g.out.neighbors(v), u)
+		_, in := slices.BinarySearch(g.in.neighbors(v), u)
+		if out && in {
+			return 2
+		}
+		return 1
+	})
+}
+
+// JaccardWeights weighs every edge with the number of neighbours its ends
+// share divided by the number of nodes joined to either end. Edges inside
+// tightly knit groups weigh more than edges every instance has.
+func JaccardWeights(g *Graph, workers int) *Weighted {
+	common := commonNeighbors(g, max(workers, 1))
+	return newWeighted(g, func(v, u int32, i int64) float64 {
+		c := float64(common[i])
+		return c / (float64(g.und.degree(v)+g.und.degree(u)) - c)
+	})
+}
+
+// AffinityWeights weighs every edge 1, plus 1 if both ends are hosted in
+// the same country and 1 if they are hosted in the same AS
+func AffinityWeights(g *Graph, locations []Location) *Weighted {
+	return newWeighted(g, func(v, u int32, _ int64) float64 {
+		a, b := locations[v], locations[u]
+		weight := 1.0
+		if a.Country != "" && a.Country == b.Country {
+			weight++
+		}
+		if a.ASN != 0 && a.ASN == b.ASN {
+			weight++
+		}
+		return weight
+	})
+}
@@ -0,0 +1,193 @@
+// Package caida reads locally downloaded CAIDA datasets about autonomous
+// systems: AS Rank, AS relationships, customer cones and AS to organization
+// mappings, so ASes can be described without asking CAIDA's API.
+package caida
+
+import (
+	"bufio"
+	"cmp"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/kothavade/mastodon-paper/config"
+	"github.com/kothavade/mastodon-paper/storage"
+)
+
+// ErrNoDatasets is returned by Load when no dataset file is configured
+var ErrNoDatasets = errors.New("no CAIDA dataset configured")
+
+// Dataset is what the loaded files say about every AS they cover
+type Dataset struct {
+	ases  map[uint]*storage.ASFacts
+	lines []string
+	// source names the loaded files, as stored with every AS
+	source string
+}
+
+// Load reads the dataset files cfg lists. Every field of an AS is taken from
+// the first file that has it: AS Rank, then the AS to organization file,
+// then the customer cones. Without an AS Rank file ASes are ranked by the
+// size of their customer cone, read from the cone file or computed from the
+// AS relationships.
+func Load(cfg config.CAIDAConfig) (*Dataset, error) {
+	if cfg == (config.CAIDAConfig{}) {
+		return nil, ErrNoDatasets
+	}
+	d := &Dataset{ases: make(map[uint]*storage.ASFacts)}
+	var names []string
+
+	if cfg.ASRank != "" {
+		records, err := readFile(cfg.ASRank, parseASRank)
+		if err != nil {
+			return nil, fmt.Errorf("caida.as_rank: %w", err)
+		}
+		for _, r := range records {
+			a := d.as(r.ASN)
+			a.Name, a.Rank, a.OrgID, a.OrgName, a.Country, a.Cone = r.Name, r.Rank, r.OrgID, r.OrgName, r.Country, r.Cone
+		}
+		d.lines = append(d.lines, fmt.Sprintf("as_rank: %d ASes from %s", len(records), cfg.ASRank))
+		names = append(names, filepath.Base(cfg.ASRank))
+	}
+
+	if cfg.ASOrg != "" {
+		orgs, err := readFile(cfg.ASOrg, parseASOrg)
+		if err != nil {
+			return nil, fmt.Errorf("caida.as_org: %w", err)
+		}
+		for asn, aut := range orgs.ases {
+			a := d.as(asn)
+			org := orgs.orgs[aut.orgID]
+			a.Name = cmp.Or(a.Name, aut.name)
+			a.OrgID = cmp.Or(a.OrgID, aut.orgID)
+			a.OrgName = cmp.Or(a.OrgName, org.name)
+			a.Country = cmp.Or(a.Country, org.country)
+		}
+		d.lines = append(d.lines, fmt.Sprintf("as_org: %d ASes of %d organizations from %s", len(orgs.ases), len(orgs.orgs), cfg.ASOrg))
+		names = append(names, filepath.Base(cfg.ASOrg))
+	}
+
+	var cones map[uint]int
+	switch {
+	case cfg.Cone != "":
+		var err error
+		cones, err = readFile(cfg.Cone, parseCones)
+		if err != nil {
+			return nil, fmt.Errorf("caida.cone: %w", err)
+		}
+		d.lines = append(d.lines, fmt.Sprintf("cone: customer cones of %d ASes from %s", len(cones), cfg.Cone))
+		names = append(names, filepath.Base(cfg.Cone))
+	case cfg.ASRel != "":
+		rels, err := readFile(cfg.ASRel, parseASRel)
+		if err != nil {
+			return nil, fmt.Errorf("caida.as_rel: %w", err)
+		}
+		cones = rels.cones()
+		d.lines = append(d.lines, fmt.Sprintf("as_rel: %d customer and %d peer links between %d ASes from %s",
+			rels.customerLinks, rels.peerLinks, len(cones), cfg.ASRel))
+		names = append(names, filepath.Base(cfg.ASRel))
+	}
+	for asn, size := range cones {
+		a := d.as(asn)
+		if a.Cone == 0 {
+			a.Cone = size
+		}
+	}
+
+	if cfg.ASRank != "" {
+		d.lines = append(d.lines, "ranks: from AS Rank")
+	} else if cones != nil {
+		rankByCone(d.ases, cones)
+		d.lines = append(d.lines, "ranks: by customer cone size, ties by ASN")
+	} else {
+		d.lines = append(d.lines, "ranks: none, configure caida.as_rank, caida.cone or caida.as_rel")
+	}
+
+	d.source = strings.Join(names, ", ")
+	for _, a := range d.ases {
+		a.Source = d.source
+	}
+	return d, nil
+}
+
+// as returns the facts of asn, adding them if the AS is new
+func (d *Dataset) as(asn uint) *storage.ASFacts {
+	a, ok := d.ases[asn]
+	if !ok {
+		a = &storage.ASFacts{ASN: asn}
+		d.ases[asn] = a
+	}
+	return a
+}
+
+// Describe returns one line about every loaded file and where ranks come
+// from
+func (d *Dataset) Describe() []string {
+	return d.lines
+}
+
+// Lookup returns what the datasets say about asn. The bool is false if no
+// dataset covers it.
+func (d *Dataset) Lookup(asn uint) (storage.ASFacts, bool) {
+	a, ok := d.ases[asn]
+	if !ok {
+		return storage.ASFacts{ASN: asn, Source: d.source}, false
+	}
+	return *a, true
+}
+
+// rankByCone ranks the ASes with a customer cone by its size, largest
+// first, as AS Rank does
+func rankByCone(ases map[uint]*storage.ASFacts, cones map[uint]int) {
+	ranked := make([]uint, 0, len(cones))
+	for asn := range cones {
+		ranked = append(ranked, asn)
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if cones[ranked[i]] != cones[ranked[j]] {
+			return cones[ranked[i]] > cones[ranked[j]]
+		}
+		return ranked[i] < ranked[j]
+	})
+	for i, asn := range ranked {
+		ases[asn].Rank = i + 1
+	}
+}
+
+// readFile parses the file at path, decompressing it first if it is gzip or
+// bzip2, as CAIDA publishes its datasets
+func readFile[T any](path string, parse func(r io.Reader) (T, error)) (T, error) {
+	var zero T
+	f, err := os.Open(path)
+	if err != nil {
+		return zero, err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	magic, _ := br.Peek(3)
+	var r io.Reader = br
+	switch {
+	case len(magic) >= 2 && magic[0] == 0x1f && magic[1] == 0x8b:
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return zero, fmt.Errorf("%s: %w", path, err)
+		}
+		defer gz.Close()
+		r = gz
+	case string(magic) == "BZh":
+		r = bzip2.NewReader(br)
+	}
+
+	v, err := parse(r)
+	if err != nil {
+		return zero, fmt.Errorf("%s: %w", path, err)
+	}
+	return v, nil
+}
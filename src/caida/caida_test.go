@@ -0,0 +1,130 @@
+package caida
+
+import (
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kothavade/mastodon-paper/config"
+	"github.com/kothavade/mastodon-paper/storage"
+)
+
+// gzipFile writes the testdata file name gzipped to a temporary directory
+func gzipFile(t *testing.T, name string) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), name+".gz")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	if _, err := gz.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadRelationships(t *testing.T) {
+	d, err := Load(config.CAIDAConfig{ASRel: "testdata/as-rel.txt.bz2", ASOrg: "testdata/as-org2info.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source := "as-org2info.txt, as-rel.txt.bz2"
+	for _, want := range []storage.ASFacts{
+		{ASN: 3356, Name: "LEVEL3", Rank: 1, OrgID: "LPL-141-ARIN", OrgName: "Level 3 Parent, LLC", Country: "US", Cone: 5, Source: source},
+		{ASN: 174, Name: "COGENT-174", Rank: 2, OrgID: "COGC-ARIN", OrgName: "Cogent Communications", Country: "US", Cone: 4, Source: source},
+		{ASN: 24940, Name: "HETZNER-AS", Rank: 3, OrgID: "ORG-HOA1-RIPE", OrgName: "Hetzner Online GmbH", Country: "DE", Cone: 3, Source: source},
+		// Equal cones are ranked by ASN
+		{ASN: 64500, Rank: 5, Cone: 1, Source: source},
+		{ASN: 64502, Rank: 6, Cone: 1, Source: source},
+	} {
+		got, ok := d.Lookup(want.ASN)
+		if !ok || got != want {
+			t.Errorf("AS%d: got %+v, %v, want %+v", want.ASN, got, ok, want)
+		}
+	}
+	if got, ok := d.Lookup(13335); ok {
+		t.Errorf("AS13335: got %+v, want nothing", got)
+	}
+
+	describe := strings.Join(d.Describe(), "\n")
+	for _, want := range []string{"as_org: 3 ASes of 3 organizations", "as_rel: 6 customer and 1 peer links between 6 ASes", "ranks: by customer cone size"} {
+		if !strings.Contains(describe, want) {
+			t.Errorf("description %q lacks %q", describe, want)
+		}
+	}
+}
+
+func TestLoadASRank(t *testing.T) {
+	d, err := Load(config.CAIDAConfig{
+		ASRank: "testdata/asns.jsonl",
+		ASOrg:  gzipFile(t, "as-org2info.txt"),
+		Cone:   "testdata/ppdc-ases.txt",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source := "asns.jsonl, as-org2info.txt.gz, ppdc-ases.txt"
+	for _, want := range []storage.ASFacts{
+		// AS Rank wins over the cone file
+		{ASN: 24940, Name: "HETZNER-AS", Rank: 1184, OrgID: "ORG-HOA1-RIPE", OrgName: "Hetzner Online GmbH", Country: "DE", Cone: 12, Source: source},
+		// Only AS Rank ranks ASes when it is configured
+		{ASN: 174, Name: "COGENT-174", OrgID: "COGC-ARIN", OrgName: "Cogent Communications", Country: "US", Source: source},
+	} {
+		got, ok := d.Lookup(want.ASN)
+		if !ok || got != want {
+			t.Errorf("AS%d: got %+v, %v, want %+v", want.ASN, got, ok, want)
+		}
+	}
+}
+
+func TestParseCones(t *testing.T) {
+	cones, err := readFile("testdata/ppdc-ases.txt", parseCones)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cones) != 2 || cones[3356] != 5 || cones[24940] != 3 {
+		t.Errorf("got %v, want 3356 with 5 ASes and 24940 with 3", cones)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	write := func(name, content string) string {
+		path := filepath.Join(t.TempDir(), name)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	for _, test := range []struct {
+		cfg  config.CAIDAConfig
+		want string
+	}{
+		{config.CAIDAConfig{}, "no CAIDA dataset configured"},
+		{config.CAIDAConfig{ASRel: write("as-rel.txt", "3356|174|2\n")}, `caida.as_rel: `},
+		{config.CAIDAConfig{ASRel: write("as-rel.txt", "3356|174|2\n")}, `line 1: unknown relationship "2"`},
+		{config.CAIDAConfig{ASRel: write("as-rel.txt", "# nothing\n")}, "no AS relationships"},
+		{config.CAIDAConfig{Cone: write("ppdc-ases.txt", "3356 AS-LEVEL3\n")}, `invalid AS number "AS-LEVEL3"`},
+		{config.CAIDAConfig{ASOrg: write("as-org2info.txt", "3356|20240101|LEVEL3|LPL-141-ARIN||ARIN\n")}, `no "# format:" line`},
+		{config.CAIDAConfig{ASRank: write("asns.jsonl", `{"asn": "", "rank": 1}`)}, "caida.as_rank: "},
+		{config.CAIDAConfig{ASRank: filepath.Join(t.TempDir(), "missing.jsonl")}, "no such file"},
+	} {
+		_, err := Load(test.cfg)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%+v: got %v, want an error containing %q", test.cfg, err, test.want)
+		}
+	}
+}
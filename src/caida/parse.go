@@ -0,0 +1,281 @@
+package caida
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// rankRecord is one AS of an AS Rank dump
+type rankRecord struct {
+	ASN                     uint
+	Name                    string
+	Rank                    int
+	OrgID, OrgName, Country string
+	Cone                    int
+}
+
+// asRankJSON is the layout of an AS Rank record, as the API returns it for
+// an asn query. ASNs are strings in the API and numbers in some dumps.
+type asRankJSON struct {
+	ASN          json.Number `json:"asn"`
+	ASNName      string      `json:"asnName"`
+	Rank         int         `json:"rank"`
+	Organization struct {
+		OrgID   string `json:"orgId"`
+		OrgName string `json:"orgName"`
+	} `json:"organization"`
+	Country struct {
+		ISO string `json:"iso"`
+	} `json:"country"`
+	Cone struct {
+		NumberAsns int `json:"numberAsns"`
+	} `json:"cone"`
+	// Node holds the record when it was dumped as an edge of an asns query
+	Node *asRankJSON `json:"node"`
+}
+
+// parseASRank reads an AS Rank dump with one JSON record per line
+func parseASRank(r io.Reader) ([]rankRecord, error) {
+	var records []rankRecord
+	err := eachLine(r, func(n int, line string) error {
+		var rec asRankJSON
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			return fmt.Errorf("line %d: %w", n, err)
+		}
+		if rec.Node != nil {
+			rec = *rec.Node
+		}
+		asn, err := parseASN(rec.ASN.String())
+		if err != nil {
+			return fmt.Errorf("line %d: %w", n, err)
+		}
+		records = append(records, rankRecord{
+			ASN:     asn,
+			Name:    rec.ASNName,
+			Rank:    rec.Rank,
+			OrgID:   rec.Organization.OrgID,
+			OrgName: rec.Organization.OrgName,
+			Country: rec.Country.ISO,
+			Cone:    rec.Cone.NumberAsns,
+		})
+		return nil
+	})
+	if err == nil && len(records) == 0 {
+		err = errors.New("no AS Rank records")
+	}
+	return records, err
+}
+
+// relationships is the AS relationship graph
+type relationships struct {
+	// customers lists the customers of every provider
+	customers                map[uint][]uint
+	ases                     map[uint]bool
+	customerLinks, peerLinks int
+}
+
+// parseASRel reads an AS relationship file. Every line is
+// provider|customer|-1 or peer|peer|0, followed by |source in serial-2.
+func parseASRel(r io.Reader) (*relationships, error) {
+	rels := &relationships{customers: make(map[uint][]uint), ases: make(map[uint]bool)}
+	err := eachLine(r, func(n int, line string) error {
+		fields := strings.Split(line, "|")
+		if len(fields) < 3 {
+			return fmt.Errorf("line %d: %q is not as1|as2|relationship", n, line)
+		}
+		a, err := parseASN(fields[0])
+		if err != nil {
+			return fmt.Errorf("line %d: %w", n, err)
+		}
+		b, err := parseASN(fields[1])
+		if err != nil {
+			return fmt.Errorf("line %d: %w", n, err)
+		}
+		switch fields[2] {
+		case "-1":
+			rels.customers[a] = append(rels.customers[a], b)
+			rels.customerLinks++
+		case "0":
+			rels.peerLinks++
+		default:
+			return fmt.Errorf("line %d: unknown relationship %q", n, fields[2])
+		}
+		rels.ases[a], rels.ases[b] = true, true
+		return nil
+	})
+	if err == nil && len(rels.ases) == 0 {
+		err = errors.New("no AS relationships")
+	}
+	return rels, err
+}
+
+// cones returns the size of the recursive customer cone of every AS: the
+// AS, its customers, their customers and so on
+func (rels *relationships) cones() map[uint]int {
+	cones := make(map[uint]int, len(rels.ases))
+	// seen holds root+1 for the ASes visited from root, so the map is
+	// reused without clearing it
+	seen := make(map[uint]uint)
+	for root := range rels.ases {
+		size := 0
+		stack := []uint{root}
+		seen[root] = root + 1
+		for len(stack) > 0 {
+			asn := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			size++
+			for _, customer := range rels.customers[asn] {
+				if seen[customer] != root+1 {
+					seen[customer] = root + 1
+					stack = append(stack, customer)
+				}
+			}
+		}
+		cones[root] = size
+	}
+	return cones
+}
+
+// parseCones reads a customer cone file. Every line is an AS followed by
+// the ASes of its cone, which include the AS itself.
+func parseCones(r io.Reader) (map[uint]int, error) {
+	cones := make(map[uint]int)
+	err := eachLine(r, func(n int, line string) error {
+		members := make(map[uint]bool)
+		var root uint
+		for i, field := range strings.Fields(line) {
+			asn, err := parseASN(field)
+			if err != nil {
+				return fmt.Errorf("line %d: %w", n, err)
+			}
+			if i == 0 {
+				root = asn
+			}
+			members[asn] = true
+		}
+		cones[root] = len(members)
+		return nil
+	})
+	if err == nil && len(cones) == 0 {
+		err = errors.New("no customer cones")
+	}
+	return cones, err
+}
+
+// organization is one organization of an AS to organization file
+type organization struct {
+	name, country string
+}
+
+// autonomousSystem is one AS of an AS to organization file
+type autonomousSystem struct {
+	name, orgID string
+}
+
+// asOrgs maps ASes to the organizations that hold them
+type asOrgs struct {
+	orgs map[string]organization
+	ases map[uint]autonomousSystem
+}
+
+// parseASOrg reads an AS to organization file. The text files hold
+// org_id|changed|org_name|country|source lines and
+// aut|changed|aut_name|org_id|opaque_id|source lines, each after a
+// "# format:" comment naming the fields; the JSON Lines files hold one
+// Organization or ASN record per line.
+func parseASOrg(r io.Reader) (*asOrgs, error) {
+	orgs := &asOrgs{orgs: make(map[string]organization), ases: make(map[uint]autonomousSystem)}
+	var format []string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if rest, ok := strings.CutPrefix(line, "# format:"); ok {
+			format = strings.Split(strings.TrimSpace(rest), "|")
+			continue
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := make(map[string]string)
+		if strings.HasPrefix(line, "{") {
+			var rec struct {
+				Type           string      `json:"type"`
+				ASN            json.Number `json:"asn"`
+				Name           string      `json:"name"`
+				OrganizationID string      `json:"organizationId"`
+				Country        string      `json:"country"`
+			}
+			if err := json.Unmarshal([]byte(line), &rec); err != nil {
+				return nil, fmt.Errorf("line %d: %w", n, err)
+			}
+			switch rec.Type {
+			case "Organization":
+				fields = map[string]string{"org_id": rec.OrganizationID, "org_name": rec.Name, "country": rec.Country}
+			case "ASN":
+				fields = map[string]string{"aut": rec.ASN.String(), "aut_name": rec.Name, "org_id": rec.OrganizationID}
+			default:
+				continue
+			}
+		} else {
+			if format == nil {
+				return nil, fmt.Errorf("line %d: no \"# format:\" line before it", n)
+			}
+			for i, value := range strings.Split(line, "|") {
+				if i < len(format) {
+					fields[format[i]] = value
+				}
+			}
+		}
+
+		if aut, ok := fields["aut"]; ok {
+			asn, err := parseASN(aut)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", n, err)
+			}
+			orgs.ases[asn] = autonomousSystem{name: fields["aut_name"], orgID: fields["org_id"]}
+		} else if id := fields["org_id"]; id != "" {
+			orgs.orgs[id] = organization{name: fields["org_name"], country: fields["country"]}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(orgs.ases) == 0 {
+		return nil, errors.New("no ASes")
+	}
+	return orgs, nil
+}
+
+// eachLine calls fn with the number and text of every line that is neither
+// empty nor a # comment
+func eachLine(r io.Reader, fn func(n int, line string) error) error {
+	scanner := bufio.NewScanner(r)
+	// Customer cones of the largest ASes hold most of the Internet
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := fn(n, line); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// parseASN parses an AS number, with or without an AS prefix
+func parseASN(s string) (uint, error) {
+	asn, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(s), "AS"), 10, 32)
+	if err != nil || asn == 0 {
+		return 0, fmt.Errorf("invalid AS number %q", s)
+	}
+	return uint(asn), nil
+}
@@ -1,10 +1,8 @@
 package collect_data
 
 import (
-	"database/sql"
-	"embed"
+	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -16,28 +14,15 @@ import (
 	"sync/atomic"
 	"time"
 
-	_ "github.com/mattn/go-sqlite3"
-	"github.com/oschwald/maxminddb-golang"
+	"github.com/kothavade/mastodon-paper/config"
+	"github.com/kothavade/mastodon-paper/fetch"
+	"github.com/kothavade/mastodon-paper/geoip"
+	"github.com/kothavade/mastodon-paper/hosting"
+	"github.com/kothavade/mastodon-paper/optout"
+	"github.com/kothavade/mastodon-paper/resolver"
+	"github.com/kothavade/mastodon-paper/storage"
 )
 
-//go:embed data/*.mmdb
-var mmdbFS embed.FS
-
-const (
-	StatusPending  = "pending"
-	StatusChecking = "checking"
-	StatusSuccess  = "success"
-	StatusFailed   = "failed"
-)
-
-const maxWorkers = 10
-
-type geoInfo struct {
-	CountryCode string
-	ASN         uint
-	ASName      string
-}
-
 // instanceStats holds the stats part of the Mastodon instance response
 type instanceStats struct {
 	Stats struct {
@@ -46,131 +31,88 @@ type instanceStats struct {
 	} `json:"stats"`
 }
 
-// initInfoDB initializes the SQLite database with a table that contains node info
-func initInfoDB() (*sql.DB, error) {
-	db, err := sql.Open("sqlite3", "./node_filter.db")
-	if err != nil {
-		return nil, fmt.Errorf("failed to open database: %w", err)
-	}
-
-	// Create nodes table if it doesn't exist
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS node_info (
-		domain       TEXT PRIMARY KEY,
-		status       TEXT,
-		ip           TEXT,
-		asn          TEXT,
-		country_code TEXT,
-		user_count   INTEGER,
-		post_count   INTEGER,
-		cloud_provider TEXT,
-		last_updated TIMESTAMP
-		)
-	`)
-	if err != nil {
-		db.Close()
-		return nil, fmt.Errorf("failed to create table: %w", err)
-	}
-
-	return db, nil
-}
-
-// initializeInfoNodes inserts node info into the database if they don't exist
-func initializeInfoNodes(db *sql.DB, nodes []string) error {
-	tx, err := db.Begin()
+// CollectData gathers IP, geo and instance stats for every node in the
+// processed node list that has not been collected yet
+func CollectData(cfg *config.Config) error {
+	// Open the geo databases first, so a missing or wrong file is reported
+	// before anything else is done
+	geo, err := geoip.Open(cfg.GeoIP)
 	if err != nil {
 		return err
 	}
-	defer tx.Rollback()
-
-	stmt, err := tx.Prepare(`
-		INSERT OR IGNORE INTO node_info (domain, status, last_updated) 
-		VALUES (?, ?, CURRENT_TIMESTAMP)
-	`)
+	defer geo.Close()
+	for _, line := range geo.Describe() {
+		fmt.Println("GeoIP", line)
+	}
+	classifier, err := hosting.Load(cfg.Hosting)
 	if err != nil {
 		return err
 	}
-	defer stmt.Close()
-
-	for _, node := range nodes {
-		_, err := stmt.Exec(node, StatusPending)
-		if err != nil {
-			return err
-		}
+	for _, line := range classifier.Describe() {
+		fmt.Println("Hosting", line)
 	}
 
-	return tx.Commit()
-}
-
-func CollectData() {
-	// Open filtered_nodes.json file
-	nodes, err := os.ReadFile("filtered_processed_nodes.json")
+	// Open the processed node list
+	nodes, err := os.ReadFile(cfg.Paths.ProcessedNodes)
 	if err != nil {
-		fmt.Println("Error reading nodes.json:", err)
-		return
+		return fmt.Errorf("error reading %s: %w", cfg.Paths.ProcessedNodes, err)
 	}
 
-	// Reading filtered_nodes.json
+	// Reading the processed node list
 	var nodesList []string
 	err = json.Unmarshal(nodes, &nodesList)
 	if err != nil {
-		fmt.Println("Error unmarshalling nodes.json:", err)
-		return
+		return fmt.Errorf("error unmarshalling %s: %w", cfg.Paths.ProcessedNodes, err)
 	}
 
 	// Init database
-	db, err := initInfoDB()
+	store, err := storage.Open(cfg.Paths.DB)
 	if err != nil {
-		fmt.Println("Error opening nodes db", err)
+		return fmt.Errorf("error opening nodes db: %w", err)
 	}
-	defer db.Close()
+	defer store.Close()
 
-	// Read embedded MaxMind DB files
-	country_v4_data, err := mmdbFS.ReadFile("data/country-ipv4.mmdb")
-	if err != nil {
-		fmt.Println("Error opening country_v4_data", err)
-	}
-	country_db_v4, err := maxminddb.FromBytes(country_v4_data)
+	run, err := store.StartRun()
 	if err != nil {
-		fmt.Println("Error opening country_db_v4", err)
+		return fmt.Errorf("error starting crawl run: %w", err)
 	}
-	defer country_db_v4.Close()
 
-	country_v6_data, err := mmdbFS.ReadFile("data/country-ipv6.mmdb")
-	if err != nil {
-		fmt.Println("Error opening country_v6_data", err)
-	}
-	country_db_v6, err := maxminddb.FromBytes(country_v6_data)
+	return collectNodes(cfg, store, run.ID, geo, classifier, nodesList)
+}
+
+// collectNodes collects the data of every pending node in the run
+func collectNodes(
+	cfg *config.Config, store *storage.Store, runID int64, geo geoip.Provider, classifier *hosting.Classifier,
+	nodesList []string,
+) error {
+	err := store.InitProbes(runID, storage.StageCollectData, nodesList)
 	if err != nil {
-		fmt.Println("Error opening country_db_v6", err)
+		return fmt.Errorf("error initializing nodes in database: %w", err)
 	}
-	defer country_db_v6.Close()
 
-	asn_v4_data, err := mmdbFS.ReadFile("data/asn-ipv4.mmdb")
+	// Nodes left running were interrupted by a crash
+	err = store.ResetInterrupted(runID, storage.StageCollectData)
 	if err != nil {
-		fmt.Println("Error opening asn_v4_data", err)
+		return fmt.Errorf("error resetting interrupted nodes: %w", err)
 	}
-	asn_db_v4, err := maxminddb.FromBytes(asn_v4_data)
+
+	pendingNodes, err := store.DomainsWithStatus(runID, storage.StageCollectData, storage.StatusPending)
 	if err != nil {
-		fmt.Println("Error opening country_db_v4", err)
+		return fmt.Errorf("error retrieving pending nodes: %w", err)
 	}
-	defer asn_db_v4.Close()
 
-	asn_v6_data, err := mmdbFS.ReadFile("data/asn-ipv6.mmdb")
+	dns, err := resolver.New(cfg.DNS, store)
 	if err != nil {
-		fmt.Println("Error opening asn_v6_data", err)
+		return err
 	}
-	asn_db_v6, err := maxminddb.FromBytes(asn_v6_data)
+	client := fetch.New(cfg, dns)
+	fmt.Println("DNS upstream", dns.Upstream())
+	checker, err := optout.New(cfg, store, client)
 	if err != nil {
-		fmt.Println("Error opening country_db_v4", err)
+		return err
 	}
-	defer asn_db_v6.Close()
-
-	initializeInfoNodes(db, nodesList)
-
-	client := &http.Client{Timeout: 5 * time.Second}
 
-	total := len(nodesList)
+	total := len(pendingNodes)
 	var processed uint32
 	// 1) start reporter
 	go func() {
@@ -187,187 +129,178 @@ func CollectData() {
 		}
 	}()
 
-	jobs := make(chan string, len(nodesList))
+	jobs := make(chan string, len(pendingNodes))
 
 	var wg sync.WaitGroup
-	for i := 0; i < maxWorkers; i++ {
+	for i := 0; i < cfg.Workers; i++ {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
 			for domain := range jobs {
-				collectForNode(db, client, country_db_v4, country_db_v6, asn_db_v4, asn_db_v6, domain)
+				collectForNode(store, runID, client, dns, checker, geo, classifier, domain)
 				atomic.AddUint32(&processed, 1)
 			}
 		}()
 	}
 
-	for _, domain := range nodesList {
+	for _, domain := range pendingNodes {
 		jobs <- domain
 	}
 	close(jobs)
 
 	wg.Wait()
 	fmt.Println("All nodes processed.")
-
+	return nil
 }
 
 func collectForNode(
-	db *sql.DB, client *http.Client,
-	countryDBv4, countryDBv6, asnDBv4, asnDBv6 *maxminddb.Reader,
-	domain string,
+	store *storage.Store, runID int64, client *fetch.Client, dns *resolver.Resolver,
+	checker *optout.Checker, geo geoip.Provider, classifier *hosting.Classifier, domain string,
 ) {
-	updateStatus(db, domain, StatusChecking)
+	store.SetStatus(runID, storage.StageCollectData, domain, storage.StatusRunning, "")
 
-	ip, err := lookupIP(domain)
+	reason, err := checker.Check(runID, domain, "/api/v1/instance")
 	if err != nil {
-		updateStatus(db, domain, StatusFailed)
+		store.SetStatus(runID, storage.StageCollectData, domain, storage.StatusFailed, err.Error())
+		return
+	}
+	if reason != "" {
+		store.SetStatus(runID, storage.StageCollectData, domain, storage.StatusSkipped, reason)
 		return
 	}
 
-	version, err := IPVersion(ip)
+	ips, err := lookupIPs(client, domain)
 	if err != nil {
-		updateStatus(db, domain, StatusFailed)
+		store.SetStatus(runID, storage.StageCollectData, domain, storage.StatusFailed, err.Error())
 		return
 	}
 
-	var geo *geoInfo
-	switch version {
-	case "ipv4":
-		geo, err = lookupGeo(ip, asnDBv4, countryDBv4)
-	default:
-		geo, err = lookupGeo(ip, asnDBv6, countryDBv6)
+	// The DNS records only describe the instance further, so it is collected
+	// with whatever records were found
+	records, err := lookupDNS(dns, domain)
+	if err != nil {
+		log.Printf("%s: %v", domain, err)
 	}
+
+	addrs := make([]storage.Address, 0, len(ips))
+	for _, ip := range ips {
+		addr, err := lookupGeo(ip, geo)
+		if err != nil {
+			store.SetStatus(runID, storage.StageCollectData, domain, storage.StatusFailed, err.Error())
+			return
+		}
+		addrs = append(addrs, addr)
+	}
+	// The address requests are made to stands for the instance
+	primary := addrs[0]
+
+	inst, header, err := fetchInstanceStats(domain, client)
 	if err != nil {
-		updateStatus(db, domain, StatusFailed)
+		store.SetStatus(runID, storage.StageCollectData, domain, storage.StatusFailed, err.Error())
 		return
 	}
 
-	inst, err := fetchInstanceStats(domain, client)
+	var cnames []string
+	for _, r := range records {
+		if r.Type == resolver.TypeCNAME {
+			cnames = append(cnames, r.Value)
+		}
+	}
+	host, evidence := classifier.Classify(hosting.Observation{
+		Domain: domain, Addresses: addrs, CNAMEs: cnames, Header: header,
+	})
+
+	err = store.SetNodeInfo(runID, domain, storage.NodeInfo{
+		IP:            primary.IP,
+		ASN:           primary.ASN,
+		ASOrg:         primary.ASOrg,
+		CountryCode:   primary.CountryCode,
+		UserCount:     inst.Stats.UserCount,
+		PostCount:     inst.Stats.StatusCount,
+		CloudProvider: host.Provider,
+		CountrySource: primary.CountrySource,
+		ASNSource:     primary.ASNSource,
+		Addresses:     addrs,
+		DNS:           records,
+
+		HostingConfidence: host.Confidence,
+		CDN:               host.CDN,
+		CDNConfidence:     host.CDNConfidence,
+		HostingEvidence:   evidence,
+	})
 	if err != nil {
-		updateStatus(db, domain, StatusFailed)
-		return
+		store.SetStatus(runID, storage.StageCollectData, domain, storage.StatusFailed, err.Error())
 	}
 
-	updateNodeInfo(db, domain,
-		ip,
-		fmt.Sprintf("%d", geo.ASN),
-		geo.CountryCode,
-		inst.Stats.UserCount,
-		inst.Stats.StatusCount,
-		detectCloudProviderFromOrg(geo.ASName),
-	)
+}
 
+// lookupDNS returns the CNAME chain, name servers and mail exchangers of
+// domain. The records found are returned along with any lookup error.
+func lookupDNS(dns *resolver.Resolver, domain string) ([]storage.DNSRecord, error) {
+	records, err := dns.Lookup(context.Background(), domain)
+	if err != nil {
+		return records, fmt.Errorf("DNS record lookup failed: %w", err)
+	}
+	return records, nil
 }
 
-func lookupIP(domain string) (string, error) {
-	ips, err := net.LookupIP(domain)
-	if err != nil || len(ips) == 0 {
-		return "", fmt.Errorf("DNS lookup failed: %v", err)
+// lookupIPs returns every A and AAAA record of domain
+func lookupIPs(client *fetch.Client, domain string) ([]string, error) {
+	ips, err := client.LookupIPs(domain)
+	if err != nil {
+		return nil, fmt.Errorf("DNS lookup failed: %w", err)
 	}
-	return ips[0].String(), nil
+	return ips, nil
 }
 
-func lookupGeo(ipStr string, asn_reader *maxminddb.Reader, country_reader *maxminddb.Reader) (*geoInfo, error) {
+// lookupGeo looks up the family, country and AS of an address. Addresses
+// the databases don't cover get empty values rather than an error.
+func lookupGeo(ipStr string, geo geoip.Provider) (storage.Address, error) {
 	ip := net.ParseIP(ipStr)
 	if ip == nil {
-		return nil, fmt.Errorf("invalid IP %q", ipStr)
-	}
-
-	// 1) ASN lookup
-	var asnRec struct {
-		AutonomousSystemNumber       uint   `maxminddb:"autonomous_system_number"`
-		AutonomousSystemOrganization string `maxminddb:"autonomous_system_organization"`
+		return storage.Address{}, fmt.Errorf("invalid IP %q", ipStr)
 	}
-	if err := asn_reader.Lookup(ip, &asnRec); err != nil {
-		return nil, fmt.Errorf("ASN lookup failed: %w", err)
-	}
-
-	// 2) Country lookup
-	var countryRec struct {
-		CountryCode string `maxminddb:"country_code"`
-	}
-	if err := country_reader.Lookup(ip, &countryRec); err != nil {
-		return nil, fmt.Errorf("Country lookup failed: %w", err)
+	info, err := geo.Lookup(ip)
+	if err != nil {
+		return storage.Address{}, err
 	}
-
-	return &geoInfo{
-		CountryCode: countryRec.CountryCode,
-		ASN:         asnRec.AutonomousSystemNumber,
-		ASName:      asnRec.AutonomousSystemOrganization,
+	family := storage.FamilyIPv6
+	if ip.To4() != nil {
+		family = storage.FamilyIPv4
+	}
+	return storage.Address{
+		IP:            ipStr,
+		Family:        family,
+		ASN:           info.ASN,
+		ASOrg:         info.ASOrg,
+		CountryCode:   info.CountryCode,
+		CountrySource: info.CountrySource,
+		ASNSource:     info.ASNSource,
 	}, nil
 }
-func fetchInstanceStats(domain string, client *http.Client) (*instanceStats, error) {
+
+// fetchInstanceStats returns the stats of an instance and the headers it
+// answered with
+func fetchInstanceStats(domain string, client *fetch.Client) (*instanceStats, http.Header, error) {
 	url := fmt.Sprintf("https://%s/api/v1/instance", domain)
 	resp, err := client.Get(url)
 	if err != nil {
-		return nil, fmt.Errorf("GET %s failed: %w", url, err)
+		return nil, nil, fmt.Errorf("GET %s failed: %w", url, err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("non-200 status: %d; body=%q", resp.StatusCode, string(body))
+		return nil, nil, fmt.Errorf("non-200 status: %d; body=%q", resp.StatusCode, string(body))
 	}
 	if ct := resp.Header.Get("Content-Type"); !strings.Contains(ct, "application/json") {
 		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("unexpected content-type %q; body=%q", ct, string(body))
+		return nil, nil, fmt.Errorf("unexpected content-type %q; body=%q", ct, string(body))
 	}
 
 	var stats instanceStats
 	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
-		return nil, fmt.Errorf("JSON decode error: %w", err)
-	}
-	return &stats, nil
-}
-
-func detectCloudProviderFromOrg(org string) string {
-	org = strings.ToLower(org)
-	switch {
-	case strings.Contains(org, "amazon"):
-		return "AWS"
-	case strings.Contains(org, "google"):
-		return "GCP"
-	case strings.Contains(org, "microsoft") || strings.Contains(org, "azure"):
-		return "Azure"
-	case strings.Contains(org, "digitalocean"):
-		return "DigitalOcean"
-	case strings.Contains(org, "linode"):
-		return "Linode"
-	case strings.Contains(org, "ovh"):
-		return "OVH"
-	case strings.Contains(org, "hetzner"):
-		return "Hetzner"
-	default:
-		return ""
-	}
-}
-
-func updateStatus(db *sql.DB, domain, status string) {
-	_, _ = db.Exec(
-		`UPDATE node_info SET status=?, last_updated=CURRENT_TIMESTAMP WHERE domain=?`,
-		status, domain,
-	)
-}
-
-func updateNodeInfo(db *sql.DB, domain, ip, asn, country string, userCount, postCount int, cloud string) {
-	_, _ = db.Exec(
-		`UPDATE node_info SET
-            status=?,
-            ip=?, asn=?, country_code=?,
-            user_count=?, post_count=?, cloud_provider=?,
-            last_updated=CURRENT_TIMESTAMP
-         WHERE domain=?`, StatusSuccess,
-		ip, asn, country, userCount, postCount, cloud, domain,
-	)
-}
-
-func IPVersion(ipStr string) (string, error) {
-	ip := net.ParseIP(ipStr)
-	if ip == nil {
-		return "", errors.New("invalid IP format")
-	}
-	if ip.To4() != nil {
-		return "ipv4", nil
+		return nil, nil, fmt.Errorf("JSON decode error: %w", err)
 	}
-	return "ipv6", nil
+	return &stats, resp.Header, nil
 }
@@ -0,0 +1,212 @@
+package collect_data
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kothavade/mastodon-paper/config"
+	"github.com/kothavade/mastodon-paper/fedtest"
+	"github.com/kothavade/mastodon-paper/filter"
+	"github.com/kothavade/mastodon-paper/geoip"
+	"github.com/kothavade/mastodon-paper/hosting"
+	"github.com/kothavade/mastodon-paper/process"
+	"github.com/kothavade/mastodon-paper/storage"
+)
+
+func TestCollectNodes(t *testing.T) {
+	instances := fedtest.Standard()
+	// alpha.test is dual stack behind Cloudflare, and beta.test is hosted
+	// in two countries, has its own zone and mail and claims to be on Fly.io
+	for i := range instances {
+		switch instances[i].Domain {
+		case "alpha.test":
+			instances[i].MoreIPs = []string{"2001:4860:4860::8888", "8.8.8.8"}
+			instances[i].DNS = []storage.DNSRecord{
+				{Name: "alpha.test", Type: "CNAME", Value: "alpha.edge.cdn.test"},
+				{Name: "alpha.edge.cdn.test", Type: "CNAME", Value: "alpha.test.cdn.cloudflare.net"},
+			}
+			instances[i].Headers = map[string]string{"CF-Ray": "8a1b2c3d4e5f6a7b-AMS"}
+		case "beta.test":
+			instances[i].MoreIPs = []string{"133.242.0.4"}
+			instances[i].DNS = []storage.DNSRecord{
+				{Name: "beta.test", Type: "SOA", Value: "ns1.dnshost.test admin.beta.test 1 7200 900 1209600 300"},
+				{Name: "beta.test", Type: "NS", Value: "ns2.dnshost.test"},
+				{Name: "beta.test", Type: "NS", Value: "ns1.dnshost.test"},
+				{Name: "beta.test", Type: "MX", Value: "20 backup.mail.test"},
+				{Name: "beta.test", Type: "MX", Value: "10 mx.beta.test"},
+			}
+			instances[i].Headers = map[string]string{"Server": "Fly/5d9c2b1 (2025-05-01)"}
+		}
+	}
+	fed := fedtest.Start(t, instances...)
+	cfg := fedtest.Config(t)
+	cfg.DNS.Upstream = fed.DNS()
+	fedtest.WriteJSON(t, cfg.Paths.Nodes, fedtest.Domains(instances))
+
+	if err := filter.FilterNodes(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := process.ProcessNodes(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	// No databases are configured, so countries come from the embedded IPv4
+	// database and ASNs are left empty
+	geo, err := geoip.Open(cfg.GeoIP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer geo.Close()
+
+	// beta.test and flaky.test have addresses in a published Hetzner range
+	ranges := filepath.Join(t.TempDir(), "hetzner.txt")
+	if err := os.WriteFile(ranges, []byte("# Hetzner\n133.242.0.0/16\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	classifier, err := hosting.Load(config.HostingConfig{Ranges: []string{"Hetzner=" + ranges}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := storage.Open(cfg.Paths.DB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	run, err := store.ActiveRun()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// ghost.test does not resolve and robots.test disallows the API
+	nodes := []string{"alpha.test", "beta.test", "flaky.test", "ghost.test", "robots.test"}
+	if err := collectNodes(cfg, store, run.ID, geo, classifier, nodes); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := store.InstancesWithStatus(run.ID, storage.StageCollectData, storage.StatusSuccess)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	for _, r := range records {
+		fmt.Fprintf(&out, "%s software=%s ip=%s country=%s (%s) asn=%v users=%d posts=%d\n",
+			r.Domain, *r.Software, *r.IP, *r.CountryCode, *r.CountrySource, r.ASN, *r.UserCount, *r.PostCount)
+	}
+	fedtest.Golden(t, "collected", out.String())
+
+	out.Reset()
+	err = store.EachAddress(run.ID, func(domain string, a storage.Address) error {
+		_, err := fmt.Fprintf(&out, "%s %s %s country=%s\n", domain, a.IP, a.Family, a.CountryCode)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fedtest.Golden(t, "addresses", out.String())
+
+	out.Reset()
+	err = store.EachDNSRecord(run.ID, func(domain string, r storage.DNSRecord) error {
+		_, err := fmt.Fprintf(&out, "%s %s %s %s\n", domain, r.Type, r.Name, r.Value)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fedtest.Golden(t, "dns", out.String())
+
+	out.Reset()
+	err = store.EachHosting(run.ID, func(domain string, h storage.Hosting) error {
+		_, err := fmt.Fprintf(&out, "%s origin=%q (%.2f) cdn=%q (%.2f)\n", domain, h.Provider, h.Confidence, h.CDN, h.CDNConfidence)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.EachHostingEvidence(run.ID, func(domain string, e storage.HostingEvidence) error {
+		_, err := fmt.Fprintf(&out, "%s %s %s %s %q %.2f\n", domain, e.Role, e.Provider, e.Source, e.Detail, e.Confidence)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fedtest.Golden(t, "hosting", out.String())
+
+	stats, err := store.AddressStats(run.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Instances != 3 || stats.IPv4Only != 2 || stats.DualStack != 1 || stats.MultiAddress != 2 || stats.MultiCountry != 1 {
+		t.Errorf("got %+v, want 3 instances, 2 IPv4 only, 1 dual stack, 2 on several addresses, 1 in several countries", stats)
+	}
+	if c := stats.Software["mastodon"]; c.Instances != 2 || c.IPv6 != 1 {
+		t.Errorf("got %+v for mastodon, want 2 instances, 1 over IPv6", c)
+	}
+	fedtest.Golden(t, "collect_probes", fedtest.DumpProbes(t, store, storage.StageCollectData))
+
+	if n := fed.Requests("flaky.test", "/api/v1/instance"); n != 2 {
+		t.Errorf("flaky.test got %d instance requests, want 2 (one retry after 429)", n)
+	}
+}
+
+func TestCollectWithoutDNSRecords(t *testing.T) {
+	instances := []fedtest.Instance{{Domain: "alpha.test", IP: "8.8.8.8", Software: "mastodon", Users: 1, Posts: 2, Peers: []string{}}}
+	fedtest.Start(t, instances...)
+	cfg := fedtest.Config(t)
+	fedtest.WriteJSON(t, cfg.Paths.Nodes, fedtest.Domains(instances))
+
+	// A resolver that never answers, so looking up the DNS records of
+	// alpha.test fails while its addresses still resolve
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	cfg.DNS.Upstream = conn.LocalAddr().String()
+	cfg.DNS.Timeout = 20 * time.Millisecond
+
+	if err := filter.FilterNodes(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := process.ProcessNodes(cfg); err != nil {
+		t.Fatal(err)
+	}
+	geo, err := geoip.Open(cfg.GeoIP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer geo.Close()
+	classifier, err := hosting.Load(config.HostingConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := storage.Open(cfg.Paths.DB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	run, err := store.ActiveRun()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := collectNodes(cfg, store, run.ID, geo, classifier, []string{"alpha.test"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := fedtest.DumpProbes(t, store, storage.StageCollectData); got != "alpha.test success\n" {
+		t.Errorf("got probes %q, want alpha.test collected without DNS records", got)
+	}
+	err = store.EachDNSRecord(run.ID, func(domain string, r storage.DNSRecord) error {
+		t.Errorf("got DNS record %+v of %s, want none", r, domain)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
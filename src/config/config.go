@@ -0,0 +1,507 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultFile is the config file read when neither -config nor MP_CONFIG is set
+const DefaultFile = "mastodon-paper.toml"
+
+// envPrefix is prepended to the name of every environment variable override
+const envPrefix = "MP_"
+
+// Config holds everything the stages need to know about their environment
+type Config struct {
+	Neo4j       Neo4jConfig    `toml:"neo4j" yaml:"neo4j"`
+	Graph       GraphConfig    `toml:"graph" yaml:"graph"`
+	Paths       PathsConfig    `toml:"paths" yaml:"paths"`
+	Discover    DiscoverConfig `toml:"discover" yaml:"discover"`
+	HTTP        HTTPConfig     `toml:"http" yaml:"http"`
+	GeoIP       GeoIPConfig    `toml:"geoip" yaml:"geoip"`
+	DNS         DNSConfig      `toml:"dns" yaml:"dns"`
+	Hosting     HostingConfig  `toml:"hosting" yaml:"hosting"`
+	CAIDA       CAIDAConfig    `toml:"caida" yaml:"caida"`
+	Workers     int            `toml:"workers" yaml:"workers"`
+	HTTPTimeout time.Duration  `toml:"http_timeout" yaml:"http_timeout"`
+}
+
+// Neo4jConfig holds the Neo4j connection settings
+type Neo4jConfig struct {
+	URI       string `toml:"uri" yaml:"uri"`
+	User      string `toml:"user" yaml:"user"`
+	Password  string `toml:"password" yaml:"password"`
+	BatchSize int    `toml:"batch_size" yaml:"batch_size"`
+}
+
+// GraphConfig chooses where graph-init, injest and injest_data write the graph
+type GraphConfig struct {
+	Sink   string `toml:"sink" yaml:"sink"`
+	Output string `toml:"output" yaml:"output"`
+}
+
+// DiscoverConfig controls the snowball crawl that builds the node list
+type DiscoverConfig struct {
+	Seeds        []string `toml:"seeds" yaml:"seeds"`
+	MaxDepth     int      `toml:"max_depth" yaml:"max_depth"`
+	MaxInstances int      `toml:"max_instances" yaml:"max_instances"`
+}
+
+// HTTPConfig controls how politely the crawling stages fetch from instances
+type HTTPConfig struct {
+	UserAgent       string        `toml:"user_agent" yaml:"user_agent"`
+	HostConcurrency int           `toml:"host_concurrency" yaml:"host_concurrency"`
+	HostInterval    time.Duration `toml:"host_interval" yaml:"host_interval"`
+	IPConcurrency   int           `toml:"ip_concurrency" yaml:"ip_concurrency"`
+	IPInterval      time.Duration `toml:"ip_interval" yaml:"ip_interval"`
+	MaxRetries      int           `toml:"max_retries" yaml:"max_retries"`
+	RetryBackoff    time.Duration `toml:"retry_backoff" yaml:"retry_backoff"`
+	MaxRetryWait    time.Duration `toml:"max_retry_wait" yaml:"max_retry_wait"`
+	RobotsTTL       time.Duration `toml:"robots_ttl" yaml:"robots_ttl"`
+}
+
+// GeoIPConfig lists the MMDB files collect_data looks IP addresses up in, in
+// order of preference. A file may cover IPv4, IPv6 or both, and may be listed
+// under both kinds if it has country and AS fields.
+type GeoIPConfig struct {
+	Country []string `toml:"country" yaml:"country"`
+	ASN     []string `toml:"asn" yaml:"asn"`
+}
+
+// DNSConfig controls the resolver the crawling stages look domains up with
+type DNSConfig struct {
+	// Upstream is the recursive resolver queried, as host or host:port. The
+	// first nameserver of /etc/resolv.conf is used if it is empty.
+	Upstream string        `toml:"upstream" yaml:"upstream"`
+	Timeout  time.Duration `toml:"timeout" yaml:"timeout"`
+	MaxTTL   time.Duration `toml:"max_ttl" yaml:"max_ttl"`
+}
+
+// HostingConfig lists the data collect_data classifies the hosting of
+// instances with, on top of the built-in provider table
+type HostingConfig struct {
+	// Providers are TOML provider tables read after the built-in one
+	Providers []string `toml:"providers" yaml:"providers"`
+	// Ranges are published IP range files, each as provider=path
+	Ranges []string `toml:"ranges" yaml:"ranges"`
+}
+
+// CAIDAConfig lists the CAIDA dataset files enrich_as describes the ASes of
+// instances with. Files may be compressed with gzip or bzip2.
+type CAIDAConfig struct {
+	// ASRank is a JSON Lines dump of AS Rank records
+	ASRank string `toml:"as_rank" yaml:"as_rank"`
+	// ASRel is an AS relationship file, serial-1 or serial-2
+	ASRel string `toml:"as_rel" yaml:"as_rel"`
+	// Cone is a customer cone file (ppdc-ases), computed from ASRel if empty
+	Cone string `toml:"cone" yaml:"cone"`
+	// ASOrg is an AS to organization file (as-org2info)
+	ASOrg string `toml:"as_org" yaml:"as_org"`
+}
+
+// PathsConfig holds the databases and files the stages read and write
+type PathsConfig struct {
+	Nodes           string `toml:"nodes" yaml:"nodes"`
+	DiscoveredNodes string `toml:"discovered_nodes" yaml:"discovered_nodes"`
+	FilteredNodes   string `toml:"filtered_nodes" yaml:"filtered_nodes"`
+	ProcessedNodes  string `toml:"processed_nodes" yaml:"processed_nodes"`
+	DB              string `toml:"db" yaml:"db"`
+	LegacyProcessDB string `toml:"legacy_process_db" yaml:"legacy_process_db"`
+	PeersCSV        string `toml:"peers_csv" yaml:"peers_csv"`
+	DataCSV         string `toml:"data_csv" yaml:"data_csv"`
+	PipelineState   string `toml:"pipeline_state" yaml:"pipeline_state"`
+	OptOut          string `toml:"opt_out" yaml:"opt_out"`
+}
+
+// Default returns the configuration the tool used before it was configurable
+func Default() *Config {
+	return &Config{
+		Neo4j: Neo4jConfig{
+			URI:       "neo4j://localhost:7687",
+			User:      "neo4j",
+			Password:  "mastodonpaper",
+			BatchSize: 5000,
+		},
+		Graph: GraphConfig{
+			Sink: "neo4j",
+		},
+		Paths: PathsConfig{
+			Nodes:           "nodes.json",
+			DiscoveredNodes: "discovered_nodes.json",
+			FilteredNodes:   "filtered_nodes.json",
+			ProcessedNodes:  "filtered_processed_nodes.json",
+			DB:              "node_filter.db",
+			LegacyProcessDB: "node_process.db",
+			PeersCSV:        "domain_peers.csv",
+			DataCSV:         "data.csv",
+			PipelineState:   "pipeline_state.json",
+			OptOut:          "opt_out.txt",
+		},
+		Discover: DiscoverConfig{
+			Seeds:    []string{"mastodon.social"},
+			MaxDepth: 2,
+		},
+		HTTP: HTTPConfig{
+			UserAgent:       "mastodon-paper/1.0 (research crawler; +https://github.com/kothavade/mastodon-paper)",
+			HostConcurrency: 2,
+			HostInterval:    500 * time.Millisecond,
+			IPConcurrency:   8,
+			IPInterval:      100 * time.Millisecond,
+			MaxRetries:      3,
+			RetryBackoff:    time.Second,
+			MaxRetryWait:    2 * time.Minute,
+			RobotsTTL:       24 * time.Hour,
+		},
+		DNS: DNSConfig{
+			Timeout: 2 * time.Second,
+			MaxTTL:  24 * time.Hour,
+		},
+		Workers:     10,
+		HTTPTimeout: 5 * time.Second,
+	}
+}
+
+// setting ties one config field to its environment variable and flag
+type setting struct {
+	key   string
+	usage string
+	get   func(c *Config) string
+	set   func(c *Config, v string) error
+}
+
+func stringSetting(key, usage string, field func(c *Config) *string) setting {
+	return setting{
+		key:   key,
+		usage: usage,
+		get:   func(c *Config) string { return *field(c) },
+		set:   func(c *Config, v string) error { *field(c) = v; return nil },
+	}
+}
+
+func intSetting(key, usage string, field func(c *Config) *int) setting {
+	return setting{
+		key:   key,
+		usage: usage,
+		get:   func(c *Config) string { return strconv.Itoa(*field(c)) },
+		set: func(c *Config, v string) error {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("invalid number %q", v)
+			}
+			*field(c) = n
+			return nil
+		},
+	}
+}
+
+func durationSetting(key, usage string, field func(c *Config) *time.Duration) setting {
+	return setting{
+		key:   key,
+		usage: usage,
+		get:   func(c *Config) string { return field(c).String() },
+		set: func(c *Config, v string) error {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return fmt.Errorf("invalid duration %q", v)
+			}
+			*field(c) = d
+			return nil
+		},
+	}
+}
+
+// listSetting reads a list from a comma-separated environment variable or flag
+func listSetting(key, usage string, field func(c *Config) *[]string) setting {
+	return setting{
+		key:   key,
+		usage: usage + ", comma-separated",
+		get:   func(c *Config) string { return strings.Join(*field(c), ",") },
+		set: func(c *Config, v string) error {
+			var items []string
+			for _, item := range strings.Split(v, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					items = append(items, item)
+				}
+			}
+			*field(c) = items
+			return nil
+		},
+	}
+}
+
+var settings = []setting{
+	stringSetting("neo4j.uri", "Neo4j connection URI", func(c *Config) *string { return &c.Neo4j.URI }),
+	stringSetting("neo4j.user", "Neo4j user", func(c *Config) *string { return &c.Neo4j.User }),
+	stringSetting("neo4j.password", "Neo4j password", func(c *Config) *string { return &c.Neo4j.Password }),
+	intSetting("neo4j.batch_size", "rows written to Neo4j or Memgraph per transaction", func(c *Config) *int { return &c.Neo4j.BatchSize }),
+	stringSetting("graph.sink", "where the graph is written: neo4j, memgraph (over Bolt with the neo4j settings), graphml, gexf or json", func(c *Config) *string { return &c.Graph.Sink }),
+	stringSetting("graph.output", "file the graphml, gexf and json sinks write, graph.<sink> if empty", func(c *Config) *string { return &c.Graph.Output }),
+	stringSetting("paths.nodes", "seed node list written by the external crawler", func(c *Config) *string { return &c.Paths.Nodes }),
+	stringSetting("paths.discovered_nodes", "node list written by discover", func(c *Config) *string { return &c.Paths.DiscoveredNodes }),
+	stringSetting("paths.filtered_nodes", "nodes that support the peers API", func(c *Config) *string { return &c.Paths.FilteredNodes }),
+	stringSetting("paths.processed_nodes", "nodes whose peers were fetched", func(c *Config) *string { return &c.Paths.ProcessedNodes }),
+	stringSetting("paths.db", "SQLite database shared by every stage", func(c *Config) *string { return &c.Paths.DB }),
+	stringSetting("paths.legacy_process_db", "node_process.db written by older versions, imported once if present", func(c *Config) *string { return &c.Paths.LegacyProcessDB }),
+	stringSetting("paths.peers_csv", "peer relationship CSV written by injest -csv", func(c *Config) *string { return &c.Paths.PeersCSV }),
+	stringSetting("paths.data_csv", "node data CSV written by injest_data -csv", func(c *Config) *string { return &c.Paths.DataCSV }),
+	stringSetting("paths.pipeline_state", "pipeline progress file used by run", func(c *Config) *string { return &c.Paths.PipelineState }),
+	stringSetting("paths.opt_out", "domains that asked not to be crawled, one per line, read if present", func(c *Config) *string { return &c.Paths.OptOut }),
+	listSetting("discover.seeds", "domains discover starts crawling from", func(c *Config) *[]string { return &c.Discover.Seeds }),
+	intSetting("discover.max_depth", "how many peer hops discover follows from the seeds", func(c *Config) *int { return &c.Discover.MaxDepth }),
+	intSetting("discover.max_instances", "stop queueing new domains after this many, 0 for no limit", func(c *Config) *int { return &c.Discover.MaxInstances }),
+	{
+		key:   "workers",
+		usage: "number of concurrent workers per stage",
+		get:   func(c *Config) string { return strconv.Itoa(c.Workers) },
+		set: func(c *Config, v string) error {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("invalid worker count %q", v)
+			}
+			c.Workers = n
+			return nil
+		},
+	},
+	durationSetting("http_timeout", "timeout for a single HTTP request", func(c *Config) *time.Duration { return &c.HTTPTimeout }),
+	stringSetting("http.user_agent", "User-Agent sent to instances, with a contact URL or address", func(c *Config) *string { return &c.HTTP.UserAgent }),
+	intSetting("http.host_concurrency", "concurrent requests to one domain", func(c *Config) *int { return &c.HTTP.HostConcurrency }),
+	durationSetting("http.host_interval", "minimum time between requests to one domain", func(c *Config) *time.Duration { return &c.HTTP.HostInterval }),
+	intSetting("http.ip_concurrency", "concurrent requests to one IP address", func(c *Config) *int { return &c.HTTP.IPConcurrency }),
+	durationSetting("http.ip_interval", "minimum time between requests to one IP address", func(c *Config) *time.Duration { return &c.HTTP.IPInterval }),
+	intSetting("http.max_retries", "retries of a request after transient errors, 429 and 503", func(c *Config) *int { return &c.HTTP.MaxRetries }),
+	durationSetting("http.retry_backoff", "initial backoff between retries, doubled each attempt", func(c *Config) *time.Duration { return &c.HTTP.RetryBackoff }),
+	durationSetting("http.max_retry_wait", "longest backoff or Retry-After honoured before giving up", func(c *Config) *time.Duration { return &c.HTTP.MaxRetryWait }),
+	durationSetting("http.robots_ttl", "how long a fetched robots.txt is reused", func(c *Config) *time.Duration { return &c.HTTP.RobotsTTL }),
+	listSetting("geoip.country", "MMDB files countries are looked up in, the embedded IPv4 database if empty", func(c *Config) *[]string { return &c.GeoIP.Country }),
+	listSetting("geoip.asn", "MMDB files autonomous systems are looked up in", func(c *Config) *[]string { return &c.GeoIP.ASN }),
+	stringSetting("dns.upstream", "recursive DNS resolver queried, as host or host:port, the first nameserver of /etc/resolv.conf if empty", func(c *Config) *string { return &c.DNS.Upstream }),
+	durationSetting("dns.timeout", "timeout for a single DNS query", func(c *Config) *time.Duration { return &c.DNS.Timeout }),
+	durationSetting("dns.max_ttl", "longest a DNS answer is cached, whatever its TTL", func(c *Config) *time.Duration { return &c.DNS.MaxTTL }),
+	listSetting("hosting.providers", "TOML hosting provider tables read after the built-in one", func(c *Config) *[]string { return &c.Hosting.Providers }),
+	listSetting("hosting.ranges", "published IP range files of hosting providers, each as provider=path", func(c *Config) *[]string { return &c.Hosting.Ranges }),
+	stringSetting("caida.as_rank", "CAIDA AS Rank JSON Lines file", func(c *Config) *string { return &c.CAIDA.ASRank }),
+	stringSetting("caida.as_rel", "CAIDA AS relationship file, ranks ASes by customer cone if caida.as_rank is empty", func(c *Config) *string { return &c.CAIDA.ASRel }),
+	stringSetting("caida.cone", "CAIDA customer cone file (ppdc-ases), computed from caida.as_rel if empty", func(c *Config) *string { return &c.CAIDA.Cone }),
+	stringSetting("caida.as_org", "CAIDA AS to organization file (as-org2info)", func(c *Config) *string { return &c.CAIDA.ASOrg }),
+}
+
+// envName turns a setting key like neo4j.uri into MP_NEO4J_URI
+func envName(key string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+}
+
+// flagName turns a setting key like paths.legacy_process_db into
+// legacy-process-db. Keys of the neo4j, graph, geoip, dns, hosting and caida
+// sections keep their prefix, as in neo4j-uri.
+func flagName(key string) string {
+	keepPrefix := strings.HasPrefix(key, "neo4j.") || strings.HasPrefix(key, "graph.") || strings.HasPrefix(key, "geoip.") ||
+		strings.HasPrefix(key, "dns.") || strings.HasPrefix(key, "hosting.") || strings.HasPrefix(key, "caida.")
+	if i := strings.LastIndex(key, "."); i >= 0 && !keepPrefix {
+		key = key[i+1:]
+	}
+	return strings.NewReplacer(".", "-", "_", "-").Replace(key)
+}
+
+// Parse builds the configuration for a subcommand from the defaults, the
+// config file, MP_* environment variables and the subcommand's flags, each
+// overriding the one before. The flags are registered on fs before parsing
+// args, so callers can add their own flags to fs first.
+func Parse(fs *flag.FlagSet, args []string) (*Config, error) {
+	configPath := fs.String("config", "", "config file (TOML or YAML, default "+DefaultFile+")")
+	values := make(map[string]*string, len(settings))
+	for _, s := range settings {
+		values[s.key] = fs.String(flagName(s.key), "", fmt.Sprintf("%s (env %s)", s.usage, envName(s.key)))
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	path := *configPath
+	if path == "" {
+		path = os.Getenv(envPrefix + "CONFIG")
+	}
+	cfg, err := Load(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var flagErr error
+	fs.Visit(func(f *flag.Flag) {
+		for _, s := range settings {
+			if flagName(s.key) == f.Name && flagErr == nil {
+				if err := s.set(cfg, *values[s.key]); err != nil {
+					flagErr = fmt.Errorf("-%s: %w", f.Name, err)
+				}
+			}
+		}
+	})
+	if flagErr != nil {
+		return nil, flagErr
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Load reads the config file at path over the defaults and applies MP_*
+// environment variables. An empty path reads DefaultFile if it exists.
+func Load(path string) (*Config, error) {
+	cfg := Default()
+
+	explicit := path != ""
+	if !explicit {
+		path = DefaultFile
+	}
+	data, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist) && !explicit:
+	case err != nil:
+		return nil, fmt.Errorf("error reading config file: %w", err)
+	default:
+		if err := decode(path, data, cfg); err != nil {
+			return nil, fmt.Errorf("error parsing config file %s: %w", path, err)
+		}
+	}
+
+	for _, s := range settings {
+		if v, ok := os.LookupEnv(envName(s.key)); ok {
+			if err := s.set(cfg, v); err != nil {
+				return nil, fmt.Errorf("%s: %w", envName(s.key), err)
+			}
+		}
+	}
+
+	return cfg, nil
+}
+
+// decode parses a config file as YAML or TOML depending on its extension
+func decode(path string, data []byte, cfg *Config) error {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		err := dec.Decode(cfg)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		return err
+	default:
+		md, err := toml.Decode(string(data), cfg)
+		if err != nil {
+			return err
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("unknown key %q", undecoded[0].String())
+		}
+		return nil
+	}
+}
+
+// Validate checks that the configuration can be used by the stages
+func (c *Config) Validate() error {
+	var errs []error
+
+	u, err := url.Parse(c.Neo4j.URI)
+	switch {
+	case err != nil:
+		errs = append(errs, fmt.Errorf("neo4j.uri: %w", err))
+	case !validNeo4jScheme(u.Scheme):
+		errs = append(errs, fmt.Errorf("neo4j.uri: unsupported scheme %q", u.Scheme))
+	case u.Host == "":
+		errs = append(errs, fmt.Errorf("neo4j.uri: missing host"))
+	}
+	if c.Neo4j.User == "" {
+		errs = append(errs, fmt.Errorf("neo4j.user must not be empty"))
+	}
+	if c.Neo4j.BatchSize < 1 {
+		errs = append(errs, fmt.Errorf("neo4j.batch_size must be at least 1, got %d", c.Neo4j.BatchSize))
+	}
+
+	if !slices.Contains(graphSinks, c.Graph.Sink) {
+		errs = append(errs, fmt.Errorf("graph.sink must be one of %s, got %q", strings.Join(graphSinks, ", "), c.Graph.Sink))
+	}
+
+	for _, s := range settings {
+		if strings.HasPrefix(s.key, "paths.") && s.get(c) == "" {
+			errs = append(errs, fmt.Errorf("%s must not be empty", s.key))
+		}
+	}
+
+	if c.Discover.MaxDepth < 0 {
+		errs = append(errs, fmt.Errorf("discover.max_depth must not be negative, got %d", c.Discover.MaxDepth))
+	}
+	if c.Discover.MaxInstances < 0 {
+		errs = append(errs, fmt.Errorf("discover.max_instances must not be negative, got %d", c.Discover.MaxInstances))
+	}
+
+	if c.Workers < 1 {
+		errs = append(errs, fmt.Errorf("workers must be at least 1, got %d", c.Workers))
+	}
+	if c.HTTPTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("http_timeout must be positive, got %s", c.HTTPTimeout))
+	}
+
+	if !strings.Contains(c.HTTP.UserAgent, "http://") && !strings.Contains(c.HTTP.UserAgent, "https://") &&
+		!strings.Contains(c.HTTP.UserAgent, "@") {
+		errs = append(errs, fmt.Errorf("http.user_agent must include a contact URL or email address"))
+	}
+	if c.HTTP.HostConcurrency < 1 {
+		errs = append(errs, fmt.Errorf("http.host_concurrency must be at least 1, got %d", c.HTTP.HostConcurrency))
+	}
+	if c.HTTP.IPConcurrency < 1 {
+		errs = append(errs, fmt.Errorf("http.ip_concurrency must be at least 1, got %d", c.HTTP.IPConcurrency))
+	}
+	if c.HTTP.HostInterval < 0 || c.HTTP.IPInterval < 0 || c.HTTP.RetryBackoff < 0 || c.HTTP.MaxRetryWait < 0 || c.HTTP.RobotsTTL < 0 {
+		errs = append(errs, fmt.Errorf("http intervals and waits must not be negative"))
+	}
+	if c.HTTP.MaxRetries < 0 {
+		errs = append(errs, fmt.Errorf("http.max_retries must not be negative, got %d", c.HTTP.MaxRetries))
+	}
+
+	if c.DNS.Timeout <= 0 {
+		errs = append(errs, fmt.Errorf("dns.timeout must be positive, got %s", c.DNS.Timeout))
+	}
+	if c.DNS.MaxTTL < 0 {
+		errs = append(errs, fmt.Errorf("dns.max_ttl must not be negative, got %s", c.DNS.MaxTTL))
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid config: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// graphSinks are the values graph.sink accepts
+var graphSinks = []string{"neo4j", "memgraph", "graphml", "gexf", "json"}
+
+func validNeo4jScheme(scheme string) bool {
+	switch scheme {
+	case "neo4j", "neo4j+s", "neo4j+ssc", "bolt", "bolt+s", "bolt+ssc":
+		return true
+	}
+	return false
+}
+
+// Print writes the configuration as TOML, with the Neo4j password masked
+func (c *Config) Print(w io.Writer) error {
+	redacted := *c
+	if redacted.Neo4j.Password != "" {
+		redacted.Neo4j.Password = "********"
+	}
+	return toml.NewEncoder(w).Encode(redacted)
+}
@@ -0,0 +1,217 @@
+package config_test
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kothavade/mastodon-paper/config"
+)
+
+// writeFile writes data to name in a temporary directory and returns its path
+func writeFile(t *testing.T, name, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestParsePrecedence(t *testing.T) {
+	path := writeFile(t, "mp.toml", `
+workers = 2
+http_timeout = "2s"
+
+[neo4j]
+batch_size = 2
+
+[paths]
+db = "file.db"
+`)
+	t.Setenv("MP_WORKERS", "3")
+	t.Setenv("MP_NEO4J_BATCH_SIZE", "3")
+	t.Setenv("MP_DISCOVER_SEEDS", "a.test, b.test")
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cfg, err := config.Parse(fs, []string{"-config", path, "-workers", "4", "-db", "flag.db"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name      string
+		got, want any
+	}{
+		// Left at the default
+		{"neo4j.user", cfg.Neo4j.User, "neo4j"},
+		// Set in the file only
+		{"http_timeout", cfg.HTTPTimeout, 2 * time.Second},
+		// Set in the file and the environment
+		{"neo4j.batch_size", cfg.Neo4j.BatchSize, 3},
+		// Set in the environment only
+		{"discover.seeds", cfg.Discover.Seeds, []string{"a.test", "b.test"}},
+		// Set in the file and by a flag
+		{"paths.db", cfg.Paths.DB, "flag.db"},
+		// Set in the file, the environment and by a flag
+		{"workers", cfg.Workers, 4},
+	} {
+		if !reflect.DeepEqual(test.got, test.want) {
+			t.Errorf("%s = %v, want %v", test.name, test.got, test.want)
+		}
+	}
+}
+
+func TestParseConfigEnv(t *testing.T) {
+	path := writeFile(t, "mp.toml", "workers = 7\n")
+	t.Setenv("MP_CONFIG", path)
+
+	cfg, err := config.Parse(flag.NewFlagSet("test", flag.ContinueOnError), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Workers != 7 {
+		t.Errorf("workers = %d, want 7 from the file named by MP_CONFIG", cfg.Workers)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		env  map[string]string
+		args []string
+		want string
+	}{
+		{"env number", map[string]string{"MP_NEO4J_BATCH_SIZE": "many"}, nil, `MP_NEO4J_BATCH_SIZE: invalid number "many"`},
+		{"env duration", map[string]string{"MP_DNS_TIMEOUT": "2"}, nil, `MP_DNS_TIMEOUT: invalid duration "2"`},
+		{"flag number", nil, []string{"-workers", "many"}, `-workers: invalid worker count "many"`},
+		{"flag validated", nil, []string{"-workers", "0"}, "workers must be at least 1, got 0"},
+		{"missing file", nil, []string{"-config", filepath.Join(t.TempDir(), "missing.toml")}, "error reading config file"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			for k, v := range test.env {
+				t.Setenv(k, v)
+			}
+			_, err := config.Parse(flag.NewFlagSet("test", flag.ContinueOnError), test.args)
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("got error %v, want %q", err, test.want)
+			}
+		})
+	}
+}
+
+func TestLoadFormats(t *testing.T) {
+	want := config.Default()
+	want.Neo4j.URI = "bolt://graph.test:7687"
+	want.Graph.Sink = "graphml"
+	want.Discover.Seeds = []string{"a.test", "b.test"}
+	want.HTTP.HostInterval = 250 * time.Millisecond
+	want.Workers = 4
+
+	for name, data := range map[string]string{
+		"mp.toml": `
+workers = 4
+
+[neo4j]
+uri = "bolt://graph.test:7687"
+
+[graph]
+sink = "graphml"
+
+[discover]
+seeds = ["a.test", "b.test"]
+
+[http]
+host_interval = "250ms"
+`,
+		"mp.yaml": `
+workers: 4
+neo4j:
+  uri: bolt://graph.test:7687
+graph:
+  sink: graphml
+discover:
+  seeds: [a.test, b.test]
+http:
+  host_interval: 250ms
+`,
+		// An empty YAML file leaves the defaults
+		"empty.yml": "",
+	} {
+		t.Run(name, func(t *testing.T) {
+			got, err := config.Load(writeFile(t, name, data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := want
+			if data == "" {
+				expected = config.Default()
+			}
+			if !reflect.DeepEqual(got, expected) {
+				t.Errorf("got %+v, want %+v", got, expected)
+			}
+		})
+	}
+}
+
+func TestLoadUnknownKey(t *testing.T) {
+	for name, data := range map[string]string{
+		"mp.toml": "[neo4j]\nurl = \"neo4j://graph.test\"\n",
+		"mp.yaml": "neo4j:\n  url: neo4j://graph.test\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := config.Load(writeFile(t, name, data))
+			if err == nil || !strings.Contains(err.Error(), "url") {
+				t.Errorf("got error %v, want the unknown key url rejected", err)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := config.Default().Validate(); err != nil {
+		t.Fatalf("defaults: %v", err)
+	}
+
+	for _, test := range []struct {
+		name   string
+		modify func(c *config.Config)
+		want   string
+	}{
+		{"neo4j uri", func(c *config.Config) { c.Neo4j.URI = "neo4j://graph.test:port" }, "neo4j.uri: parse"},
+		{"neo4j scheme", func(c *config.Config) { c.Neo4j.URI = "http://graph.test" }, `neo4j.uri: unsupported scheme "http"`},
+		{"neo4j host", func(c *config.Config) { c.Neo4j.URI = "bolt:///db" }, "neo4j.uri: missing host"},
+		{"neo4j user", func(c *config.Config) { c.Neo4j.User = "" }, "neo4j.user must not be empty"},
+		{"batch size", func(c *config.Config) { c.Neo4j.BatchSize = 0 }, "neo4j.batch_size must be at least 1, got 0"},
+		{"graph sink", func(c *config.Config) { c.Graph.Sink = "dot" }, `graph.sink must be one of neo4j, memgraph, graphml, gexf, json, got "dot"`},
+		{"path", func(c *config.Config) { c.Paths.PipelineState = "" }, "paths.pipeline_state must not be empty"},
+		{"max depth", func(c *config.Config) { c.Discover.MaxDepth = -1 }, "discover.max_depth must not be negative, got -1"},
+		{"max instances", func(c *config.Config) { c.Discover.MaxInstances = -1 }, "discover.max_instances must not be negative, got -1"},
+		{"workers", func(c *config.Config) { c.Workers = 0 }, "workers must be at least 1, got 0"},
+		{"http timeout", func(c *config.Config) { c.HTTPTimeout = 0 }, "http_timeout must be positive, got 0s"},
+		{"user agent", func(c *config.Config) { c.HTTP.UserAgent = "mastodon-paper/1.0" }, "http.user_agent must include a contact URL or email address"},
+		{"host concurrency", func(c *config.Config) { c.HTTP.HostConcurrency = 0 }, "http.host_concurrency must be at least 1, got 0"},
+		{"ip concurrency", func(c *config.Config) { c.HTTP.IPConcurrency = 0 }, "http.ip_concurrency must be at least 1, got 0"},
+		{"interval", func(c *config.Config) { c.HTTP.RobotsTTL = -time.Second }, "http intervals and waits must not be negative"},
+		{"max retries", func(c *config.Config) { c.HTTP.MaxRetries = -1 }, "http.max_retries must not be negative, got -1"},
+		{"dns timeout", func(c *config.Config) { c.DNS.Timeout = 0 }, "dns.timeout must be positive, got 0s"},
+		{"dns max ttl", func(c *config.Config) { c.DNS.MaxTTL = -time.Second }, "dns.max_ttl must not be negative, got -1s"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := config.Default()
+			test.modify(cfg)
+			err := cfg.Validate()
+			if err == nil {
+				t.Fatalf("got no error, want %q", test.want)
+			}
+			// Only the broken setting is reported
+			if got := strings.TrimPrefix(err.Error(), "invalid config: "); !strings.HasPrefix(got, test.want) || strings.Contains(got, "\n") {
+				t.Errorf("got error %q, want only %q", err, test.want)
+			}
+		})
+	}
+}
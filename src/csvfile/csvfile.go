@@ -0,0 +1,130 @@
+// Package csvfile writes RFC 4180 CSV files whose header describes the type
+// of every column, in the name:type form neo4j-admin import reads.
+package csvfile
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// Column types
+const (
+	String = "string"
+	Long   = "long"
+)
+
+// Column describes one column of a CSV file
+type Column struct {
+	Name string
+	Type string
+	// Required columns must not be NULL; rows missing them are skipped
+	Required bool
+}
+
+// Writer writes rows to a CSV file. NULL values are written as empty fields.
+type Writer struct {
+	path    string
+	file    *os.File
+	csv     *csv.Writer
+	columns []Column
+	record  []string
+
+	// Written and Skipped count the rows written and skipped so far
+	Written int
+	Skipped int
+}
+
+// Create creates the file at path and writes its schema header
+func Create(path string, columns []Column) (*Writer, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s: %w", path, err)
+	}
+
+	w := &Writer{
+		path:    path,
+		file:    f,
+		csv:     csv.NewWriter(f),
+		columns: columns,
+		record:  make([]string, len(columns)),
+	}
+	for i, c := range columns {
+		w.record[i] = c.Name + ":" + c.Type
+	}
+	if err := w.csv.Write(w.record); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return w, nil
+}
+
+// Write writes one row with a value for every column, in order. Values are
+// strings or integers, or pointers to them where nil means NULL. A row with
+// a NULL in a required column is skipped.
+func (w *Writer) Write(values ...any) error {
+	if len(values) != len(w.columns) {
+		return fmt.Errorf("%s: got %d values for %d columns", w.path, len(values), len(w.columns))
+	}
+
+	for i, c := range w.columns {
+		field, ok, err := format(c, values[i])
+		if err != nil {
+			return fmt.Errorf("%s: %w", w.path, err)
+		}
+		if !ok && c.Required {
+			w.Skipped++
+			return nil
+		}
+		w.record[i] = field
+	}
+
+	if err := w.csv.Write(w.record); err != nil {
+		return fmt.Errorf("failed to write %s: %w", w.path, err)
+	}
+	w.Written++
+	return nil
+}
+
+// format returns the field for a value of a column, and false if it is NULL
+func format(c Column, v any) (string, bool, error) {
+	switch c.Type {
+	case String:
+		switch v := v.(type) {
+		case string:
+			return v, true, nil
+		case *string:
+			if v == nil {
+				return "", false, nil
+			}
+			return *v, true, nil
+		}
+	case Long:
+		switch v := v.(type) {
+		case int:
+			return strconv.Itoa(v), true, nil
+		case int64:
+			return strconv.FormatInt(v, 10), true, nil
+		case *int64:
+			if v == nil {
+				return "", false, nil
+			}
+			return strconv.FormatInt(*v, 10), true, nil
+		}
+	}
+	return "", false, fmt.Errorf("column %s of type %s cannot hold %T", c.Name, c.Type, v)
+}
+
+// Close flushes the rows and closes the file
+func (w *Writer) Close() error {
+	w.csv.Flush()
+	err := w.csv.Error()
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", w.path, err)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package csvfile_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kothavade/mastodon-paper/csvfile"
+)
+
+func TestWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.csv")
+	w, err := csvfile.Create(path, []csvfile.Column{
+		{Name: "domain", Type: csvfile.String, Required: true},
+		{Name: "as_org", Type: csvfile.String},
+		{Name: "users", Type: csvfile.Long},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	org := `Example, "Hosting"` + "\nLtd"
+	users := int64(42)
+	rows := [][]any{
+		{"a.test", &org, &users},
+		{"b.test", (*string)(nil), (*int64)(nil)},
+		{(*string)(nil), &org, &users},
+		{"c.test", "", 7},
+	}
+	for _, row := range rows {
+		if err := w.Write(row...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Write("d.test", "x", "not a number"); err == nil {
+		t.Error("writing a string to a long column succeeded")
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if w.Written != 3 || w.Skipped != 1 {
+		t.Errorf("written %d, skipped %d, want 3 and 1", w.Written, w.Skipped)
+	}
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "domain:string,as_org:string,users:long\n" +
+		"a.test,\"Example, \"\"Hosting\"\"\nLtd\",42\n" +
+		"b.test,,\n" +
+		"c.test,,7\n"
+	if string(got) != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
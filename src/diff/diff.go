@@ -0,0 +1,315 @@
+package diff
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/kothavade/mastodon-paper/config"
+	"github.com/kothavade/mastodon-paper/filter"
+	"github.com/kothavade/mastodon-paper/storage"
+)
+
+// Kinds of change between two crawl runs
+const (
+	KindAppeared    = "appeared"
+	KindDied        = "died"
+	KindChanged     = "changed"
+	KindEdgeAdded   = "edge_added"
+	KindEdgeRemoved = "edge_removed"
+)
+
+// maxListed is how many examples of each kind the human summary prints
+const maxListed = 20
+
+// Change is one difference between two crawl runs
+type Change struct {
+	Kind   string `json:"kind"`
+	Domain string `json:"domain"`
+	Peer   string `json:"peer,omitempty"`
+	Field  string `json:"field,omitempty"`
+	Old    string `json:"old,omitempty"`
+	New    string `json:"new,omitempty"`
+}
+
+// Options selects where the machine-readable output is written and which
+// peer edges are compared. Empty paths are skipped.
+type Options struct {
+	JSONPath string
+	CSVPath  string
+	// AllPeers compares every reported peer instead of only peers running supported software
+	AllPeers bool
+}
+
+// Diff compares two crawl runs and reports which instances appeared, died or
+// changed software or hosting, and which peer edges were added or removed.
+// An instance is alive in a run if its software was identified in that run.
+// Edges are compared only for instances whose peers were fetched in both runs.
+func Diff(cfg *config.Config, runA, runB int64, opts Options) error {
+	store, err := storage.Open(cfg.Paths.DB)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	for _, id := range []int64{runA, runB} {
+		if _, err := store.GetRun(id); err != nil {
+			return err
+		}
+	}
+
+	before, err := store.InstancesWithStatus(runA, storage.StageFilter, storage.StatusSuccess)
+	if err != nil {
+		return fmt.Errorf("failed to load run %d: %w", runA, err)
+	}
+	after, err := store.InstancesWithStatus(runB, storage.StageFilter, storage.StatusSuccess)
+	if err != nil {
+		return fmt.Errorf("failed to load run %d: %w", runB, err)
+	}
+	changes := instanceChanges(before, after)
+
+	out, err := newOutput(runA, runB, opts)
+	if err != nil {
+		return err
+	}
+	defer out.close()
+
+	counts := make(map[string]int)
+	fieldCounts := make(map[string]int)
+	listed := make(map[string][]Change)
+	record := func(c Change) error {
+		counts[c.Kind]++
+		if c.Kind == KindChanged {
+			fieldCounts[c.Field]++
+		}
+		if len(listed[c.Kind]) < maxListed {
+			listed[c.Kind] = append(listed[c.Kind], c)
+		}
+		return out.write(c)
+	}
+
+	for _, c := range changes {
+		if err := record(c); err != nil {
+			return err
+		}
+	}
+
+	edgeFilter := storage.EdgeFilter{}
+	if !opts.AllPeers {
+		edgeFilter.PeerSoftware = filter.SupportedSoftware()
+	}
+	// Edges are streamed since a near-complete graph has millions of them
+	err = store.EachEdgeDiff(runA, runB, edgeFilter, func(domain, peer string, added bool) error {
+		kind := KindEdgeRemoved
+		if added {
+			kind = KindEdgeAdded
+		}
+		return record(Change{Kind: kind, Domain: domain, Peer: peer})
+	})
+	if err != nil {
+		return fmt.Errorf("failed to compare peer edges: %w", err)
+	}
+
+	if err := out.finish(counts, fieldCounts); err != nil {
+		return err
+	}
+
+	printSummary(runA, runB, len(before), len(after), counts, fieldCounts, listed)
+	return nil
+}
+
+// instanceChanges compares the instances alive in two runs
+func instanceChanges(before, after []storage.InstanceRecord) []Change {
+	old := make(map[string]storage.InstanceRecord, len(before))
+	for _, r := range before {
+		old[r.Domain] = r
+	}
+	seen := make(map[string]bool, len(after))
+
+	var changes []Change
+	for _, r := range after {
+		seen[r.Domain] = true
+		prev, ok := old[r.Domain]
+		if !ok {
+			changes = append(changes, Change{Kind: KindAppeared, Domain: r.Domain, New: str(r.Software)})
+			continue
+		}
+		for _, f := range fields {
+			o, n := f.value(prev), f.value(r)
+			// Facts missing from either run were not collected, not changed
+			if o != "" && n != "" && o != n {
+				changes = append(changes, Change{Kind: KindChanged, Domain: r.Domain, Field: f.name, Old: o, New: n})
+			}
+		}
+	}
+	for _, r := range before {
+		if !seen[r.Domain] {
+			changes = append(changes, Change{Kind: KindDied, Domain: r.Domain, Old: str(r.Software)})
+		}
+	}
+
+	sort.SliceStable(changes, func(i, j int) bool {
+		if changes[i].Kind != changes[j].Kind {
+			return changes[i].Kind < changes[j].Kind
+		}
+		return changes[i].Domain < changes[j].Domain
+	})
+	return changes
+}
+
+// fields lists the instance facts compared between runs
+var fields = []struct {
+	name  string
+	value func(r storage.InstanceRecord) string
+}{
+	{"software", func(r storage.InstanceRecord) string { return str(r.Software) }},
+	{"country_code", func(r storage.InstanceRecord) string { return str(r.CountryCode) }},
+	{"asn", func(r storage.InstanceRecord) string { return num(r.ASN) }},
+	{"cloud_provider", func(r storage.InstanceRecord) string { return str(r.CloudProvider) }},
+}
+
+func printSummary(runA, runB int64, before, after int, counts, fieldCounts map[string]int, listed map[string][]Change) {
+	fmt.Printf("Run %d -> run %d: %d -> %d live instances\n\n", runA, runB, before, after)
+	fmt.Printf("Instances appeared:   %d\n", counts[KindAppeared])
+	fmt.Printf("Instances died:       %d\n", counts[KindDied])
+	fmt.Printf("Instances changed:    %d\n", counts[KindChanged])
+	for _, f := range fields {
+		if fieldCounts[f.name] > 0 {
+			fmt.Printf("  %-18s  %d\n", f.name, fieldCounts[f.name])
+		}
+	}
+	fmt.Printf("Peer edges added:     %d\n", counts[KindEdgeAdded])
+	fmt.Printf("Peer edges removed:   %d\n", counts[KindEdgeRemoved])
+
+	for _, kind := range []string{KindAppeared, KindDied, KindChanged} {
+		if len(listed[kind]) == 0 {
+			continue
+		}
+		if counts[kind] > len(listed[kind]) {
+			fmt.Printf("\n%s (first %d of %d):\n", kind, len(listed[kind]), counts[kind])
+		} else {
+			fmt.Printf("\n%s (%d):\n", kind, len(listed[kind]))
+		}
+		for _, c := range listed[kind] {
+			switch kind {
+			case KindChanged:
+				fmt.Printf("  %s %s: %s -> %s\n", c.Domain, c.Field, c.Old, c.New)
+			default:
+				fmt.Printf("  %s (%s%s)\n", c.Domain, c.Old, c.New)
+			}
+		}
+	}
+}
+
+// output streams changes to the optional JSON and CSV files
+type output struct {
+	jsonFile *os.File
+	json     *bufio.Writer
+	csvFile  *os.File
+	csv      *csv.Writer
+	first    bool
+}
+
+func newOutput(runA, runB int64, opts Options) (*output, error) {
+	out := &output{first: true}
+	if opts.JSONPath != "" {
+		f, err := os.Create(opts.JSONPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create %s: %w", opts.JSONPath, err)
+		}
+		out.jsonFile = f
+		out.json = bufio.NewWriter(f)
+		if _, err := fmt.Fprintf(out.json, "{\"run_a\":%d,\"run_b\":%d,\"changes\":[\n", runA, runB); err != nil {
+			out.close()
+			return nil, err
+		}
+	}
+	if opts.CSVPath != "" {
+		f, err := os.Create(opts.CSVPath)
+		if err != nil {
+			out.close()
+			return nil, fmt.Errorf("failed to create %s: %w", opts.CSVPath, err)
+		}
+		out.csvFile = f
+		out.csv = csv.NewWriter(f)
+		if err := out.csv.Write([]string{"kind", "domain", "peer", "field", "old", "new"}); err != nil {
+			out.close()
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+func (o *output) write(c Change) error {
+	if o.jsonFile != nil {
+		data, err := json.Marshal(c)
+		if err != nil {
+			return err
+		}
+		sep := ",\n"
+		if o.first {
+			sep = ""
+			o.first = false
+		}
+		if _, err := io.WriteString(o.json, sep+string(data)); err != nil {
+			return err
+		}
+	}
+	if o.csv != nil {
+		return o.csv.Write([]string{c.Kind, c.Domain, c.Peer, c.Field, c.Old, c.New})
+	}
+	return nil
+}
+
+// finish closes the changes array and appends the summary counts to the JSON output
+func (o *output) finish(counts, fieldCounts map[string]int) error {
+	if o.jsonFile != nil {
+		summary, err := json.Marshal(map[string]any{"counts": counts, "changed_fields": fieldCounts})
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(o.json, "\n],\"summary\":%s}\n", summary); err != nil {
+			return err
+		}
+		if err := o.json.Flush(); err != nil {
+			return err
+		}
+		fmt.Println("Wrote changes to", o.jsonFile.Name())
+	}
+	if o.csv != nil {
+		o.csv.Flush()
+		if err := o.csv.Error(); err != nil {
+			return err
+		}
+		fmt.Println("Wrote changes to", o.csvFile.Name())
+	}
+	return nil
+}
+
+func (o *output) close() {
+	if o.jsonFile != nil {
+		o.jsonFile.Close()
+	}
+	if o.csvFile != nil {
+		o.csvFile.Close()
+	}
+}
+
+func str(p *string) string {
+	if p == nil {
+		return ""
+	}
+	return *p
+}
+
+func num(p *int64) string {
+	if p == nil {
+		return ""
+	}
+	return strconv.FormatInt(*p, 10)
+}
@@ -0,0 +1,87 @@
+package diff_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kothavade/mastodon-paper/config"
+	"github.com/kothavade/mastodon-paper/diff"
+	"github.com/kothavade/mastodon-paper/fedtest"
+	"github.com/kothavade/mastodon-paper/filter"
+	"github.com/kothavade/mastodon-paper/process"
+	"github.com/kothavade/mastodon-paper/storage"
+)
+
+// crawl filters and processes instances into a new run and finishes it
+func crawl(t *testing.T, cfg *config.Config, instances ...fedtest.Instance) int64 {
+	t.Helper()
+	fedtest.Start(t, instances...)
+	fedtest.WriteJSON(t, cfg.Paths.Nodes, fedtest.Domains(instances))
+
+	if err := filter.FilterNodes(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := process.ProcessNodes(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := storage.Open(cfg.Paths.DB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	run, err := store.ActiveRun()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.FinishRun(run.ID); err != nil {
+		t.Fatal(err)
+	}
+	return run.ID
+}
+
+func TestDiff(t *testing.T) {
+	cfg := fedtest.Config(t)
+	runA := crawl(t, cfg,
+		fedtest.Instance{Domain: "alpha.test", Software: "mastodon", Peers: []string{"beta.test", "gamma.test", "dying.test", "stranger.test"}},
+		fedtest.Instance{Domain: "beta.test", Software: "pleroma", Peers: []string{"alpha.test", "gamma.test"}},
+		fedtest.Instance{Domain: "gamma.test", Software: "mastodon", Peers: []string{"alpha.test", "beta.test"}},
+		fedtest.Instance{Domain: "dying.test", Software: "mastodon", Peers: []string{"alpha.test"}},
+	)
+	runB := crawl(t, cfg,
+		fedtest.Instance{Domain: "alpha.test", Software: "mastodon", Peers: []string{"beta.test", "newbie.test", "stranger.test", "other.test"}},
+		// Switched software
+		fedtest.Instance{Domain: "beta.test", Software: "misskey", Peers: []string{"alpha.test", "gamma.test", "newbie.test"}},
+		// Its peers could not be fetched, which must not remove its edges
+		fedtest.Instance{
+			Domain: "gamma.test", Software: "mastodon", Peers: []string{},
+			Faults: map[string]fedtest.Fault{"/api/v1/instance/peers": {Malformed: true}},
+		},
+		fedtest.Instance{
+			Domain: "dying.test", Software: "mastodon",
+			Faults: map[string]fedtest.Fault{"/.well-known/nodeinfo": {Status: 500}},
+		},
+		fedtest.Instance{Domain: "newbie.test", Software: "mastodon", Peers: []string{"alpha.test"}},
+	)
+
+	for _, test := range []struct {
+		name string
+		opts diff.Options
+	}{
+		{"diff", diff.Options{}},
+		{"diff_all_peers", diff.Options{AllPeers: true}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			test.opts.CSVPath = filepath.Join(t.TempDir(), "changes.csv")
+			if err := diff.Diff(cfg, runA, runB, test.opts); err != nil {
+				t.Fatal(err)
+			}
+			got, err := os.ReadFile(test.opts.CSVPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fedtest.Golden(t, test.name, string(got))
+		})
+	}
+}
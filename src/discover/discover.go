@@ -0,0 +1,262 @@
+package discover
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/kothavade/mastodon-paper/config"
+	"github.com/kothavade/mastodon-paper/fetch"
+	"github.com/kothavade/mastodon-paper/filter"
+	"github.com/kothavade/mastodon-paper/optout"
+	"github.com/kothavade/mastodon-paper/process"
+	"github.com/kothavade/mastodon-paper/resolver"
+	"github.com/kothavade/mastodon-paper/storage"
+)
+
+// Discover crawls the network breadth-first from the seed domains, probing
+// the software of every domain it finds and following the peers of the ones
+// that support the peers API. The frontier lives in the database, so an
+// interrupted crawl resumes where it stopped. Every discovered domain is
+// written to the discovered node list, which can replace nodes.json.
+func Discover(cfg *config.Config) error {
+	if len(cfg.Discover.Seeds) == 0 {
+		return fmt.Errorf("no seed domains to discover from")
+	}
+
+	store, err := storage.Open(cfg.Paths.DB)
+	if err != nil {
+		return fmt.Errorf("error initializing database: %w", err)
+	}
+	defer store.Close()
+
+	run, err := store.StartRun()
+	if err != nil {
+		return fmt.Errorf("error starting crawl run: %w", err)
+	}
+
+	seeds := normalizeDomains(cfg.Discover.Seeds)
+	if _, err := store.AddToFrontier(run.ID, seeds, 0, ""); err != nil {
+		return fmt.Errorf("error adding seeds to frontier: %w", err)
+	}
+
+	// Domains left running were interrupted by a crash
+	if err := store.ResetInterruptedFrontier(run.ID); err != nil {
+		return fmt.Errorf("error resetting interrupted domains: %w", err)
+	}
+
+	dns, err := resolver.New(cfg.DNS, store)
+	if err != nil {
+		return err
+	}
+	client := fetch.New(cfg, dns)
+	checker, err := optout.New(cfg, store, client)
+	if err != nil {
+		return err
+	}
+
+	c := &crawler{
+		cfg:     cfg,
+		store:   store,
+		runID:   run.ID,
+		client:  client,
+		checker: checker,
+	}
+
+	for {
+		depth, domains, err := store.NextFrontierLevel(run.ID)
+		if errors.Is(err, sql.ErrNoRows) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error reading frontier: %w", err)
+		}
+
+		fmt.Printf("Discovering depth %d: %d domains\n", depth, len(domains))
+		added, err := c.expandLevel(depth, domains)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Depth %d done, queued %d new domains\n", depth, added)
+	}
+
+	discovered, err := store.FrontierDomains(run.ID)
+	if err != nil {
+		return fmt.Errorf("error retrieving discovered domains: %w", err)
+	}
+
+	discoveredFile, err := os.Create(cfg.Paths.DiscoveredNodes)
+	if err != nil {
+		return fmt.Errorf("error creating %s: %w", cfg.Paths.DiscoveredNodes, err)
+	}
+	defer discoveredFile.Close()
+
+	err = json.NewEncoder(discoveredFile).Encode(discovered)
+	if err != nil {
+		return fmt.Errorf("error writing to %s: %w", cfg.Paths.DiscoveredNodes, err)
+	}
+	fmt.Println("Discovered nodes written to", cfg.Paths.DiscoveredNodes)
+
+	depths, err := store.FrontierDepths(run.ID)
+	if err != nil {
+		return fmt.Errorf("error getting frontier stats: %w", err)
+	}
+	levels := make([]int, 0, len(depths))
+	for depth := range depths {
+		levels = append(levels, depth)
+	}
+	sort.Ints(levels)
+
+	fmt.Printf("\nDiscovery complete. Stats:\n")
+	fmt.Printf("Total domains: %d\n", len(discovered))
+	for _, depth := range levels {
+		fmt.Printf("Depth %d: %d\n", depth, depths[depth])
+	}
+	return nil
+}
+
+// crawler expands one frontier level at a time
+type crawler struct {
+	cfg     *config.Config
+	store   *storage.Store
+	runID   int64
+	client  *fetch.Client
+	checker *optout.Checker
+
+	// mu serializes the size check and insert that enforce max_instances
+	mu    sync.Mutex
+	added int
+}
+
+// expandLevel probes every domain of one frontier level and queues the peers
+// of the supported ones at the next depth. It returns how many were queued.
+func (c *crawler) expandLevel(depth int, domains []string) (int, error) {
+	// Probes are recorded in the run so the filter and process stages skip
+	// domains discover already checked
+	if err := c.store.InitProbes(c.runID, storage.StageFilter, domains); err != nil {
+		return 0, fmt.Errorf("error initializing nodes in database: %w", err)
+	}
+
+	c.added = 0
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	for w := 0; w < c.cfg.Workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for domain := range jobs {
+				status := storage.StatusSuccess
+				if err := c.expand(depth, domain); err != nil {
+					fmt.Printf("  Skipping %s: %v\n", domain, err)
+					status = storage.StatusFailed
+				}
+				if err := c.store.SetFrontierStatus(c.runID, domain, status); err != nil {
+					fmt.Printf("  Error updating frontier for %s: %v\n", domain, err)
+				}
+			}
+		}()
+	}
+
+	for _, domain := range domains {
+		jobs <- domain
+	}
+	close(jobs)
+	wg.Wait()
+
+	return c.added, nil
+}
+
+// expand probes a single domain and, unless it is at the maximum depth,
+// queues its peers
+func (c *crawler) expand(depth int, domain string) error {
+	if err := c.store.SetFrontierStatus(c.runID, domain, storage.StatusRunning); err != nil {
+		return err
+	}
+
+	if reason := c.checker.Listed(domain); reason != "" {
+		return c.store.SetStatus(c.runID, storage.StageFilter, domain, storage.StatusSkipped, reason)
+	}
+
+	info, err := filter.ProbeNodeInfo(c.client, domain)
+	if err != nil {
+		if dbErr := c.store.SetStatus(c.runID, storage.StageFilter, domain, storage.StatusFailed, err.Error()); dbErr != nil {
+			fmt.Printf("  Error updating status for %s: %v\n", domain, dbErr)
+		}
+		return err
+	}
+	software := info.Software.Name
+	if err := c.store.SetOptOut(c.runID, domain, info.OptOut()); err != nil {
+		return err
+	}
+	if err := c.store.SetSoftware(c.runID, domain, software); err != nil {
+		return err
+	}
+	if !filter.IsSupported(software) || depth >= c.cfg.Discover.MaxDepth {
+		return nil
+	}
+
+	if err := c.store.InitProbes(c.runID, storage.StageProcess, []string{domain}); err != nil {
+		return err
+	}
+	reason, err := process.CheckPeers(c.checker, c.runID, domain)
+	if err == nil && reason != "" {
+		return c.store.SetStatus(c.runID, storage.StageProcess, domain, storage.StatusSkipped, reason)
+	}
+	var peers []string
+	if err == nil {
+		peers, err = process.FetchPeers(c.client, domain)
+	}
+	if err != nil {
+		if dbErr := c.store.SetStatus(c.runID, storage.StageProcess, domain, storage.StatusFailed, err.Error()); dbErr != nil {
+			fmt.Printf("  Error updating status for %s: %v\n", domain, dbErr)
+		}
+		return err
+	}
+	peers = normalizeDomains(peers)
+	if err := c.store.SetPeers(c.runID, domain, peers); err != nil {
+		return fmt.Errorf("error storing peers: %w", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if limit := c.cfg.Discover.MaxInstances; limit > 0 {
+		size, err := c.store.FrontierSize(c.runID)
+		if err != nil {
+			return err
+		}
+		if size >= limit {
+			return nil
+		}
+		// Peers already in the frontier do not count, so this may stop short
+		if len(peers) > limit-size {
+			peers = peers[:limit-size]
+		}
+	}
+
+	added, err := c.store.AddToFrontier(c.runID, peers, depth+1, domain)
+	if err != nil {
+		return fmt.Errorf("error queueing peers: %w", err)
+	}
+	c.added += added
+	fmt.Printf("  %s (%s): %d peers, %d new\n", domain, software, len(peers), added)
+	return nil
+}
+
+// normalizeDomains lowercases domains and drops entries that cannot be hostnames
+func normalizeDomains(domains []string) []string {
+	normalized := make([]string, 0, len(domains))
+	for _, domain := range domains {
+		domain = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+		if domain == "" || strings.ContainsAny(domain, "/:@ *") {
+			continue
+		}
+		normalized = append(normalized, domain)
+	}
+	return normalized
+}
@@ -0,0 +1,50 @@
+package discover_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/kothavade/mastodon-paper/discover"
+	"github.com/kothavade/mastodon-paper/fedtest"
+	"github.com/kothavade/mastodon-paper/storage"
+)
+
+func TestDiscover(t *testing.T) {
+	fed := fedtest.Start(t, fedtest.Standard()...)
+	cfg := fedtest.Config(t)
+	cfg.Discover.Seeds = []string{"Beta.Test."}
+	cfg.Discover.MaxDepth = 1
+
+	if err := discover.Discover(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	discovered, err := os.ReadFile(cfg.Paths.DiscoveredNodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fedtest.Golden(t, "discovered_nodes", string(discovered))
+
+	store, err := storage.Open(cfg.Paths.DB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	run, err := store.ActiveRun()
+	if err != nil {
+		t.Fatal(err)
+	}
+	depths, err := store.FrontierDepths(run.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if depths[0] != 1 || depths[1] != 3 || len(depths) != 2 {
+		t.Errorf("frontier depths = %v, want 1 seed and its 3 peers", depths)
+	}
+	fedtest.Golden(t, "discover_probes", fedtest.DumpProbes(t, store, storage.StageFilter))
+
+	// Peers at the maximum depth are probed but not expanded
+	if n := fed.Requests("alpha.test", "/api/v1/instance/peers"); n != 0 {
+		t.Errorf("alpha.test is at the maximum depth but its peers were fetched %d times", n)
+	}
+}
@@ -0,0 +1,70 @@
+// Package enrich_as describes the autonomous systems instances are hosted in
+// with CAIDA's rank, organization, country and customer cone, read from
+// local dataset files so the analysis needs no network access.
+package enrich_as
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/kothavade/mastodon-paper/caida"
+	"github.com/kothavade/mastodon-paper/config"
+	"github.com/kothavade/mastodon-paper/storage"
+)
+
+// EnrichAS records what the configured CAIDA datasets say about every AS
+// collect_data found in the active run. Without any dataset configured it
+// does nothing, so the pipeline runs without them.
+func EnrichAS(cfg *config.Config) error {
+	dataset, err := caida.Load(cfg.CAIDA)
+	if errors.Is(err, caida.ErrNoDatasets) {
+		fmt.Println("No CAIDA datasets configured, skipping AS enrichment")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, line := range dataset.Describe() {
+		fmt.Println("CAIDA", line)
+	}
+
+	store, err := storage.Open(cfg.Paths.DB)
+	if err != nil {
+		return fmt.Errorf("error opening nodes db: %w", err)
+	}
+	defer store.Close()
+
+	run, err := store.ActiveRun()
+	if err != nil {
+		return err
+	}
+	return enrich(store, run.ID, dataset)
+}
+
+// enrich stores the facts of every AS of the run, counting those the
+// datasets do not cover
+func enrich(store *storage.Store, runID int64, dataset *caida.Dataset) error {
+	asns, err := store.RunASNs(runID)
+	if err != nil {
+		return fmt.Errorf("failed to read the ASes of run %d: %w", runID, err)
+	}
+
+	facts := make([]storage.ASFacts, 0, len(asns))
+	ranked, missing := 0, 0
+	for _, asn := range asns {
+		f, ok := dataset.Lookup(asn)
+		if !ok {
+			missing++
+		}
+		if f.Rank != 0 {
+			ranked++
+		}
+		facts = append(facts, f)
+	}
+	if err := store.SetASFacts(runID, facts); err != nil {
+		return fmt.Errorf("failed to save AS facts: %w", err)
+	}
+
+	fmt.Printf("Run %d: enriched %d ASes, %d ranked, %d not in any dataset\n", runID, len(asns), ranked, missing)
+	return nil
+}
@@ -0,0 +1,87 @@
+package enrich_as_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kothavade/mastodon-paper/enrich_as"
+	"github.com/kothavade/mastodon-paper/fedtest"
+	"github.com/kothavade/mastodon-paper/runs"
+	"github.com/kothavade/mastodon-paper/storage"
+)
+
+func TestEnrichAS(t *testing.T) {
+	cfg := fedtest.Config(t)
+	dir := t.TempDir()
+	cfg.CAIDA.ASRel = filepath.Join(dir, "as-rel.txt")
+	cfg.CAIDA.ASOrg = filepath.Join(dir, "as-org2info.txt")
+	for path, content := range map[string]string{
+		cfg.CAIDA.ASRel: "3356|24940|-1\n3356|64500|-1\n24940|64501|-1\n",
+		cfg.CAIDA.ASOrg: "# format:org_id|changed|org_name|country|source\n" +
+			"ORG-HOA1-RIPE|20240101|Hetzner Online GmbH|DE|RIPE\n" +
+			"# format:aut|changed|aut_name|org_id|opaque_id|source\n" +
+			"24940|20240101|HETZNER-AS|ORG-HOA1-RIPE||RIPE\n",
+	} {
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	store, err := storage.Open(cfg.Paths.DB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	run, err := store.StartRun()
+	if err != nil {
+		t.Fatal(err)
+	}
+	infos := map[string]storage.NodeInfo{
+		"a.test": {IP: "192.0.2.1", ASN: 24940, CloudProvider: "Hetzner"},
+		"b.test": {IP: "192.0.2.2", ASN: 24940},
+		// 3356 is only the AS of a second address
+		"c.test": {IP: "192.0.2.3", ASN: 64500, Addresses: []storage.Address{
+			{IP: "192.0.2.3", Family: storage.FamilyIPv4, ASN: 64500},
+			{IP: "2001:db8::3", Family: storage.FamilyIPv6, ASN: 3356},
+		}},
+		"d.test": {IP: "192.0.2.4", ASN: 13335, CloudProvider: "Cloudflare"},
+		"e.test": {IP: "192.0.2.5"},
+	}
+	domains := []string{"a.test", "b.test", "c.test", "d.test", "e.test"}
+	if err := store.InitProbes(run.ID, storage.StageCollectData, domains); err != nil {
+		t.Fatal(err)
+	}
+	for _, domain := range domains {
+		if err := store.SetNodeInfo(run.ID, domain, infos[domain]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.Close()
+
+	// Enriching twice replaces the facts
+	for range 2 {
+		if err := enrich_as.EnrichAS(cfg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	csvPath := filepath.Join(dir, "asn_cloud_analysis.csv")
+	factsPath := filepath.Join(dir, "as_facts.csv")
+	if err := runs.ASNs(cfg, run.ID, csvPath, factsPath); err != nil {
+		t.Fatal(err)
+	}
+	for name, path := range map[string]string{"asn_cloud_analysis": csvPath, "as_facts": factsPath} {
+		got, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fedtest.Golden(t, name, string(got))
+	}
+}
+
+func TestEnrichASWithoutDatasets(t *testing.T) {
+	cfg := fedtest.Config(t)
+	if err := enrich_as.EnrichAS(cfg); err != nil {
+		t.Errorf("got %v, want the stage skipped", err)
+	}
+}
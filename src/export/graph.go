@@ -0,0 +1,118 @@
+package export
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/kothavade/mastodon-paper/config"
+	"github.com/kothavade/mastodon-paper/filter"
+	"github.com/kothavade/mastodon-paper/graph"
+	"github.com/kothavade/mastodon-paper/storage"
+)
+
+// GraphOptions controls what Graph writes
+type GraphOptions struct {
+	// Format is graphml, gexf, json or edgelist
+	Format string
+	// Output is the file to write, run-<id>-peers.<format> if empty
+	Output string
+	// Reciprocal keeps only edges whose peer also reports the instance
+	Reciprocal bool
+	// AllPeers keeps every reported peer instead of only peers running supported software
+	AllPeers bool
+}
+
+// Graph writes the peer graph of a run to a single file for Gephi or
+// NetworkX, with the facts collected about every instance as node attributes.
+// An edge list has no attributes. An id of 0 uses the baseline run.
+func Graph(cfg *config.Config, id int64, opts GraphOptions) error {
+	store, err := storage.Open(cfg.Paths.DB)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	run, err := store.RunOrBaseline(id)
+	if err != nil {
+		return err
+	}
+
+	output := opts.Output
+	if output == "" {
+		output = fmt.Sprintf("run-%d-peers.%s", run.ID, opts.Format)
+	}
+	edgeFilter := storage.EdgeFilter{Reciprocal: opts.Reciprocal}
+	if !opts.AllPeers {
+		edgeFilter.PeerSoftware = filter.SupportedSoftware()
+	}
+
+	if opts.Format == "edgelist" {
+		return writeEdgeList(store, run.ID, edgeFilter, output)
+	}
+
+	ctx := context.Background()
+	sink, err := graph.Create(output, opts.Format)
+	if err != nil {
+		return err
+	}
+	defer sink.Close(ctx)
+
+	records, err := store.InstancesWithStatus(run.ID, storage.StageFilter, storage.StatusSuccess)
+	if err != nil {
+		return fmt.Errorf("failed to query instances: %w", err)
+	}
+	props := make([]graph.Properties, 0, len(records))
+	for _, r := range records {
+		values := graph.InstanceValues(r)
+		if r.ASOrg != nil {
+			values["as_org"] = *r.ASOrg
+		}
+		props = append(props, graph.Properties{Node: graph.Instance(r.Domain), Values: values})
+	}
+	if err := sink.SetProperties(ctx, props); err != nil {
+		return err
+	}
+
+	edges := 0
+	err = store.EachPeerEdge(run.ID, edgeFilter, func(domain, peer string) error {
+		edges++
+		return sink.UpsertEdges(ctx, []graph.Edge{graph.PeerEdge(domain, peer)})
+	})
+	if err != nil {
+		return fmt.Errorf("failed to query peer edges: %w", err)
+	}
+
+	if err := sink.Flush(ctx); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %d instances and %d peer edges of run %d to %s\n", len(records), edges, run.ID, output)
+	return nil
+}
+
+// writeEdgeList writes one "domain peer" line per edge, the format
+// networkx.read_edgelist reads
+func writeEdgeList(store *storage.Store, runID int64, edgeFilter storage.EdgeFilter, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", path, err)
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	edges := 0
+	err = store.EachPeerEdge(runID, edgeFilter, func(domain, peer string) error {
+		edges++
+		_, err := fmt.Fprintf(w, "%s %s\n", domain, peer)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	fmt.Printf("Wrote %d peer edges of run %d to %s\n", edges, runID, path)
+	return f.Close()
+}
@@ -0,0 +1,67 @@
+package export_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kothavade/mastodon-paper/config"
+	"github.com/kothavade/mastodon-paper/export"
+	"github.com/kothavade/mastodon-paper/fedtest"
+	"github.com/kothavade/mastodon-paper/filter"
+	"github.com/kothavade/mastodon-paper/process"
+	"github.com/kothavade/mastodon-paper/storage"
+)
+
+func TestGraph(t *testing.T) {
+	cfg, runID := crawl(t)
+
+	for _, tc := range []struct {
+		name string
+		opts export.GraphOptions
+	}{
+		{"edgelist", export.GraphOptions{Format: "edgelist", AllPeers: true}},
+		{"edgelist_reciprocal", export.GraphOptions{Format: "edgelist", AllPeers: true, Reciprocal: true}},
+		{"graphml_known", export.GraphOptions{Format: "graphml"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.opts.Output = filepath.Join(t.TempDir(), tc.name)
+			if err := export.Graph(cfg, runID, tc.opts); err != nil {
+				t.Fatal(err)
+			}
+			got, err := os.ReadFile(tc.opts.Output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fedtest.Golden(t, tc.name, string(got))
+		})
+	}
+}
+
+// crawl filters and processes the standard federation and returns its config
+// and the run it crawled
+func crawl(t *testing.T) (*config.Config, int64) {
+	t.Helper()
+	instances := fedtest.Standard()
+	fedtest.Start(t, instances...)
+	cfg := fedtest.Config(t)
+	fedtest.WriteJSON(t, cfg.Paths.Nodes, fedtest.Domains(instances))
+
+	if err := filter.FilterNodes(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := process.ProcessNodes(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := storage.Open(cfg.Paths.DB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	run, err := store.ActiveRun()
+	store.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg, run.ID
+}
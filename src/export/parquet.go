@@ -0,0 +1,195 @@
+package export
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/kothavade/mastodon-paper/config"
+	"github.com/kothavade/mastodon-paper/filter"
+	"github.com/kothavade/mastodon-paper/storage"
+	"github.com/parquet-go/parquet-go"
+)
+
+// ParquetOptions controls what Parquet writes
+type ParquetOptions struct {
+	// Dir is the directory the files are written to
+	Dir string
+	// AllPeers keeps every reported peer instead of only peers running supported software
+	AllPeers bool
+}
+
+// instanceRow is a row of run-<id>-instances.parquet and facts.parquet: the
+// facts collected about an instance in one run
+type instanceRow struct {
+	RunID         int64   `parquet:"run_id"`
+	Domain        string  `parquet:"domain"`
+	Software      *string `parquet:"software,optional"`
+	IP            *string `parquet:"ip,optional"`
+	ASN           *int64  `parquet:"asn,optional"`
+	ASOrg         *string `parquet:"as_org,optional"`
+	CountryCode   *string `parquet:"country_code,optional"`
+	UserCount     *int64  `parquet:"user_count,optional"`
+	PostCount     *int64  `parquet:"post_count,optional"`
+	CloudProvider *string `parquet:"cloud_provider,optional"`
+}
+
+// edgeRow is a row of run-<id>-peers.parquet
+type edgeRow struct {
+	Domain string `parquet:"domain"`
+	Peer   string `parquet:"peer"`
+}
+
+// runRow is a row of runs.parquet
+type runRow struct {
+	ID         int64      `parquet:"id"`
+	StartedAt  time.Time  `parquet:"started_at"`
+	FinishedAt *time.Time `parquet:"finished_at,optional"`
+	Pinned     bool       `parquet:"pinned"`
+	Instances  int64      `parquet:"instances"`
+}
+
+// Parquet writes typed Parquet files for pandas, notebooks and DuckDB to dir:
+// the instances and peer edges of a run, the facts collected about every
+// instance in every run and the runs themselves. Only peers running supported
+// software are written unless opts.AllPeers is set. An id of 0 exports the
+// baseline run.
+func Parquet(cfg *config.Config, id int64, opts ParquetOptions) error {
+	store, err := storage.Open(cfg.Paths.DB)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	run, err := store.RunOrBaseline(id)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(opts.Dir, 0o755); err != nil {
+		return err
+	}
+
+	instancesPath := filepath.Join(opts.Dir, fmt.Sprintf("run-%d-instances.parquet", run.ID))
+	records, err := store.InstancesWithStatus(run.ID, storage.StageFilter, storage.StatusSuccess)
+	if err != nil {
+		return fmt.Errorf("failed to query instances: %w", err)
+	}
+	err = writeParquet(instancesPath, "instance", func(write func(instanceRow) error) error {
+		for _, r := range records {
+			if err := write(newInstanceRow(run.ID, r)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %d instances to %s\n", len(records), instancesPath)
+
+	edgeFilter := storage.EdgeFilter{}
+	if !opts.AllPeers {
+		edgeFilter.PeerSoftware = filter.SupportedSoftware()
+	}
+	peersPath := filepath.Join(opts.Dir, fmt.Sprintf("run-%d-peers.parquet", run.ID))
+	edges := 0
+	err = writeParquet(peersPath, "peer", func(write func(edgeRow) error) error {
+		return store.EachPeerEdge(run.ID, edgeFilter, func(domain, peer string) error {
+			edges++
+			return write(edgeRow{Domain: domain, Peer: peer})
+		})
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %d peer edges to %s\n", edges, peersPath)
+
+	runs, err := store.ListRuns()
+	if err != nil {
+		return err
+	}
+	runsPath := filepath.Join(opts.Dir, "runs.parquet")
+	err = writeParquet(runsPath, "run", func(write func(runRow) error) error {
+		for _, r := range runs {
+			row := runRow{
+				ID:         r.ID,
+				StartedAt:  r.StartedAt,
+				FinishedAt: r.FinishedAt,
+				Pinned:     r.Pinned,
+				Instances:  int64(r.Instances),
+			}
+			if err := write(row); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %d runs to %s\n", len(runs), runsPath)
+
+	factsPath := filepath.Join(opts.Dir, "facts.parquet")
+	facts := 0
+	err = writeParquet(factsPath, "instance", func(write func(instanceRow) error) error {
+		for _, r := range runs {
+			records, err := store.InstancesWithStatus(r.ID, storage.StageFilter, storage.StatusSuccess)
+			if err != nil {
+				return fmt.Errorf("failed to query instances of run %d: %w", r.ID, err)
+			}
+			for _, rec := range records {
+				if err := write(newInstanceRow(r.ID, rec)); err != nil {
+					return err
+				}
+			}
+			facts += len(records)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %d instance facts from %d runs to %s\n", facts, len(runs), factsPath)
+	return nil
+}
+
+func newInstanceRow(runID int64, r storage.InstanceRecord) instanceRow {
+	return instanceRow{
+		RunID:         runID,
+		Domain:        r.Domain,
+		Software:      r.Software,
+		IP:            r.IP,
+		ASN:           r.ASN,
+		ASOrg:         r.ASOrg,
+		CountryCode:   r.CountryCode,
+		UserCount:     r.UserCount,
+		PostCount:     r.PostCount,
+		CloudProvider: r.CloudProvider,
+	}
+}
+
+// writeParquet creates path with the schema of T under the given name and
+// lets fill write its rows
+func writeParquet[T any](path, name string, fill func(write func(T) error) error) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", path, err)
+	}
+	defer f.Close()
+
+	schema := parquet.NewSchema(name, parquet.SchemaOf(new(T)))
+	w := parquet.NewGenericWriter[T](f, schema, parquet.Compression(&parquet.Zstd))
+	err = fill(func(row T) error {
+		_, err := w.Write([]T{row})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return f.Close()
+}
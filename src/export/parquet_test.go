@@ -0,0 +1,95 @@
+package export_test
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kothavade/mastodon-paper/export"
+	"github.com/kothavade/mastodon-paper/fedtest"
+	"github.com/parquet-go/parquet-go"
+)
+
+func TestParquet(t *testing.T) {
+	cfg, runID := crawl(t)
+	dir := t.TempDir()
+	if err := export.Parquet(cfg, runID, export.ParquetOptions{Dir: dir}); err != nil {
+		t.Fatal(err)
+	}
+
+	instances := dumpParquet(t, filepath.Join(dir, fmt.Sprintf("run-%d-instances.parquet", runID)))
+	fedtest.Golden(t, "parquet_instances", instances)
+	peers := dumpParquet(t, filepath.Join(dir, fmt.Sprintf("run-%d-peers.parquet", runID)))
+	fedtest.Golden(t, "parquet_peers", peers)
+
+	// With a single run, facts.parquet holds the same rows as the run's instances
+	if facts := dumpParquet(t, filepath.Join(dir, "facts.parquet")); facts != instances {
+		t.Errorf("facts.parquet differs from the instances of run %d:\n%s", runID, facts)
+	}
+
+	runs, err := parquet.ReadFile[runRow](filepath.Join(dir, "runs.parquet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 1 || runs[0].ID != runID || runs[0].StartedAt.IsZero() || runs[0].FinishedAt != nil {
+		t.Errorf("runs.parquet holds %+v, want only the unfinished run %d", runs, runID)
+	}
+}
+
+type runRow struct {
+	ID         int64      `parquet:"id"`
+	StartedAt  time.Time  `parquet:"started_at"`
+	FinishedAt *time.Time `parquet:"finished_at,optional"`
+}
+
+// dumpParquet returns the schema of a Parquet file followed by one line per
+// row naming every column's value
+func dumpParquet(t *testing.T, path string) string {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := parquet.OpenFile(f, info.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b strings.Builder
+	b.WriteString(file.Schema().String() + "\n")
+	columns := file.Schema().Columns()
+	reader := parquet.NewReader(file)
+	defer reader.Close()
+	rows := make([]parquet.Row, 1)
+	for {
+		n, err := reader.ReadRows(rows)
+		if n == 1 {
+			fields := make([]string, 0, len(columns))
+			for _, v := range rows[0] {
+				value := v.String()
+				if v.IsNull() {
+					value = "NULL"
+				}
+				fields = append(fields, columns[v.Column()][0]+"="+value)
+			}
+			b.WriteString(strings.Join(fields, " ") + "\n")
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,219 @@
+package fedtest
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/kothavade/mastodon-paper/storage"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// zoneRecords make up the zone every fake domain is in, test
+var zoneRecords = []storage.DNSRecord{
+	{Name: "test", Type: "SOA", Value: "a.nic.test hostmaster.nic.test 1 7200 900 1209600 300"},
+	{Name: "test", Type: "NS", Value: "a.nic.test"},
+	{Name: "test", Type: "NS", Value: "b.nic.test"},
+}
+
+// defaultTTL is the TTL of records that do not set one
+const defaultTTL = 300
+
+// dnsServer answers DNS questions over UDP as a recursive resolver would:
+// CNAMEs are followed, and answers without records carry the SOA of the
+// zone the name is in
+type dnsServer struct {
+	conn    net.PacketConn
+	records []storage.DNSRecord
+}
+
+// startDNS serves the records of the instances: their DNS records, the
+// test. zone, and IP and MoreIPs at the end of each domain's CNAME chain
+func (f *Federation) startDNS(t testing.TB) {
+	t.Helper()
+
+	records := append([]storage.DNSRecord(nil), zoneRecords...)
+	for _, inst := range f.instances {
+		records = append(records, inst.DNS...)
+		canonical := inst.Domain
+		for _, r := range inst.DNS {
+			if r.Type == "CNAME" && r.Name == canonical {
+				canonical = r.Value
+			}
+		}
+		for _, ip := range append([]string{inst.IP}, inst.MoreIPs...) {
+			qtype := "A"
+			if net.ParseIP(ip).To4() == nil {
+				qtype = "AAAA"
+			}
+			records = append(records, storage.DNSRecord{Name: canonical, Type: qtype, Value: ip})
+		}
+	}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.dns = &dnsServer{conn: conn, records: records}
+	go f.serveDNS()
+	t.Cleanup(func() { conn.Close() })
+}
+
+// DNS returns the address of the federation's DNS server, for dns.upstream
+func (f *Federation) DNS() string {
+	return f.dns.conn.LocalAddr().String()
+}
+
+// DNSQueries returns how many questions the DNS server was asked
+func (f *Federation) DNSQueries() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.dnsQueries
+}
+
+func (f *Federation) serveDNS() {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := f.dns.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		var query dnsmessage.Message
+		if err := query.Unpack(buf[:n]); err != nil || len(query.Questions) != 1 {
+			continue
+		}
+		f.mu.Lock()
+		f.dnsQueries++
+		f.mu.Unlock()
+
+		resp, err := f.dns.respond(query)
+		if err != nil {
+			panic(err)
+		}
+		f.dns.conn.WriteTo(resp, addr)
+	}
+}
+
+// respond packs the response to a query
+func (s *dnsServer) respond(query dnsmessage.Message) ([]byte, error) {
+	q := query.Questions[0]
+	name := strings.TrimSuffix(strings.ToLower(q.Name.String()), ".")
+	qtype := strings.TrimPrefix(q.Type.String(), "Type")
+
+	rcode, answers, authority := s.answer(name, qtype)
+	resp := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID: query.ID, Response: true, RecursionDesired: query.RecursionDesired, RecursionAvailable: true,
+			RCode: rcode,
+		},
+		Questions: query.Questions,
+	}
+	for _, section := range []struct {
+		records   []storage.DNSRecord
+		resources *[]dnsmessage.Resource
+	}{{answers, &resp.Answers}, {authority, &resp.Authorities}} {
+		for _, r := range section.records {
+			res, err := resource(r)
+			if err != nil {
+				return nil, err
+			}
+			*section.resources = append(*section.resources, res)
+		}
+	}
+	return resp.Pack()
+}
+
+// answer returns the response code, answer and authority of a question
+func (s *dnsServer) answer(name, qtype string) (dnsmessage.RCode, []storage.DNSRecord, []storage.DNSRecord) {
+	var answers []storage.DNSRecord
+	for range len(s.records) {
+		cname, ok := s.find(name, "CNAME")
+		if !ok || qtype == "CNAME" {
+			break
+		}
+		answers = append(answers, cname)
+		name = cname.Value
+	}
+
+	found := false
+	for _, r := range s.records {
+		if r.Name == name && r.Type == qtype {
+			answers = append(answers, r)
+			found = true
+		}
+	}
+	if found {
+		return dnsmessage.RCodeSuccess, answers, nil
+	}
+
+	rcode := dnsmessage.RCodeNameError
+	for _, r := range s.records {
+		if r.Name == name || strings.HasSuffix(r.Name, "."+name) {
+			rcode = dnsmessage.RCodeSuccess
+		}
+	}
+	for zone := name; zone != ""; {
+		if soa, ok := s.find(zone, "SOA"); ok {
+			return rcode, answers, []storage.DNSRecord{soa}
+		}
+		_, zone, _ = strings.Cut(zone, ".")
+	}
+	return rcode, answers, nil
+}
+
+// find returns the first record of name and type
+func (s *dnsServer) find(name, qtype string) (storage.DNSRecord, bool) {
+	for _, r := range s.records {
+		if r.Name == name && r.Type == qtype {
+			return r, true
+		}
+	}
+	return storage.DNSRecord{}, false
+}
+
+// resource converts a record to its wire form
+func resource(r storage.DNSRecord) (dnsmessage.Resource, error) {
+	name, err := dnsmessage.NewName(r.Name + ".")
+	if err != nil {
+		return dnsmessage.Resource{}, err
+	}
+	ttl := r.TTL
+	if ttl == 0 {
+		ttl = defaultTTL
+	}
+	res := dnsmessage.Resource{Header: dnsmessage.ResourceHeader{Name: name, Class: dnsmessage.ClassINET, TTL: ttl}}
+
+	fields := strings.Fields(r.Value)
+	switch r.Type {
+	case "A":
+		var a [4]byte
+		copy(a[:], net.ParseIP(r.Value).To4())
+		res.Body = &dnsmessage.AResource{A: a}
+	case "AAAA":
+		var aaaa [16]byte
+		copy(aaaa[:], net.ParseIP(r.Value).To16())
+		res.Body = &dnsmessage.AAAAResource{AAAA: aaaa}
+	case "CNAME":
+		res.Body = &dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName(r.Value + ".")}
+	case "NS":
+		res.Body = &dnsmessage.NSResource{NS: dnsmessage.MustNewName(r.Value + ".")}
+	case "MX":
+		pref, _ := strconv.Atoi(fields[0])
+		res.Body = &dnsmessage.MXResource{Pref: uint16(pref), MX: dnsmessage.MustNewName(fields[1] + ".")}
+	case "SOA":
+		var n [5]uint32
+		for i := range n {
+			v, _ := strconv.ParseUint(fields[2+i], 10, 32)
+			n[i] = uint32(v)
+		}
+		res.Body = &dnsmessage.SOAResource{
+			NS: dnsmessage.MustNewName(fields[0] + "."), MBox: dnsmessage.MustNewName(fields[1] + "."),
+			Serial: n[0], Refresh: n[1], Retry: n[2], Expire: n[3], MinTTL: n[4],
+		}
+	default:
+		return res, fmt.Errorf("unsupported record type %s", r.Type)
+	}
+	return res, nil
+}
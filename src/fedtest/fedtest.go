@@ -0,0 +1,240 @@
+// Package fedtest runs an in-process fake Fediverse so the crawling stages can
+// be tested end to end without touching the network.
+package fedtest
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kothavade/mastodon-paper/fetch"
+	"github.com/kothavade/mastodon-paper/storage"
+)
+
+// Instance is one fake server of the federation
+type Instance struct {
+	Domain string
+	// IP is what the domain resolves to
+	IP string
+	// MoreIPs are further addresses the domain resolves to, after IP
+	MoreIPs []string
+	// Software is the name served through nodeinfo. Instances without
+	// software serve no nodeinfo.
+	Software string
+	// NodeInfoVersion is the nodeinfo schema served, 2.0 unless set
+	NodeInfoVersion string
+	Metadata        map[string]any
+	// Peers is served by the peers API, which is missing if Peers is nil
+	Peers []string
+	Users int
+	Posts int
+	// Robots is served as robots.txt, which is missing if Robots is empty
+	Robots string
+	// Faults replace the response to the request paths they are keyed by
+	Faults map[string]Fault
+	// Headers are sent with every response
+	Headers map[string]string
+	// DNS is served by the federation's DNS server along with the A and
+	// AAAA records of IP and MoreIPs, which are put at the end of the
+	// domain's CNAME chain. Chains are listed in order.
+	DNS []storage.DNSRecord
+}
+
+// Fault makes an instance misbehave on one path
+type Fault struct {
+	// Status is sent instead of the normal response if set
+	Status int
+	// RetryAfter is sent as the Retry-After header of a faulty response
+	RetryAfter string
+	// Delay is waited before responding
+	Delay time.Duration
+	// Malformed sends invalid JSON instead of the normal body
+	Malformed bool
+	// Times limits the fault to the first requests; 0 means every request
+	Times int
+}
+
+// Federation serves every Instance from one TLS server, routing on the Host
+// header
+type Federation struct {
+	server    *httptest.Server
+	dns       *dnsServer
+	instances map[string]*Instance
+
+	mu         sync.Mutex
+	requests   map[string]int
+	userAgents map[string]bool
+	dnsQueries int
+}
+
+// Start serves the instances and points the clients fetch.New creates at
+// them until the test ends. Domains without an instance do not resolve. The
+// instances' DNS records are served at DNS.
+func Start(t testing.TB, instances ...Instance) *Federation {
+	t.Helper()
+
+	f := &Federation{
+		instances:  make(map[string]*Instance),
+		requests:   make(map[string]int),
+		userAgents: make(map[string]bool),
+	}
+	for i := range instances {
+		inst := instances[i]
+		if inst.IP == "" {
+			inst.IP = fmt.Sprintf("192.0.2.%d", i+1)
+		}
+		f.instances[inst.Domain] = &inst
+	}
+	f.server = httptest.NewTLSServer(http.HandlerFunc(f.serve))
+	f.startDNS(t)
+
+	previous := fetch.DefaultNetwork
+	fetch.DefaultNetwork = f.Network()
+	t.Cleanup(func() {
+		fetch.DefaultNetwork = previous
+		f.server.Close()
+	})
+	return f
+}
+
+// Network connects to the federation whatever address a domain resolves to
+func (f *Federation) Network() fetch.Network {
+	addr := f.server.Listener.Addr().String()
+	dialer := &net.Dialer{}
+	return fetch.Network{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, addr)
+			},
+			// The test certificate is not issued for the fake domains
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+		Resolver: resolver{f},
+	}
+}
+
+// Requests returns how many requests an instance received for path
+func (f *Federation) Requests(domain, path string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests[domain+path]
+}
+
+// UserAgents returns every User-Agent the federation was sent, sorted
+func (f *Federation) UserAgents() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	agents := make([]string, 0, len(f.userAgents))
+	for agent := range f.userAgents {
+		agents = append(agents, agent)
+	}
+	sort.Strings(agents)
+	return agents
+}
+
+func (f *Federation) serve(w http.ResponseWriter, r *http.Request) {
+	domain, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		domain = r.Host
+	}
+	inst, ok := f.instances[domain]
+	if !ok {
+		http.Error(w, "unknown host", http.StatusMisdirectedRequest)
+		return
+	}
+
+	for name, value := range inst.Headers {
+		w.Header().Set(name, value)
+	}
+
+	f.mu.Lock()
+	f.requests[domain+r.URL.Path]++
+	count := f.requests[domain+r.URL.Path]
+	f.userAgents[r.UserAgent()] = true
+	f.mu.Unlock()
+
+	if fault, ok := inst.Faults[r.URL.Path]; ok && (fault.Times == 0 || count <= fault.Times) {
+		if fault.Delay > 0 {
+			select {
+			case <-time.After(fault.Delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if fault.RetryAfter != "" {
+			w.Header().Set("Retry-After", fault.RetryAfter)
+		}
+		if fault.Status != 0 {
+			http.Error(w, http.StatusText(fault.Status), fault.Status)
+			return
+		}
+		if fault.Malformed {
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"truncated": [`)
+			return
+		}
+	}
+
+	version := inst.NodeInfoVersion
+	if version == "" {
+		version = "2.0"
+	}
+
+	switch {
+	case r.URL.Path == "/.well-known/nodeinfo" && inst.Software != "":
+		writeJSON(w, map[string]any{"links": []map[string]string{{
+			"rel":  "http://nodeinfo.diaspora.software/ns/schema/" + version,
+			"href": fmt.Sprintf("https://%s/nodeinfo/%s", domain, version),
+		}}})
+	case r.URL.Path == "/nodeinfo/"+version && inst.Software != "":
+		writeJSON(w, map[string]any{
+			"version":  version,
+			"software": map[string]string{"name": inst.Software, "version": "1.0.0"},
+			"usage":    map[string]any{"users": map[string]int{"total": inst.Users}, "localPosts": inst.Posts},
+			"metadata": inst.Metadata,
+		})
+	case r.URL.Path == "/api/v1/instance" && inst.Software != "":
+		writeJSON(w, map[string]any{
+			"uri":   domain,
+			"stats": map[string]int{"user_count": inst.Users, "status_count": inst.Posts, "domain_count": len(inst.Peers)},
+		})
+	case r.URL.Path == "/api/v1/instance/peers" && inst.Peers != nil:
+		writeJSON(w, inst.Peers)
+	case r.URL.Path == "/robots.txt" && inst.Robots != "":
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprint(w, inst.Robots)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(v)
+}
+
+// resolver answers with the IP of each instance of the federation
+type resolver struct {
+	f *Federation
+}
+
+func (r resolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	inst, ok := r.f.instances[strings.ToLower(host)]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	addrs := []net.IPAddr{{IP: net.ParseIP(inst.IP)}}
+	for _, ip := range inst.MoreIPs {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+	return addrs, nil
+}
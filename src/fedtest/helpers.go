@@ -0,0 +1,165 @@
+package fedtest
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kothavade/mastodon-paper/config"
+	"github.com/kothavade/mastodon-paper/storage"
+)
+
+var update = flag.Bool("update", false, "rewrite golden files with the current output")
+
+// Config returns a configuration that keeps every file in a temporary
+// directory and fails fast, for running stages against a federation
+func Config(t testing.TB) *config.Config {
+	t.Helper()
+
+	dir := t.TempDir()
+	cfg := config.Default()
+	cfg.Paths = config.PathsConfig{
+		Nodes:           filepath.Join(dir, "nodes.json"),
+		DiscoveredNodes: filepath.Join(dir, "discovered_nodes.json"),
+		FilteredNodes:   filepath.Join(dir, "filtered_nodes.json"),
+		ProcessedNodes:  filepath.Join(dir, "filtered_processed_nodes.json"),
+		DB:              filepath.Join(dir, "node_filter.db"),
+		LegacyProcessDB: filepath.Join(dir, "node_process.db"),
+		PeersCSV:        filepath.Join(dir, "domain_peers.csv"),
+		DataCSV:         filepath.Join(dir, "data.csv"),
+		PipelineState:   filepath.Join(dir, "pipeline_state.json"),
+		OptOut:          filepath.Join(dir, "opt_out.txt"),
+	}
+	cfg.Workers = 4
+	cfg.HTTPTimeout = 500 * time.Millisecond
+	cfg.HTTP.HostInterval = 0
+	cfg.HTTP.IPInterval = 0
+	cfg.HTTP.MaxRetries = 1
+	cfg.HTTP.RetryBackoff = time.Millisecond
+	cfg.HTTP.MaxRetryWait = time.Second
+	return cfg
+}
+
+// Standard is a small federation exercising every path through the stages:
+// supported and unsupported software, both nodeinfo versions, opt-outs,
+// transient and permanent failures, slow and malformed responses, and peers
+// that do not exist
+func Standard() []Instance {
+	return []Instance{
+		{
+			Domain: "alpha.test", IP: "8.8.8.8", Software: "mastodon", Users: 120, Posts: 4500,
+			Peers: []string{"beta.test", "gamma.test", "pixel.test", "ghost.test", "flaky.test"},
+		},
+		{
+			Domain: "beta.test", IP: "1.1.1.1", Software: "pleroma", NodeInfoVersion: "2.1", Users: 15, Posts: 300,
+			Peers: []string{"alpha.test", "gamma.test", "elsewhere.test"},
+		},
+		{
+			Domain: "gamma.test", IP: "193.0.6.139", Software: "misskey", Users: 7, Posts: 42,
+			Peers:  []string{"alpha.test"},
+			Faults: map[string]Fault{"/api/v1/instance/peers": {Malformed: true}},
+		},
+		{
+			Domain: "flaky.test", IP: "133.242.0.3", Software: "mastodon", Users: 3, Posts: 9,
+			Peers: []string{"alpha.test", "beta.test"},
+			Faults: map[string]Fault{
+				"/.well-known/nodeinfo": {Status: 503, RetryAfter: "0", Times: 1},
+				"/api/v1/instance":      {Status: 429, RetryAfter: "0", Times: 1},
+			},
+		},
+		{Domain: "pixel.test", Software: "pixelfed", Peers: []string{"alpha.test"}},
+		{
+			Domain: "slow.test", Software: "mastodon", Peers: []string{},
+			Faults: map[string]Fault{"/.well-known/nodeinfo": {Delay: 5 * time.Second}},
+		},
+		{
+			Domain: "broken.test", Software: "mastodon",
+			Faults: map[string]Fault{"/nodeinfo/2.0": {Malformed: true}},
+		},
+		{
+			Domain: "down.test", Software: "mastodon",
+			Faults: map[string]Fault{"/.well-known/nodeinfo": {Status: 500}},
+		},
+		{
+			Domain: "hidden.test", Software: "mastodon", Peers: []string{"alpha.test"},
+			Metadata: map[string]any{"noindex": true},
+		},
+		{
+			Domain: "robots.test", Software: "mastodon", Peers: []string{"alpha.test"},
+			Robots: "User-agent: mastodon-paper\nDisallow: /api/\n",
+		},
+		{Domain: "static.test"},
+	}
+}
+
+// Domains returns the domains of instances, plus any extra ones
+func Domains(instances []Instance, extra ...string) []string {
+	domains := make([]string, 0, len(instances)+len(extra))
+	for _, inst := range instances {
+		domains = append(domains, inst.Domain)
+	}
+	return append(domains, extra...)
+}
+
+// WriteJSON writes v to path as JSON
+func WriteJSON(t testing.TB, path string, v any) {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// DumpProbes renders the probes of a stage in the active run, one per line
+func DumpProbes(t testing.TB, store *storage.Store, stage string) string {
+	t.Helper()
+	run, err := store.ActiveRun()
+	if err != nil {
+		t.Fatal(err)
+	}
+	probes, err := store.Probes(run.ID, stage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b strings.Builder
+	for _, p := range probes {
+		b.WriteString(p.Domain + " " + p.Status)
+		if p.Error != "" {
+			b.WriteString(": " + p.Error)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// Golden compares got with testdata/<name>.golden, rewriting the file
+// instead when the tests run with -update
+func Golden(t testing.TB, name, got string) {
+	t.Helper()
+	path := filepath.Join("testdata", name+".golden")
+	if *update {
+		if err := os.MkdirAll("testdata", 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(got), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v (run with -update to create it)", err)
+	}
+	if got != string(want) {
+		t.Errorf("%s differs from %s:\n--- got\n%s\n--- want\n%s", name, path, got, want)
+	}
+}
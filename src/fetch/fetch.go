@@ -0,0 +1,352 @@
+package fetch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/kothavade/mastodon-paper/config"
+)
+
+// Resolver looks up the addresses of a host. *net.Resolver implements it.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// Client fetches from instances politely: it identifies itself, limits how
+// many requests run against each domain and IP address and how often they
+// start, and retries transient failures, honouring Retry-After. It is safe
+// for concurrent use and should be shared by every worker of a stage.
+type Client struct {
+	http     *http.Client
+	resolver Resolver
+	cfg      config.HTTPConfig
+
+	mu    sync.Mutex
+	hosts map[string]*limiter
+	ips   map[string]*limiter
+	addrs map[string][]string
+}
+
+// Network is what a Client connects through. Nil fields mean the real network.
+type Network struct {
+	Transport http.RoundTripper
+	Resolver  Resolver
+}
+
+// DefaultNetwork is the network of the clients New creates. Tests replace it
+// to run the stages against an in-process federation.
+var DefaultNetwork Network
+
+// New returns a Client using the HTTP settings and timeout of cfg that looks
+// domains up with resolver, or the system resolver if it is nil. The
+// resolver of DefaultNetwork replaces it if set.
+func New(cfg *config.Config, resolver Resolver) *Client {
+	network := DefaultNetwork
+	if network.Resolver == nil {
+		network.Resolver = resolver
+	}
+	return NewWithNetwork(cfg, network)
+}
+
+// NewWithNetwork returns a Client that connects through network
+func NewWithNetwork(cfg *config.Config, network Network) *Client {
+	c := &Client{
+		resolver: network.Resolver,
+		cfg:      cfg.HTTP,
+		hosts:    make(map[string]*limiter),
+		ips:      make(map[string]*limiter),
+		addrs:    make(map[string][]string),
+	}
+	if c.resolver == nil {
+		c.resolver = net.DefaultResolver
+	}
+	if network.Transport != nil {
+		c.http = &http.Client{Timeout: cfg.HTTPTimeout, Transport: network.Transport, CheckRedirect: sameHost}
+		return c
+	}
+
+	dialer := &net.Dialer{Timeout: cfg.HTTPTimeout}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// Connect to the address the per-IP limit was taken for, so the limit
+	// covers the connection that is actually made
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if pin, ok := ctx.Value(pinKey{}).(pinnedAddr); ok {
+			if host, port, err := net.SplitHostPort(addr); err == nil && host == pin.host {
+				addr = net.JoinHostPort(pin.ip, port)
+			}
+		}
+		return dialer.DialContext(ctx, network, addr)
+	}
+
+	c.http = &http.Client{Timeout: cfg.HTTPTimeout, Transport: transport, CheckRedirect: sameHost}
+	return c
+}
+
+// sameHost follows redirects within the host of the request only. A redirect
+// to another host is returned to the caller instead, since following it here
+// would skip that host's limits, address pinning and robots.txt and opt-out
+// checks; the caller can fetch the new location through Get.
+func sameHost(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	if req.URL.Hostname() != via[0].URL.Hostname() {
+		return http.ErrUseLastResponse
+	}
+	return nil
+}
+
+// pinKey is the context key of the address a request's host is dialled at
+type pinKey struct{}
+
+type pinnedAddr struct {
+	host, ip string
+}
+
+// Get fetches url once the domain and IP limits allow it, retrying transient
+// errors and 429, 502, 503 and 504 responses with jittered exponential
+// backoff. Redirects to another host are returned rather than followed. The
+// caller must close the body of the returned response, which holds the domain
+// and IP slots of the request until it is closed.
+func (c *Client) Get(url string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", c.cfg.UserAgent)
+	req.Header.Set("Accept", "application/json")
+
+	host := req.URL.Hostname()
+	ip, err := c.resolve(req.Context(), host)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(context.WithValue(req.Context(), pinKey{}, pinnedAddr{host: host, ip: ip}))
+
+	hostLimit := c.limiter(c.hosts, host, c.cfg.HostConcurrency, c.cfg.HostInterval)
+	ipLimit := c.limiter(c.ips, ip, c.cfg.IPConcurrency, c.cfg.IPInterval)
+
+	for attempt := 0; ; attempt++ {
+		// The domain slot is always taken before the IP slot so requests
+		// never wait on each other in a cycle
+		hostLimit.acquire()
+		ipLimit.acquire()
+		release := func() {
+			ipLimit.release()
+			hostLimit.release()
+		}
+		resp, err := c.http.Do(req)
+
+		wait, retry := c.backoff(attempt, resp, err)
+		if !retry || attempt >= c.cfg.MaxRetries {
+			if err != nil && attempt > 0 {
+				err = fmt.Errorf("after %d attempts: %w", attempt+1, err)
+			}
+			if resp == nil {
+				release()
+				return nil, err
+			}
+			// The body is still being downloaded, so the slots are held
+			// until the caller closes it
+			resp.Body = &releasingBody{ReadCloser: resp.Body, release: release}
+			return resp, err
+		}
+
+		if resp != nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+		}
+		release()
+		// The next attempt waits in acquire, along with every other
+		// request to the domain
+		hostLimit.delay(wait)
+	}
+}
+
+// releasingBody frees the domain and IP slots of a request when its body is
+// first closed
+type releasingBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// backoff decides whether a request is retried and how long to wait first.
+// A Retry-After header is honoured unless it asks for longer than
+// max_retry_wait, in which case the response is returned as is.
+func (c *Client) backoff(attempt int, resp *http.Response, err error) (time.Duration, bool) {
+	if err != nil {
+		return c.jitter(attempt), transient(err)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		if wait, ok := retryAfter(resp.Header.Get("Retry-After")); ok {
+			return wait, wait <= c.cfg.MaxRetryWait
+		}
+		return c.jitter(attempt), true
+	case http.StatusBadGateway, http.StatusGatewayTimeout:
+		return c.jitter(attempt), true
+	}
+	return 0, false
+}
+
+// jitter returns a random wait of up to retry_backoff * 2^attempt, capped at max_retry_wait
+func (c *Client) jitter(attempt int) time.Duration {
+	ceiling := c.cfg.RetryBackoff << attempt
+	if ceiling <= 0 || ceiling > c.cfg.MaxRetryWait {
+		ceiling = c.cfg.MaxRetryWait
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	return rand.N(ceiling)
+}
+
+// transient reports whether a request error is worth retrying
+func transient(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsTimeout || dnsErr.IsTemporary
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF)
+}
+
+// retryAfter parses a Retry-After header given in seconds or as an HTTP date
+func retryAfter(header string) (time.Duration, bool) {
+	if header == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(header); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if at, err := http.ParseTime(header); err == nil {
+		return max(time.Until(at), 0), true
+	}
+	return 0, false
+}
+
+// LookupIP returns the address requests to host are made to
+func (c *Client) LookupIP(host string) (string, error) {
+	return c.resolve(context.Background(), host)
+}
+
+// LookupIPs returns every address host resolves to, IPv4 and IPv6, without
+// duplicates. The first is the one requests are made to.
+func (c *Client) LookupIPs(host string) ([]string, error) {
+	return c.resolveAll(context.Background(), host)
+}
+
+// resolve returns the address requests to host are made to
+func (c *Client) resolve(ctx context.Context, host string) (string, error) {
+	ips, err := c.resolveAll(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	return ips[0], nil
+}
+
+// resolveAll returns every address of host. Lookups are cached for the life
+// of the client so every request to a domain counts against the same IP
+// limit.
+func (c *Client) resolveAll(ctx context.Context, host string) ([]string, error) {
+	if net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+
+	c.mu.Lock()
+	ips, ok := c.addrs[host]
+	c.mu.Unlock()
+	if ok {
+		return ips, nil
+	}
+
+	addrs, err := c.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %w", host, err)
+	}
+	for _, addr := range addrs {
+		if ip := addr.IP.String(); !slices.Contains(ips, ip) {
+			ips = append(ips, ip)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("failed to resolve %s: no addresses", host)
+	}
+
+	c.mu.Lock()
+	c.addrs[host] = ips
+	c.mu.Unlock()
+	return ips, nil
+}
+
+// limiter returns the limiter for key in limiters, creating it on first use
+func (c *Client) limiter(limiters map[string]*limiter, key string, concurrency int, interval time.Duration) *limiter {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	l, ok := limiters[key]
+	if !ok {
+		l = &limiter{slots: make(chan struct{}, concurrency), interval: interval}
+		limiters[key] = l
+	}
+	return l
+}
+
+// limiter bounds the concurrent requests to one domain or IP address and
+// spaces out when they start
+type limiter struct {
+	slots    chan struct{}
+	interval time.Duration
+
+	mu   sync.Mutex
+	next time.Time // earliest time the next request may start
+}
+
+// acquire blocks until a slot is free and the interval since the last start has passed
+func (l *limiter) acquire() {
+	l.slots <- struct{}{}
+
+	l.mu.Lock()
+	start := time.Now()
+	if l.next.After(start) {
+		start = l.next
+	}
+	l.next = start.Add(l.interval)
+	l.mu.Unlock()
+
+	time.Sleep(time.Until(start))
+}
+
+func (l *limiter) release() {
+	<-l.slots
+}
+
+// delay holds back requests that have not started yet for at least d
+func (l *limiter) delay(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if until := time.Now().Add(d); until.After(l.next) {
+		l.next = until
+	}
+}
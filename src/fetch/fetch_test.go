@@ -0,0 +1,172 @@
+package fetch_test
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kothavade/mastodon-paper/fedtest"
+	"github.com/kothavade/mastodon-paper/fetch"
+)
+
+func get(t *testing.T, c *fetch.Client, url string) int {
+	t.Helper()
+	resp, err := c.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestRetries(t *testing.T) {
+	fed := fedtest.Start(t,
+		fedtest.Instance{Domain: "busy.test", Software: "mastodon", Faults: map[string]fedtest.Fault{
+			"/api/v1/instance": {Status: 429, RetryAfter: "1", Times: 1},
+		}},
+		fedtest.Instance{Domain: "closed.test", Software: "mastodon", Faults: map[string]fedtest.Fault{
+			"/api/v1/instance": {Status: 503, RetryAfter: "3600"},
+		}},
+		fedtest.Instance{Domain: "gone.test"},
+	)
+	cfg := fedtest.Config(t)
+	cfg.HTTP.MaxRetries = 3
+	c := fetch.New(cfg, nil)
+
+	start := time.Now()
+	if status := get(t, c, "https://busy.test/api/v1/instance"); status != http.StatusOK {
+		t.Errorf("busy.test status = %d, want 200 after retrying", status)
+	}
+	if waited := time.Since(start); waited < time.Second {
+		t.Errorf("retried after %s, want the 1s Retry-After honoured", waited)
+	}
+
+	// A Retry-After longer than max_retry_wait is given up on at once
+	if status := get(t, c, "https://closed.test/api/v1/instance"); status != http.StatusServiceUnavailable {
+		t.Errorf("closed.test status = %d, want 503", status)
+	}
+	if n := fed.Requests("closed.test", "/api/v1/instance"); n != 1 {
+		t.Errorf("closed.test got %d requests, want 1", n)
+	}
+
+	// Client errors are not retried
+	if status := get(t, c, "https://gone.test/api/v1/instance"); status != http.StatusNotFound {
+		t.Errorf("gone.test status = %d, want 404", status)
+	}
+	if n := fed.Requests("gone.test", "/api/v1/instance"); n != 1 {
+		t.Errorf("gone.test got %d requests, want 1", n)
+	}
+
+	if agents := fed.UserAgents(); len(agents) != 1 || agents[0] != cfg.HTTP.UserAgent {
+		t.Errorf("User-Agents = %q, want only %q", agents, cfg.HTTP.UserAgent)
+	}
+}
+
+func TestHostInterval(t *testing.T) {
+	fedtest.Start(t, fedtest.Instance{Domain: "alpha.test", Software: "mastodon"})
+	cfg := fedtest.Config(t)
+	cfg.HTTP.HostInterval = 100 * time.Millisecond
+	c := fetch.New(cfg, nil)
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := c.Get("https://alpha.test/api/v1/instance")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+
+	// Four requests start at least 100ms apart
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Errorf("4 requests took %s, want at least 300ms", elapsed)
+	}
+}
+
+func TestSlotHeldUntilBodyClosed(t *testing.T) {
+	fedtest.Start(t, fedtest.Instance{Domain: "alpha.test", Software: "mastodon"})
+	cfg := fedtest.Config(t)
+	cfg.HTTP.HostConcurrency = 1
+	c := fetch.New(cfg, nil)
+
+	first, err := c.Get("https://alpha.test/api/v1/instance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan int)
+	go func() {
+		resp, err := c.Get("https://alpha.test/api/v1/instance")
+		if err != nil {
+			t.Error(err)
+			close(done)
+			return
+		}
+		resp.Body.Close()
+		done <- resp.StatusCode
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("second request finished while the first body was open")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// Closing twice frees the slot once
+	first.Body.Close()
+	first.Body.Close()
+	select {
+	case status := <-done:
+		if status != http.StatusOK {
+			t.Errorf("second request status = %d, want 200", status)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("second request still blocked after the first body was closed")
+	}
+}
+
+func TestRedirects(t *testing.T) {
+	fed := fedtest.Start(t,
+		fedtest.Instance{Domain: "alpha.test", Software: "mastodon"},
+		fedtest.Instance{
+			Domain: "moved.test", Software: "mastodon",
+			Headers: map[string]string{"Location": "https://alpha.test/api/v1/instance"},
+			Faults:  map[string]fedtest.Fault{"/api/v1/instance": {Status: http.StatusMovedPermanently}},
+		},
+		fedtest.Instance{
+			Domain: "renamed.test", Software: "mastodon",
+			Headers: map[string]string{"Location": "/api/v1/instance"},
+			Faults:  map[string]fedtest.Fault{"/api/v1/old": {Status: http.StatusMovedPermanently}},
+		},
+	)
+	c := fetch.New(fedtest.Config(t), nil)
+
+	// A redirect to another host is left to the caller, which has to go
+	// through Get and the other host's limits
+	resp, err := c.Get("https://moved.test/api/v1/instance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMovedPermanently || resp.Header.Get("Location") != "https://alpha.test/api/v1/instance" {
+		t.Errorf("moved.test got %d to %q, want the redirect to alpha.test", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	if n := fed.Requests("alpha.test", "/api/v1/instance"); n != 0 {
+		t.Errorf("alpha.test got %d requests, want the redirect not followed", n)
+	}
+
+	// Redirects within the host are followed
+	if status := get(t, c, "https://renamed.test/api/v1/old"); status != http.StatusOK {
+		t.Errorf("renamed.test status = %d, want 200 after the redirect", status)
+	}
+	if n := fed.Requests("renamed.test", "/api/v1/instance"); n != 1 {
+		t.Errorf("renamed.test got %d requests to the new location, want 1", n)
+	}
+}
@@ -1,22 +1,51 @@
 package filter
 
 import (
-	"database/sql"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"sort"
 	"sync"
-	"time"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/kothavade/mastodon-paper/config"
+	"github.com/kothavade/mastodon-paper/fetch"
+	"github.com/kothavade/mastodon-paper/optout"
+	"github.com/kothavade/mastodon-paper/resolver"
+	"github.com/kothavade/mastodon-paper/storage"
 )
 
 type NodeInfo struct {
 	Software struct {
 		Name string `json:"name"`
 	} `json:"software"`
+	Metadata map[string]any `json:"metadata"`
+}
+
+// optOutFlags are nodeinfo metadata flags by which an instance asks not to be
+// indexed, with the value that means opting out. They are checked in order so
+// an instance setting several is always given the same reason.
+var optOutFlags = []struct {
+	flag   string
+	optOut bool
+}{
+	{"noindex", true},
+	{"noIndex", true},
+	{"noai", true},
+	{"noAI", true},
+	{"indexable", false},
+}
+
+// OptOut returns the metadata flag by which the instance opted out of being
+// crawled, or an empty string if it did not
+func (n NodeInfo) OptOut() string {
+	for _, f := range optOutFlags {
+		if v, ok := n.Metadata[f.flag].(bool); ok && v == f.optOut {
+			return fmt.Sprintf("nodeinfo metadata sets %s to %t", f.flag, v)
+		}
+	}
+	return ""
 }
 
 type NodeInfoWellKnown struct {
@@ -26,202 +55,103 @@ type NodeInfoWellKnown struct {
 	} `json:"links"`
 }
 
-const (
-	StatusPending  = "pending"
-	StatusChecking = "checking"
-	StatusSuccess  = "success"
-	StatusFailed   = "failed"
-)
-
-func initDB() (*sql.DB, error) {
-	db, err := sql.Open("sqlite3", "./node_filter.db")
-	if err != nil {
-		return nil, fmt.Errorf("failed to open database: %w", err)
-	}
-
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS nodes (
-			domain TEXT PRIMARY KEY,
-			status TEXT,
-			software TEXT,
-			error TEXT,
-			last_updated TIMESTAMP
-		)
-	`)
-	if err != nil {
-		db.Close()
-		return nil, fmt.Errorf("failed to create table: %w", err)
-	}
-
-	return db, nil
+// supportedSoftware lists the software that implements the peers API
+var supportedSoftware = map[string]bool{
+	"mastodon":   true,
+	"pleroma":    true,
+	"misskey":    true,
+	"bookwyrm":   true,
+	"smithereen": true,
 }
 
-func FilterNodes() {
-	nodes, err := os.ReadFile("nodes.json")
+// FilterNodes probes every domain in the node list for its software and writes
+// the ones that support the peers API to the filtered node list
+func FilterNodes(cfg *config.Config) error {
+	nodes, err := os.ReadFile(cfg.Paths.Nodes)
 	if err != nil {
-		fmt.Println("Error reading nodes.json:", err)
-		return
+		return fmt.Errorf("error reading %s: %w", cfg.Paths.Nodes, err)
 	}
 
 	var nodesList []string
 	err = json.Unmarshal(nodes, &nodesList)
 	if err != nil {
-		fmt.Println("Error unmarshalling nodes.json:", err)
-		return
+		return fmt.Errorf("error unmarshalling %s: %w", cfg.Paths.Nodes, err)
 	}
 
-	db, err := initDB()
+	store, err := storage.Open(cfg.Paths.DB)
 	if err != nil {
-		fmt.Println("Error initializing database:", err)
-		return
+		return fmt.Errorf("error initializing database: %w", err)
 	}
-	defer db.Close()
+	defer store.Close()
 
-	err = initializeNodes(db, nodesList)
+	run, err := store.StartRun()
 	if err != nil {
-		fmt.Println("Error initializing nodes in database:", err)
-		return
+		return fmt.Errorf("error starting crawl run: %w", err)
 	}
 
-	filteredNodes, err := filterNodesBySoftware(db, nodesList)
+	err = store.InitProbes(run.ID, storage.StageFilter, nodesList)
 	if err != nil {
-		fmt.Println("Error filtering nodes:", err)
-		return
+		return fmt.Errorf("error initializing nodes in database: %w", err)
 	}
 
-	filteredNodesFile, err := os.Create("filtered_nodes.json")
+	// Nodes left running were interrupted by a crash
+	err = store.ResetInterrupted(run.ID, storage.StageFilter)
 	if err != nil {
-		fmt.Println("Error creating filtered_nodes.json:", err)
-		return
+		return fmt.Errorf("error resetting interrupted nodes: %w", err)
 	}
-	defer filteredNodesFile.Close()
 
-	err = json.NewEncoder(filteredNodesFile).Encode(filteredNodes)
+	filteredNodes, err := filterNodesBySoftware(cfg, store, run.ID)
 	if err != nil {
-		fmt.Println("Error writing to filtered_nodes.json:", err)
-		return
+		return fmt.Errorf("error filtering nodes: %w", err)
 	}
 
-	fmt.Println("Filtered nodes written to filtered_nodes.json")
-
-	total, checked, supported, err := getNodeStats(db)
+	filteredNodesFile, err := os.Create(cfg.Paths.FilteredNodes)
 	if err != nil {
-		fmt.Println("Error getting node stats:", err)
-		return
+		return fmt.Errorf("error creating %s: %w", cfg.Paths.FilteredNodes, err)
 	}
+	defer filteredNodesFile.Close()
 
-	fmt.Printf("Total nodes: %d, Checked: %d, Supported: %d\n", total, checked, supported)
-}
-
-func initializeNodes(db *sql.DB, nodes []string) error {
-	tx, err := db.Begin()
+	err = json.NewEncoder(filteredNodesFile).Encode(filteredNodes)
 	if err != nil {
-		return err
+		return fmt.Errorf("error writing to %s: %w", cfg.Paths.FilteredNodes, err)
 	}
-	defer tx.Rollback()
 
-	stmt, err := tx.Prepare(`
-		INSERT OR IGNORE INTO nodes (domain, status, last_updated) 
-		VALUES (?, ?, CURRENT_TIMESTAMP)
-	`)
-	if err != nil {
-		return err
-	}
-	defer stmt.Close()
+	fmt.Println("Filtered nodes written to", cfg.Paths.FilteredNodes)
 
-	for _, node := range nodes {
-		_, err := stmt.Exec(node, StatusPending)
-		if err != nil {
-			return err
-		}
-	}
-
-	return tx.Commit()
-}
-
-func getNodeStats(db *sql.DB) (total int, checked int, supported int, err error) {
-	err = db.QueryRow("SELECT COUNT(*) FROM nodes").Scan(&total)
+	counts, err := store.ProbeCounts(run.ID, storage.StageFilter)
 	if err != nil {
-		return
+		return fmt.Errorf("error getting node stats: %w", err)
 	}
-
-	err = db.QueryRow("SELECT COUNT(*) FROM nodes WHERE status != ?", StatusPending).Scan(&checked)
-	if err != nil {
-		return
+	total := 0
+	for _, count := range counts {
+		total += count
 	}
 
-	err = db.QueryRow("SELECT COUNT(*) FROM nodes WHERE status = ? AND software IN ('mastodon', 'pleroma', 'misskey', 'bookwyrm', 'smithereen')", StatusSuccess).Scan(&supported)
-	if err != nil {
-		return
-	}
-
-	return
+	fmt.Printf("Total nodes: %d, Checked: %d, Supported: %d\n", total, total-counts[storage.StatusPending], len(filteredNodes))
+	return nil
 }
 
-func filterNodesBySoftware(db *sql.DB, nodes []string) ([]string, error) {
-	supportedSoftware := map[string]bool{
-		"mastodon":   true,
-		"pleroma":    true,
-		"misskey":    true,
-		"bookwyrm":   true,
-		"smithereen": true,
-	}
-
-	resultChan := make(chan string)
-
+// filterNodesBySoftware probes the software of every pending node and returns
+// all nodes, old and new, that run supported software
+func filterNodesBySoftware(cfg *config.Config, store *storage.Store, runID int64) ([]string, error) {
 	var wg sync.WaitGroup
 
-	concurrencyLimit := 10
+	concurrencyLimit := cfg.Workers
 	semaphore := make(chan struct{}, concurrencyLimit)
 
-	var filteredNodes []string
-	done := make(chan struct{})
-	go func() {
-		for node := range resultChan {
-			filteredNodes = append(filteredNodes, node)
-		}
-		done <- struct{}{}
-	}()
-
-	client := &http.Client{
-		Timeout: 5 * time.Second,
-	}
-
-	// First, collect already processed supported nodes
-	rows, err := db.Query(`
-		SELECT domain FROM nodes 
-		WHERE status = ? AND software IN ('mastodon', 'pleroma', 'misskey', 'bookwyrm', 'smithereen')
-	`, StatusSuccess)
+	dns, err := resolver.New(cfg.DNS, store)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var node string
-		if err := rows.Scan(&node); err != nil {
-			return nil, err
-		}
-		resultChan <- node
-	}
-
-	// Then process pending nodes
-	pendingRows, err := db.Query(`
-		SELECT domain FROM nodes 
-		WHERE status = ?
-	`, StatusPending)
+	client := fetch.New(cfg, dns)
+	checker, err := optout.New(cfg, store, client)
 	if err != nil {
 		return nil, err
 	}
-	defer pendingRows.Close()
 
-	var pendingNodes []string
-	for pendingRows.Next() {
-		var node string
-		if err := pendingRows.Scan(&node); err != nil {
-			return nil, err
-		}
-		pendingNodes = append(pendingNodes, node)
+	pendingNodes, err := store.DomainsWithStatus(runID, storage.StageFilter, storage.StatusPending)
+	if err != nil {
+		return nil, err
 	}
 
 	// Process each pending node
@@ -235,78 +165,78 @@ func filterNodesBySoftware(db *sql.DB, nodes []string) ([]string, error) {
 
 			fmt.Printf("Checking software for node: %s\n", node)
 
-			_, err := db.Exec(`
-				UPDATE nodes 
-				SET status = ?, last_updated = CURRENT_TIMESTAMP 
-				WHERE domain = ?
-			`, StatusChecking, node)
+			err := store.SetStatus(runID, storage.StageFilter, node, storage.StatusRunning, "")
 			if err != nil {
 				fmt.Printf("  Error updating status for %s: %v\n", node, err)
 				return
 			}
 
-			nodeInfoURL, err := getNodeInfoURL(client, node)
-			if err != nil {
-				fmt.Printf("  Skipping %s: %v\n", node, err)
-				_, dbErr := db.Exec(`
-					UPDATE nodes 
-					SET status = ?, error = ?, last_updated = CURRENT_TIMESTAMP 
-					WHERE domain = ?
-				`, StatusFailed, err.Error(), node)
-				if dbErr != nil {
+			if reason := checker.Listed(node); reason != "" {
+				fmt.Printf("  Skipping %s: %s\n", node, reason)
+				if dbErr := store.SetStatus(runID, storage.StageFilter, node, storage.StatusSkipped, reason); dbErr != nil {
 					fmt.Printf("  Error updating status for %s: %v\n", node, dbErr)
 				}
 				return
 			}
 
-			software, err := getNodeSoftware(client, nodeInfoURL)
+			info, err := ProbeNodeInfo(client, node)
 			if err != nil {
 				fmt.Printf("  Skipping %s: %v\n", node, err)
-				_, dbErr := db.Exec(`
-					UPDATE nodes 
-					SET status = ?, error = ?, last_updated = CURRENT_TIMESTAMP 
-					WHERE domain = ?
-				`, StatusFailed, err.Error(), node)
-				if dbErr != nil {
+				if dbErr := store.SetStatus(runID, storage.StageFilter, node, storage.StatusFailed, err.Error()); dbErr != nil {
 					fmt.Printf("  Error updating status for %s: %v\n", node, dbErr)
 				}
 				return
 			}
 
+			software := info.Software.Name
 			if supportedSoftware[software] {
 				fmt.Printf("  Found supported software '%s' for %s\n", software, node)
-				_, dbErr := db.Exec(`
-					UPDATE nodes 
-					SET status = ?, software = ?, last_updated = CURRENT_TIMESTAMP 
-					WHERE domain = ?
-				`, StatusSuccess, software, node)
-				if dbErr != nil {
-					fmt.Printf("  Error updating status for %s: %v\n", node, dbErr)
-				}
-				resultChan <- node
 			} else {
 				fmt.Printf("  Unsupported software '%s' for %s\n", software, node)
-				_, dbErr := db.Exec(`
-					UPDATE nodes 
-					SET status = ?, software = ?, last_updated = CURRENT_TIMESTAMP 
-					WHERE domain = ?
-				`, StatusSuccess, software, node)
-				if dbErr != nil {
+			}
+			if reason := info.OptOut(); reason != "" {
+				fmt.Printf("  %s opted out: %s\n", node, reason)
+				if dbErr := store.SetOptOut(runID, node, reason); dbErr != nil {
 					fmt.Printf("  Error updating status for %s: %v\n", node, dbErr)
 				}
 			}
+			if dbErr := store.SetSoftware(runID, node, software); dbErr != nil {
+				fmt.Printf("  Error updating status for %s: %v\n", node, dbErr)
+			}
 		}(node)
 	}
 
 	wg.Wait()
-	close(resultChan)
 
-	<-done
+	// Both previously and newly checked nodes come from the database
+	return store.DomainsWithSoftware(runID, SupportedSoftware())
+}
 
-	return filteredNodes, nil
+// SupportedSoftware returns the names of the software that implements the peers API
+func SupportedSoftware() []string {
+	names := make([]string, 0, len(supportedSoftware))
+	for name := range supportedSoftware {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// IsSupported reports whether software implements the peers API
+func IsSupported(software string) bool {
+	return supportedSoftware[software]
+}
+
+// ProbeNodeInfo returns the nodeinfo document a domain advertises
+func ProbeNodeInfo(client *fetch.Client, domain string) (NodeInfo, error) {
+	nodeInfoURL, err := getNodeInfoURL(client, domain)
+	if err != nil {
+		return NodeInfo{}, err
+	}
+	return getNodeInfo(client, nodeInfoURL)
 }
 
-func getNodeInfoURL(client *http.Client, node string) (string, error) {
+func getNodeInfoURL(client *fetch.Client, node string) (string, error) {
 	wellKnownURL := fmt.Sprintf("https://%s/.well-known/nodeinfo", node)
 
 	resp, err := client.Get(wellKnownURL)
@@ -340,30 +270,30 @@ func getNodeInfoURL(client *http.Client, node string) (string, error) {
 	return "", fmt.Errorf("no nodeinfo link found")
 }
 
-func getNodeSoftware(client *http.Client, nodeInfoURL string) (string, error) {
+func getNodeInfo(client *fetch.Client, nodeInfoURL string) (NodeInfo, error) {
 	resp, err := client.Get(nodeInfoURL)
 	if err != nil {
-		return "", fmt.Errorf("failed to access nodeinfo endpoint: %w", err)
+		return NodeInfo{}, fmt.Errorf("failed to access nodeinfo endpoint: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("nodeinfo endpoint returned status %d", resp.StatusCode)
+		return NodeInfo{}, fmt.Errorf("nodeinfo endpoint returned status %d", resp.StatusCode)
 	}
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return "", fmt.Errorf("failed to read nodeinfo response: %w", err)
+		return NodeInfo{}, fmt.Errorf("failed to read nodeinfo response: %w", err)
 	}
 
 	var nodeInfo NodeInfo
 	if err := json.Unmarshal(body, &nodeInfo); err != nil {
-		return "", fmt.Errorf("failed to parse nodeinfo response: %w", err)
+		return NodeInfo{}, fmt.Errorf("failed to parse nodeinfo response: %w", err)
 	}
 
 	if nodeInfo.Software.Name == "" {
-		return "", fmt.Errorf("software name not found in nodeinfo")
+		return NodeInfo{}, fmt.Errorf("software name not found in nodeinfo")
 	}
 
-	return nodeInfo.Software.Name, nil
+	return nodeInfo, nil
 }
@@ -0,0 +1,81 @@
+package filter_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/kothavade/mastodon-paper/fedtest"
+	"github.com/kothavade/mastodon-paper/filter"
+	"github.com/kothavade/mastodon-paper/storage"
+)
+
+func TestFilterNodes(t *testing.T) {
+	instances := fedtest.Standard()
+	fed := fedtest.Start(t, instances...)
+	cfg := fedtest.Config(t)
+	fedtest.WriteJSON(t, cfg.Paths.Nodes, fedtest.Domains(instances, "ghost.test"))
+	if err := os.WriteFile(cfg.Paths.OptOut, []byte("# asked by email\nstatic.test\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := filter.FilterNodes(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	filtered, err := os.ReadFile(cfg.Paths.FilteredNodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fedtest.Golden(t, "filtered_nodes", string(filtered))
+
+	store, err := storage.Open(cfg.Paths.DB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	fedtest.Golden(t, "filter_probes", fedtest.DumpProbes(t, store, storage.StageFilter))
+
+	run, err := store.ActiveRun()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reason, err := store.OptOut(run.ID, "hidden.test"); err != nil || reason == "" {
+		t.Errorf("hidden.test opt-out = %q, %v; want the noindex flag recorded", reason, err)
+	}
+	if n := fed.Requests("flaky.test", "/.well-known/nodeinfo"); n != 2 {
+		t.Errorf("flaky.test got %d well-known requests, want 2 (one retry after 503)", n)
+	}
+	if n := fed.Requests("static.test", "/.well-known/nodeinfo"); n != 0 {
+		t.Errorf("static.test is on the opt-out list but got %d requests", n)
+	}
+
+	// A second run over the same run resumes and probes nothing again
+	if err := filter.FilterNodes(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if n := fed.Requests("alpha.test", "/.well-known/nodeinfo"); n != 1 {
+		t.Errorf("alpha.test probed %d times, want 1", n)
+	}
+}
+
+func TestOptOut(t *testing.T) {
+	for _, test := range []struct {
+		metadata map[string]any
+		want     string
+	}{
+		{nil, ""},
+		{map[string]any{"noindex": false, "indexable": true}, ""},
+		{map[string]any{"indexable": false}, "nodeinfo metadata sets indexable to false"},
+		// The first flag in order gives the reason whatever the map order
+		{map[string]any{"indexable": false, "noAI": true, "noindex": true}, "nodeinfo metadata sets noindex to true"},
+		{map[string]any{"indexable": false, "noAI": true}, "nodeinfo metadata sets noAI to true"},
+	} {
+		info := filter.NodeInfo{Metadata: test.metadata}
+		for range 10 {
+			if got := info.OptOut(); got != test.want {
+				t.Errorf("%v: got %q, want %q", test.metadata, got, test.want)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,318 @@
+// Package geoip looks up the country and autonomous system an IP address is
+// hosted in, in MMDB files such as MaxMind GeoLite2, DB-IP and IPinfo.
+package geoip
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kothavade/mastodon-paper/config"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// embeddedCountry is the country database used when none is configured. It
+// only covers IPv4.
+//
+//go:embed data/country-ipv4.mmdb
+var embeddedCountry []byte
+
+// Info is what the databases know about an IP address; empty fields are
+// unknown
+type Info struct {
+	CountryCode string
+	ASN         uint
+	ASOrg       string
+	// CountrySource and ASNSource name the database build the country and
+	// the AS were found in
+	CountrySource string
+	ASNSource     string
+}
+
+// Provider looks up where IP addresses are hosted
+type Provider interface {
+	// Lookup returns what is known about ip. An address no database covers
+	// is not an error; its Info is empty.
+	Lookup(ip net.IP) (Info, error)
+	Close() error
+}
+
+// Kinds of database, named after their config keys
+const (
+	KindCountry = "country"
+	KindASN     = "asn"
+)
+
+// probes are well-known addresses looked up when a database is opened, to
+// check it has the fields of its kind
+var probes = []net.IP{net.ParseIP("8.8.8.8"), net.ParseIP("1.1.1.1"), net.ParseIP("2001:4860:4860::8888")}
+
+// Database is one opened MMDB file
+type Database struct {
+	// Path is the file the database was read from, or "embedded"
+	Path   string
+	reader *maxminddb.Reader
+}
+
+// OpenDatabase opens the MMDB file at path and checks it has the fields of
+// kind, KindCountry or KindASN
+func OpenDatabase(path, kind string) (*Database, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("geoip.%s: %w", kind, err)
+	}
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("geoip.%s: %s is not a valid MMDB file: %w", kind, path, err)
+	}
+	db := &Database{Path: path, reader: reader}
+	if err := db.check(kind); err != nil {
+		reader.Close()
+		return nil, fmt.Errorf("geoip.%s: %s: %w", kind, path, err)
+	}
+	return db, nil
+}
+
+// openEmbedded opens the country database embedded in the binary
+func openEmbedded() (*Database, error) {
+	reader, err := maxminddb.FromBytes(embeddedCountry)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the embedded country database: %w", err)
+	}
+	return &Database{Path: "embedded", reader: reader}, nil
+}
+
+// check returns an error if the database's metadata is unusable, or if a
+// probe address it covers has a record without the fields of kind, as when
+// a country database is configured as an ASN one
+func (d *Database) check(kind string) error {
+	meta := d.reader.Metadata
+	if meta.IPVersion != 4 && meta.IPVersion != 6 {
+		return fmt.Errorf("unsupported IP version %d", meta.IPVersion)
+	}
+	for _, ip := range probes {
+		record, ok, err := d.lookup(ip)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		var has bool
+		switch kind {
+		case KindCountry:
+			has = countryOf(record) != ""
+		case KindASN:
+			asn, org := asnOf(record)
+			has = asn != 0 || org != ""
+		}
+		if !has {
+			return fmt.Errorf("the record of %s has no %s fields, only %s", ip, kind, fields(record))
+		}
+		return nil
+	}
+	return nil
+}
+
+// Type returns the database type recorded in the file, such as
+// GeoLite2-Country
+func (d *Database) Type() string {
+	return d.reader.Metadata.DatabaseType
+}
+
+// Built returns when the database was built
+func (d *Database) Built() time.Time {
+	return time.Unix(int64(d.reader.Metadata.BuildEpoch), 0).UTC()
+}
+
+// Source names the database build, such as "GeoLite2-Country 2025-05-13"
+func (d *Database) Source() string {
+	return d.Type() + " " + d.Built().Format(time.DateOnly)
+}
+
+// Covers reports whether the database has records for ip's version. IPv6
+// databases include IPv4.
+func (d *Database) Covers(ip net.IP) bool {
+	return d.reader.Metadata.IPVersion == 6 || ip.To4() != nil
+}
+
+// IPVersions describes the addresses the database covers
+func (d *Database) IPVersions() string {
+	if d.reader.Metadata.IPVersion == 6 {
+		return "IPv4 and IPv6"
+	}
+	return "IPv4"
+}
+
+// Close releases the database
+func (d *Database) Close() error {
+	return d.reader.Close()
+}
+
+// lookup returns the record of ip and whether there is one
+func (d *Database) lookup(ip net.IP) (map[string]any, bool, error) {
+	if !d.Covers(ip) {
+		return nil, false, nil
+	}
+	var record map[string]any
+	_, ok, err := d.reader.LookupNetwork(ip, &record)
+	if err != nil {
+		return nil, false, fmt.Errorf("lookup of %s in %s failed: %w", ip, d.Path, err)
+	}
+	return record, ok, nil
+}
+
+// Databases looks countries and autonomous systems up in lists of
+// databases; the first database with a value for an address wins
+type Databases struct {
+	Country []*Database
+	ASN     []*Database
+}
+
+// Open opens the databases cfg lists, or the embedded IPv4 country database
+// if cfg lists no country databases. Every file is checked before it is
+// used, so a missing or wrong file is reported before the crawl starts.
+func Open(cfg config.GeoIPConfig) (*Databases, error) {
+	d := &Databases{}
+	for _, path := range cfg.Country {
+		db, err := OpenDatabase(path, KindCountry)
+		if err != nil {
+			d.Close()
+			return nil, err
+		}
+		d.Country = append(d.Country, db)
+	}
+	for _, path := range cfg.ASN {
+		db, err := OpenDatabase(path, KindASN)
+		if err != nil {
+			d.Close()
+			return nil, err
+		}
+		d.ASN = append(d.ASN, db)
+	}
+	if len(d.Country) == 0 {
+		db, err := openEmbedded()
+		if err != nil {
+			d.Close()
+			return nil, err
+		}
+		d.Country = append(d.Country, db)
+	}
+	return d, nil
+}
+
+// Lookup returns the country and AS of ip from the first database of each
+// kind that knows them
+func (d *Databases) Lookup(ip net.IP) (Info, error) {
+	var info Info
+	for _, db := range d.Country {
+		record, ok, err := db.lookup(ip)
+		if err != nil {
+			return Info{}, err
+		}
+		if code := countryOf(record); ok && code != "" {
+			info.CountryCode, info.CountrySource = code, db.Source()
+			break
+		}
+	}
+	for _, db := range d.ASN {
+		record, ok, err := db.lookup(ip)
+		if err != nil {
+			return Info{}, err
+		}
+		if asn, org := asnOf(record); ok && (asn != 0 || org != "") {
+			info.ASN, info.ASOrg, info.ASNSource = asn, org, db.Source()
+			break
+		}
+	}
+	return info, nil
+}
+
+// Describe returns one line about every database, and about the addresses
+// no database covers
+func (d *Databases) Describe() []string {
+	var lines []string
+	for _, kind := range []struct {
+		name string
+		dbs  []*Database
+	}{{KindCountry, d.Country}, {KindASN, d.ASN}} {
+		v6 := false
+		for _, db := range kind.dbs {
+			lines = append(lines, fmt.Sprintf("%s: %s (%s) from %s", kind.name, db.Source(), db.IPVersions(), db.Path))
+			v6 = v6 || db.reader.Metadata.IPVersion == 6
+		}
+		switch {
+		case len(kind.dbs) == 0:
+			lines = append(lines, fmt.Sprintf("%s: no database, values will be empty", kind.name))
+		case !v6:
+			lines = append(lines, fmt.Sprintf("%s: no IPv6 database, values of IPv6 addresses will be empty", kind.name))
+		}
+	}
+	return lines
+}
+
+// Close releases every database
+func (d *Databases) Close() error {
+	var errs []error
+	for _, db := range slices.Concat(d.Country, d.ASN) {
+		errs = append(errs, db.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// countryOf returns the ISO country code of a record in the MaxMind and DB-IP
+// layout (country.iso_code), the IPinfo layouts (country or country_code) or
+// the ip-location-db layout (country_code)
+func countryOf(record map[string]any) string {
+	switch country := record["country"].(type) {
+	case map[string]any:
+		if code, ok := country["iso_code"].(string); ok {
+			return code
+		}
+	case string:
+		return country
+	}
+	code, _ := record["country_code"].(string)
+	return code
+}
+
+// asnOf returns the AS number and organisation of a record in the MaxMind,
+// DB-IP and ip-location-db layout (autonomous_system_number and
+// autonomous_system_organization) or the IPinfo layouts ("AS13335" in asn,
+// with name or as_name)
+func asnOf(record map[string]any) (uint, string) {
+	var asn uint
+	if n, ok := record["autonomous_system_number"].(uint64); ok {
+		asn = uint(n)
+	}
+	if s, ok := record["asn"].(string); ok {
+		if n, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(s), "AS"), 10, 32); err == nil {
+			asn = uint(n)
+		}
+	}
+
+	for _, key := range []string{"autonomous_system_organization", "as_name", "name"} {
+		if org, ok := record[key].(string); ok && org != "" {
+			return asn, org
+		}
+	}
+	return asn, ""
+}
+
+// fields lists the top-level fields of a record, for error messages
+func fields(record map[string]any) string {
+	var names []string
+	for name := range record {
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return "an empty record"
+	}
+	slices.Sort(names)
+	return strings.Join(names, ", ")
+}
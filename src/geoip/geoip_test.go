@@ -0,0 +1,111 @@
+package geoip
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kothavade/mastodon-paper/config"
+)
+
+// writeEmbedded writes the embedded country database to a file
+func writeEmbedded(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "country-ipv4.mmdb")
+	if err := os.WriteFile(path, embeddedCountry, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestOpen(t *testing.T) {
+	geo, err := Open(config.GeoIPConfig{Country: []string{writeEmbedded(t)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer geo.Close()
+
+	info, err := geo.Lookup(net.ParseIP("8.8.8.8"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Info{CountryCode: "US", CountrySource: "country ipv4 2025-05-18"}); info != want {
+		t.Errorf("got %+v, want %+v", info, want)
+	}
+
+	// Neither an IPv4 database nor a missing ASN database is an error
+	info, err = geo.Lookup(net.ParseIP("2001:4860:4860::8888"))
+	if err != nil || info != (Info{}) {
+		t.Errorf("IPv6 lookup gave %+v, %v, want nothing", info, err)
+	}
+
+	describe := strings.Join(geo.Describe(), "\n")
+	for _, want := range []string{"country: country ipv4 2025-05-18 (IPv4) from ", "no IPv6 database", "asn: no database"} {
+		if !strings.Contains(describe, want) {
+			t.Errorf("description %q lacks %q", describe, want)
+		}
+	}
+}
+
+func TestOpenEmbedded(t *testing.T) {
+	geo, err := Open(config.GeoIPConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer geo.Close()
+	if len(geo.Country) != 1 || geo.Country[0].Path != "embedded" {
+		t.Errorf("got country databases %v, want the embedded one", geo.Country)
+	}
+}
+
+func TestOpenDatabaseErrors(t *testing.T) {
+	dir := t.TempDir()
+	garbage := filepath.Join(dir, "garbage.mmdb")
+	if err := os.WriteFile(garbage, []byte("not a database"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		path, kind, want string
+	}{
+		{filepath.Join(dir, "missing.mmdb"), KindCountry, "geoip.country: stat "},
+		{garbage, KindCountry, "is not a valid MMDB file"},
+		{writeEmbedded(t), KindASN, "has no asn fields, only country_code"},
+	} {
+		db, err := OpenDatabase(test.path, test.kind)
+		if err == nil {
+			db.Close()
+			t.Errorf("%s opened as %s", test.path, test.kind)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.want) {
+			t.Errorf("got %q, want it to contain %q", err, test.want)
+		}
+	}
+}
+
+func TestRecordLayouts(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		record  map[string]any
+		country string
+		asn     uint
+		org     string
+	}{
+		{"maxmind country", map[string]any{"country": map[string]any{"iso_code": "DE", "names": map[string]any{}}}, "DE", 0, ""},
+		{"maxmind asn", map[string]any{"autonomous_system_number": uint64(24940), "autonomous_system_organization": "Hetzner Online GmbH"}, "", 24940, "Hetzner Online GmbH"},
+		{"ipinfo country", map[string]any{"country": "FR", "country_name": "France"}, "FR", 0, ""},
+		{"ipinfo asn", map[string]any{"asn": "AS16276", "name": "OVH SAS", "domain": "ovhcloud.com"}, "", 16276, "OVH SAS"},
+		{"ipinfo lite", map[string]any{"country_code": "JP", "asn": "AS2516", "as_name": "KDDI"}, "JP", 2516, "KDDI"},
+		{"ip-location-db", map[string]any{"country_code": "AU"}, "AU", 0, ""},
+	} {
+		if got := countryOf(test.record); got != test.country {
+			t.Errorf("%s: got country %q, want %q", test.name, got, test.country)
+		}
+		if asn, org := asnOf(test.record); asn != test.asn || org != test.org {
+			t.Errorf("%s: got AS %d %q, want %d %q", test.name, asn, org, test.asn, test.org)
+		}
+	}
+}
@@ -3,9 +3,20 @@ module github.com/kothavade/mastodon-paper
 go 1.24.3
 
 require (
-	github.com/mattn/go-sqlite3 v1.14.28 // indirect
-	github.com/neo4j/neo4j-go-driver/v5 v5.28.1 // indirect
-	github.com/oschwald/maxminddb-golang v1.13.1 // indirect
-	github.com/oschwald/maxminddb-golang/v2 v2.0.0-beta.3 // indirect
-	golang.org/x/sys v0.30.0 // indirect
+	github.com/BurntSushi/toml v1.6.0
+	github.com/mattn/go-sqlite3 v1.14.28
+	github.com/neo4j/neo4j-go-driver/v5 v5.28.1
+	github.com/oschwald/maxminddb-golang v1.13.1
+	github.com/parquet-go/parquet-go v0.25.1
+	golang.org/x/net v0.44.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/andybalholm/brotli v1.1.0 // indirect
+	github.com/google/uuid v1.6.0 // indirect
+	github.com/klauspost/compress v1.17.9 // indirect
+	github.com/pierrec/lz4/v4 v4.1.21 // indirect
+	github.com/stretchr/testify v1.10.0 // indirect
+	golang.org/x/sys v0.36.0 // indirect
 )
@@ -0,0 +1,299 @@
+package graph
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/kothavade/mastodon-paper/config"
+	"github.com/neo4j/neo4j-go-driver/v5/neo4j"
+)
+
+// dialect holds what differs between the databases the Bolt sink writes to
+type dialect struct {
+	name string
+	// schema returns the statements that keep the key of a label unique
+	schema func(label string, l nodeLabel) []string
+	// awaitIndexes waits for indexes the database builds in the background
+	awaitIndexes string
+}
+
+var neo4jDialect = dialect{
+	name: "Neo4j",
+	schema: func(label string, l nodeLabel) []string {
+		return []string{fmt.Sprintf("CREATE CONSTRAINT %s IF NOT EXISTS FOR (n:%s) REQUIRE n.%s IS UNIQUE", l.constraint, label, l.key)}
+	},
+	awaitIndexes: "CALL db.awaitIndexes(300)",
+}
+
+// memgraphDialect needs an index besides the constraint for MERGE to use, and
+// has no IF NOT EXISTS
+var memgraphDialect = dialect{
+	name: "Memgraph",
+	schema: func(label string, l nodeLabel) []string {
+		return []string{
+			fmt.Sprintf("CREATE INDEX ON :%s(%s)", label, l.key),
+			fmt.Sprintf("CREATE CONSTRAINT ON (n:%s) ASSERT n.%s IS UNIQUE", label, l.key),
+		}
+	},
+}
+
+// relationshipTypes are the relationship types the sinks accept. Types and
+// labels cannot be query parameters, so only known ones are written.
+var relationshipTypes = map[string]bool{PeersWith: true, HostedIn: true, AnnouncedBy: true}
+
+// boltSink writes to a Neo4j or Memgraph database, merging everything it is
+// given in one transaction once cfg.Neo4j.BatchSize writes are buffered
+type boltSink struct {
+	driver    neo4j.DriverWithContext
+	session   neo4j.SessionWithContext
+	batchSize int
+
+	nodes []NodeRef
+	edges []Edge
+	props []Properties
+}
+
+func openBolt(ctx context.Context, cfg *config.Config, d dialect) (Sink, error) {
+	driver, err := neo4j.NewDriverWithContext(
+		cfg.Neo4j.URI,
+		neo4j.BasicAuth(cfg.Neo4j.User, cfg.Neo4j.Password, ""))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s driver: %w", d.name, err)
+	}
+
+	err = driver.VerifyConnectivity(ctx)
+	if err != nil {
+		driver.Close(ctx)
+		return nil, fmt.Errorf("failed to connect to %s: %w", d.name, err)
+	}
+	fmt.Printf("%s connection established.\n", d.name)
+
+	s := &boltSink{
+		driver:    driver,
+		session:   driver.NewSession(ctx, neo4j.SessionConfig{AccessMode: neo4j.AccessModeWrite}),
+		batchSize: cfg.Neo4j.BatchSize,
+	}
+	if err := s.ensureSchema(ctx, d); err != nil {
+		s.Close(ctx)
+		return nil, err
+	}
+	return s, nil
+}
+
+// ensureSchema creates the constraints the graph relies on if they do not
+// exist yet, and waits for their indexes to come online. Duplicate nodes left
+// by earlier versions, which created nodes without a constraint, are removed
+// first since the constraint cannot be created while they exist.
+func (s *boltSink) ensureSchema(ctx context.Context, d dialect) error {
+	for _, label := range slices.Sorted(maps.Keys(labels)) {
+		l := labels[label]
+		removed, err := neo4j.ExecuteWrite(ctx, s.session, func(tx neo4j.ManagedTransaction) (int64, error) {
+			// MERGE matched every duplicate, so the node that is kept
+			// already has every relationship the others had
+			result, err := tx.Run(ctx, fmt.Sprintf(`
+				MATCH (n:%s)
+				WITH n.%s AS key, collect(n) AS nodes
+				WHERE size(nodes) > 1
+				UNWIND tail(nodes) AS duplicate
+				DETACH DELETE duplicate
+				RETURN count(*) AS removed`, label, l.key), nil)
+			if err != nil {
+				return 0, err
+			}
+			record, err := result.Single(ctx)
+			if err != nil {
+				return 0, err
+			}
+			return record.Values[0].(int64), nil
+		})
+		if err != nil {
+			return fmt.Errorf("error removing duplicate %s nodes: %w", label, err)
+		}
+		if removed > 0 {
+			fmt.Printf("Removed %d duplicate %s nodes\n", removed, label)
+		}
+
+		for _, query := range d.schema(label, l) {
+			err := s.run(ctx, query)
+			if err != nil && !strings.Contains(err.Error(), "already exists") {
+				return fmt.Errorf("error creating constraint on %s: %w", label, err)
+			}
+		}
+	}
+
+	if d.awaitIndexes != "" {
+		if err := s.run(ctx, d.awaitIndexes); err != nil {
+			return fmt.Errorf("error waiting for indexes: %w", err)
+		}
+	}
+	return nil
+}
+
+// run runs a query in its own transaction, as schema changes must be
+func (s *boltSink) run(ctx context.Context, query string) error {
+	result, err := s.session.Run(ctx, query, nil)
+	if err != nil {
+		return err
+	}
+	_, err = result.Consume(ctx)
+	return err
+}
+
+func (s *boltSink) UpsertNodes(ctx context.Context, nodes []NodeRef) error {
+	s.nodes = append(s.nodes, nodes...)
+	return s.flushIfFull(ctx)
+}
+
+func (s *boltSink) UpsertEdges(ctx context.Context, edges []Edge) error {
+	s.edges = append(s.edges, edges...)
+	return s.flushIfFull(ctx)
+}
+
+func (s *boltSink) SetProperties(ctx context.Context, props []Properties) error {
+	s.props = append(s.props, props...)
+	return s.flushIfFull(ctx)
+}
+
+func (s *boltSink) flushIfFull(ctx context.Context) error {
+	if len(s.nodes)+len(s.edges)+len(s.props) < s.batchSize {
+		return nil
+	}
+	return s.Flush(ctx)
+}
+
+// Flush merges everything buffered in one transaction
+func (s *boltSink) Flush(ctx context.Context) error {
+	statements, err := s.statements()
+	if err != nil || len(statements) == 0 {
+		return err
+	}
+
+	_, err = s.session.ExecuteWrite(ctx, func(tx neo4j.ManagedTransaction) (any, error) {
+		for _, st := range statements {
+			if _, err := tx.Run(ctx, st.query, st.params); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	s.nodes, s.edges, s.props = s.nodes[:0], s.edges[:0], s.props[:0]
+	return nil
+}
+
+func (s *boltSink) Close(ctx context.Context) error {
+	s.session.Close(ctx)
+	return s.driver.Close(ctx)
+}
+
+// statement is a query with its parameters
+type statement struct {
+	query  string
+	params map[string]any
+}
+
+// statements turns the buffered writes into one UNWIND statement per label
+// or relationship type. Nodes are created first, then properties are set and
+// old links removed, and finally edges and new links are merged.
+func (s *boltSink) statements() ([]statement, error) {
+	var statements []statement
+
+	keys := make(map[string][]any)
+	for _, n := range s.nodes {
+		keys[n.Label] = append(keys[n.Label], n.Key)
+	}
+	for _, label := range slices.Sorted(maps.Keys(keys)) {
+		key, err := keyProperty(label)
+		if err != nil {
+			return nil, err
+		}
+		statements = append(statements, statement{
+			query:  fmt.Sprintf("UNWIND $keys AS key MERGE (:%s {%s: key})", label, key),
+			params: map[string]any{"keys": keys[label]},
+		})
+	}
+
+	values := make(map[string][]any)
+	unlink := make(map[string][]any)
+	edges := slices.Clone(s.edges)
+	for _, p := range s.props {
+		v := p.Values
+		if v == nil {
+			v = map[string]any{}
+		}
+		values[p.Node.Label] = append(values[p.Node.Label], map[string]any{"key": p.Node.Key, "values": v})
+
+		if len(p.Links) == 0 {
+			continue
+		}
+		types := slices.Sorted(maps.Keys(p.Links))
+		unlink[p.Node.Label] = append(unlink[p.Node.Label], map[string]any{"key": p.Node.Key, "types": types})
+		for _, typ := range types {
+			for _, to := range p.Links[typ] {
+				edges = append(edges, Edge{From: p.Node, Type: typ, To: to})
+			}
+		}
+	}
+	for _, label := range slices.Sorted(maps.Keys(values)) {
+		key, err := keyProperty(label)
+		if err != nil {
+			return nil, err
+		}
+		statements = append(statements, statement{
+			query: fmt.Sprintf(`
+				UNWIND $rows AS row
+				MERGE (n:%s {%s: row.key})
+				SET n += row.values`, label, key),
+			params: map[string]any{"rows": values[label]},
+		})
+	}
+	for _, label := range slices.Sorted(maps.Keys(unlink)) {
+		key, _ := keyProperty(label)
+		statements = append(statements, statement{
+			query: fmt.Sprintf(`
+				UNWIND $rows AS row
+				MATCH (n:%s {%s: row.key})-[r]->()
+				WHERE type(r) IN row.types
+				DELETE r`, label, key),
+			params: map[string]any{"rows": unlink[label]},
+		})
+	}
+
+	type edgeGroup struct{ from, typ, to string }
+	groups := make(map[edgeGroup][]any)
+	for _, e := range edges {
+		g := edgeGroup{e.From.Label, e.Type, e.To.Label}
+		groups[g] = append(groups[g], map[string]any{"from": e.From.Key, "to": e.To.Key})
+	}
+	for _, g := range slices.SortedFunc(maps.Keys(groups), func(a, b edgeGroup) int {
+		return cmp.Or(cmp.Compare(a.from, b.from), cmp.Compare(a.typ, b.typ), cmp.Compare(a.to, b.to))
+	}) {
+		if !relationshipTypes[g.typ] {
+			return nil, fmt.Errorf("unknown relationship type %q", g.typ)
+		}
+		fromKey, err := keyProperty(g.from)
+		if err != nil {
+			return nil, err
+		}
+		toKey, err := keyProperty(g.to)
+		if err != nil {
+			return nil, err
+		}
+		statements = append(statements, statement{
+			query: fmt.Sprintf(`
+				UNWIND $rows AS row
+				MERGE (a:%s {%s: row.from})
+				MERGE (b:%s {%s: row.to})
+				MERGE (a)-[:%s]->(b)`, g.from, fromKey, g.to, toKey, g.typ),
+			params: map[string]any{"rows": groups[g]},
+		})
+	}
+	return statements, nil
+}
@@ -0,0 +1,301 @@
+package graph
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+)
+
+// format reads and writes a whole graph in one file format
+type format interface {
+	read(r io.Reader) (*memGraph, error)
+	write(w io.Writer, g *memGraph) error
+}
+
+// fileSink keeps the graph in memory and writes it to a file on Flush, so the
+// graph can be produced without a database server
+type fileSink struct {
+	path   string
+	format format
+	graph  *memGraph
+}
+
+// openFile loads the graph in path, if it exists, to add to it
+func openFile(path string, f format) (Sink, error) {
+	s := &fileSink{path: path, format: f, graph: newMemGraph()}
+
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", path, err)
+	}
+	defer file.Close()
+
+	s.graph, err = f.read(file)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", path, err)
+	}
+	fmt.Printf("Loaded %d nodes from %s\n", len(s.graph.nodes), path)
+	return s, nil
+}
+
+func (s *fileSink) UpsertNodes(ctx context.Context, nodes []NodeRef) error {
+	for _, n := range nodes {
+		if err := s.graph.upsertNode(n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *fileSink) UpsertEdges(ctx context.Context, edges []Edge) error {
+	for _, e := range edges {
+		if err := s.graph.upsertEdge(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *fileSink) SetProperties(ctx context.Context, props []Properties) error {
+	for _, p := range props {
+		if err := s.graph.setProperties(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Flush rewrites the file with the whole graph, replacing it only once the
+// new file is complete
+func (s *fileSink) Flush(ctx context.Context) error {
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("error creating %s: %w", s.path, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	err = s.format.write(tmp, s.graph)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("error writing %s: %w", s.path, err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("error writing %s: %w", s.path, err)
+	}
+	return nil
+}
+
+func (s *fileSink) Close(ctx context.Context) error {
+	return nil
+}
+
+// memGraph is a whole graph held in memory
+type memGraph struct {
+	// nodes holds the properties of every node, without its key
+	nodes map[NodeRef]map[string]any
+	// out holds the outgoing edges of every node that has any
+	out map[NodeRef]map[Edge]bool
+}
+
+func newMemGraph() *memGraph {
+	return &memGraph{
+		nodes: make(map[NodeRef]map[string]any),
+		out:   make(map[NodeRef]map[Edge]bool),
+	}
+}
+
+func (g *memGraph) upsertNode(n NodeRef) error {
+	if _, ok := g.nodes[n]; ok {
+		return nil
+	}
+	if _, err := keyProperty(n.Label); err != nil {
+		return err
+	}
+	switch n.Key.(type) {
+	case string, int64:
+	default:
+		return fmt.Errorf("%s key %v is not a string or int64", n.Label, n.Key)
+	}
+	g.nodes[n] = make(map[string]any)
+	return nil
+}
+
+func (g *memGraph) upsertEdge(e Edge) error {
+	if !relationshipTypes[e.Type] {
+		return fmt.Errorf("unknown relationship type %q", e.Type)
+	}
+	if err := g.upsertNode(e.From); err != nil {
+		return err
+	}
+	if err := g.upsertNode(e.To); err != nil {
+		return err
+	}
+	if g.out[e.From] == nil {
+		g.out[e.From] = make(map[Edge]bool)
+	}
+	g.out[e.From][e] = true
+	return nil
+}
+
+func (g *memGraph) setProperties(p Properties) error {
+	if err := g.upsertNode(p.Node); err != nil {
+		return err
+	}
+	props := g.nodes[p.Node]
+	for name, v := range p.Values {
+		if v == nil {
+			delete(props, name)
+		} else {
+			props[name] = v
+		}
+	}
+
+	for e := range g.out[p.Node] {
+		if _, ok := p.Links[e.Type]; ok {
+			delete(g.out[p.Node], e)
+		}
+	}
+	for typ, targets := range p.Links {
+		for _, to := range targets {
+			if err := g.upsertEdge(Edge{From: p.Node, Type: typ, To: to}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// addNode adds a node read from a file, given all of its properties
+// including the key
+func (g *memGraph) addNode(label string, props map[string]any) (NodeRef, error) {
+	key, err := keyProperty(label)
+	if err != nil {
+		return NodeRef{}, err
+	}
+	n := NodeRef{Label: label, Key: props[key]}
+	if err := g.upsertNode(n); err != nil {
+		return NodeRef{}, err
+	}
+	for name, v := range props {
+		if name != key {
+			g.nodes[n][name] = v
+		}
+	}
+	return n, nil
+}
+
+// properties returns every property of a node, including its key
+func (g *memGraph) properties(n NodeRef) map[string]any {
+	key, _ := keyProperty(n.Label)
+	props := map[string]any{key: n.Key}
+	for name, v := range g.nodes[n] {
+		props[name] = v
+	}
+	return props
+}
+
+// sortedNodes returns the nodes ordered by label and key
+func (g *memGraph) sortedNodes() []NodeRef {
+	nodes := make([]NodeRef, 0, len(g.nodes))
+	for n := range g.nodes {
+		nodes = append(nodes, n)
+	}
+	slices.SortFunc(nodes, compareNodes)
+	return nodes
+}
+
+// sortedEdges returns the edges ordered by source, type and target
+func (g *memGraph) sortedEdges() []Edge {
+	var edges []Edge
+	for _, out := range g.out {
+		for e := range out {
+			edges = append(edges, e)
+		}
+	}
+	slices.SortFunc(edges, func(a, b Edge) int {
+		return cmp.Or(compareNodes(a.From, b.From), cmp.Compare(a.Type, b.Type), compareNodes(a.To, b.To))
+	})
+	return edges
+}
+
+func compareNodes(a, b NodeRef) int {
+	if c := cmp.Compare(a.Label, b.Label); c != 0 {
+		return c
+	}
+	ai, aInt := a.Key.(int64)
+	bi, bInt := b.Key.(int64)
+	if aInt && bInt {
+		return cmp.Compare(ai, bi)
+	}
+	return cmp.Compare(fmt.Sprint(a.Key), fmt.Sprint(b.Key))
+}
+
+// nodeID is the id a node is written with
+func nodeID(n NodeRef) string {
+	return fmt.Sprintf("%s:%v", n.Label, n.Key)
+}
+
+// attributeTypes returns the type of every node property in the graph, as
+// GraphML and GEXF name them. A property with values of several types is
+// written as a string.
+func (g *memGraph) attributeTypes() map[string]string {
+	types := map[string]string{"label": "string"}
+	for n := range g.nodes {
+		for name, v := range g.properties(n) {
+			t := attributeType(v)
+			if prev, ok := types[name]; ok && prev != t {
+				t = "string"
+			}
+			types[name] = t
+		}
+	}
+	return types
+}
+
+func attributeType(v any) string {
+	switch v.(type) {
+	case int64:
+		return "long"
+	case float64:
+		return "double"
+	case bool:
+		return "boolean"
+	default:
+		return "string"
+	}
+}
+
+// formatValue writes a property value as XML attribute text
+func formatValue(v any) string {
+	switch v := v.(type) {
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// parseValue reads a property value of a GraphML or GEXF attribute type
+func parseValue(s, typ string) (any, error) {
+	switch typ {
+	case "long", "int", "integer":
+		return strconv.ParseInt(s, 10, 64)
+	case "double", "float":
+		return strconv.ParseFloat(s, 64)
+	case "boolean":
+		return strconv.ParseBool(s)
+	default:
+		return s, nil
+	}
+}
@@ -6,111 +6,170 @@ import (
 	"fmt"
 	"os"
 
-	"github.com/neo4j/neo4j-go-driver/v5/neo4j"
+	"github.com/kothavade/mastodon-paper/config"
+	"github.com/kothavade/mastodon-paper/storage"
 )
 
-func Init() {
-	ctx := context.Background()
-	dbUri := "neo4j://localhost:7687"
-	dbUser := "neo4j"
-	dbPassword := "mastodonpaper"
+// Node labels and relationship types of the graph
+const (
+	LabelInstance      = "MastodonNode"
+	LabelCountry       = "Country"
+	LabelAS            = "AutonomousSystem"
+	LabelCloudProvider = "CloudProvider"
 
-	driver, err := neo4j.NewDriverWithContext(
-		dbUri,
-		neo4j.BasicAuth(dbUser, dbPassword, ""))
-	if err != nil {
-		panic(err)
-	}
-	defer driver.Close(ctx)
+	PeersWith   = "PEERS_WITH"
+	HostedIn    = "HOSTED_IN"
+	AnnouncedBy = "ANNOUNCED_BY"
+)
 
-	err = driver.VerifyConnectivity(ctx)
-	if err != nil {
-		panic(err)
+// nodeLabel describes the nodes of one label
+type nodeLabel struct {
+	// key is the property that identifies a node
+	key string
+	// constraint names the uniqueness constraint on key
+	constraint string
+}
+
+var labels = map[string]nodeLabel{
+	LabelInstance:      {key: "url", constraint: "domain_name"},
+	LabelCountry:       {key: "code", constraint: "country_code"},
+	LabelAS:            {key: "asn", constraint: "as_number"},
+	LabelCloudProvider: {key: "name", constraint: "cloud_provider_name"},
+}
+
+// keyProperty returns the property that identifies nodes of a label
+func keyProperty(label string) (string, error) {
+	l, ok := labels[label]
+	if !ok {
+		return "", fmt.Errorf("unknown node label %q", label)
 	}
-	fmt.Println("Neo4j connection established.")
+	return l.key, nil
+}
 
-	session := driver.NewSession(ctx, neo4j.SessionConfig{AccessMode: neo4j.AccessModeWrite})
-	defer session.Close(ctx)
+// Instance refers to the node of a Fediverse instance
+func Instance(domain string) NodeRef {
+	return NodeRef{Label: LabelInstance, Key: domain}
+}
 
-	// for each node in filtered_processed_nodes.json, create a node in the graph
-	nodes, err := os.ReadFile("filtered_processed_nodes.json")
-	if err != nil {
-		panic(err)
+// Country refers to the node of a country by its ISO code
+func Country(code string) NodeRef {
+	return NodeRef{Label: LabelCountry, Key: code}
+}
+
+// AutonomousSystem refers to the node of an AS by its number
+func AutonomousSystem(asn int64) NodeRef {
+	return NodeRef{Label: LabelAS, Key: asn}
+}
+
+// CloudProvider refers to the node of a cloud provider by its name
+func CloudProvider(name string) NodeRef {
+	return NodeRef{Label: LabelCloudProvider, Key: name}
+}
+
+// PeerEdge is the relationship from an instance to a peer it reports
+func PeerEdge(domain, peer string) Edge {
+	return Edge{From: Instance(domain), Type: PeersWith, To: Instance(peer)}
+}
+
+// InstanceProperties returns the collected facts of an instance as properties
+// of its node, linked to the Country it is HOSTED_IN, the AutonomousSystem its
+// IP is ANNOUNCED_BY and the CloudProvider it is HOSTED_IN. Facts that are
+// missing remove the property and the link.
+func InstanceProperties(r storage.InstanceRecord) []Properties {
+	// ASN 0 means the IP was not found in the ASN database
+	if r.ASN != nil && *r.ASN == 0 {
+		r.ASN = nil
 	}
 
-	var nodesList []string
-	json.Unmarshal(nodes, &nodesList)
+	inst := Properties{
+		Node:   Instance(r.Domain),
+		Values: InstanceValues(r),
+		Links:  map[string][]NodeRef{HostedIn: nil, AnnouncedBy: nil},
+	}
+	if r.CountryCode != nil {
+		inst.Links[HostedIn] = append(inst.Links[HostedIn], Country(*r.CountryCode))
+	}
+	if r.CloudProvider != nil {
+		inst.Links[HostedIn] = append(inst.Links[HostedIn], CloudProvider(*r.CloudProvider))
+	}
+	if r.ASN != nil {
+		inst.Links[AnnouncedBy] = []NodeRef{AutonomousSystem(*r.ASN)}
+	}
+	props := []Properties{inst}
 
-	for _, node := range nodesList {
-		_, err := session.ExecuteWrite(ctx, func(tx neo4j.ManagedTransaction) (any, error) {
-			_, err := tx.Run(ctx, "CREATE (n:MastodonNode {url: $url})", map[string]any{"url": node})
-			return nil, err
+	// Keep the name an earlier run found if this one has none
+	if r.ASN != nil && r.ASOrg != nil {
+		props = append(props, Properties{
+			Node:   AutonomousSystem(*r.ASN),
+			Values: map[string]any{"name": *r.ASOrg},
 		})
-		if err != nil {
-			panic(err)
-		}
-		fmt.Println("Created node", node)
+	}
+	return props
+}
+
+// InstanceValues returns the collected facts of an instance as node
+// properties, nil for the facts that are missing
+func InstanceValues(r storage.InstanceRecord) map[string]any {
+	// ASN 0 means the IP was not found in the ASN database
+	if r.ASN != nil && *r.ASN == 0 {
+		r.ASN = nil
+	}
+	return map[string]any{
+		"software":       nullable(r.Software),
+		"ip":             nullable(r.IP),
+		"asn":            nullable(r.ASN),
+		"country_code":   nullable(r.CountryCode),
+		"user_count":     nullable(r.UserCount),
+		"post_count":     nullable(r.PostCount),
+		"cloud_provider": nullable(r.CloudProvider),
 	}
 }
 
-func ImportPeerRelationships() {
+// nullable turns a nullable column into a property value, nil for NULL
+func nullable[T any](p *T) any {
+	if p == nil {
+		return nil
+	}
+	return *p
+}
+
+// Init creates a MastodonNode for every processed node in the configured
+// sink. Nodes are upserted on their url, so it can be rerun against a graph
+// that already holds them.
+func Init(cfg *config.Config) error {
 	ctx := context.Background()
-	dbUri := "neo4j://localhost:7687"
-	dbUser := "neo4j"
-	dbPassword := "mastodonpaper"
 
-	driver, err := neo4j.NewDriverWithContext(
-		dbUri,
-		neo4j.BasicAuth(dbUser, dbPassword, ""))
+	nodes, err := os.ReadFile(cfg.Paths.ProcessedNodes)
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("error reading %s: %w", cfg.Paths.ProcessedNodes, err)
 	}
-	defer driver.Close(ctx)
 
-	err = driver.VerifyConnectivity(ctx)
+	var nodesList []string
+	err = json.Unmarshal(nodes, &nodesList)
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("error unmarshalling %s: %w", cfg.Paths.ProcessedNodes, err)
 	}
-	fmt.Println("Neo4j connection established.")
-
-	session := driver.NewSession(ctx, neo4j.SessionConfig{AccessMode: neo4j.AccessModeWrite})
-	defer session.Close(ctx)
-
-	// Create constraint for unique domain names
-	_, err = session.ExecuteWrite(ctx, func(tx neo4j.ManagedTransaction) (any, error) {
-		_, err := tx.Run(ctx,
-			"CREATE CONSTRAINT domain_name IF NOT EXISTS FOR (d:MastodonNode) REQUIRE d.url IS UNIQUE;",
-			nil)
-		return nil, err
-	})
+
+	sink, err := Open(ctx, cfg)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	fmt.Println("Created unique constraint on MastodonNode urls")
-
-	// Import CSV and create relationships
-	_, err = session.ExecuteWrite(ctx, func(tx neo4j.ManagedTransaction) (any, error) {
-		result, err := tx.Run(ctx, `
-			LOAD CSV WITH HEADERS FROM 'file:///domain_peers.csv' AS row
-			MERGE (domain:MastodonNode {url: row.domain})
-			MERGE (peer:MastodonNode {url: row.peer})
-			MERGE (domain)-[:PEERS_WITH]->(peer)
-			RETURN count(*) as relationships`,
-			nil)
-		if err != nil {
-			return nil, err
-		}
+	defer sink.Close(ctx)
 
-		record, err := result.Single(ctx)
-		if err != nil {
-			return nil, err
+	for start := 0; start < len(nodesList); start += cfg.Neo4j.BatchSize {
+		end := min(start+cfg.Neo4j.BatchSize, len(nodesList))
+		refs := make([]NodeRef, 0, end-start)
+		for _, node := range nodesList[start:end] {
+			refs = append(refs, Instance(node))
+		}
+		if err := sink.UpsertNodes(ctx, refs); err != nil {
+			return fmt.Errorf("error writing nodes: %w", err)
 		}
+		fmt.Printf("Merged %d/%d nodes\n", end, len(nodesList))
+	}
 
-		count := record.Values[0].(int64)
-		fmt.Printf("Created %d peer relationships\n", count)
-		return nil, nil
-	})
-	if err != nil {
-		panic(err)
+	if err := sink.Flush(ctx); err != nil {
+		return fmt.Errorf("error writing nodes: %w", err)
 	}
+	return nil
 }
@@ -0,0 +1,150 @@
+package graph
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+)
+
+// graphML writes the graph as GraphML. Every node carries its label and
+// properties as data; every edge carries its relationship type.
+type graphML struct{}
+
+type graphMLFile struct {
+	XMLName xml.Name     `xml:"graphml"`
+	XMLNS   string       `xml:"xmlns,attr"`
+	Keys    []graphMLKey `xml:"key"`
+	Graph   graphMLGraph `xml:"graph"`
+}
+
+type graphMLKey struct {
+	ID   string `xml:"id,attr"`
+	For  string `xml:"for,attr"`
+	Name string `xml:"attr.name,attr"`
+	Type string `xml:"attr.type,attr"`
+}
+
+type graphMLGraph struct {
+	ID          string        `xml:"id,attr"`
+	EdgeDefault string        `xml:"edgedefault,attr"`
+	Nodes       []graphMLNode `xml:"node"`
+	Edges       []graphMLEdge `xml:"edge"`
+}
+
+type graphMLNode struct {
+	ID   string        `xml:"id,attr"`
+	Data []graphMLData `xml:"data"`
+}
+
+type graphMLEdge struct {
+	Source string        `xml:"source,attr"`
+	Target string        `xml:"target,attr"`
+	Data   []graphMLData `xml:"data"`
+}
+
+type graphMLData struct {
+	Key   string `xml:"key,attr"`
+	Value string `xml:",chardata"`
+}
+
+func (graphML) write(w io.Writer, g *memGraph) error {
+	f := graphMLFile{
+		XMLNS: "http://graphml.graphdrawing.org/xmlns",
+		Graph: graphMLGraph{ID: "fediverse", EdgeDefault: "directed"},
+	}
+
+	types := g.attributeTypes()
+	for _, name := range slices.Sorted(maps.Keys(types)) {
+		f.Keys = append(f.Keys, graphMLKey{ID: "node_" + name, For: "node", Name: name, Type: types[name]})
+	}
+	f.Keys = append(f.Keys, graphMLKey{ID: "edge_type", For: "edge", Name: "type", Type: "string"})
+
+	for _, n := range g.sortedNodes() {
+		node := graphMLNode{ID: nodeID(n), Data: []graphMLData{{Key: "node_label", Value: n.Label}}}
+		props := g.properties(n)
+		for _, name := range slices.Sorted(maps.Keys(props)) {
+			node.Data = append(node.Data, graphMLData{Key: "node_" + name, Value: formatValue(props[name])})
+		}
+		f.Graph.Nodes = append(f.Graph.Nodes, node)
+	}
+	for _, e := range g.sortedEdges() {
+		f.Graph.Edges = append(f.Graph.Edges, graphMLEdge{
+			Source: nodeID(e.From),
+			Target: nodeID(e.To),
+			Data:   []graphMLData{{Key: "edge_type", Value: e.Type}},
+		})
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(f); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+func (graphML) read(r io.Reader) (*memGraph, error) {
+	var f graphMLFile
+	if err := xml.NewDecoder(r).Decode(&f); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]graphMLKey)
+	for _, k := range f.Keys {
+		keys[k.ID] = k
+	}
+
+	g := newMemGraph()
+	ids := make(map[string]NodeRef)
+	for _, node := range f.Graph.Nodes {
+		var label string
+		props := make(map[string]any)
+		for _, d := range node.Data {
+			k, ok := keys[d.Key]
+			if !ok {
+				return nil, fmt.Errorf("node %s: undeclared key %q", node.ID, d.Key)
+			}
+			if k.Name == "label" {
+				label = d.Value
+				continue
+			}
+			v, err := parseValue(d.Value, k.Type)
+			if err != nil {
+				return nil, fmt.Errorf("node %s: %s: %w", node.ID, k.Name, err)
+			}
+			props[k.Name] = v
+		}
+		n, err := g.addNode(label, props)
+		if err != nil {
+			return nil, fmt.Errorf("node %s: %w", node.ID, err)
+		}
+		ids[node.ID] = n
+	}
+
+	for _, edge := range f.Graph.Edges {
+		var typ string
+		for _, d := range edge.Data {
+			if keys[d.Key].Name == "type" {
+				typ = d.Value
+			}
+		}
+		from, ok := ids[edge.Source]
+		if !ok {
+			return nil, fmt.Errorf("edge from unknown node %s", edge.Source)
+		}
+		to, ok := ids[edge.Target]
+		if !ok {
+			return nil, fmt.Errorf("edge to unknown node %s", edge.Target)
+		}
+		if err := g.upsertEdge(Edge{From: from, Type: typ, To: to}); err != nil {
+			return nil, err
+		}
+	}
+	return g, nil
+}
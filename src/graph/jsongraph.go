@@ -0,0 +1,96 @@
+package graph
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// jsonGraph writes the graph in the JSON Graph Format
+// (https://jsongraphformat.info), with node properties as metadata
+type jsonGraph struct{}
+
+type jgfFile struct {
+	Graph jgfGraph `json:"graph"`
+}
+
+type jgfGraph struct {
+	Directed bool               `json:"directed"`
+	Nodes    map[string]jgfNode `json:"nodes"`
+	Edges    []jgfEdge          `json:"edges"`
+}
+
+type jgfNode struct {
+	Label    string         `json:"label"`
+	Metadata map[string]any `json:"metadata"`
+}
+
+type jgfEdge struct {
+	Source   string `json:"source"`
+	Target   string `json:"target"`
+	Relation string `json:"relation"`
+}
+
+func (jsonGraph) write(w io.Writer, g *memGraph) error {
+	f := jgfFile{Graph: jgfGraph{
+		Directed: true,
+		Nodes:    make(map[string]jgfNode, len(g.nodes)),
+		Edges:    []jgfEdge{},
+	}}
+	for n := range g.nodes {
+		f.Graph.Nodes[nodeID(n)] = jgfNode{Label: n.Label, Metadata: g.properties(n)}
+	}
+	for _, e := range g.sortedEdges() {
+		f.Graph.Edges = append(f.Graph.Edges, jgfEdge{Source: nodeID(e.From), Target: nodeID(e.To), Relation: e.Type})
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(f)
+}
+
+func (jsonGraph) read(r io.Reader) (*memGraph, error) {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	var f jgfFile
+	if err := dec.Decode(&f); err != nil {
+		return nil, err
+	}
+
+	g := newMemGraph()
+	ids := make(map[string]NodeRef)
+	for id, node := range f.Graph.Nodes {
+		props := make(map[string]any, len(node.Metadata))
+		for name, v := range node.Metadata {
+			// Numbers keep the int64 type of counts and ASNs
+			if num, ok := v.(json.Number); ok {
+				if i, err := num.Int64(); err == nil {
+					v = i
+				} else if v, err = num.Float64(); err != nil {
+					return nil, fmt.Errorf("node %s: %s: %w", id, name, err)
+				}
+			}
+			props[name] = v
+		}
+		n, err := g.addNode(node.Label, props)
+		if err != nil {
+			return nil, fmt.Errorf("node %s: %w", id, err)
+		}
+		ids[id] = n
+	}
+
+	for _, edge := range f.Graph.Edges {
+		from, ok := ids[edge.Source]
+		if !ok {
+			return nil, fmt.Errorf("edge from unknown node %s", edge.Source)
+		}
+		to, ok := ids[edge.Target]
+		if !ok {
+			return nil, fmt.Errorf("edge to unknown node %s", edge.Target)
+		}
+		if err := g.upsertEdge(Edge{From: from, Type: edge.Relation, To: to}); err != nil {
+			return nil, err
+		}
+	}
+	return g, nil
+}
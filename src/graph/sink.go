@@ -0,0 +1,91 @@
+package graph
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/kothavade/mastodon-paper/config"
+)
+
+// NodeRef identifies a node by its label and the value of the label's key
+// property, a string or an int64
+type NodeRef struct {
+	Label string
+	Key   any
+}
+
+// Edge is a relationship of Type from one node to another
+type Edge struct {
+	From NodeRef
+	Type string
+	To   NodeRef
+}
+
+// Properties are values to set on a node; a nil value removes the property.
+// Links replaces the node's outgoing relationships of every type it lists with
+// relationships to the given nodes, so an empty list removes them.
+type Properties struct {
+	Node   NodeRef
+	Values map[string]any
+	Links  map[string][]NodeRef
+}
+
+// Sink receives the graph from the commands that build it. Every write is an
+// upsert, so writing the same data twice leaves the graph unchanged. Writes
+// may be buffered until Flush.
+type Sink interface {
+	// UpsertNodes creates the nodes that do not exist yet
+	UpsertNodes(ctx context.Context, nodes []NodeRef) error
+	// UpsertEdges creates the edges, and the nodes they connect, that do not
+	// exist yet
+	UpsertEdges(ctx context.Context, edges []Edge) error
+	// SetProperties sets properties and links on nodes, creating missing ones
+	SetProperties(ctx context.Context, props []Properties) error
+	// Flush writes everything buffered so far
+	Flush(ctx context.Context) error
+	// Close releases the sink without flushing it
+	Close(ctx context.Context) error
+}
+
+// Open returns the sink cfg.Graph.Sink selects. Database sinks connect with
+// the neo4j settings and create the schema; file sinks load the graph already
+// in their output file so that commands can add to it one after another.
+func Open(ctx context.Context, cfg *config.Config) (Sink, error) {
+	switch cfg.Graph.Sink {
+	case "neo4j":
+		return openBolt(ctx, cfg, neo4jDialect)
+	case "memgraph":
+		return openBolt(ctx, cfg, memgraphDialect)
+	}
+	f, ok := formats[cfg.Graph.Sink]
+	if !ok {
+		return nil, fmt.Errorf("unknown graph sink %q", cfg.Graph.Sink)
+	}
+	return openFile(OutputPath(cfg), f)
+}
+
+// formats are the file formats a graph can be written in
+var formats = map[string]format{
+	"graphml": graphML{},
+	"gexf":    gexf{},
+	"json":    jsonGraph{},
+}
+
+// Create returns a file sink that writes a new graph to path in the format
+// (graphml, gexf or json), replacing the file on Flush
+func Create(path, formatName string) (Sink, error) {
+	f, ok := formats[formatName]
+	if !ok {
+		return nil, fmt.Errorf("unknown graph format %q", formatName)
+	}
+	return &fileSink{path: path, format: f, graph: newMemGraph()}, nil
+}
+
+// OutputPath returns the file a file sink writes: graph.output, or
+// graph.<sink> if it is empty
+func OutputPath(cfg *config.Config) string {
+	if cfg.Graph.Output != "" {
+		return cfg.Graph.Output
+	}
+	return "graph." + cfg.Graph.Sink
+}
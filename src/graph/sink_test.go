@@ -0,0 +1,95 @@
+package graph
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kothavade/mastodon-paper/config"
+	"github.com/kothavade/mastodon-paper/fedtest"
+	"github.com/kothavade/mastodon-paper/storage"
+)
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+// write runs one command's worth of writes through a sink opened on cfg
+func write(t *testing.T, cfg *config.Config, fn func(ctx context.Context, sink Sink) error) {
+	t.Helper()
+	ctx := context.Background()
+	sink, err := Open(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close(ctx)
+	if err := fn(ctx, sink); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileSinks(t *testing.T) {
+	alpha := storage.InstanceRecord{
+		Domain: "alpha.test", Software: ptr("mastodon"), IP: ptr("8.8.8.8"), ASN: ptr(int64(15169)),
+		ASOrg: ptr("GOOGLE"), CountryCode: ptr("US"), UserCount: ptr(int64(120)), PostCount: ptr(int64(4500)),
+		CloudProvider: ptr("GCP"),
+	}
+	beta := storage.InstanceRecord{
+		Domain: "beta.test", Software: ptr("pleroma"), IP: ptr("1.1.1.1"), ASN: ptr(int64(0)),
+		CountryCode: ptr("AU"), UserCount: ptr(int64(15)),
+	}
+
+	for _, sink := range []string{"graphml", "gexf", "json"} {
+		t.Run(sink, func(t *testing.T) {
+			cfg := config.Default()
+			cfg.Graph.Sink = sink
+			cfg.Graph.Output = filepath.Join(t.TempDir(), "graph."+sink)
+
+			// graph-init, injest and injest_data, each run twice
+			for range 2 {
+				write(t, cfg, func(ctx context.Context, s Sink) error {
+					return s.UpsertNodes(ctx, []NodeRef{Instance("alpha.test"), Instance("beta.test")})
+				})
+				write(t, cfg, func(ctx context.Context, s Sink) error {
+					return s.UpsertEdges(ctx, []Edge{
+						PeerEdge("alpha.test", "beta.test"),
+						PeerEdge("beta.test", "alpha.test"),
+						PeerEdge("beta.test", "gamma.test"),
+					})
+				})
+				write(t, cfg, func(ctx context.Context, s Sink) error {
+					return s.SetProperties(ctx, append(InstanceProperties(alpha), InstanceProperties(beta)...))
+				})
+			}
+
+			// A later run moved alpha and lost its cloud provider and post count
+			moved := alpha
+			moved.CountryCode = ptr("DE")
+			moved.CloudProvider = nil
+			moved.PostCount = nil
+			write(t, cfg, func(ctx context.Context, s Sink) error {
+				return s.SetProperties(ctx, InstanceProperties(moved))
+			})
+
+			got, err := os.ReadFile(cfg.Graph.Output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fedtest.Golden(t, "sink."+sink, string(got))
+
+			// Reading the file back and writing it again changes nothing
+			write(t, cfg, func(ctx context.Context, s Sink) error { return nil })
+			again, err := os.ReadFile(cfg.Graph.Output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(again) != string(got) {
+				t.Errorf("rewriting %s changed it:\n%s", cfg.Graph.Output, again)
+			}
+		})
+	}
+}
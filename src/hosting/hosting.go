@@ -0,0 +1,321 @@
+// Package hosting classifies who hosts an instance and which CDN, if any,
+// sits in front of it. Evidence comes from a table of providers matched
+// against the AS of every address, the instance domain, its CNAME chain and
+// its response headers, and from published IP range files.
+package hosting
+
+import (
+	_ "embed"
+	"fmt"
+	"math"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/kothavade/mastodon-paper/config"
+	"github.com/kothavade/mastodon-paper/storage"
+)
+
+// builtinProviders is the provider table used before any configured one
+//
+//go:embed data/providers.toml
+var builtinProviders []byte
+
+// Provider kinds. CDNs sit in front of an origin, the others host it.
+const (
+	KindCDN     = "cdn"
+	KindCloud   = "cloud"
+	KindManaged = "managed"
+)
+
+// Evidence sources
+const (
+	SourceRange  = "range"
+	SourceASN    = "asn"
+	SourceOrg    = "org"
+	SourceDomain = "domain"
+	SourceCNAME  = "cname"
+	SourceHeader = "header"
+)
+
+// confidence is how sure one match from each source makes the classifier.
+// AS organisation names are matched by substring, so they count least.
+var confidence = map[string]float64{
+	SourceRange:  0.95,
+	SourceASN:    0.9,
+	SourceDomain: 0.9,
+	SourceCNAME:  0.9,
+	SourceHeader: 0.8,
+	SourceOrg:    0.6,
+}
+
+// addressSources are the sources that describe an address rather than the
+// instance. Behind a CDN the addresses are the CDN's, so they say nothing
+// about the origin.
+var addressSources = []string{SourceRange, SourceASN, SourceOrg}
+
+// Provider is one entry of a provider table
+type Provider struct {
+	Name string `toml:"name"`
+	Kind string `toml:"kind"`
+	ASNs []uint `toml:"asns"`
+	// Orgs are matched as substrings of the AS organisation, ignoring case,
+	// for ASes the table does not list
+	Orgs []string `toml:"orgs"`
+	// Domains are matched as suffixes of the instance domain and of the
+	// targets of its CNAME chain
+	Domains []string `toml:"domains"`
+	// Headers are header names, or "name: value" where value is a
+	// substring of the header value, ignoring case
+	Headers []string `toml:"headers"`
+}
+
+// providerTable is the layout of a provider table file
+type providerTable struct {
+	Providers []Provider `toml:"provider"`
+}
+
+// rangeFile is a published range file that was loaded
+type rangeFile struct {
+	provider, path string
+	prefixes       int
+}
+
+// Classifier classifies the hosting of instances. It is safe for
+// concurrent use once loaded.
+type Classifier struct {
+	providers []*Provider
+	byASN     map[uint]*Provider
+	ranges    *prefixTable
+	tables    []string
+	files     []rangeFile
+}
+
+// Observation is what is known about an instance when it is classified
+type Observation struct {
+	Domain    string
+	Addresses []storage.Address
+	// CNAMEs are the targets of the domain's CNAME chain
+	CNAMEs []string
+	// Header holds the headers of a response from the instance
+	Header http.Header
+}
+
+// Load reads the built-in provider table, the tables and range files cfg
+// lists, and checks them, so a missing or wrong file is reported before the
+// crawl starts
+func Load(cfg config.HostingConfig) (*Classifier, error) {
+	c := &Classifier{byASN: make(map[uint]*Provider), ranges: newPrefixTable()}
+	if err := c.addTable(builtinProviders, "built-in"); err != nil {
+		return nil, err
+	}
+	for _, path := range cfg.Providers {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("hosting.providers: %w", err)
+		}
+		if err := c.addTable(data, path); err != nil {
+			return nil, fmt.Errorf("hosting.providers: %w", err)
+		}
+	}
+
+	for _, p := range c.providers {
+		for _, asn := range p.ASNs {
+			if other, ok := c.byASN[asn]; ok {
+				return nil, fmt.Errorf("AS%d is listed for both %s and %s", asn, other.Name, p.Name)
+			}
+			c.byASN[asn] = p
+		}
+	}
+
+	for _, spec := range cfg.Ranges {
+		if err := c.addRanges(spec); err != nil {
+			return nil, fmt.Errorf("hosting.ranges: %w", err)
+		}
+	}
+	return c, nil
+}
+
+// addTable adds the providers of a table; a provider with the name of one
+// already known replaces it
+func (c *Classifier) addTable(data []byte, name string) error {
+	var table providerTable
+	md, err := toml.Decode(string(data), &table)
+	if err != nil {
+		return fmt.Errorf("%s provider table: %w", name, err)
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		return fmt.Errorf("%s provider table: unknown key %s", name, undecoded[0])
+	}
+	for _, p := range table.Providers {
+		if p.Name == "" {
+			return fmt.Errorf("%s provider table: a provider has no name", name)
+		}
+		if !slices.Contains([]string{KindCDN, KindCloud, KindManaged}, p.Kind) {
+			return fmt.Errorf("%s provider table: %s has kind %q, want cdn, cloud or managed", name, p.Name, p.Kind)
+		}
+		if i := slices.IndexFunc(c.providers, func(q *Provider) bool { return q.Name == p.Name }); i >= 0 {
+			c.providers[i] = &p
+		} else {
+			c.providers = append(c.providers, &p)
+		}
+	}
+	c.tables = append(c.tables, name)
+	return nil
+}
+
+// addRanges loads a range file given as provider=path
+func (c *Classifier) addRanges(spec string) error {
+	name, path, ok := strings.Cut(spec, "=")
+	if !ok || name == "" || path == "" {
+		return fmt.Errorf("%q is not provider=path", spec)
+	}
+	i := slices.IndexFunc(c.providers, func(p *Provider) bool { return strings.EqualFold(p.Name, name) })
+	if i < 0 {
+		return fmt.Errorf("%s: unknown provider %q, add it to a hosting.providers table", path, name)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	prefixes := parseRanges(data)
+	if len(prefixes) == 0 {
+		return fmt.Errorf("%s has no IP prefixes", path)
+	}
+	for _, prefix := range prefixes {
+		c.ranges.add(prefix, c.providers[i])
+	}
+	c.files = append(c.files, rangeFile{provider: c.providers[i].Name, path: path, prefixes: len(prefixes)})
+	return nil
+}
+
+// Describe returns one line about the provider tables and every range file
+func (c *Classifier) Describe() []string {
+	lines := []string{fmt.Sprintf("providers: %d from %s", len(c.providers), strings.Join(c.tables, ", "))}
+	for _, f := range c.files {
+		lines = append(lines, fmt.Sprintf("ranges: %s, %d prefixes from %s", f.provider, f.prefixes, f.path))
+	}
+	if len(c.files) == 0 {
+		lines = append(lines, "ranges: no files, addresses are matched by AS only")
+	}
+	return lines
+}
+
+// Classify concludes who hosts an instance and which CDN sits in front of
+// it, "" if unknown, with every piece of evidence found. The confidence in
+// a provider combines its evidence as 1 - (1-c1)(1-c2)...; the most likely
+// provider of each role wins.
+func (c *Classifier) Classify(obs Observation) (storage.Hosting, []storage.HostingEvidence) {
+	var evidence []storage.HostingEvidence
+	add := func(p *Provider, source, detail string) {
+		e := storage.HostingEvidence{
+			Role: storage.RoleOrigin, Provider: p.Name, Source: source, Detail: detail, Confidence: confidence[source],
+		}
+		if p.Kind == KindCDN {
+			e.Role = storage.RoleCDN
+		}
+		if !slices.Contains(evidence, e) {
+			evidence = append(evidence, e)
+		}
+	}
+
+	for _, a := range obs.Addresses {
+		if addr, err := netip.ParseAddr(a.IP); err == nil {
+			if p, prefix, ok := c.ranges.lookup(addr); ok {
+				add(p, SourceRange, fmt.Sprintf("%s in %s", a.IP, prefix))
+			}
+		}
+		if p, ok := c.byASN[a.ASN]; ok && a.ASN != 0 {
+			add(p, SourceASN, fmt.Sprintf("%s in AS%d", a.IP, a.ASN))
+		} else if p := c.matchOrg(a.ASOrg); p != nil {
+			add(p, SourceOrg, fmt.Sprintf("%s in %s", a.IP, a.ASOrg))
+		}
+	}
+	for _, p := range c.providers {
+		for _, suffix := range p.Domains {
+			if underDomain(obs.Domain, suffix) {
+				add(p, SourceDomain, obs.Domain)
+			}
+			for _, target := range obs.CNAMEs {
+				if underDomain(target, suffix) {
+					add(p, SourceCNAME, target)
+				}
+			}
+		}
+		for _, spec := range p.Headers {
+			if header, ok := matchHeader(obs.Header, spec); ok {
+				add(p, SourceHeader, header)
+			}
+		}
+	}
+
+	var h storage.Hosting
+	h.CDN, h.CDNConfidence = best(evidence, storage.RoleCDN, nil)
+	var ignore []string
+	if h.CDN != "" {
+		ignore = addressSources
+	}
+	h.Provider, h.Confidence = best(evidence, storage.RoleOrigin, ignore)
+	return h, evidence
+}
+
+// matchOrg returns the first provider one of whose organisation substrings
+// org contains
+func (c *Classifier) matchOrg(org string) *Provider {
+	if org == "" {
+		return nil
+	}
+	org = strings.ToLower(org)
+	for _, p := range c.providers {
+		for _, sub := range p.Orgs {
+			if strings.Contains(org, strings.ToLower(sub)) {
+				return p
+			}
+		}
+	}
+	return nil
+}
+
+// best returns the provider of role the evidence is most confident in, and
+// that confidence rounded to two decimals. Evidence from the ignored
+// sources does not count.
+func best(evidence []storage.HostingEvidence, role string, ignore []string) (string, float64) {
+	doubt := make(map[string]float64)
+	for _, e := range evidence {
+		if e.Role != role || slices.Contains(ignore, e.Source) {
+			continue
+		}
+		if _, ok := doubt[e.Provider]; !ok {
+			doubt[e.Provider] = 1
+		}
+		doubt[e.Provider] *= 1 - e.Confidence
+	}
+
+	provider, lowest := "", 1.0
+	for name, d := range doubt {
+		if d < lowest || (d == lowest && name < provider) {
+			provider, lowest = name, d
+		}
+	}
+	return provider, math.Round((1-lowest)*100) / 100
+}
+
+// underDomain reports whether name is domain or one of its subdomains
+func underDomain(name, domain string) bool {
+	return name == domain || strings.HasSuffix(name, "."+domain)
+}
+
+// matchHeader returns the header matching spec, formatted as "name: value"
+func matchHeader(header http.Header, spec string) (string, bool) {
+	name, want, _ := strings.Cut(spec, ":")
+	name, want = strings.TrimSpace(name), strings.ToLower(strings.TrimSpace(want))
+	for _, value := range header.Values(name) {
+		if strings.Contains(strings.ToLower(value), want) {
+			return strings.ToLower(name) + ": " + value, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,169 @@
+package hosting
+
+import (
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kothavade/mastodon-paper/config"
+	"github.com/kothavade/mastodon-paper/storage"
+)
+
+// writeFile writes content to name in a temporary directory
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestClassify(t *testing.T) {
+	aws := writeFile(t, "ip-ranges.json", `{
+		"syncToken": "1747000000",
+		"prefixes": [{"ip_prefix": "3.5.140.0/22", "region": "ap-northeast-2", "service": "AMAZON"}],
+		"ipv6_prefixes": [{"ipv6_prefix": "2600:1f18::/33", "region": "us-east-1", "service": "AMAZON"}]
+	}`)
+	c, err := Load(config.HostingConfig{Ranges: []string{"aws=" + aws}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name string
+		obs  Observation
+		want storage.Hosting
+	}{
+		{
+			"range beats the AS organisation",
+			Observation{Domain: "a.example", Addresses: []storage.Address{
+				{IP: "3.5.141.7", ASOrg: "Hetzner Online GmbH"},
+				{IP: "2600:1f18:4000::1"},
+			}},
+			storage.Hosting{Provider: "AWS", Confidence: 1},
+		},
+		{
+			"AS organisation fallback",
+			Observation{Domain: "b.example", Addresses: []storage.Address{{IP: "192.0.2.1", ASN: 64500, ASOrg: "OVH SAS"}}},
+			storage.Hosting{Provider: "OVH", Confidence: 0.6},
+		},
+		{
+			"CDN hides the addresses' provider",
+			Observation{
+				Domain:    "c.example",
+				Addresses: []storage.Address{{IP: "192.0.2.2", ASN: 16509, ASOrg: "AMAZON-02"}},
+				Header:    http.Header{"X-Amz-Cf-Id": {"abc"}, "Via": {"1.1 f00.cloudfront.net (CloudFront)"}},
+			},
+			storage.Hosting{CDN: "CloudFront", CDNConfidence: 0.96},
+		},
+		{
+			"CDN in front of managed hosting",
+			Observation{
+				Domain:    "d.example",
+				Addresses: []storage.Address{{IP: "192.0.2.3", ASN: 13335}},
+				CNAMEs:    []string{"d.masto.host"},
+			},
+			storage.Hosting{Provider: "masto.host", Confidence: 0.9, CDN: "Cloudflare", CDNConfidence: 0.9},
+		},
+		{
+			"nothing known",
+			Observation{Domain: "e.example", Addresses: []storage.Address{{IP: "192.0.2.4"}}},
+			storage.Hosting{},
+		},
+	} {
+		got, evidence := c.Classify(test.obs)
+		if got != test.want {
+			t.Errorf("%s: got %+v, want %+v from %+v", test.name, got, test.want, evidence)
+		}
+	}
+}
+
+func TestParseRanges(t *testing.T) {
+	for _, test := range []struct {
+		name, data string
+		want       []string
+	}{
+		{"gcp", `{"prefixes": [{"ipv4Prefix": "34.1.208.0/20", "scope": "africa-south1"}, {"ipv6Prefix": "2600:1900:8000::/44"}]}`,
+			[]string{"34.1.208.0/20", "2600:1900:8000::/44"}},
+		{"cloudflare", "173.245.48.0/20\n103.21.244.0/22\n", []string{"173.245.48.0/20", "103.21.244.0/22"}},
+		{"geofeed", "# prefix,country,region,city\n5.101.96.0/21,NL,NL-NH,Amsterdam,\n2a03:b0c0::/32,US,,,\n",
+			[]string{"5.101.96.0/21", "2a03:b0c0::/32"}},
+		{"addresses", "192.0.2.7 host\n", []string{"192.0.2.7/32"}},
+	} {
+		var got []string
+		for _, prefix := range parseRanges([]byte(test.data)) {
+			got = append(got, prefix.String())
+		}
+		if strings.Join(got, " ") != strings.Join(test.want, " ") {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestPrefixTable(t *testing.T) {
+	outer, inner := &Provider{Name: "outer"}, &Provider{Name: "inner"}
+	table := newPrefixTable()
+	table.add(netip.MustParsePrefix("10.0.0.0/8"), outer)
+	table.add(netip.MustParsePrefix("10.1.2.0/24"), inner)
+
+	for addr, want := range map[string]string{"10.1.2.3": "inner", "10.1.3.1": "outer", "::ffff:10.1.2.3": "inner", "11.0.0.1": ""} {
+		got := ""
+		if p, _, ok := table.lookup(netip.MustParseAddr(addr)); ok {
+			got = p.Name
+		}
+		if got != want {
+			t.Errorf("%s: got %q, want %q", addr, got, want)
+		}
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	empty := writeFile(t, "empty.txt", "# nothing here\n")
+	badKind := writeFile(t, "providers.toml", "[[provider]]\n  name = \"Example\"\n  kind = \"isp\"\n")
+	typo := writeFile(t, "typo.toml", "[[provider]]\n  name = \"Example\"\n  kind = \"cloud\"\n  asn = [64500]\n")
+	clash := writeFile(t, "clash.toml", "[[provider]]\n  name = \"Example\"\n  kind = \"cloud\"\n  asns = [24940]\n")
+
+	for _, test := range []struct {
+		cfg  config.HostingConfig
+		want string
+	}{
+		{config.HostingConfig{Ranges: []string{"aws"}}, `"aws" is not provider=path`},
+		{config.HostingConfig{Ranges: []string{"Nowhere=" + empty}}, `unknown provider "Nowhere"`},
+		{config.HostingConfig{Ranges: []string{"AWS=" + empty}}, "has no IP prefixes"},
+		{config.HostingConfig{Ranges: []string{"AWS=" + filepath.Join(t.TempDir(), "missing.json")}}, "no such file"},
+		{config.HostingConfig{Providers: []string{badKind}}, `has kind "isp"`},
+		{config.HostingConfig{Providers: []string{typo}}, "unknown key provider.asn"},
+		{config.HostingConfig{Providers: []string{clash}}, "AS24940 is listed for both Hetzner and Example"},
+	} {
+		_, err := Load(test.cfg)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%+v: got %v, want an error containing %q", test.cfg, err, test.want)
+		}
+	}
+}
+
+func TestProviderOverride(t *testing.T) {
+	table := writeFile(t, "providers.toml", `
+[[provider]]
+  name = "Hetzner"
+  kind = "cloud"
+  asns = [64512]
+
+[[provider]]
+  name = "Example Host"
+  kind = "managed"
+  domains = ["example.social"]
+`)
+	c, err := Load(config.HostingConfig{Providers: []string{table}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := c.Classify(Observation{Domain: "x.example.social", Addresses: []storage.Address{{IP: "192.0.2.1", ASN: 24940}}})
+	if want := (storage.Hosting{Provider: "Example Host", Confidence: 0.9}); got != want {
+		t.Errorf("got %+v, want %+v: Hetzner's AS should have been replaced", got, want)
+	}
+}
@@ -0,0 +1,103 @@
+package hosting
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// prefixTable finds the provider whose published range holds an address,
+// by longest prefix match
+type prefixTable struct {
+	// bits lists the prefix lengths in the table, longest first
+	bits     []int
+	prefixes map[netip.Prefix]*Provider
+}
+
+func newPrefixTable() *prefixTable {
+	return &prefixTable{prefixes: make(map[netip.Prefix]*Provider)}
+}
+
+// add adds a prefix of provider. A prefix listed twice keeps its first
+// provider.
+func (t *prefixTable) add(prefix netip.Prefix, provider *Provider) {
+	prefix = prefix.Masked()
+	if _, ok := t.prefixes[prefix]; ok {
+		return
+	}
+	t.prefixes[prefix] = provider
+	if !slices.Contains(t.bits, prefix.Bits()) {
+		t.bits = append(t.bits, prefix.Bits())
+		slices.SortFunc(t.bits, func(a, b int) int { return b - a })
+	}
+}
+
+// lookup returns the provider and prefix of the longest prefix holding addr
+func (t *prefixTable) lookup(addr netip.Addr) (*Provider, netip.Prefix, bool) {
+	addr = addr.Unmap()
+	for _, bits := range t.bits {
+		if bits > addr.BitLen() {
+			continue
+		}
+		prefix, err := addr.Prefix(bits)
+		if err != nil {
+			continue
+		}
+		if provider, ok := t.prefixes[prefix]; ok {
+			return provider, prefix, true
+		}
+	}
+	return nil, netip.Prefix{}, false
+}
+
+// parseRanges returns the prefixes of a published range file. Every string
+// that is a prefix anywhere in a JSON file counts, which covers the AWS,
+// Google Cloud, Azure, Oracle and Fastly files; other files are read as
+// text with the prefix or address first on each line, as in Cloudflare's
+// lists and CSV geofeeds.
+func parseRanges(data []byte) []netip.Prefix {
+	var prefixes []netip.Prefix
+	var doc any
+	if json.Unmarshal(data, &doc) == nil {
+		walkStrings(doc, func(s string) {
+			if prefix, err := netip.ParsePrefix(s); err == nil {
+				prefixes = append(prefixes, prefix)
+			}
+		})
+		return prefixes
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.FieldsFunc(line, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' })
+		if len(fields) == 0 {
+			continue
+		}
+		if prefix, err := netip.ParsePrefix(fields[0]); err == nil {
+			prefixes = append(prefixes, prefix)
+		} else if addr, err := netip.ParseAddr(fields[0]); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+		}
+	}
+	return prefixes
+}
+
+// walkStrings calls fn with every string in a decoded JSON document
+func walkStrings(v any, fn func(string)) {
+	switch v := v.(type) {
+	case string:
+		fn(v)
+	case []any:
+		for _, item := range v {
+			walkStrings(item, fn)
+		}
+	case map[string]any:
+		for _, item := range v {
+			walkStrings(item, fn)
+		}
+	}
+}
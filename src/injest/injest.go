@@ -2,113 +2,121 @@ package injest
 
 import (
 	"context"
-	"database/sql"
-	"encoding/json"
 	"fmt"
-	"os"
 	"path/filepath"
 
-	_ "github.com/mattn/go-sqlite3"
-	"github.com/neo4j/neo4j-go-driver/v5/neo4j"
+	"github.com/kothavade/mastodon-paper/config"
+	"github.com/kothavade/mastodon-paper/csvfile"
+	"github.com/kothavade/mastodon-paper/filter"
+	"github.com/kothavade/mastodon-paper/graph"
+	"github.com/kothavade/mastodon-paper/storage"
 )
 
-const (
-	StatusPending    = "pending"
-	StatusProcessing = "processing"
-	StatusCompleted  = "completed"
-	StatusFailed     = "failed"
-)
+// Options controls which peer relationships are written
+type Options struct {
+	// AllPeers writes every reported peer instead of only peers running supported software
+	AllPeers bool
+	// CSV also writes the relationships to the peers CSV
+	CSV bool
+}
 
-func Injest() {
+// Injest streams the peer relationships of every processed node from the
+// database into the configured graph sink, cfg.Neo4j.BatchSize edges at a
+// time. Nodes and relationships are upserted, so rerunning it, including
+// after an interruption, does not create duplicates.
+func Injest(cfg *config.Config, opts Options) error {
 	ctx := context.Background()
 
-	dbUri := "neo4j://localhost:7687"
-	dbUser := "neo4j"
-	dbPassword := "mastodonpaper"
-
-	driver, err := neo4j.NewDriverWithContext(
-		dbUri,
-		neo4j.BasicAuth(dbUser, dbPassword, ""))
-	if err != nil {
-		panic(err)
-	}
-	defer driver.Close(ctx)
-
-	err = driver.VerifyConnectivity(ctx)
+	sink, err := graph.Open(ctx, cfg)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	fmt.Println("Neo4j connection established.")
-
-	session := driver.NewSession(ctx, neo4j.SessionConfig{AccessMode: neo4j.AccessModeWrite})
-	defer session.Close(ctx)
+	defer sink.Close(ctx)
 
-	db, err := sql.Open("sqlite3", "node_process.db?cache=shared")
+	store, err := storage.Open(cfg.Paths.DB)
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("failed to open database: %w", err)
 	}
-	defer db.Close()
+	defer store.Close()
 
-	// Get total count of nodes to process
-	var totalNodes int
-	err = db.QueryRow("SELECT COUNT(*) FROM process_nodes WHERE status = 'completed'").Scan(&totalNodes)
+	run, err := store.ActiveRun()
 	if err != nil {
-		panic(err)
+		return err
 	}
-	fmt.Printf("Found %d nodes to process\n", totalNodes)
+	fmt.Printf("Writing peers of crawl run %d\n", run.ID)
 
-	rows, err := db.Query("SELECT domain, peers FROM process_nodes WHERE status = 'completed'")
-	if err != nil {
-		panic(err)
+	peerSoftware := filter.SupportedSoftware()
+	if opts.AllPeers {
+		peerSoftware = nil
 	}
-	defer rows.Close()
 
-	// Create a CSV file for Neo4j import
-	csvPath := "domain_peers.csv"
-	csvFile, err := os.Create(csvPath)
+	totalEdges, err := store.CountPeerEdges(run.ID, storage.EdgeFilter{PeerSoftware: peerSoftware})
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("failed to count peer edges: %w", err)
 	}
-	defer csvFile.Close()
-
-	// Write CSV header
-	_, err = csvFile.WriteString("domain,peer\n")
-	if err != nil {
-		panic(err)
+	fmt.Printf("Found %d peer edges to write\n", totalEdges)
+
+	var csvFile *csvfile.Writer
+	if opts.CSV {
+		csvFile, err = csvfile.Create(cfg.Paths.PeersCSV, []csvfile.Column{
+			{Name: "domain", Type: csvfile.String, Required: true},
+			{Name: "peer", Type: csvfile.String, Required: true},
+		})
+		if err != nil {
+			return err
+		}
+		defer csvFile.Close()
 	}
 
-	i := 0
-	for rows.Next() {
-		var domain string
-		var peersJSON string
-		if err := rows.Scan(&domain, &peersJSON); err != nil {
-			fmt.Printf("Error scanning row: %v\n", err)
-			continue
+	written := 0
+	batch := make([]graph.Edge, 0, cfg.Neo4j.BatchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
 		}
-
-		var peers []string
-		if err := json.Unmarshal([]byte(peersJSON), &peers); err != nil {
-			fmt.Printf("Error unmarshalling peers for %s: %v\n", domain, err)
-			continue
+		if err := sink.UpsertEdges(ctx, batch); err != nil {
+			return fmt.Errorf("error writing peer edges: %w", err)
 		}
+		written += len(batch)
+		batch = batch[:0]
+		fmt.Printf("Wrote %d/%d edges\n", written, totalEdges)
+		return nil
+	}
 
-		// Write each domain-peer relationship to CSV
-		for _, peer := range peers {
-			_, err = csvFile.WriteString(fmt.Sprintf("%s,%s\n", domain, peer))
-			if err != nil {
-				fmt.Printf("Error writing to CSV: %v\n", err)
-				continue
+	err = store.EachPeerEdge(run.ID, storage.EdgeFilter{PeerSoftware: peerSoftware}, func(domain, peer string) error {
+		if csvFile != nil {
+			if err := csvFile.Write(domain, peer); err != nil {
+				return err
 			}
 		}
 
-		fmt.Printf("Wrote %s (%d/%d) to CSV\n", domain, i+1, totalNodes)
-		i++
+		batch = append(batch, graph.PeerEdge(domain, peer))
+		if len(batch) == cfg.Neo4j.BatchSize {
+			return flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
 	}
+	if err := flush(); err != nil {
+		return err
+	}
+	if err := sink.Flush(ctx); err != nil {
+		return fmt.Errorf("error writing peer edges: %w", err)
+	}
+	fmt.Printf("Merged %d peer edges into the %s graph\n", written, cfg.Graph.Sink)
 
-	absPath, err := filepath.Abs(csvPath)
-	if err != nil {
-		fmt.Printf("Error getting absolute path: %v\n", err)
-		absPath = csvPath
+	if csvFile != nil {
+		if err := csvFile.Close(); err != nil {
+			return err
+		}
+		absPath, err := filepath.Abs(cfg.Paths.PeersCSV)
+		if err != nil {
+			fmt.Printf("Error getting absolute path: %v\n", err)
+			absPath = cfg.Paths.PeersCSV
+		}
+		fmt.Printf("CSV file created at: %s (%d rows, %d skipped)\n", absPath, csvFile.Written, csvFile.Skipped)
 	}
-	fmt.Printf("CSV file created at: %s\n", absPath)
+	return nil
 }
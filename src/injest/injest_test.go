@@ -0,0 +1,100 @@
+package injest_test
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kothavade/mastodon-paper/fedtest"
+	"github.com/kothavade/mastodon-paper/filter"
+	"github.com/kothavade/mastodon-paper/injest"
+	"github.com/kothavade/mastodon-paper/process"
+	"github.com/kothavade/mastodon-paper/storage"
+)
+
+// jsonGraph is the part of the json sink's file the tests look at
+type jsonGraph struct {
+	Graph struct {
+		Edges []struct {
+			Source   string `json:"source"`
+			Target   string `json:"target"`
+			Relation string `json:"relation"`
+		} `json:"edges"`
+	} `json:"graph"`
+}
+
+func TestInjest(t *testing.T) {
+	instances := fedtest.Standard()
+	fedtest.Start(t, instances...)
+	cfg := fedtest.Config(t)
+	cfg.Graph.Sink = "json"
+	cfg.Graph.Output = filepath.Join(t.TempDir(), "graph.json")
+	// Far fewer than the edges, so they are written over several batches
+	cfg.Neo4j.BatchSize = 2
+	fedtest.WriteJSON(t, cfg.Paths.Nodes, fedtest.Domains(instances))
+
+	if err := filter.FilterNodes(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := process.ProcessNodes(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := storage.Open(cfg.Paths.DB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	run, err := store.ActiveRun()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := store.CountPeerEdges(run.ID, storage.EdgeFilter{PeerSoftware: filter.SupportedSoftware()})
+	store.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want <= cfg.Neo4j.BatchSize {
+		t.Fatalf("only %d peer edges, want more than the batch size", want)
+	}
+
+	if err := injest.Injest(cfg, injest.Options{}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(cfg.Graph.Output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fedtest.Golden(t, "injest", string(got))
+
+	var g jsonGraph
+	if err := json.Unmarshal(got, &g); err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[[2]string]bool)
+	for _, e := range g.Graph.Edges {
+		if e.Relation != "PEERS_WITH" {
+			continue
+		}
+		key := [2]string{e.Source, e.Target}
+		if seen[key] {
+			t.Errorf("edge %s -> %s written twice", e.Source, e.Target)
+		}
+		seen[key] = true
+	}
+	if len(seen) != want {
+		t.Errorf("wrote %d peer edges, want all %d", len(seen), want)
+	}
+
+	// Injesting into the same graph again merges into the edges already there
+	if err := injest.Injest(cfg, injest.Options{}); err != nil {
+		t.Fatal(err)
+	}
+	again, err := os.ReadFile(cfg.Graph.Output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(again) != string(got) {
+		t.Errorf("injesting twice changed the graph:\n%s", again)
+	}
+}
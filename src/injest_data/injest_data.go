@@ -2,105 +2,97 @@ package injest_data
 
 import (
 	"context"
-	"database/sql"
 	"fmt"
-	"os"
 	"path/filepath"
 
-	_ "github.com/mattn/go-sqlite3"
-	"github.com/neo4j/neo4j-go-driver/v5/neo4j"
+	"github.com/kothavade/mastodon-paper/config"
+	"github.com/kothavade/mastodon-paper/csvfile"
+	"github.com/kothavade/mastodon-paper/graph"
+	"github.com/kothavade/mastodon-paper/storage"
 )
 
-const (
-	StatusPending    = "pending"
-	StatusProcessing = "processing"
-	StatusCompleted  = "completed"
-	StatusFailed     = "failed"
-)
+// Options controls where the node data is written
+type Options struct {
+	// CSV also writes the node data to the data CSV
+	CSV bool
+}
 
-func InjestData() {
+// InjestData sets the collected info of every node as properties of its
+// MastodonNode in the configured graph sink, cfg.Neo4j.BatchSize nodes at a
+// time, and links the node to its Country, AutonomousSystem and CloudProvider
+func InjestData(cfg *config.Config, opts Options) error {
 	ctx := context.Background()
 
-	dbUri := "neo4j://localhost:7687"
-	dbUser := "neo4j"
-	dbPassword := "mastodonpaper"
-
-	driver, err := neo4j.NewDriverWithContext(
-		dbUri,
-		neo4j.BasicAuth(dbUser, dbPassword, ""))
+	sink, err := graph.Open(ctx, cfg)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	defer driver.Close(ctx)
+	defer sink.Close(ctx)
 
-	err = driver.VerifyConnectivity(ctx)
+	store, err := storage.Open(cfg.Paths.DB)
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("failed to open database: %w", err)
 	}
-	fmt.Println("Neo4j connection established.")
+	defer store.Close()
 
-	session := driver.NewSession(ctx, neo4j.SessionConfig{AccessMode: neo4j.AccessModeWrite})
-	defer session.Close(ctx)
-
-	db, err := sql.Open("sqlite3", "node_filter.db")
+	run, err := store.ActiveRun()
 	if err != nil {
-		panic(err)
+		return err
 	}
-	defer db.Close()
+	fmt.Printf("Writing node data of crawl run %d\n", run.ID)
 
-	// Get total count of nodes to process
-	var totalNodes int
-	err = db.QueryRow("SELECT COUNT(*) FROM node_info WHERE status = 'success'").Scan(&totalNodes)
+	records, err := store.InstancesWithStatus(run.ID, storage.StageCollectData, storage.StatusSuccess)
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("failed to query nodes: %w", err)
 	}
+	totalNodes := len(records)
 	fmt.Printf("Found %d nodes to process\n", totalNodes)
 
-	rows, err := db.Query("SELECT domain, ip, asn, country_code, user_count, post_count, cloud_provider FROM node_info WHERE status = 'success'")
-	if err != nil {
-		panic(err)
+	for start := 0; start < totalNodes; start += cfg.Neo4j.BatchSize {
+		end := min(start+cfg.Neo4j.BatchSize, totalNodes)
+		var props []graph.Properties
+		for _, r := range records[start:end] {
+			props = append(props, graph.InstanceProperties(r)...)
+		}
+		if err := sink.SetProperties(ctx, props); err != nil {
+			return fmt.Errorf("error writing node data: %w", err)
+		}
+		fmt.Printf("Wrote %d/%d nodes\n", end, totalNodes)
+	}
+	if err := sink.Flush(ctx); err != nil {
+		return fmt.Errorf("error writing node data: %w", err)
 	}
-	defer rows.Close()
 
-	// Create a CSV file for Neo4j import
-	csvPath := "data.csv"
-	csvFile, err := os.Create(csvPath)
-	if err != nil {
-		panic(err)
+	if opts.CSV {
+		return writeCSV(cfg.Paths.DataCSV, records)
 	}
-	defer csvFile.Close()
+	return nil
+}
 
-	// Write CSV header
-	_, err = csvFile.WriteString("domain,ip,asn,country_code,user_count,post_count,cloud_provider\n")
+// writeCSV writes the node data to the data CSV
+func writeCSV(csvPath string, records []storage.InstanceRecord) error {
+	csvFile, err := csvfile.Create(csvPath, []csvfile.Column{
+		{Name: "domain", Type: csvfile.String, Required: true},
+		{Name: "ip", Type: csvfile.String},
+		{Name: "asn", Type: csvfile.Long},
+		{Name: "country_code", Type: csvfile.String},
+		{Name: "user_count", Type: csvfile.Long},
+		{Name: "post_count", Type: csvfile.Long},
+		{Name: "cloud_provider", Type: csvfile.String},
+	})
 	if err != nil {
-		panic(err)
+		return err
 	}
+	defer csvFile.Close()
 
-	i := 0
-	for rows.Next() {
-		var domain string
-		var ip string
-		var asn string
-		var country_code string
-		var user_count int
-		var post_count int
-		var cloud_provider string
-		if err := rows.Scan(&domain, &ip, &asn, &country_code, &user_count, &post_count, &cloud_provider); err != nil {
-			fmt.Printf("Error scanning row: %v\n", err)
-			continue
-		}
-
-		// Write each domain-peer relationship to CSV
-		_, err = csvFile.WriteString(fmt.Sprintf("%s,%s,%s,%s,%d,%d,%s\n", domain, ip, asn, country_code, user_count, post_count, cloud_provider))
+	for _, r := range records {
+		err := csvFile.Write(r.Domain, r.IP, r.ASN, r.CountryCode, r.UserCount, r.PostCount, r.CloudProvider)
 		if err != nil {
-			fmt.Printf("Error writing to CSV: %v\n", err)
-			continue
-		}
-
-		if i%100 == 0 {
-			fmt.Printf("Wrote %d/%d to CSV\n", i+1, totalNodes)
+			return err
 		}
-		i++
+	}
+	if err := csvFile.Close(); err != nil {
+		return err
 	}
 
 	absPath, err := filepath.Abs(csvPath)
@@ -108,5 +100,6 @@ func InjestData() {
 		fmt.Printf("Error getting absolute path: %v\n", err)
 		absPath = csvPath
 	}
-	fmt.Printf("CSV file created at: %s\n", absPath)
+	fmt.Printf("CSV file created at: %s (%d rows, %d skipped)\n", absPath, csvFile.Written, csvFile.Skipped)
+	return nil
 }
@@ -0,0 +1,135 @@
+package injest_data_test
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/kothavade/mastodon-paper/config"
+	"github.com/kothavade/mastodon-paper/fedtest"
+	"github.com/kothavade/mastodon-paper/injest_data"
+	"github.com/kothavade/mastodon-paper/storage"
+)
+
+// jsonGraph is the part of the json sink's file the tests look at
+type jsonGraph struct {
+	Graph struct {
+		Nodes map[string]struct {
+			Metadata map[string]any `json:"metadata"`
+		} `json:"nodes"`
+		Edges []struct {
+			Source   string `json:"source"`
+			Target   string `json:"target"`
+			Relation string `json:"relation"`
+		} `json:"edges"`
+	} `json:"graph"`
+}
+
+// collect records infos as the collect_data results of the open run
+func collect(t *testing.T, cfg *config.Config, infos map[string]storage.NodeInfo) {
+	t.Helper()
+	store, err := storage.Open(cfg.Paths.DB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	run, err := store.StartRun()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var domains []string
+	for domain := range infos {
+		domains = append(domains, domain)
+	}
+	slices.Sort(domains)
+	if err := store.InitProbes(run.ID, storage.StageCollectData, domains); err != nil {
+		t.Fatal(err)
+	}
+	for _, domain := range domains {
+		if err := store.SetNodeInfo(run.ID, domain, infos[domain]); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// injestData writes the node data to the graph file and returns the file and
+// the graph it holds
+func injestData(t *testing.T, cfg *config.Config) (string, jsonGraph) {
+	t.Helper()
+	if err := injest_data.InjestData(cfg, injest_data.Options{}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(cfg.Graph.Output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var g jsonGraph
+	if err := json.Unmarshal(data, &g); err != nil {
+		t.Fatal(err)
+	}
+	return string(data), g
+}
+
+// links returns the relationships of a node, sorted, as "RELATION target"
+func links(g jsonGraph, node string) []string {
+	var got []string
+	for _, e := range g.Graph.Edges {
+		if e.Source == node {
+			got = append(got, e.Relation+" "+e.Target)
+		}
+	}
+	slices.Sort(got)
+	return got
+}
+
+func TestInjestData(t *testing.T) {
+	cfg := fedtest.Config(t)
+	cfg.Graph.Sink = "json"
+	cfg.Graph.Output = filepath.Join(t.TempDir(), "graph.json")
+	// Fewer than the nodes, so they are written over several batches
+	cfg.Neo4j.BatchSize = 1
+
+	collect(t, cfg, map[string]storage.NodeInfo{
+		"alpha.test": {IP: "192.0.2.1", ASN: 24940, ASOrg: "HETZNER-AS", CountryCode: "DE", UserCount: 120, PostCount: 4500, CloudProvider: "Hetzner"},
+		"beta.test":  {IP: "192.0.2.2", ASN: 13335, CountryCode: "US", UserCount: 15},
+		"gamma.test": {IP: "192.0.2.3"},
+	})
+	got, g := injestData(t, cfg)
+	fedtest.Golden(t, "injest_data", got)
+
+	alpha := g.Graph.Nodes["MastodonNode:alpha.test"].Metadata
+	if alpha["ip"] != "192.0.2.1" || alpha["asn"] != 24940.0 || alpha["country_code"] != "DE" ||
+		alpha["user_count"] != 120.0 || alpha["post_count"] != 4500.0 || alpha["cloud_provider"] != "Hetzner" {
+		t.Errorf("alpha.test has properties %v, want every collected fact", alpha)
+	}
+	for node, want := range map[string][]string{
+		"MastodonNode:alpha.test": {"ANNOUNCED_BY AutonomousSystem:24940", "HOSTED_IN CloudProvider:Hetzner", "HOSTED_IN Country:DE"},
+		"MastodonNode:beta.test":  {"ANNOUNCED_BY AutonomousSystem:13335", "HOSTED_IN Country:US"},
+		"MastodonNode:gamma.test": nil,
+	} {
+		if got := links(g, node); !slices.Equal(got, want) {
+			t.Errorf("%s links %v, want %v", node, got, want)
+		}
+	}
+
+	// alpha moved to another provider and beta's address is no longer found
+	collect(t, cfg, map[string]storage.NodeInfo{
+		"alpha.test": {IP: "192.0.2.9", ASN: 16509, CountryCode: "US", UserCount: 130, PostCount: 4600, CloudProvider: "AWS"},
+		"beta.test":  {IP: "192.0.2.2", UserCount: 15},
+		"gamma.test": {IP: "192.0.2.3", CountryCode: "NL"},
+	})
+	got, g = injestData(t, cfg)
+	fedtest.Golden(t, "injest_data_changed", got)
+
+	for node, want := range map[string][]string{
+		"MastodonNode:alpha.test": {"ANNOUNCED_BY AutonomousSystem:16509", "HOSTED_IN CloudProvider:AWS", "HOSTED_IN Country:US"},
+		"MastodonNode:beta.test":  nil,
+		"MastodonNode:gamma.test": {"HOSTED_IN Country:NL"},
+	} {
+		if got := links(g, node); !slices.Equal(got, want) {
+			t.Errorf("after the change %s links %v, want %v", node, got, want)
+		}
+	}
+}
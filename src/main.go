@@ -1,45 +1,373 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
+	"strconv"
 
+	"github.com/kothavade/mastodon-paper/analyze"
 	"github.com/kothavade/mastodon-paper/collect_data"
+	"github.com/kothavade/mastodon-paper/config"
+	"github.com/kothavade/mastodon-paper/diff"
+	"github.com/kothavade/mastodon-paper/discover"
+	"github.com/kothavade/mastodon-paper/enrich_as"
+	"github.com/kothavade/mastodon-paper/export"
 	"github.com/kothavade/mastodon-paper/filter"
 	"github.com/kothavade/mastodon-paper/graph"
 	"github.com/kothavade/mastodon-paper/injest"
 	"github.com/kothavade/mastodon-paper/injest_data"
+	"github.com/kothavade/mastodon-paper/pipeline"
 	"github.com/kothavade/mastodon-paper/process"
+	"github.com/kothavade/mastodon-paper/runs"
+	"github.com/kothavade/mastodon-paper/storage"
 )
 
+const usage = `Usage: go run main.go <command> [flags]
+
+Commands:
+  run [-force] [stage...]  run the pipeline, skipping stages that are up to date
+  status                   show which pipeline stages are up to date
+  discover                 crawl peers breadth-first from seed domains to build a node list
+  filter                   filter the node list to software that supports the peers API
+  process                  fetch the peers of every filtered node
+  collect_data             collect IP, geo and stats for every processed node
+  enrich_as                describe the ASes of instances from local CAIDA datasets
+  injest [-all-peers] [-csv]  merge peer relationships into the graph, optionally also to the peers CSV
+  injest_data [-csv]       set node data as properties in the graph, optionally also to the data CSV
+  graph-init               merge nodes into the graph for all processed nodes
+  runs list                list crawl runs
+  runs pin <run>           use a run as the analysis baseline (runs unpin to clear)
+  runs finish              finish the crawl run in progress
+  runs export [-dir d] [-all-peers] [run]  write a run's instances and peers to CSV (default baseline)
+  runs peers [run]         show how many peers fall outside the supported instances
+  runs addresses [-csv f] [run]  show IPv6 adoption and instances on several addresses
+  runs dns [-csv f] [run]  show CNAME targets, DNS providers and mail providers instances share
+  runs hosting [-csv f] [run]  show the CDNs and hosting providers of instances, with confidence
+  runs asns [-csv f] [-facts-csv f] [run]  show the CAIDA rank, country and customer cone of the ASes instances are in
+  diff [-json f] [-csv f] [-all-peers] <runA> <runB>  report instance and peer changes between runs
+  export graph [-format graphml|gexf|json|edgelist] [-out f] [-reciprocal] [-all-peers] [run]
+                           write a run's peer graph with instance attributes to one file
+  export parquet [-dir d] [-all-peers] [run]  write a run's instances and peers, and every
+                           run's facts, to Parquet files
+  analyze [-dir d] [-samples n] [-seed s] [-directed] [-reciprocal] [-all-peers] [-null-graphs n] [run]
+                           write path lengths, degrees, clustering, PageRank and betweenness to CSV,
+                           optionally compared with Erdős–Rényi and configuration-model graphs
+  analyze communities [-weight reciprocity|jaccard|affinity] [-alpha a] [-resolution r] [-seed s]
+                      [-dir d] [-reciprocal] [-all-peers] [run]
+                           find communities in the significant backbone of the weighted peer graph
+  migrate                  upgrade the database schema and import legacy databases
+  config print             print the effective configuration
+
+Every command accepts -config <file> and flags overriding single settings;
+run a command with -h to list them. The graph commands write to neo4j, or to
+the database or file chosen with -graph-sink.`
+
 func main() {
 
 	args := os.Args[1:]
 	if len(args) == 0 {
-		fmt.Println("Usage: go run main.go <filter|process|collect_data>")
+		fmt.Println(usage)
 		return
 	}
 
+	fs := flag.NewFlagSet(args[0], flag.ExitOnError)
+
+	var err error
 	switch args[0] {
+	// Run the whole pipeline as a DAG, resuming where it left off
+	case "run":
+		force := fs.Bool("force", false, "rerun stages even if they are up to date")
+		cfg := parseConfig(fs, args[1:])
+		err = pipeline.Run(cfg, fs.Args(), *force)
+	case "status":
+		err = pipeline.Status(parseConfig(fs, args[1:]))
+	// Build a node list by snowball crawling from seed domains
+	case "discover":
+		err = discover.Discover(parseConfig(fs, args[1:]))
 	// Filter nodes.json to software that supports the peers API
 	case "filter":
-		filter.FilterNodes()
-	// Create nodes in neo4j for all nodes
+		err = filter.FilterNodes(parseConfig(fs, args[1:]))
+	// Merge nodes into neo4j for all processed nodes
 	case "graph-init":
-		graph.Init()
+		err = graph.Init(parseConfig(fs, args[1:]))
 
 	case "collect_data":
-		collect_data.CollectData()
+		err = collect_data.CollectData(parseConfig(fs, args[1:]))
 
 	case "process":
-		process.ProcessNodes()
+		err = process.ProcessNodes(parseConfig(fs, args[1:]))
+	// Describe the ASes of instances from CAIDA datasets
+	case "enrich_as":
+		err = enrich_as.EnrichAS(parseConfig(fs, args[1:]))
 	// Injest the relationships into neo4j
 	case "injest":
-		injest.Injest()
-	// Injest the data for nodes into neo4j
+		allPeers := fs.Bool("all-peers", false, "write every reported peer, not only peers running supported software")
+		csv := fs.Bool("csv", false, "also write the relationships to the peers CSV")
+		cfg := parseConfig(fs, args[1:])
+		err = injest.Injest(cfg, injest.Options{AllPeers: *allPeers, CSV: *csv})
+	// Injest the data for nodes into neo4j, with countries, ASes and cloud providers
 	case "injest_data":
-		injest_data.InjestData()
+		csv := fs.Bool("csv", false, "also write the node data to the data CSV")
+		cfg := parseConfig(fs, args[1:])
+		err = injest_data.InjestData(cfg, injest_data.Options{CSV: *csv})
+	// Manage crawl runs (snapshots)
+	case "runs":
+		err = runsCommand(args[1:])
+	// Compare two crawl runs
+	case "diff":
+		jsonPath := fs.String("json", "", "write every change as JSON to this file")
+		csvPath := fs.String("csv", "", "write every change as CSV to this file")
+		allPeers := fs.Bool("all-peers", false, "compare every reported peer, not only peers running supported software")
+		cfg := parseConfig(fs, args[1:])
+		if fs.NArg() != 2 {
+			err = fmt.Errorf("diff needs two run IDs")
+			break
+		}
+		var runA, runB int64
+		runA, err = runArg(fs, 0, true)
+		if err == nil {
+			runB, err = runArg(fs, 1, true)
+		}
+		if err == nil {
+			err = diff.Diff(cfg, runA, runB, diff.Options{JSONPath: *jsonPath, CSVPath: *csvPath, AllPeers: *allPeers})
+		}
+	// Compute network statistics of a run's peer graph
+	case "analyze":
+		if len(args) > 1 && args[1] == "communities" {
+			err = communitiesCommand(args[2:])
+			break
+		}
+		dir := fs.String("dir", ".", "directory to write the CSV files to")
+		samples := fs.Int("samples", 1000, "source nodes to estimate path lengths and betweenness from, 0 for every node")
+		seed := fs.Uint64("seed", 1, "seed for choosing the source nodes")
+		directed := fs.Bool("directed", false, "follow peer edges only in the direction they were reported")
+		reciprocal := fs.Bool("reciprocal", false, "keep only edges whose peer also reports the instance")
+		allPeers := fs.Bool("all-peers", false, "keep every reported peer, not only peers running supported software")
+		nullGraphs := fs.Int("null-graphs", 0, "random graphs of every null model to compare with, 0 to skip")
+		cfg := parseConfig(fs, args[1:])
+		var id int64
+		id, err = runArg(fs, 0, false)
+		if err == nil {
+			err = analyze.Analyze(cfg, id, analyze.Options{
+				Dir:        *dir,
+				Samples:    *samples,
+				Seed:       *seed,
+				Directed:   *directed,
+				Reciprocal: *reciprocal,
+				AllPeers:   *allPeers,
+				NullGraphs: *nullGraphs,
+			})
+		}
+	// Export a run to files for analysis outside the tool
+	case "export":
+		err = exportCommand(args[1:])
+	// Upgrade the database in place, including node_process.db from older versions
+	case "migrate":
+		err = migrate(parseConfig(fs, args[1:]))
+	// Show the configuration after applying the file, environment and flags
+	case "config":
+		if len(args) < 2 || args[1] != "print" {
+			fmt.Println(usage)
+			return
+		}
+		fs = flag.NewFlagSet("config print", flag.ExitOnError)
+		err = parseConfig(fs, args[2:]).Print(os.Stdout)
+	default:
+		fmt.Println(usage)
+	}
+
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+}
+
+// parseConfig loads the configuration for a subcommand, exiting if it is invalid
+func parseConfig(fs *flag.FlagSet, args []string) *config.Config {
+	cfg, err := config.Parse(fs, args)
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(2)
+	}
+	return cfg
+}
+
+// runsCommand dispatches the runs subcommands
+func runsCommand(args []string) error {
+	if len(args) == 0 {
+		fmt.Println(usage)
+		return nil
+	}
+
+	fs := flag.NewFlagSet("runs "+args[0], flag.ExitOnError)
+	switch args[0] {
+	case "list":
+		return runs.List(parseConfig(fs, args[1:]))
+	case "pin":
+		cfg := parseConfig(fs, args[1:])
+		id, err := runArg(fs, 0, true)
+		if err != nil {
+			return err
+		}
+		return runs.Pin(cfg, id)
+	case "unpin":
+		return runs.Unpin(parseConfig(fs, args[1:]))
+	case "finish":
+		return runs.Finish(parseConfig(fs, args[1:]))
+	case "export":
+		dir := fs.String("dir", ".", "directory to write the CSV files to")
+		allPeers := fs.Bool("all-peers", false, "write every reported peer, not only peers running supported software")
+		cfg := parseConfig(fs, args[1:])
+		id, err := runArg(fs, 0, false)
+		if err != nil {
+			return err
+		}
+		return runs.Export(cfg, id, *dir, *allPeers)
+	case "peers":
+		cfg := parseConfig(fs, args[1:])
+		id, err := runArg(fs, 0, false)
+		if err != nil {
+			return err
+		}
+		return runs.Peers(cfg, id)
+	case "addresses":
+		csvPath := fs.String("csv", "", "also write every resolved address to this CSV file")
+		cfg := parseConfig(fs, args[1:])
+		id, err := runArg(fs, 0, false)
+		if err != nil {
+			return err
+		}
+		return runs.Addresses(cfg, id, *csvPath)
+	case "dns":
+		csvPath := fs.String("csv", "", "also write every DNS record to this CSV file")
+		cfg := parseConfig(fs, args[1:])
+		id, err := runArg(fs, 0, false)
+		if err != nil {
+			return err
+		}
+		return runs.DNS(cfg, id, *csvPath)
+	case "hosting":
+		csvPath := fs.String("csv", "", "also write every piece of hosting evidence to this CSV file")
+		cfg := parseConfig(fs, args[1:])
+		id, err := runArg(fs, 0, false)
+		if err != nil {
+			return err
+		}
+		return runs.Hosting(cfg, id, *csvPath)
+	case "asns":
+		csvPath := fs.String("csv", "", "also write instance counts by AS to this CSV file, as paper/asn_cloud_analysis.csv")
+		factsPath := fs.String("facts-csv", "", "also write the organization, country and customer cone of every AS to this CSV file")
+		cfg := parseConfig(fs, args[1:])
+		id, err := runArg(fs, 0, false)
+		if err != nil {
+			return err
+		}
+		return runs.ASNs(cfg, id, *csvPath, *factsPath)
 	default:
-		fmt.Println("Usage: go run main.go <filter|process|collect_data>")
+		fmt.Println(usage)
+		return nil
+	}
+}
+
+// exportCommand dispatches the export subcommands
+func exportCommand(args []string) error {
+	if len(args) == 0 {
+		fmt.Println(usage)
+		return nil
+	}
+
+	fs := flag.NewFlagSet("export "+args[0], flag.ExitOnError)
+	switch args[0] {
+	case "graph":
+		format := fs.String("format", "graphml", "graphml, gexf, json or edgelist")
+		out := fs.String("out", "", "file to write (default run-<id>-peers.<format>)")
+		reciprocal := fs.Bool("reciprocal", false, "keep only edges whose peer also reports the instance")
+		allPeers := fs.Bool("all-peers", false, "keep every reported peer, not only peers running supported software")
+		cfg := parseConfig(fs, args[1:])
+		id, err := runArg(fs, 0, false)
+		if err != nil {
+			return err
+		}
+		return export.Graph(cfg, id, export.GraphOptions{
+			Format:     *format,
+			Output:     *out,
+			Reciprocal: *reciprocal,
+			AllPeers:   *allPeers,
+		})
+	case "parquet":
+		dir := fs.String("dir", ".", "directory to write the Parquet files to")
+		allPeers := fs.Bool("all-peers", false, "write every reported peer, not only peers running supported software")
+		cfg := parseConfig(fs, args[1:])
+		id, err := runArg(fs, 0, false)
+		if err != nil {
+			return err
+		}
+		return export.Parquet(cfg, id, export.ParquetOptions{Dir: *dir, AllPeers: *allPeers})
+	default:
+		fmt.Println(usage)
+		return nil
+	}
+}
+
+// communitiesCommand runs analyze communities
+func communitiesCommand(args []string) error {
+	fs := flag.NewFlagSet("analyze communities", flag.ExitOnError)
+	dir := fs.String("dir", ".", "directory to write the CSV files to")
+	weight := fs.String("weight", analyze.WeightJaccard, "edge weight: reciprocity, jaccard or affinity")
+	alpha := fs.Float64("alpha", 0.05, "keep edges whose disparity filter p-value is below alpha")
+	resolution := fs.Float64("resolution", 1, "modularity resolution, above 1 for smaller communities")
+	seed := fs.Uint64("seed", 1, "seed for the order nodes are moved in")
+	reciprocal := fs.Bool("reciprocal", false, "keep only edges whose peer also reports the instance")
+	allPeers := fs.Bool("all-peers", false, "keep every reported peer, not only peers running supported software")
+	cfg := parseConfig(fs, args)
+	id, err := runArg(fs, 0, false)
+	if err != nil {
+		return err
+	}
+	return analyze.Communities(cfg, id, analyze.CommunityOptions{
+		Dir:        *dir,
+		Weight:     *weight,
+		Alpha:      *alpha,
+		Resolution: *resolution,
+		Seed:       *seed,
+		Reciprocal: *reciprocal,
+		AllPeers:   *allPeers,
+	})
+}
+
+// runArg parses the i-th positional argument as a run ID, returning 0 if it
+// is optional and missing
+func runArg(fs *flag.FlagSet, i int, required bool) (int64, error) {
+	if fs.NArg() <= i {
+		if required {
+			return 0, fmt.Errorf("missing run ID")
+		}
+		return 0, nil
+	}
+	id, err := strconv.ParseInt(fs.Arg(i), 10, 64)
+	if err != nil || id < 1 {
+		return 0, fmt.Errorf("invalid run ID %q", fs.Arg(i))
+	}
+	return id, nil
+}
+
+// migrate brings the database up to the latest schema version
+func migrate(cfg *config.Config) error {
+	store, err := storage.Open(cfg.Paths.DB)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	if err := store.ImportLegacyProcessDB(cfg.Paths.LegacyProcessDB); err != nil {
+		return err
+	}
+
+	version, err := store.Version()
+	if err != nil {
+		return err
 	}
+	fmt.Printf("%s is at schema version %d\n", cfg.Paths.DB, version)
+	return nil
 }
@@ -0,0 +1,185 @@
+package optout
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kothavade/mastodon-paper/config"
+	"github.com/kothavade/mastodon-paper/fetch"
+	"github.com/kothavade/mastodon-paper/storage"
+)
+
+// maxRobotsSize is how much of a robots.txt is read, the minimum RFC 9309 requires
+const maxRobotsSize = 500 << 10
+
+// Checker decides whether an instance may be crawled. It respects the local
+// opt-out list, the opt-out an instance advertises in its nodeinfo metadata,
+// and robots.txt rules for our User-Agent.
+type Checker struct {
+	store  *storage.Store
+	client *fetch.Client
+	agent  string
+	ttl    time.Duration
+	listed map[string]bool
+
+	mu     sync.Mutex
+	robots map[string]*robotsTxt
+}
+
+// New returns a Checker that reads and caches robots.txt through store and
+// client. The opt-out list is read from cfg.Paths.OptOut if it exists.
+func New(cfg *config.Config, store *storage.Store, client *fetch.Client) (*Checker, error) {
+	listed, err := loadList(cfg.Paths.OptOut)
+	if err != nil {
+		return nil, err
+	}
+	return &Checker{
+		store:  store,
+		client: client,
+		agent:  productToken(cfg.HTTP.UserAgent),
+		ttl:    cfg.HTTP.RobotsTTL,
+		listed: listed,
+		robots: make(map[string]*robotsTxt),
+	}, nil
+}
+
+// Listed returns why a domain is on the local opt-out list, or an empty
+// string if it is not. An entry also covers its subdomains.
+func (c *Checker) Listed(domain string) string {
+	for d := domain; d != ""; {
+		if c.listed[d] {
+			return "on the local opt-out list"
+		}
+		_, parent, ok := strings.Cut(d, ".")
+		if !ok {
+			break
+		}
+		d = parent
+	}
+	return ""
+}
+
+// Check returns why path on domain must not be requested in the run, or an
+// empty string if it may be
+func (c *Checker) Check(runID int64, domain, path string) (string, error) {
+	if reason := c.Listed(domain); reason != "" {
+		return reason, nil
+	}
+
+	reason, err := c.store.OptOut(runID, domain)
+	if err != nil || reason != "" {
+		return reason, err
+	}
+
+	robots, err := c.robotsFor(domain)
+	if err != nil {
+		return "", err
+	}
+	if !robots.allowed(c.agent, path) {
+		return fmt.Sprintf("robots.txt disallows %s for %s", path, c.agent), nil
+	}
+	return "", nil
+}
+
+// robotsFor returns the robots.txt of a domain, fetching it if the cached
+// copy is missing or older than the TTL
+func (c *Checker) robotsFor(domain string) (*robotsTxt, error) {
+	c.mu.Lock()
+	robots, ok := c.robots[domain]
+	c.mu.Unlock()
+	if ok {
+		return robots, nil
+	}
+
+	file, ok, err := c.store.CachedRobots(domain)
+	if err != nil {
+		return nil, fmt.Errorf("error reading cached robots.txt: %w", err)
+	}
+	if !ok || time.Since(file.FetchedAt) > c.ttl {
+		file, err = c.fetchRobots(domain)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.store.SaveRobots(domain, file); err != nil {
+			return nil, fmt.Errorf("error caching robots.txt: %w", err)
+		}
+	}
+
+	switch {
+	case file.Status >= 200 && file.Status < 300:
+		robots = parseRobots(file.Body)
+	case file.Status >= 500:
+		// RFC 9309: a server error means the whole site is disallowed
+		robots = parseRobots("User-agent: *\nDisallow: /\n")
+	default:
+		// A missing robots.txt allows everything
+		robots = &robotsTxt{}
+	}
+
+	c.mu.Lock()
+	c.robots[domain] = robots
+	c.mu.Unlock()
+	return robots, nil
+}
+
+func (c *Checker) fetchRobots(domain string) (storage.RobotsFile, error) {
+	resp, err := c.client.Get(fmt.Sprintf("https://%s/robots.txt", domain))
+	if err != nil {
+		return storage.RobotsFile{}, fmt.Errorf("failed to fetch robots.txt: %w", err)
+	}
+	defer resp.Body.Close()
+
+	file := storage.RobotsFile{Status: resp.StatusCode, FetchedAt: time.Now()}
+	if resp.StatusCode == http.StatusOK {
+		body, err := io.ReadAll(io.LimitReader(resp.Body, maxRobotsSize))
+		if err != nil {
+			return storage.RobotsFile{}, fmt.Errorf("failed to read robots.txt: %w", err)
+		}
+		file.Body = string(body)
+	}
+	return file, nil
+}
+
+// productToken returns the name robots.txt groups address us by: the
+// User-Agent up to the first slash or space
+func productToken(userAgent string) string {
+	if i := strings.IndexAny(userAgent, "/ "); i >= 0 {
+		return userAgent[:i]
+	}
+	return userAgent
+}
+
+// loadList reads an opt-out list with one domain per line and # comments
+func loadList(path string) (map[string]bool, error) {
+	listed := make(map[string]bool)
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return listed, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", path, err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		if domain := strings.ToLower(strings.TrimSpace(line)); domain != "" {
+			listed[domain] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", path, err)
+	}
+	return listed, nil
+}
@@ -0,0 +1,131 @@
+package optout
+
+import (
+	"strings"
+)
+
+// robotsRule is one Allow or Disallow line
+type robotsRule struct {
+	allow   bool
+	pattern string
+}
+
+// robotsGroup is a run of User-agent lines and the rules that follow them
+type robotsGroup struct {
+	agents []string
+	rules  []robotsRule
+}
+
+// robotsTxt is a parsed robots.txt following RFC 9309
+type robotsTxt struct {
+	groups []robotsGroup
+}
+
+// parseRobots parses a robots.txt body, ignoring lines it does not understand
+func parseRobots(body string) *robotsTxt {
+	r := &robotsTxt{}
+	var current *robotsGroup
+	inRules := false
+
+	for _, line := range strings.Split(body, "\n") {
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		switch key {
+		case "user-agent":
+			// User-agent lines after rules start a new group
+			if current == nil || inRules {
+				r.groups = append(r.groups, robotsGroup{})
+				current = &r.groups[len(r.groups)-1]
+				inRules = false
+			}
+			current.agents = append(current.agents, strings.ToLower(value))
+		case "allow", "disallow":
+			if current == nil {
+				continue
+			}
+			inRules = true
+			// An empty Disallow allows everything and matches nothing
+			if value != "" {
+				current.rules = append(current.rules, robotsRule{allow: key == "allow", pattern: value})
+			}
+		}
+	}
+	return r
+}
+
+// allowed reports whether agent may fetch path. The rules of every group
+// naming agent apply, or those of the * groups if none does; the longest
+// matching pattern wins, and Allow wins a tie.
+func (r *robotsTxt) allowed(agent, path string) bool {
+	if path == "/robots.txt" {
+		return true
+	}
+
+	agent = strings.ToLower(agent)
+	var rules []robotsRule
+	// A group naming agent may have no rules, which allows everything
+	matched := false
+	for _, g := range r.groups {
+		for _, a := range g.agents {
+			if a == agent {
+				rules = append(rules, g.rules...)
+				matched = true
+				break
+			}
+		}
+	}
+	if !matched {
+		for _, g := range r.groups {
+			for _, a := range g.agents {
+				if a == "*" {
+					rules = append(rules, g.rules...)
+					break
+				}
+			}
+		}
+	}
+
+	best, allow := -1, true
+	for _, rule := range rules {
+		if !matchPattern(rule.pattern, path) {
+			continue
+		}
+		if n := len(rule.pattern); n > best || (n == best && rule.allow) {
+			best, allow = n, rule.allow
+		}
+	}
+	return allow
+}
+
+// matchPattern matches a path against a robots.txt pattern, where * matches
+// any sequence and a trailing $ anchors the end of the path
+func matchPattern(pattern, path string) bool {
+	anchored := strings.HasSuffix(pattern, "$")
+	pattern = strings.TrimSuffix(pattern, "$")
+
+	parts := strings.Split(pattern, "*")
+	if !strings.HasPrefix(path, parts[0]) {
+		return false
+	}
+	rest := path[len(parts[0]):]
+	for i, part := range parts[1:] {
+		// The last part of an anchored pattern must end the path
+		if anchored && i == len(parts)-2 {
+			return strings.HasSuffix(rest, part)
+		}
+		j := strings.Index(rest, part)
+		if j < 0 {
+			return false
+		}
+		rest = rest[j+len(part):]
+	}
+	return !anchored || rest == ""
+}
@@ -0,0 +1,69 @@
+package optout
+
+import "testing"
+
+func TestRobotsAllowed(t *testing.T) {
+	robots := parseRobots(`# research crawlers
+User-agent: GPTBot
+User-agent: mastodon-paper
+Disallow: /api/
+Allow: /api/v1/instance$
+
+User-agent: *
+Disallow: /
+Allow: /api/v1/instance/peers
+`)
+
+	tests := []struct {
+		agent, path string
+		want        bool
+	}{
+		{"mastodon-paper", "/api/v1/instance/peers", false},
+		{"mastodon-paper", "/api/v1/instance", true},
+		{"Mastodon-Paper", "/about", true},
+		{"other", "/api/v1/instance/peers", true},
+		{"other", "/api/v1/instance", false},
+		{"other", "/robots.txt", true},
+	}
+	for _, tt := range tests {
+		if got := robots.allowed(tt.agent, tt.path); got != tt.want {
+			t.Errorf("allowed(%q, %q) = %v, want %v", tt.agent, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestRobotsEmptyAgentGroup(t *testing.T) {
+	// An empty Disallow for our agent allows everything, whatever * says
+	robots := parseRobots(`User-agent: mastodon-paper
+Disallow:
+
+User-agent: *
+Disallow: /
+`)
+	if !robots.allowed("mastodon-paper", "/api/v1/instance/peers") {
+		t.Errorf("mastodon-paper disallowed, want its own empty group to allow everything")
+	}
+	if robots.allowed("other", "/api/v1/instance/peers") {
+		t.Errorf("other allowed, want the * group to disallow everything")
+	}
+}
+
+func TestMatchPattern(t *testing.T) {
+	tests := []struct {
+		pattern, path string
+		want          bool
+	}{
+		{"/api/", "/api/v1/instance", true},
+		{"/api/", "/about", false},
+		{"/*.json$", "/a/b.json", true},
+		{"/*.json$", "/a/b.json?x=1", false},
+		{"/a*b*c", "/axxbyyc/z", true},
+		{"/peers$", "/peers", true},
+		{"/peers$", "/peers/1", false},
+	}
+	for _, tt := range tests {
+		if got := matchPattern(tt.pattern, tt.path); got != tt.want {
+			t.Errorf("matchPattern(%q, %q) = %v, want %v", tt.pattern, tt.path, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,300 @@
+package pipeline
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/kothavade/mastodon-paper/collect_data"
+	"github.com/kothavade/mastodon-paper/config"
+	"github.com/kothavade/mastodon-paper/enrich_as"
+	"github.com/kothavade/mastodon-paper/filter"
+	"github.com/kothavade/mastodon-paper/injest"
+	"github.com/kothavade/mastodon-paper/injest_data"
+	"github.com/kothavade/mastodon-paper/process"
+	"github.com/kothavade/mastodon-paper/storage"
+)
+
+// Stage is one step of the pipeline and the files it hands to the next steps
+type Stage struct {
+	Name    string
+	Deps    []string
+	Inputs  []string
+	Outputs []string
+	Run     func(cfg *config.Config) error
+}
+
+// stageState is the persisted progress of a single stage
+type stageState struct {
+	RunID       int64     `json:"run_id"`
+	StartedAt   time.Time `json:"started_at"`
+	CompletedAt time.Time `json:"completed_at,omitzero"`
+}
+
+// Stages lists the pipeline stages in dependency order
+func Stages(cfg *config.Config) []Stage {
+	return []Stage{
+		{
+			Name:    "filter",
+			Inputs:  []string{cfg.Paths.Nodes},
+			Outputs: []string{cfg.Paths.FilteredNodes},
+			Run:     filter.FilterNodes,
+		},
+		{
+			Name:    "process",
+			Deps:    []string{"filter"},
+			Inputs:  []string{cfg.Paths.FilteredNodes},
+			Outputs: []string{cfg.Paths.ProcessedNodes},
+			Run:     process.ProcessNodes,
+		},
+		{
+			Name: "collect_data",
+			Deps: []string{"process"},
+			// A new build of a geo database reruns the lookups
+			Inputs: slices.Concat([]string{cfg.Paths.ProcessedNodes}, cfg.GeoIP.Country, cfg.GeoIP.ASN),
+			Run:    collect_data.CollectData,
+		},
+		{
+			Name: "enrich_as",
+			Deps: []string{"collect_data"},
+			// A newer dataset snapshot reruns the enrichment
+			Inputs: slices.DeleteFunc([]string{cfg.CAIDA.ASRank, cfg.CAIDA.ASRel, cfg.CAIDA.Cone, cfg.CAIDA.ASOrg},
+				func(path string) bool { return path == "" }),
+			Run: enrich_as.EnrichAS,
+		},
+		{
+			Name:   "injest",
+			Deps:   []string{"process"},
+			Inputs: []string{cfg.Paths.ProcessedNodes},
+			Run: func(cfg *config.Config) error {
+				return injest.Injest(cfg, injest.Options{})
+			},
+		},
+		{
+			Name: "injest_data",
+			Deps: []string{"collect_data"},
+			// The facts it writes are read from the database, so any later
+			// change to them reruns it
+			Inputs: []string{cfg.Paths.DB},
+			Run: func(cfg *config.Config) error {
+				return injest_data.InjestData(cfg, injest_data.Options{})
+			},
+		},
+	}
+}
+
+// Run executes the given stages and everything they depend on as part of the
+// unfinished crawl run, skipping stages that already completed for that run
+// and whose outputs are newer than their inputs and dependencies. With no
+// targets every stage is run, and the crawl run is finished afterwards so the
+// next invocation starts a new one. force reruns stages even if they are up to date.
+func Run(cfg *config.Config, targets []string, force bool) error {
+	stages := Stages(cfg)
+	byName := make(map[string]Stage)
+	for _, stage := range stages {
+		byName[stage.Name] = stage
+	}
+	if len(targets) == 0 {
+		for _, stage := range stages {
+			targets = append(targets, stage.Name)
+		}
+	}
+
+	wanted := make(map[string]bool)
+	var want func(name string) error
+	want = func(name string) error {
+		stage, ok := byName[name]
+		if !ok {
+			return fmt.Errorf("unknown stage %q", name)
+		}
+		if wanted[name] {
+			return nil
+		}
+		wanted[name] = true
+		for _, dep := range stage.Deps {
+			if err := want(dep); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, target := range targets {
+		if err := want(target); err != nil {
+			return err
+		}
+	}
+
+	state, err := loadState(cfg.Paths.PipelineState)
+	if err != nil {
+		return err
+	}
+
+	store, err := storage.Open(cfg.Paths.DB)
+	if err != nil {
+		return err
+	}
+	run, err := store.StartRun()
+	store.Close()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Crawl run %d\n", run.ID)
+
+	for _, stage := range stages {
+		if !wanted[stage.Name] {
+			continue
+		}
+
+		if !force {
+			upToDate, reason := isUpToDate(stage, state, run.ID)
+			if upToDate {
+				fmt.Printf("[%s] up to date, skipping\n", stage.Name)
+				continue
+			}
+			fmt.Printf("[%s] running: %s\n", stage.Name, reason)
+		} else {
+			fmt.Printf("[%s] running: forced\n", stage.Name)
+		}
+
+		// The start is recorded before running so a crash leaves the stage incomplete
+		state[stage.Name] = stageState{RunID: run.ID, StartedAt: time.Now()}
+		if err := saveState(cfg.Paths.PipelineState, state); err != nil {
+			return err
+		}
+
+		if err := stage.Run(cfg); err != nil {
+			return fmt.Errorf("stage %s failed: %w", stage.Name, err)
+		}
+
+		st := state[stage.Name]
+		st.CompletedAt = time.Now()
+		state[stage.Name] = st
+		if err := saveState(cfg.Paths.PipelineState, state); err != nil {
+			return err
+		}
+		fmt.Printf("[%s] done in %s\n", stage.Name, st.CompletedAt.Sub(st.StartedAt).Round(time.Second))
+	}
+
+	// Only a full pipeline completes a crawl
+	if len(wanted) < len(stages) {
+		return nil
+	}
+	store, err = storage.Open(cfg.Paths.DB)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	if err := store.FinishRun(run.ID); err != nil {
+		return err
+	}
+	fmt.Printf("Crawl run %d finished\n", run.ID)
+	return nil
+}
+
+// Status prints the recorded state of every stage for the unfinished crawl run
+func Status(cfg *config.Config) error {
+	state, err := loadState(cfg.Paths.PipelineState)
+	if err != nil {
+		return err
+	}
+
+	store, err := storage.Open(cfg.Paths.DB)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	var runID int64
+	run, err := store.OpenRun()
+	switch {
+	case err == nil:
+		runID = run.ID
+		fmt.Printf("Crawl run %d in progress since %s\n", run.ID, run.StartedAt.Format(time.RFC3339))
+	case errors.Is(err, sql.ErrNoRows):
+		fmt.Println("No crawl run in progress, run will start a new one")
+	default:
+		return err
+	}
+
+	for _, stage := range Stages(cfg) {
+		upToDate, reason := isUpToDate(stage, state, runID)
+		if upToDate {
+			fmt.Printf("%-12s up to date (completed %s)\n", stage.Name, state[stage.Name].CompletedAt.Format(time.RFC3339))
+		} else {
+			fmt.Printf("%-12s stale: %s\n", stage.Name, reason)
+		}
+	}
+	return nil
+}
+
+// isUpToDate reports whether a stage can be skipped in the run, and if not, why
+func isUpToDate(stage Stage, state map[string]stageState, runID int64) (bool, string) {
+	st, ok := state[stage.Name]
+	if !ok {
+		return false, "never run"
+	}
+	if st.RunID != runID {
+		return false, "new crawl run"
+	}
+	if st.CompletedAt.IsZero() {
+		return false, "previous run did not complete"
+	}
+
+	for _, dep := range stage.Deps {
+		depState := state[dep]
+		if depState.CompletedAt.IsZero() || depState.CompletedAt.After(st.CompletedAt) {
+			return false, fmt.Sprintf("dependency %s is newer", dep)
+		}
+	}
+
+	for _, output := range stage.Outputs {
+		if _, err := os.Stat(output); err != nil {
+			return false, fmt.Sprintf("output %s is missing", output)
+		}
+	}
+
+	for _, input := range stage.Inputs {
+		info, err := os.Stat(input)
+		if err != nil {
+			return false, fmt.Sprintf("input %s is missing", input)
+		}
+		if info.ModTime().After(st.CompletedAt) {
+			return false, fmt.Sprintf("input %s changed", input)
+		}
+	}
+
+	return true, ""
+}
+
+// loadState reads the pipeline state file, returning an empty state if there is none
+func loadState(stateFile string) (map[string]stageState, error) {
+	state := make(map[string]stageState)
+	data, err := os.ReadFile(stateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", stateFile, err)
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("error unmarshalling %s: %w", stateFile, err)
+	}
+	return state, nil
+}
+
+// saveState atomically writes the pipeline state file
+func saveState(stateFile string, state map[string]stageState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := stateFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("error writing %s: %w", tmp, err)
+	}
+	return os.Rename(tmp, stateFile)
+}
@@ -0,0 +1,93 @@
+package pipeline
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/kothavade/mastodon-paper/config"
+	"github.com/kothavade/mastodon-paper/fedtest"
+)
+
+// completions returns when every stage of the state file last completed
+func completions(t *testing.T, cfg *config.Config) map[string]time.Time {
+	t.Helper()
+	state, err := loadState(cfg.Paths.PipelineState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(map[string]time.Time)
+	for name, st := range state {
+		done[name] = st.CompletedAt
+	}
+	return done
+}
+
+// rerun returns the sorted names of the stages that completed again since before
+func rerun(before, after map[string]time.Time) []string {
+	var names []string
+	for name, at := range after {
+		if !at.Equal(before[name]) {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+// touch marks path as modified now
+func touch(t *testing.T, path string) {
+	t.Helper()
+	now := time.Now()
+	if err := os.Chtimes(path, now, now); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRun(t *testing.T) {
+	instances := fedtest.Standard()
+	fed := fedtest.Start(t, instances...)
+	cfg := fedtest.Config(t)
+	cfg.DNS.Upstream = fed.DNS()
+	cfg.Graph.Sink = "json"
+	cfg.Graph.Output = filepath.Join(t.TempDir(), "graph.json")
+	fedtest.WriteJSON(t, cfg.Paths.Nodes, fedtest.Domains(instances))
+
+	// Without enrich_as the crawl run is left open between invocations
+	targets := []string{"injest", "injest_data"}
+	all := []string{"collect_data", "filter", "injest", "injest_data", "process"}
+	step := func(name string, targets []string, force bool, want []string) {
+		t.Helper()
+		before := completions(t, cfg)
+		if err := Run(cfg, targets, force); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if got := rerun(before, completions(t, cfg)); !slices.Equal(got, want) {
+			t.Errorf("%s: ran %v, want %v", name, got, want)
+		}
+	}
+
+	step("first run", targets, false, all)
+	step("second run", targets, false, nil)
+
+	touch(t, cfg.Paths.FilteredNodes)
+	step("changed process input", targets, false, []string{"collect_data", "injest", "injest_data", "process"})
+	touch(t, cfg.Paths.DB)
+	step("changed database", targets, false, []string{"injest_data"})
+
+	step("forced", targets, true, all)
+
+	// The full pipeline runs the one missing stage and finishes the crawl
+	// run, so the next invocation starts over in a new one
+	step("full pipeline", nil, false, []string{"enrich_as"})
+	step("new crawl run", targets, false, all)
+	state, err := loadState(cfg.Paths.PipelineState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := state["filter"]; st.RunID != 2 {
+		t.Errorf("filter completed for run %d, want 2", st.RunID)
+	}
+}
@@ -1,126 +1,21 @@
 package process
 
 import (
-	"database/sql"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"sync"
-	"time"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/kothavade/mastodon-paper/config"
+	"github.com/kothavade/mastodon-paper/fetch"
+	"github.com/kothavade/mastodon-paper/filter"
+	"github.com/kothavade/mastodon-paper/optout"
+	"github.com/kothavade/mastodon-paper/resolver"
+	"github.com/kothavade/mastodon-paper/storage"
 )
 
-// Node processing status constants
-const (
-	StatusPending    = "pending"
-	StatusProcessing = "processing"
-	StatusCompleted  = "completed"
-	StatusFailed     = "failed"
-)
-
-// initProcessDB initializes the SQLite database for processing state
-func initProcessDB() (*sql.DB, error) {
-	db, err := sql.Open("sqlite3", "./node_process.db")
-	if err != nil {
-		return nil, fmt.Errorf("failed to open database: %w", err)
-	}
-
-	// Create process_nodes table if it doesn't exist
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS process_nodes (
-			domain TEXT PRIMARY KEY,
-			status TEXT,
-			error TEXT,
-			last_updated TIMESTAMP,
-			peers TEXT
-		)
-	`)
-	if err != nil {
-		db.Close()
-		return nil, fmt.Errorf("failed to create table: %w", err)
-	}
-
-	return db, nil
-}
-
-// initializeProcessNodes inserts nodes into the database if they don't exist
-func initializeProcessNodes(db *sql.DB, nodes []string) error {
-	tx, err := db.Begin()
-	if err != nil {
-		return err
-	}
-	defer tx.Rollback()
-
-	stmt, err := tx.Prepare(`
-		INSERT OR IGNORE INTO process_nodes (domain, status, last_updated, peers) 
-		VALUES (?, ?, CURRENT_TIMESTAMP, ?)
-	`)
-	if err != nil {
-		return err
-	}
-	defer stmt.Close()
-
-	for _, node := range nodes {
-		_, err := stmt.Exec(node, StatusPending, "")
-		if err != nil {
-			return err
-		}
-	}
-
-	return tx.Commit()
-}
-
-// getPendingNodes retrieves nodes that still need to be processed
-func getPendingNodes(db *sql.DB) ([]string, error) {
-	rows, err := db.Query(`
-		SELECT domain FROM process_nodes 
-		WHERE status = ?
-	`, StatusPending)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	var pendingNodes []string
-	for rows.Next() {
-		var node string
-		if err := rows.Scan(&node); err != nil {
-			return nil, err
-		}
-		pendingNodes = append(pendingNodes, node)
-	}
-
-	return pendingNodes, nil
-}
-
-// getProcessStats returns statistics about node processing
-func getProcessStats(db *sql.DB) (total int, completed int, failed int, pending int, err error) {
-	err = db.QueryRow("SELECT COUNT(*) FROM process_nodes").Scan(&total)
-	if err != nil {
-		return
-	}
-
-	err = db.QueryRow("SELECT COUNT(*) FROM process_nodes WHERE status = ?", StatusCompleted).Scan(&completed)
-	if err != nil {
-		return
-	}
-
-	err = db.QueryRow("SELECT COUNT(*) FROM process_nodes WHERE status = ?", StatusFailed).Scan(&failed)
-	if err != nil {
-		return
-	}
-
-	err = db.QueryRow("SELECT COUNT(*) FROM process_nodes WHERE status = ?", StatusPending).Scan(&pending)
-	if err != nil {
-		return
-	}
-
-	return
-}
-
 // NodeResult represents the result of fetching peers for a node
 type NodeResult struct {
 	Node  string
@@ -128,50 +23,66 @@ type NodeResult struct {
 	Error error
 }
 
-func ProcessNodes() {
-	sqliteDB, err := initProcessDB()
+// ProcessNodes fetches the peers of every node in the filtered node list and
+// writes the nodes whose peers were fetched to the processed node list
+func ProcessNodes(cfg *config.Config) error {
+	store, err := storage.Open(cfg.Paths.DB)
 	if err != nil {
-		panic(fmt.Sprintf("Failed to initialize SQLite database: %v", err))
+		return fmt.Errorf("failed to initialize SQLite database: %w", err)
 	}
-	defer sqliteDB.Close()
+	defer store.Close()
 	fmt.Println("SQLite database initialized for process state tracking.")
 
-	nodes, err := os.ReadFile("filtered_nodes.json")
+	run, err := store.StartRun()
+	if err != nil {
+		return fmt.Errorf("error starting crawl run: %w", err)
+	}
+
+	// Carry over progress recorded by older versions in their own database
+	err = store.ImportLegacyProcessDB(cfg.Paths.LegacyProcessDB)
+	if err != nil {
+		return fmt.Errorf("error importing %s: %w", cfg.Paths.LegacyProcessDB, err)
+	}
+
+	nodes, err := os.ReadFile(cfg.Paths.FilteredNodes)
 	if err != nil {
-		fmt.Println("Error reading filtered_nodes.json:", err)
-		return
+		return fmt.Errorf("error reading %s: %w", cfg.Paths.FilteredNodes, err)
 	}
 
 	var nodesList []string
 	err = json.Unmarshal(nodes, &nodesList)
 	if err != nil {
-		fmt.Println("Error unmarshalling filtered_nodes.json:", err)
-		return
+		return fmt.Errorf("error unmarshalling %s: %w", cfg.Paths.FilteredNodes, err)
 	}
 
 	// Initialize nodes in the SQLite database
-	err = initializeProcessNodes(sqliteDB, nodesList)
+	err = store.InitProbes(run.ID, storage.StageProcess, nodesList)
 	if err != nil {
-		fmt.Println("Error initializing nodes in database:", err)
-		return
+		return fmt.Errorf("error initializing nodes in database: %w", err)
+	}
+
+	// Nodes left running were interrupted by a crash
+	err = store.ResetInterrupted(run.ID, storage.StageProcess)
+	if err != nil {
+		return fmt.Errorf("error resetting interrupted nodes: %w", err)
 	}
 
 	// Get pending nodes
-	pendingNodes, err := getPendingNodes(sqliteDB)
+	pendingNodes, err := store.DomainsWithStatus(run.ID, storage.StageProcess, storage.StatusPending)
 	if err != nil {
-		fmt.Println("Error retrieving pending nodes:", err)
-		return
+		return fmt.Errorf("error retrieving pending nodes: %w", err)
 	}
 	fmt.Printf("Found %d pending nodes to process\n", len(pendingNodes))
 
-	nodesSet := make(map[string]bool)
-	for _, node := range nodesList {
-		nodesSet[node] = true
+	// Shared by the workers so the per-domain and per-IP limits hold
+	dns, err := resolver.New(cfg.DNS, store)
+	if err != nil {
+		return err
 	}
-
-	// Create HTTP client with timeout
-	client := &http.Client{
-		Timeout: 5 * time.Second,
+	client := fetch.New(cfg, dns)
+	checker, err := optout.New(cfg, store, client)
+	if err != nil {
+		return err
 	}
 
 	// Create channels for worker pool
@@ -180,12 +91,12 @@ func ProcessNodes() {
 	var wg sync.WaitGroup
 
 	// Start workers
-	numWorkers := 10
+	numWorkers := cfg.Workers
 	fmt.Printf("Starting %d workers to process nodes\n", numWorkers)
 	for w := 1; w <= numWorkers; w++ {
 		wg.Add(1)
 		go func() {
-			worker(client, sqliteDB, jobs, results, &wg, nodesSet)
+			worker(client, checker, store, run.ID, jobs, results, &wg)
 		}()
 	}
 
@@ -211,48 +122,75 @@ func ProcessNodes() {
 	}
 
 	// Display final stats
-	total, completed, failed, pending, err := getProcessStats(sqliteDB)
+	counts, err := store.ProbeCounts(run.ID, storage.StageProcess)
+	if err != nil {
+		return fmt.Errorf("error getting process stats: %w", err)
+	}
+	total := 0
+	for _, count := range counts {
+		total += count
+	}
+	fmt.Printf("\nProcessing complete. Stats:\n")
+	fmt.Printf("Total nodes: %d\n", total)
+	fmt.Printf("Completed: %d\n", counts[storage.StatusSuccess])
+	fmt.Printf("Failed: %d\n", counts[storage.StatusFailed])
+	fmt.Printf("Skipped (opted out): %d\n", counts[storage.StatusSkipped])
+	fmt.Printf("Pending: %d\n", counts[storage.StatusPending])
+
+	if err := printPeerStats(store, run.ID); err != nil {
+		return fmt.Errorf("error getting peer stats: %w", err)
+	}
+
+	// Write the nodes that answered the peers API for the later stages
+	completedNodes, err := store.DomainsWithStatus(run.ID, storage.StageProcess, storage.StatusSuccess)
 	if err != nil {
-		fmt.Println("Error getting process stats:", err)
-	} else {
-		fmt.Printf("\nProcessing complete. Stats:\n")
-		fmt.Printf("Total nodes: %d\n", total)
-		fmt.Printf("Completed: %d\n", completed)
-		fmt.Printf("Failed: %d\n", failed)
-		fmt.Printf("Pending: %d\n", pending)
+		return fmt.Errorf("error retrieving completed nodes: %w", err)
 	}
+
+	processedNodesFile, err := os.Create(cfg.Paths.ProcessedNodes)
+	if err != nil {
+		return fmt.Errorf("error creating %s: %w", cfg.Paths.ProcessedNodes, err)
+	}
+	defer processedNodesFile.Close()
+
+	err = json.NewEncoder(processedNodesFile).Encode(completedNodes)
+	if err != nil {
+		return fmt.Errorf("error writing to %s: %w", cfg.Paths.ProcessedNodes, err)
+	}
+	fmt.Println("Processed nodes written to", cfg.Paths.ProcessedNodes)
+
+	return nil
 }
 
 // worker processes jobs from the jobs channel
-func worker(client *http.Client, db *sql.DB, jobs <-chan string, results chan<- NodeResult, wg *sync.WaitGroup, nodesSet map[string]bool) {
+func worker(client *fetch.Client, checker *optout.Checker, store *storage.Store, runID int64, jobs <-chan string, results chan<- NodeResult, wg *sync.WaitGroup) {
 	defer wg.Done()
 
 	for node := range jobs {
-		// Update status to processing
-		updateNodeStatus(db, node, StatusProcessing, "")
-
-		// Construct API endpoint
-		endpoint := fmt.Sprintf("https://%s/api/v1/instance/peers", node)
+		// Update status to running
+		store.SetStatus(runID, storage.StageProcess, node, storage.StatusRunning, "")
+
+		// Respect instances that opted out of crawling
+		reason, err := CheckPeers(checker, runID, node)
+		if err == nil && reason != "" {
+			store.SetStatus(runID, storage.StageProcess, node, storage.StatusSkipped, reason)
+			results <- NodeResult{Node: node}
+			continue
+		}
 
 		// Fetch peers
-		peers, err := fetchAPIData(client, endpoint)
+		var peers []string
+		if err == nil {
+			peers, err = FetchPeers(client, node)
+		}
 
 		// Update database with result
 		if err != nil {
-			updateNodeStatus(db, node, StatusFailed, err.Error())
+			store.SetStatus(runID, storage.StageProcess, node, storage.StatusFailed, err.Error())
 		} else {
-			// Convert peers to JSON string
-			var filteredPeers []string
-			for _, peer := range peers {
-				if nodesSet[peer] {
-					filteredPeers = append(filteredPeers, peer)
-				}
-			}
-			peersJSON, err := json.Marshal(filteredPeers)
-			if err != nil {
-				updateNodeStatus(db, node, StatusFailed, fmt.Sprintf("Error marshalling peers: %v", err))
-			} else {
-				updateNodeWithPeers(db, node, string(peersJSON))
+			// Peers are stored raw; readers pick the known set at query time
+			if err := store.SetPeers(runID, node, peers); err != nil {
+				store.SetStatus(runID, storage.StageProcess, node, storage.StatusFailed, fmt.Sprintf("Error storing peers: %v", err))
 			}
 		}
 
@@ -261,30 +199,22 @@ func worker(client *http.Client, db *sql.DB, jobs <-chan string, results chan<-
 	}
 }
 
-// updateNodeStatus updates the status and error message for a node
-func updateNodeStatus(db *sql.DB, node string, status string, errorMsg string) error {
-	_, err := db.Exec(`
-		UPDATE process_nodes 
-		SET status = ?, error = ?, last_updated = CURRENT_TIMESTAMP 
-		WHERE domain = ?
-	`, status, errorMsg, node)
+// peersPath is the path of the peers API
+const peersPath = "/api/v1/instance/peers"
 
-	return err
+// CheckPeers returns why the peers of domain must not be fetched in the run,
+// or an empty string if they may be
+func CheckPeers(checker *optout.Checker, runID int64, domain string) (string, error) {
+	return checker.Check(runID, domain, peersPath)
 }
 
-// updateNodeWithPeers updates a node with its peers and marks it as completed
-func updateNodeWithPeers(db *sql.DB, node string, peersJSON string) error {
-	_, err := db.Exec(`
-		UPDATE process_nodes 
-		SET status = ?, peers = ?, last_updated = CURRENT_TIMESTAMP, error = NULL
-		WHERE domain = ?
-	`, StatusCompleted, peersJSON, node)
-
-	return err
+// FetchPeers returns the domains an instance reports through the peers API
+func FetchPeers(client *fetch.Client, domain string) ([]string, error) {
+	return fetchAPIData(client, "https://"+domain+peersPath)
 }
 
 // fetchAPIData retrieves JSON data from the given endpoint
-func fetchAPIData(client *http.Client, endpoint string) ([]string, error) {
+func fetchAPIData(client *fetch.Client, endpoint string) ([]string, error) {
 	resp, err := client.Get(endpoint)
 	if err != nil {
 		return nil, err
@@ -307,3 +237,16 @@ func fetchAPIData(client *http.Client, endpoint string) ([]string, error) {
 	}
 	return data, nil
 }
+
+// printPeerStats reports how many of the stored peers fall outside the set of
+// instances running supported software
+func printPeerStats(store *storage.Store, runID int64) error {
+	stats, err := store.PeerStats(runID, filter.SupportedSoftware())
+	if err != nil {
+		return err
+	}
+	known := stats.Classes[storage.PeerKnown]
+	fmt.Printf("Peer edges: %d to %d distinct peers, %d edges (%d peers) outside the known set\n",
+		stats.Edges, stats.Peers, stats.Edges-known.Edges, stats.Peers-known.Peers)
+	return nil
+}
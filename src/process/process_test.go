@@ -0,0 +1,79 @@
+package process_test
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/kothavade/mastodon-paper/fedtest"
+	"github.com/kothavade/mastodon-paper/filter"
+	"github.com/kothavade/mastodon-paper/process"
+	"github.com/kothavade/mastodon-paper/storage"
+)
+
+func TestProcessNodes(t *testing.T) {
+	instances := fedtest.Standard()
+	fed := fedtest.Start(t, instances...)
+	cfg := fedtest.Config(t)
+	fedtest.WriteJSON(t, cfg.Paths.Nodes, fedtest.Domains(instances, "ghost.test"))
+
+	if err := filter.FilterNodes(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := process.ProcessNodes(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	processed, err := os.ReadFile(cfg.Paths.ProcessedNodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fedtest.Golden(t, "processed_nodes", string(processed))
+
+	store, err := storage.Open(cfg.Paths.DB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	fedtest.Golden(t, "process_probes", fedtest.DumpProbes(t, store, storage.StageProcess))
+
+	run, err := store.ActiveRun()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Raw peers are kept; the known view drops peers without supported software
+	var edges strings.Builder
+	for _, view := range []struct {
+		name     string
+		software []string
+	}{{"all", nil}, {"known", filter.SupportedSoftware()}} {
+		fmt.Fprintf(&edges, "# %s\n", view.name)
+		err := store.EachPeerEdge(run.ID, storage.EdgeFilter{PeerSoftware: view.software}, func(domain, peer string) error {
+			fmt.Fprintf(&edges, "%s -> %s\n", domain, peer)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats, err := store.PeerStats(run.ID, filter.SupportedSoftware())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(&edges, "# stats\nedges %d, peers %d\n", stats.Edges, stats.Peers)
+	for _, class := range []string{storage.PeerKnown, storage.PeerOtherSoftware, storage.PeerUnreachable, storage.PeerUnprobed} {
+		c := stats.Classes[class]
+		fmt.Fprintf(&edges, "%s: %d edges, %d peers\n", class, c.Edges, c.Peers)
+	}
+	fedtest.Golden(t, "peer_edges", edges.String())
+
+	if n := fed.Requests("robots.test", "/api/v1/instance/peers"); n != 0 {
+		t.Errorf("robots.txt disallows the peers API of robots.test but it got %d requests", n)
+	}
+	if n := fed.Requests("hidden.test", "/api/v1/instance/peers"); n != 0 {
+		t.Errorf("hidden.test set noindex but got %d peers requests", n)
+	}
+}
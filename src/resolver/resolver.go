@@ -0,0 +1,525 @@
+// Package resolver looks domains up through a recursive DNS resolver. It
+// caches answers for their TTL in memory and in the database, and finds the
+// CNAME chain, name servers and mail exchangers of instance domains, which
+// show the CDNs and DNS providers instances share.
+package resolver
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kothavade/mastodon-paper/config"
+	"github.com/kothavade/mastodon-paper/storage"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Response codes of cached answers. Other codes are errors and not cached.
+const (
+	RcodeSuccess  = "NOERROR"
+	RcodeNXDomain = "NXDOMAIN"
+)
+
+// Record types looked up
+const (
+	TypeA     = "A"
+	TypeAAAA  = "AAAA"
+	TypeCNAME = "CNAME"
+	TypeNS    = "NS"
+	TypeMX    = "MX"
+	TypeSOA   = "SOA"
+)
+
+var types = map[string]dnsmessage.Type{
+	TypeA:     dnsmessage.TypeA,
+	TypeAAAA:  dnsmessage.TypeAAAA,
+	TypeCNAME: dnsmessage.TypeCNAME,
+	TypeNS:    dnsmessage.TypeNS,
+	TypeMX:    dnsmessage.TypeMX,
+	TypeSOA:   dnsmessage.TypeSOA,
+}
+
+// resolvConf lists the system's nameservers, the first of which is the
+// default upstream
+const resolvConf = "/etc/resolv.conf"
+
+const (
+	// maxCNAMEs is the longest CNAME chain followed
+	maxCNAMEs = 16
+	// negativeTTL is how long an answer without records or SOA is cached
+	negativeTTL = 5 * time.Minute
+	// udpSize is the EDNS0 payload size advertised, small enough to avoid
+	// fragmentation
+	udpSize = 1232
+	// attempts is how many times a query that timed out is sent
+	attempts = 2
+)
+
+// question is the key of a cached answer
+type question struct {
+	name, qtype string
+}
+
+// Resolver queries one upstream resolver and caches its answers. It is safe
+// for concurrent use.
+type Resolver struct {
+	upstream string
+	timeout  time.Duration
+	maxTTL   time.Duration
+	// store keeps answers across stages and runs; nil caches in memory only
+	store *storage.Store
+
+	mu    sync.Mutex
+	cache map[question]storage.DNSAnswer
+}
+
+// New returns a Resolver querying the upstream of cfg, or the first
+// nameserver of /etc/resolv.conf, and caching answers in store if it is not
+// nil
+func New(cfg config.DNSConfig, store *storage.Store) (*Resolver, error) {
+	upstream := cfg.Upstream
+	if upstream == "" {
+		var err error
+		if upstream, err = systemNameserver(); err != nil {
+			return nil, fmt.Errorf("dns.upstream is empty and %w", err)
+		}
+	}
+	if _, _, err := net.SplitHostPort(upstream); err != nil {
+		upstream = net.JoinHostPort(upstream, "53")
+	}
+	return &Resolver{
+		upstream: upstream,
+		timeout:  cfg.Timeout,
+		maxTTL:   cfg.MaxTTL,
+		store:    store,
+		cache:    make(map[question]storage.DNSAnswer),
+	}, nil
+}
+
+// systemNameserver returns the first nameserver of /etc/resolv.conf
+func systemNameserver() (string, error) {
+	f, err := os.Open(resolvConf)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the system nameservers: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			// Strip the zone of link-local IPv6 nameservers
+			host, _, _ := strings.Cut(fields[1], "%")
+			return host, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("failed to read the system nameservers: %w", err)
+	}
+	return "", fmt.Errorf("%s lists no nameserver", resolvConf)
+}
+
+// Upstream returns the host:port of the resolver queried
+func (r *Resolver) Upstream() string {
+	return r.upstream
+}
+
+// LookupIPAddr returns the IPv4 and then the IPv6 addresses of host, at the
+// end of its CNAME chain. The addresses of one family are returned even if
+// looking up the other failed; the error is returned only if neither gave
+// any address.
+func (r *Resolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	name := normalize(host)
+	var addrs []net.IPAddr
+	var firstErr error
+	for _, qtype := range []string{TypeA, TypeAAAA} {
+		_, records, err := r.follow(ctx, name, qtype)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		for _, rec := range records {
+			addrs = append(addrs, net.IPAddr{IP: net.ParseIP(rec.Value)})
+		}
+	}
+	if len(addrs) > 0 {
+		return addrs, nil
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, Server: r.upstream, IsNotFound: true}
+}
+
+// Lookup returns the DNS records of an instance domain: the CNAME chain from
+// the domain to its canonical name in order, the name servers of the zone
+// the domain is in, and the mail exchangers of the canonical name, the last
+// two sorted. A domain that does not exist has no records. If some of the
+// lookups fail, the records the others found are returned with their errors.
+func (r *Resolver) Lookup(ctx context.Context, domain string) ([]storage.DNSRecord, error) {
+	name := normalize(domain)
+	chain, _, chainErr := r.follow(ctx, name, TypeA)
+	_, ns, nsErr := r.zone(ctx, name)
+	_, mx, mxErr := r.follow(ctx, name, TypeMX)
+
+	slices.SortFunc(ns, func(a, b storage.DNSRecord) int { return strings.Compare(a.Value, b.Value) })
+	slices.SortFunc(mx, func(a, b storage.DNSRecord) int {
+		pa, ha := splitMX(a.Value)
+		pb, hb := splitMX(b.Value)
+		if pa != pb {
+			return pa - pb
+		}
+		return strings.Compare(ha, hb)
+	})
+
+	var records []storage.DNSRecord
+	for _, rec := range slices.Concat(chain, ns, mx) {
+		rec.TTL = 0
+		records = append(records, rec)
+	}
+	return records, errors.Join(chainErr, nsErr, mxErr)
+}
+
+// follow looks up the records of type qtype of name, following CNAMEs. It
+// returns the CNAME chain and the records at its end.
+func (r *Resolver) follow(ctx context.Context, name, qtype string) ([]storage.DNSRecord, []storage.DNSRecord, error) {
+	var chain []storage.DNSRecord
+	seen := map[string]bool{name: true}
+	for range maxCNAMEs {
+		answer, err := r.query(ctx, name, qtype)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// Upstream resolvers usually include the whole chain in one answer
+		moved := false
+		for {
+			i := slices.IndexFunc(answer.Answer, func(rec storage.DNSRecord) bool {
+				return rec.Type == TypeCNAME && rec.Name == name
+			})
+			if i < 0 || qtype == TypeCNAME {
+				break
+			}
+			cname := answer.Answer[i]
+			if seen[cname.Value] {
+				return nil, nil, &net.DNSError{Err: "CNAME loop", Name: cname.Value, Server: r.upstream}
+			}
+			seen[cname.Value] = true
+			chain = append(chain, cname)
+			name, moved = cname.Value, true
+		}
+
+		var records []storage.DNSRecord
+		for _, rec := range answer.Answer {
+			if rec.Type == qtype && rec.Name == name {
+				records = append(records, rec)
+			}
+		}
+		// Ask again for the end of a chain the answer stopped short of
+		if len(records) > 0 || !moved || answer.Rcode != RcodeSuccess {
+			return chain, records, nil
+		}
+	}
+	return nil, nil, &net.DNSError{Err: "CNAME chain too long", Name: name, Server: r.upstream}
+}
+
+// zone returns the zone name is in and its name servers, found by asking
+// for the NS records of name and then of its parents. A negative answer
+// carries the SOA of the zone, which is jumped to directly.
+func (r *Resolver) zone(ctx context.Context, name string) (string, []storage.DNSRecord, error) {
+	for name != "" {
+		answer, err := r.query(ctx, name, TypeNS)
+		if err != nil {
+			return "", nil, err
+		}
+		var ns []storage.DNSRecord
+		for _, rec := range answer.Answer {
+			if rec.Type == TypeNS && rec.Name == name {
+				ns = append(ns, rec)
+			}
+		}
+		if len(ns) > 0 {
+			return name, ns, nil
+		}
+
+		next := parent(name)
+		for _, rec := range answer.Authority {
+			// The SOA of a CNAME's target may be in another zone
+			if rec.Type == TypeSOA && rec.Name != name && strings.HasSuffix(name, "."+rec.Name) {
+				next = rec.Name
+			}
+		}
+		name = next
+	}
+	return "", nil, nil
+}
+
+// query returns the answer to a question from the cache, or from the
+// upstream resolver once the cached answer has expired
+func (r *Resolver) query(ctx context.Context, name, qtype string) (storage.DNSAnswer, error) {
+	q := question{name, qtype}
+	now := time.Now()
+
+	r.mu.Lock()
+	answer, ok := r.cache[q]
+	r.mu.Unlock()
+	if ok && r.fresh(answer, now) {
+		return answer, nil
+	}
+
+	if r.store != nil {
+		answer, ok, err := r.store.CachedDNS(name, qtype)
+		if err != nil {
+			return answer, fmt.Errorf("error reading cached DNS answer: %w", err)
+		}
+		if ok && r.fresh(answer, now) {
+			r.remember(q, answer)
+			return answer, nil
+		}
+	}
+
+	answer, err := r.exchange(ctx, name, qtype)
+	if err != nil {
+		return answer, err
+	}
+	answer.FetchedAt = now
+	answer.ExpiresAt = now.Add(ttl(answer))
+	r.remember(q, answer)
+	if r.store != nil {
+		if err := r.store.SaveDNS(name, qtype, answer); err != nil {
+			return answer, fmt.Errorf("error caching DNS answer: %w", err)
+		}
+	}
+	return answer, nil
+}
+
+func (r *Resolver) remember(q question, answer storage.DNSAnswer) {
+	r.mu.Lock()
+	r.cache[q] = answer
+	r.mu.Unlock()
+}
+
+// fresh reports whether a cached answer may still be used: neither its TTL
+// nor max_ttl has run out
+func (r *Resolver) fresh(answer storage.DNSAnswer, now time.Time) bool {
+	return answer.ExpiresAt.After(now) && answer.FetchedAt.Add(r.maxTTL).After(now)
+}
+
+// ttl returns the lowest TTL of the records of an answer, or of the SOA of
+// a negative answer
+func ttl(answer storage.DNSAnswer) time.Duration {
+	records := answer.Answer
+	if len(records) == 0 {
+		records = answer.Authority
+	}
+	if len(records) == 0 {
+		return negativeTTL
+	}
+	lowest := slices.MinFunc(records, func(a, b storage.DNSRecord) int { return int(a.TTL) - int(b.TTL) })
+	return time.Duration(lowest.TTL) * time.Second
+}
+
+// exchange asks the upstream resolver, over UDP and then over TCP if the
+// answer was truncated. Timeouts are retried.
+func (r *Resolver) exchange(ctx context.Context, name, qtype string) (storage.DNSAnswer, error) {
+	msg, id, err := newQuery(name, types[qtype])
+	if err != nil {
+		return storage.DNSAnswer{}, fmt.Errorf("failed to build DNS query for %s: %w", name, err)
+	}
+
+	var resp *dnsmessage.Message
+	for attempt := 1; ; attempt++ {
+		resp, err = r.send(ctx, "udp", msg, id)
+		if err == nil && resp.Truncated {
+			resp, err = r.send(ctx, "tcp", msg, id)
+		}
+		var netErr net.Error
+		if err == nil || attempt >= attempts || !errors.As(err, &netErr) || !netErr.Timeout() {
+			break
+		}
+	}
+	if err != nil {
+		dnsErr := &net.DNSError{Err: err.Error(), Name: name, Server: r.upstream, IsTemporary: true}
+		var netErr net.Error
+		dnsErr.IsTimeout = errors.As(err, &netErr) && netErr.Timeout()
+		return storage.DNSAnswer{}, dnsErr
+	}
+
+	switch resp.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+	default:
+		return storage.DNSAnswer{}, &net.DNSError{
+			Err: "server answered " + rcodeName(resp.RCode), Name: name, Server: r.upstream,
+			IsTemporary: resp.RCode == dnsmessage.RCodeServerFailure,
+		}
+	}
+
+	answer := storage.DNSAnswer{Rcode: rcodeName(resp.RCode)}
+	answer.Answer = records(resp.Answers)
+	answer.Authority = records(resp.Authorities)
+	return answer, nil
+}
+
+// send sends a packed query over network and waits for the response with
+// the same ID, for at most the query timeout
+func (r *Resolver) send(ctx context.Context, network string, msg []byte, id uint16) (*dnsmessage.Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, r.upstream)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if network == "tcp" {
+		framed := binary.BigEndian.AppendUint16(nil, uint16(len(msg)))
+		msg = append(framed, msg...)
+	}
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+
+	for {
+		var buf []byte
+		if network == "tcp" {
+			var size [2]byte
+			if _, err := io.ReadFull(conn, size[:]); err != nil {
+				return nil, err
+			}
+			buf = make([]byte, binary.BigEndian.Uint16(size[:]))
+			if _, err := io.ReadFull(conn, buf); err != nil {
+				return nil, err
+			}
+		} else {
+			buf = make([]byte, 65535)
+			n, err := conn.Read(buf)
+			if err != nil {
+				return nil, err
+			}
+			buf = buf[:n]
+		}
+
+		var resp dnsmessage.Message
+		if err := resp.Unpack(buf); err != nil {
+			return nil, fmt.Errorf("malformed DNS response: %w", err)
+		}
+		// Late answers to an earlier attempt are dropped
+		if resp.ID == id && resp.Response {
+			return &resp, nil
+		}
+	}
+}
+
+// newQuery packs a recursive query for the records of type t of name
+func newQuery(name string, t dnsmessage.Type) ([]byte, uint16, error) {
+	qname, err := dnsmessage.NewName(name + ".")
+	if err != nil {
+		return nil, 0, err
+	}
+	id := uint16(rand.N(1 << 16))
+	var opt dnsmessage.ResourceHeader
+	if err := opt.SetEDNS0(udpSize, dnsmessage.RCodeSuccess, false); err != nil {
+		return nil, 0, err
+	}
+	msg := dnsmessage.Message{
+		Header:      dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions:   []dnsmessage.Question{{Name: qname, Type: t, Class: dnsmessage.ClassINET}},
+		Additionals: []dnsmessage.Resource{{Header: opt, Body: &dnsmessage.OPTResource{}}},
+	}
+	packed, err := msg.Pack()
+	return packed, id, err
+}
+
+// records converts the resources of a response section, leaving out types
+// that are never looked up
+func records(resources []dnsmessage.Resource) []storage.DNSRecord {
+	var recs []storage.DNSRecord
+	for _, res := range resources {
+		rec := storage.DNSRecord{Name: fqdn(res.Header.Name), TTL: res.Header.TTL}
+		switch body := res.Body.(type) {
+		case *dnsmessage.AResource:
+			rec.Type, rec.Value = TypeA, net.IP(body.A[:]).String()
+		case *dnsmessage.AAAAResource:
+			rec.Type, rec.Value = TypeAAAA, net.IP(body.AAAA[:]).String()
+		case *dnsmessage.CNAMEResource:
+			rec.Type, rec.Value = TypeCNAME, fqdn(body.CNAME)
+		case *dnsmessage.NSResource:
+			rec.Type, rec.Value = TypeNS, fqdn(body.NS)
+		case *dnsmessage.MXResource:
+			rec.Type, rec.Value = TypeMX, fmt.Sprintf("%d %s", body.Pref, fqdn(body.MX))
+		case *dnsmessage.SOAResource:
+			rec.Type = TypeSOA
+			rec.Value = fmt.Sprintf("%s %s %d %d %d %d %d", fqdn(body.NS), fqdn(body.MBox),
+				body.Serial, body.Refresh, body.Retry, body.Expire, body.MinTTL)
+			// Negative answers are cached for the lower of the SOA's TTL
+			// and its minimum, as RFC 2308 asks
+			rec.TTL = min(rec.TTL, body.MinTTL)
+		default:
+			continue
+		}
+		recs = append(recs, rec)
+	}
+	return recs
+}
+
+// rcodeName returns the mnemonic of a response code, such as NXDOMAIN
+func rcodeName(code dnsmessage.RCode) string {
+	switch code {
+	case dnsmessage.RCodeSuccess:
+		return RcodeSuccess
+	case dnsmessage.RCodeFormatError:
+		return "FORMERR"
+	case dnsmessage.RCodeServerFailure:
+		return "SERVFAIL"
+	case dnsmessage.RCodeNameError:
+		return RcodeNXDomain
+	case dnsmessage.RCodeNotImplemented:
+		return "NOTIMP"
+	case dnsmessage.RCodeRefused:
+		return "REFUSED"
+	}
+	return "RCODE" + strconv.Itoa(int(code))
+}
+
+// splitMX splits the value of an MX record into its preference and exchange
+func splitMX(value string) (int, string) {
+	pref, host, _ := strings.Cut(value, " ")
+	n, _ := strconv.Atoi(pref)
+	return n, host
+}
+
+// fqdn returns a name in lower case without the trailing dot
+func fqdn(name dnsmessage.Name) string {
+	return normalize(name.String())
+}
+
+// normalize returns a domain in lower case without the trailing dot
+func normalize(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(domain), ".")
+}
+
+// parent returns the name with its first label removed, "" for a top-level
+// domain
+func parent(name string) string {
+	_, rest, _ := strings.Cut(name, ".")
+	return rest
+}
@@ -0,0 +1,168 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kothavade/mastodon-paper/config"
+	"github.com/kothavade/mastodon-paper/fedtest"
+	"github.com/kothavade/mastodon-paper/storage"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// newResolver returns a Resolver querying the federation
+func newResolver(t *testing.T, fed *fedtest.Federation, maxTTL time.Duration, store *storage.Store) *Resolver {
+	t.Helper()
+	r, err := New(config.DNSConfig{Upstream: fed.DNS(), Timeout: time.Second, MaxTTL: maxTTL}, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestLookupIPAddr(t *testing.T) {
+	fed := fedtest.Start(t, fedtest.Instance{
+		Domain: "alpha.test", IP: "192.0.2.1", MoreIPs: []string{"2001:db8::1", "192.0.2.2"},
+		DNS: []storage.DNSRecord{{Name: "alpha.test", Type: "CNAME", Value: "edge.cdn.test"}},
+	})
+	r := newResolver(t, fed, time.Hour, nil)
+
+	addrs, err := r.LookupIPAddr(context.Background(), "Alpha.Test.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprint(addrs), "[{192.0.2.1 } {192.0.2.2 } {2001:db8::1 }]"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	_, err = r.LookupIPAddr(context.Background(), "ghost.test")
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		t.Errorf("got %v for a missing domain, want a not found DNSError", err)
+	}
+}
+
+func TestLookupIPAddrPartial(t *testing.T) {
+	// A resolver that answers A queries and never AAAA ones
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var query dnsmessage.Message
+			if query.Unpack(buf[:n]) != nil || len(query.Questions) != 1 || query.Questions[0].Type != dnsmessage.TypeA {
+				continue
+			}
+			resp := dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: query.ID, Response: true, RecursionAvailable: true},
+				Questions: query.Questions,
+				Answers: []dnsmessage.Resource{{
+					Header: dnsmessage.ResourceHeader{Name: query.Questions[0].Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 300},
+					Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+				}},
+			}
+			if packed, err := resp.Pack(); err == nil {
+				conn.WriteTo(packed, addr)
+			}
+		}
+	}()
+
+	r, err := New(config.DNSConfig{Upstream: conn.LocalAddr().String(), Timeout: 20 * time.Millisecond}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrs, err := r.LookupIPAddr(context.Background(), "alpha.test")
+	if err != nil {
+		t.Fatalf("got %v, want the IPv4 address despite the AAAA timeout", err)
+	}
+	if got, want := fmt.Sprint(addrs), "[{192.0.2.1 }]"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestCache(t *testing.T) {
+	fed := fedtest.Start(t, fedtest.Instance{
+		Domain: "beta.test",
+		DNS:    []storage.DNSRecord{{Name: "beta.test", Type: "MX", Value: "10 mx.beta.test"}},
+	})
+	store, err := storage.Open(filepath.Join(t.TempDir(), "dns.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	lookup := func(r *Resolver) int {
+		t.Helper()
+		before := fed.DNSQueries()
+		records, err := r.Lookup(context.Background(), "beta.test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) != 3 {
+			t.Errorf("got records %v, want two NS and one MX", records)
+		}
+		return fed.DNSQueries() - before
+	}
+
+	r := newResolver(t, fed, time.Hour, store)
+	if n := lookup(r); n == 0 {
+		t.Errorf("first lookup sent no queries")
+	}
+	if n := lookup(r); n != 0 {
+		t.Errorf("lookup from memory sent %d queries", n)
+	}
+	if n := lookup(newResolver(t, fed, time.Hour, store)); n != 0 {
+		t.Errorf("lookup from the database sent %d queries", n)
+	}
+	// A max_ttl of 0 caches nothing
+	if n := lookup(newResolver(t, fed, 0, store)); n == 0 {
+		t.Errorf("uncached lookup sent no queries")
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	// A resolver that never answers
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	r, err := New(config.DNSConfig{Upstream: conn.LocalAddr().String(), Timeout: 20 * time.Millisecond}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = r.LookupIPAddr(context.Background(), "alpha.test")
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || !dnsErr.IsTimeout {
+		t.Errorf("got %v, want a timeout DNSError", err)
+	}
+}
+
+func TestUpstream(t *testing.T) {
+	for upstream, want := range map[string]string{
+		"192.0.2.53":      "192.0.2.53:53",
+		"192.0.2.53:5353": "192.0.2.53:5353",
+		"2001:db8::53":    "[2001:db8::53]:53",
+	} {
+		r, err := New(config.DNSConfig{Upstream: upstream}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Upstream() != want {
+			t.Errorf("upstream %s became %s, want %s", upstream, r.Upstream(), want)
+		}
+	}
+}
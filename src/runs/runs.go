@@ -0,0 +1,753 @@
+package runs
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kothavade/mastodon-paper/config"
+	"github.com/kothavade/mastodon-paper/filter"
+	"github.com/kothavade/mastodon-paper/resolver"
+	"github.com/kothavade/mastodon-paper/storage"
+	"golang.org/x/net/publicsuffix"
+)
+
+// List prints every crawl run with its state
+func List(cfg *config.Config) error {
+	store, err := storage.Open(cfg.Paths.DB)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	runs, err := store.ListRuns()
+	if err != nil {
+		return err
+	}
+	if len(runs) == 0 {
+		fmt.Println("No crawl runs yet")
+		return nil
+	}
+
+	baseline, err := store.BaselineRun()
+	if err != nil && !errors.Is(err, storage.ErrNoRuns) {
+		return err
+	}
+
+	fmt.Printf("%-6s %-20s %-20s %10s  %s\n", "RUN", "STARTED", "FINISHED", "INSTANCES", "")
+	for _, run := range runs {
+		finished := "in progress"
+		if run.FinishedAt != nil {
+			finished = run.FinishedAt.Format(time.DateTime)
+		}
+		marker := ""
+		switch {
+		case run.Pinned:
+			marker = "baseline (pinned)"
+		case run.ID == baseline.ID:
+			marker = "baseline"
+		}
+		fmt.Printf("%-6d %-20s %-20s %10d  %s\n", run.ID, run.StartedAt.Format(time.DateTime), finished, run.Instances, marker)
+	}
+	return nil
+}
+
+// Pin makes a run the baseline used by analyses and exports
+func Pin(cfg *config.Config, id int64) error {
+	store, err := storage.Open(cfg.Paths.DB)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	if err := store.PinRun(id); err != nil {
+		return err
+	}
+	fmt.Printf("Pinned run %d as the analysis baseline\n", id)
+	return nil
+}
+
+// Unpin makes the latest finished run the baseline again
+func Unpin(cfg *config.Config) error {
+	store, err := storage.Open(cfg.Paths.DB)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	if err := store.UnpinRun(); err != nil {
+		return err
+	}
+	fmt.Println("Unpinned the analysis baseline")
+	return nil
+}
+
+// Finish marks the unfinished run as complete so the next crawl starts a new one
+func Finish(cfg *config.Config) error {
+	store, err := storage.Open(cfg.Paths.DB)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	run, err := store.OpenRun()
+	if err != nil {
+		return fmt.Errorf("no crawl run in progress")
+	}
+	if err := store.FinishRun(run.ID); err != nil {
+		return err
+	}
+	fmt.Printf("Finished crawl run %d\n", run.ID)
+	return nil
+}
+
+// Export writes the instances and peer edges of a run to CSV files in dir.
+// Only peers running supported software are written unless allPeers is set.
+// An id of 0 exports the baseline run.
+func Export(cfg *config.Config, id int64, dir string, allPeers bool) error {
+	store, err := storage.Open(cfg.Paths.DB)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	run, err := store.RunOrBaseline(id)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	instancesPath := filepath.Join(dir, fmt.Sprintf("run-%d-instances.csv", run.ID))
+	records, err := store.InstancesWithStatus(run.ID, storage.StageFilter, storage.StatusSuccess)
+	if err != nil {
+		return fmt.Errorf("failed to query instances: %w", err)
+	}
+	err = writeCSV(instancesPath, func(w *csv.Writer) error {
+		err := w.Write([]string{"domain", "software", "ip", "asn", "as_org", "country_code", "user_count", "post_count", "cloud_provider"})
+		if err != nil {
+			return err
+		}
+		for _, r := range records {
+			err := w.Write([]string{r.Domain, str(r.Software), str(r.IP), num(r.ASN), str(r.ASOrg),
+				str(r.CountryCode), num(r.UserCount), num(r.PostCount), str(r.CloudProvider)})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %d instances to %s\n", len(records), instancesPath)
+
+	peerSoftware := filter.SupportedSoftware()
+	if allPeers {
+		peerSoftware = nil
+	}
+	peersPath := filepath.Join(dir, fmt.Sprintf("run-%d-peers.csv", run.ID))
+	edges := 0
+	err = writeCSV(peersPath, func(w *csv.Writer) error {
+		if err := w.Write([]string{"domain", "peer"}); err != nil {
+			return err
+		}
+		return store.EachPeerEdge(run.ID, storage.EdgeFilter{PeerSoftware: peerSoftware}, func(domain, peer string) error {
+			edges++
+			return w.Write([]string{domain, peer})
+		})
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %d peer edges to %s\n", edges, peersPath)
+	return nil
+}
+
+// Peers prints how the peers reported in a run split between instances
+// running supported software and domains outside that set. An id of 0 uses
+// the baseline run.
+func Peers(cfg *config.Config, id int64) error {
+	store, err := storage.Open(cfg.Paths.DB)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	run, err := store.RunOrBaseline(id)
+	if err != nil {
+		return err
+	}
+
+	stats, err := store.PeerStats(run.ID, filter.SupportedSoftware())
+	if err != nil {
+		return fmt.Errorf("failed to compute peer stats: %w", err)
+	}
+
+	fmt.Printf("Run %d: %d peer edges to %d distinct peers\n\n", run.ID, stats.Edges, stats.Peers)
+	fmt.Printf("%-16s %10s %6s %10s %6s\n", "PEERS", "EDGES", "", "DOMAINS", "")
+	for _, class := range []string{storage.PeerKnown, storage.PeerOtherSoftware, storage.PeerUnreachable, storage.PeerUnprobed} {
+		c := stats.Classes[class]
+		fmt.Printf("%-16s %10d %5.1f%% %10d %5.1f%%\n", class, c.Edges, percent(c.Edges, stats.Edges), c.Peers, percent(c.Peers, stats.Peers))
+	}
+
+	if len(stats.OtherSoftware) > 0 {
+		software := make([]string, 0, len(stats.OtherSoftware))
+		for name := range stats.OtherSoftware {
+			software = append(software, name)
+		}
+		sort.Slice(software, func(i, j int) bool {
+			a, b := stats.OtherSoftware[software[i]], stats.OtherSoftware[software[j]]
+			if a != b {
+				return a > b
+			}
+			return software[i] < software[j]
+		})
+		if len(software) > maxSoftwareListed {
+			software = software[:maxSoftwareListed]
+		}
+		fmt.Printf("\nMost common other software among peers:\n")
+		for _, name := range software {
+			fmt.Printf("  %-24s %d\n", name, stats.OtherSoftware[name])
+		}
+	}
+	return nil
+}
+
+// maxSoftwareListed is how many kinds of other software Peers prints
+const maxSoftwareListed = 15
+
+// Addresses prints how many instances of a run are reachable over IPv4, IPv6
+// or both, and over several addresses, countries or ASes, with IPv6 adoption
+// by software and country. With csvPath set every address is also written
+// there. An id of 0 uses the baseline run.
+func Addresses(cfg *config.Config, id int64, csvPath string) error {
+	store, err := storage.Open(cfg.Paths.DB)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	run, err := store.RunOrBaseline(id)
+	if err != nil {
+		return err
+	}
+
+	stats, err := store.AddressStats(run.ID)
+	if err != nil {
+		return fmt.Errorf("failed to compute address stats: %w", err)
+	}
+
+	ipv6 := stats.IPv6Only + stats.DualStack
+	fmt.Printf("Run %d: %d instances with resolved addresses\n\n", run.ID, stats.Instances)
+	fmt.Printf("%-18s %10s %6s\n", "REACHABLE OVER", "INSTANCES", "")
+	for _, row := range []struct {
+		name  string
+		count int
+	}{
+		{"IPv4 only", stats.IPv4Only},
+		{"IPv6 only", stats.IPv6Only},
+		{"dual stack", stats.DualStack},
+		{"IPv6 at all", ipv6},
+		{"several addresses", stats.MultiAddress},
+		{"several countries", stats.MultiCountry},
+		{"several ASes", stats.MultiASN},
+	} {
+		fmt.Printf("%-18s %10d %5.1f%%\n", row.name, row.count, percent(row.count, stats.Instances))
+	}
+	if stats.Users > 0 {
+		fmt.Printf("\n%.1f%% of %d users are on instances reachable over IPv6\n",
+			100*float64(stats.IPv6Users)/float64(stats.Users), stats.Users)
+	}
+
+	printAdoption("SOFTWARE", stats.Software)
+	printAdoption("COUNTRY", stats.Countries)
+
+	if csvPath == "" {
+		return nil
+	}
+	written := 0
+	err = writeCSV(csvPath, func(w *csv.Writer) error {
+		if err := w.Write([]string{"domain", "ip", "family", "asn", "as_org", "country_code", "country_source", "asn_source"}); err != nil {
+			return err
+		}
+		return store.EachAddress(run.ID, func(domain string, a storage.Address) error {
+			written++
+			asn := ""
+			if a.ASN != 0 {
+				asn = strconv.FormatUint(uint64(a.ASN), 10)
+			}
+			return w.Write([]string{domain, a.IP, a.Family, asn, a.ASOrg, a.CountryCode, a.CountrySource, a.ASNSource})
+		})
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("\nWrote %d addresses to %s\n", written, csvPath)
+	return nil
+}
+
+// DNS prints how many instances of a run are fronted by a CNAME, and the
+// CDNs, DNS providers and mail providers most instances share, each named by
+// the registered domain of the CNAME target, name server or mail exchanger.
+// With csvPath set every record is also written there. An id of 0 uses the
+// baseline run.
+func DNS(cfg *config.Config, id int64, csvPath string) error {
+	store, err := storage.Open(cfg.Paths.DB)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	run, err := store.RunOrBaseline(id)
+	if err != nil {
+		return err
+	}
+
+	// Providers are counted once per instance
+	cdns, dnsProviders, mailProviders := map[string]int{}, map[string]int{}, map[string]int{}
+	seen := map[string]bool{}
+	var domains, fronted int
+	last := ""
+	canonical := map[string]string{}
+	err = store.EachDNSRecord(run.ID, func(domain string, r storage.DNSRecord) error {
+		if domain != last {
+			domains++
+			last = domain
+			clear(seen)
+		}
+		var counts map[string]int
+		host := r.Value
+		switch r.Type {
+		case resolver.TypeCNAME:
+			canonical[domain] = r.Value
+			return nil
+		case resolver.TypeNS:
+			counts = dnsProviders
+		case resolver.TypeMX:
+			counts = mailProviders
+			_, host, _ = strings.Cut(r.Value, " ")
+		default:
+			return nil
+		}
+		if provider := registeredDomain(host); !seen[r.Type+provider] {
+			seen[r.Type+provider] = true
+			counts[provider]++
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read DNS records: %w", err)
+	}
+	for _, target := range canonical {
+		fronted++
+		cdns[registeredDomain(target)]++
+	}
+
+	fmt.Printf("Run %d: %d instances with DNS records\n", run.ID, domains)
+	fmt.Printf("%d (%.1f%%) are an alias (CNAME) of another name\n", fronted, percent(fronted, domains))
+	printProviders("CNAME TARGET", cdns, domains)
+	printProviders("DNS PROVIDER", dnsProviders, domains)
+	printProviders("MAIL PROVIDER", mailProviders, domains)
+
+	if csvPath == "" {
+		return nil
+	}
+	written := 0
+	err = writeCSV(csvPath, func(w *csv.Writer) error {
+		if err := w.Write([]string{"domain", "type", "name", "value"}); err != nil {
+			return err
+		}
+		return store.EachDNSRecord(run.ID, func(domain string, r storage.DNSRecord) error {
+			written++
+			return w.Write([]string{domain, r.Type, r.Name, r.Value})
+		})
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("\nWrote %d DNS records to %s\n", written, csvPath)
+	return nil
+}
+
+// Hosting prints how many instances of a run sit behind a CDN, which CDNs
+// and origin hosting providers are most common, and how confident the
+// classification is. With csvPath set every piece of evidence is also
+// written there. An id of 0 uses the baseline run.
+func Hosting(cfg *config.Config, id int64, csvPath string) error {
+	store, err := storage.Open(cfg.Paths.DB)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	run, err := store.RunOrBaseline(id)
+	if err != nil {
+		return err
+	}
+
+	cdns, origins := map[string]int{}, map[string]int{}
+	// bands counts the instances of each role by confidence
+	bands := map[string]*[3]int{storage.RoleCDN: {}, storage.RoleOrigin: {}}
+	instances := 0
+	err = store.EachHosting(run.ID, func(domain string, h storage.Hosting) error {
+		instances++
+		origins[h.Provider]++
+		if h.CDN != "" {
+			cdns[h.CDN]++
+			bands[storage.RoleCDN][confidenceBand(h.CDNConfidence)]++
+		}
+		if h.Provider != "" {
+			bands[storage.RoleOrigin][confidenceBand(h.Confidence)]++
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read hosting: %w", err)
+	}
+
+	behindCDN := 0
+	for _, n := range cdns {
+		behindCDN += n
+	}
+	known := instances - origins[""]
+	fmt.Printf("Run %d: %d instances with classified hosting\n", run.ID, instances)
+	fmt.Printf("%d (%.1f%%) sit behind a CDN, the origin of %d (%.1f%%) is known\n",
+		behindCDN, percent(behindCDN, instances), known, percent(known, instances))
+
+	fmt.Printf("\n%-8s %10s %10s %10s\n", "ROLE", "HIGH", "MEDIUM", "LOW")
+	for _, role := range []string{storage.RoleCDN, storage.RoleOrigin} {
+		b := bands[role]
+		fmt.Printf("%-8s %10d %10d %10d\n", role, b[0], b[1], b[2])
+	}
+
+	printProviders("CDN", cdns, instances)
+	if n, ok := origins[""]; ok {
+		delete(origins, "")
+		origins["(unknown)"] = n
+	}
+	printProviders("ORIGIN", origins, instances)
+
+	if csvPath == "" {
+		return nil
+	}
+	written := 0
+	err = writeCSV(csvPath, func(w *csv.Writer) error {
+		if err := w.Write([]string{"domain", "role", "provider", "source", "detail", "confidence"}); err != nil {
+			return err
+		}
+		return store.EachHostingEvidence(run.ID, func(domain string, e storage.HostingEvidence) error {
+			written++
+			return w.Write([]string{domain, e.Role, e.Provider, e.Source, e.Detail, strconv.FormatFloat(e.Confidence, 'f', 2, 64)})
+		})
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("\nWrote %d pieces of evidence to %s\n", written, csvPath)
+	return nil
+}
+
+// NoRank is written as the rank of ASes AS Rank does not rank, as
+// asn_cloud_analysis.py did, so the paper can sort the CSV as numbers
+const NoRank = 999999
+
+// maxASesListed is how many ASes ASNs prints
+const maxASesListed = 20
+
+// ASNs prints the ASes most instances of a run are hosted in with their
+// CAIDA rank, country and customer cone, as recorded by enrich_as. With
+// csvPath set the instance counts of every AS, split by whether a hosting
+// provider was recognised, are written there in the layout of
+// paper/asn_cloud_analysis.csv. With factsPath set the organization,
+// country and customer cone of every AS are written there. An id of 0 uses
+// the baseline run.
+func ASNs(cfg *config.Config, id int64, csvPath, factsPath string) error {
+	store, err := storage.Open(cfg.Paths.DB)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	run, err := store.RunOrBaseline(id)
+	if err != nil {
+		return err
+	}
+
+	facts := make(map[uint]storage.ASFacts)
+	source := ""
+	err = store.EachASFacts(run.ID, func(f storage.ASFacts) error {
+		facts[f.ASN] = f
+		source = f.Source
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read AS facts: %w", err)
+	}
+	if len(facts) == 0 {
+		return fmt.Errorf("run %d has no AS facts, run enrich_as with CAIDA datasets after collect_data with a geoip.asn database", run.ID)
+	}
+	counts, err := store.ASInstanceCounts(run.ID)
+	if err != nil {
+		return fmt.Errorf("failed to count instances by AS: %w", err)
+	}
+
+	// instances and cloud count the instances of every AS, and of those how
+	// many are on a recognised hosting provider
+	instances, cloud := map[uint]int{}, map[uint]int{}
+	total := 0
+	for _, c := range counts {
+		instances[c.ASN] += c.Instances
+		total += c.Instances
+		if c.Cloud {
+			cloud[c.ASN] += c.Instances
+		}
+	}
+	ranked := 0
+	for _, f := range facts {
+		if f.Rank != 0 {
+			ranked++
+		}
+	}
+	fmt.Printf("Run %d: %d instances with a known AS, %d ASes enriched, %d of them ranked\n", run.ID, total, len(facts), ranked)
+	fmt.Printf("Datasets: %s\n", source)
+
+	asns := make([]uint, 0, len(instances))
+	for asn := range instances {
+		asns = append(asns, asn)
+	}
+	sort.Slice(asns, func(i, j int) bool {
+		if instances[asns[i]] != instances[asns[j]] {
+			return instances[asns[i]] > instances[asns[j]]
+		}
+		return asns[i] < asns[j]
+	})
+	if len(asns) > maxASesListed {
+		asns = asns[:maxASesListed]
+	}
+	fmt.Printf("\n%7s %8s %-24s %-7s %8s %10s %6s %6s\n", "RANK", "ASN", "NAME", "COUNTRY", "CONE", "INSTANCES", "", "CLOUD")
+	for _, asn := range asns {
+		f := facts[asn]
+		rank, cone := "-", "-"
+		if f.Rank != 0 {
+			rank = strconv.Itoa(f.Rank)
+		}
+		if f.Cone != 0 {
+			cone = strconv.Itoa(f.Cone)
+		}
+		fmt.Printf("%7s %8d %-24.24s %-7s %8s %10d %5.1f%% %6d\n",
+			rank, asn, f.Name, f.Country, cone, instances[asn], percent(instances[asn], total), cloud[asn])
+	}
+
+	rankOf := func(asn uint) int {
+		if r := facts[asn].Rank; r != 0 {
+			return r
+		}
+		return NoRank
+	}
+	nameOf := func(asn uint) string {
+		if name := facts[asn].Name; name != "" {
+			return name
+		}
+		return "Unknown"
+	}
+
+	if csvPath != "" {
+		sort.SliceStable(counts, func(i, j int) bool {
+			if rankOf(counts[i].ASN) != rankOf(counts[j].ASN) {
+				return rankOf(counts[i].ASN) < rankOf(counts[j].ASN)
+			}
+			if counts[i].ASN != counts[j].ASN {
+				return counts[i].ASN < counts[j].ASN
+			}
+			return !counts[i].Cloud && counts[j].Cloud
+		})
+		err = writeCSV(csvPath, func(w *csv.Writer) error {
+			if err := w.Write([]string{"as_rank", "asn", "as_name", "is_cloud", "instance_count"}); err != nil {
+				return err
+			}
+			for _, c := range counts {
+				isCloud := "0"
+				if c.Cloud {
+					isCloud = "1"
+				}
+				err := w.Write([]string{
+					strconv.Itoa(rankOf(c.ASN)), strconv.FormatUint(uint64(c.ASN), 10), nameOf(c.ASN), isCloud,
+					strconv.Itoa(c.Instances),
+				})
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("\nWrote %d rows to %s\n", len(counts), csvPath)
+	}
+
+	if factsPath != "" {
+		all := make([]uint, 0, len(facts))
+		for asn := range facts {
+			all = append(all, asn)
+		}
+		sort.Slice(all, func(i, j int) bool {
+			if rankOf(all[i]) != rankOf(all[j]) {
+				return rankOf(all[i]) < rankOf(all[j])
+			}
+			return all[i] < all[j]
+		})
+		err = writeCSV(factsPath, func(w *csv.Writer) error {
+			header := []string{"asn", "as_rank", "as_name", "org_id", "org_name", "country", "cone_asns", "source"}
+			if err := w.Write(header); err != nil {
+				return err
+			}
+			for _, asn := range all {
+				f := facts[asn]
+				cone := ""
+				if f.Cone != 0 {
+					cone = strconv.Itoa(f.Cone)
+				}
+				err := w.Write([]string{
+					strconv.FormatUint(uint64(asn), 10), strconv.Itoa(rankOf(asn)), nameOf(asn),
+					f.OrgID, f.OrgName, f.Country, cone, f.Source,
+				})
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Wrote %d ASes to %s\n", len(all), factsPath)
+	}
+	return nil
+}
+
+// confidenceBand returns 0 for a high confidence of at least 0.8, 1 for a
+// medium one of at least 0.5 and 2 for a low one
+func confidenceBand(c float64) int {
+	switch {
+	case c >= 0.8:
+		return 0
+	case c >= 0.5:
+		return 1
+	}
+	return 2
+}
+
+// registeredDomain returns the domain a host was registered under, such as
+// cloudflare.com for ns1.cloudflare.com, or the host itself if it is a
+// public suffix
+func registeredDomain(host string) string {
+	if domain, err := publicsuffix.EffectiveTLDPlusOne(host); err == nil {
+		return domain
+	}
+	return host
+}
+
+// printProviders prints the providers most instances use, with the share of
+// the instances of the run
+func printProviders(title string, counts map[string]int, total int) {
+	if len(counts) == 0 {
+		return
+	}
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	if len(keys) > maxSoftwareListed {
+		keys = keys[:maxSoftwareListed]
+	}
+
+	fmt.Printf("\n%-32s %10s %6s\n", title, "INSTANCES", "")
+	for _, key := range keys {
+		fmt.Printf("%-32s %10d %5.1f%%\n", key, counts[key], percent(counts[key], total))
+	}
+}
+
+// printAdoption prints the share of instances reachable over IPv6 for the
+// most common values of a split, such as software
+func printAdoption(title string, counts map[string]storage.FamilyCount) {
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := counts[keys[i]].Instances, counts[keys[j]].Instances
+		if a != b {
+			return a > b
+		}
+		return keys[i] < keys[j]
+	})
+	if len(keys) > maxSoftwareListed {
+		keys = keys[:maxSoftwareListed]
+	}
+
+	fmt.Printf("\n%-24s %10s %10s %6s\n", title, "INSTANCES", "IPV6", "")
+	for _, key := range keys {
+		c := counts[key]
+		name := key
+		if name == "" {
+			name = "(unknown)"
+		}
+		fmt.Printf("%-24s %10d %10d %5.1f%%\n", name, c.Instances, c.IPv6, percent(c.IPv6, c.Instances))
+	}
+}
+
+func percent(n, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(n) / float64(total)
+}
+
+// writeCSV creates path and lets write fill it through a CSV writer
+func writeCSV(path string, write func(w *csv.Writer) error) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", path, err)
+	}
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	if err := write(w); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return f.Close()
+}
+
+func str(p *string) string {
+	if p == nil {
+		return ""
+	}
+	return *p
+}
+
+func num(p *int64) string {
+	if p == nil {
+		return ""
+	}
+	return strconv.FormatInt(*p, 10)
+}
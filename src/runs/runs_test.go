@@ -0,0 +1,147 @@
+package runs_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kothavade/mastodon-paper/config"
+	"github.com/kothavade/mastodon-paper/fedtest"
+	"github.com/kothavade/mastodon-paper/filter"
+	"github.com/kothavade/mastodon-paper/process"
+	"github.com/kothavade/mastodon-paper/runs"
+	"github.com/kothavade/mastodon-paper/storage"
+)
+
+// crawl filters and processes instances into a new run and finishes it
+func crawl(t *testing.T, cfg *config.Config, instances ...fedtest.Instance) int64 {
+	t.Helper()
+	fedtest.Start(t, instances...)
+	fedtest.WriteJSON(t, cfg.Paths.Nodes, fedtest.Domains(instances))
+
+	if err := filter.FilterNodes(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := process.ProcessNodes(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := storage.Open(cfg.Paths.DB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	run, err := store.ActiveRun()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.FinishRun(run.ID); err != nil {
+		t.Fatal(err)
+	}
+	return run.ID
+}
+
+// twoRuns crawls a small federation twice, changing it in between
+func twoRuns(t *testing.T) (cfg *config.Config, runA, runB int64) {
+	t.Helper()
+	cfg = fedtest.Config(t)
+	runA = crawl(t, cfg,
+		fedtest.Instance{Domain: "alpha.test", Software: "mastodon", Peers: []string{"beta.test", "gone.test", "stranger.test"}},
+		fedtest.Instance{Domain: "beta.test", Software: "pleroma", Peers: []string{"alpha.test"}},
+		fedtest.Instance{Domain: "gone.test", Software: "mastodon", Peers: []string{"alpha.test"}},
+	)
+	runB = crawl(t, cfg,
+		fedtest.Instance{Domain: "alpha.test", Software: "mastodon", Peers: []string{"beta.test", "new.test"}},
+		fedtest.Instance{Domain: "beta.test", Software: "misskey", Peers: []string{"alpha.test", "new.test"}},
+		fedtest.Instance{Domain: "new.test", Software: "mastodon", Peers: []string{"alpha.test"}},
+	)
+	return cfg, runA, runB
+}
+
+// readExport returns the instances and peers files Export wrote for run to dir
+func readExport(t *testing.T, dir string, run string) (instances, peers string) {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(dir, "run-"+run+"-instances.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	instances = string(data)
+	data, err = os.ReadFile(filepath.Join(dir, "run-"+run+"-peers.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return instances, string(data)
+}
+
+func TestExport(t *testing.T) {
+	cfg, runA, runB := twoRuns(t)
+	if runA != 1 || runB != 2 {
+		t.Fatalf("crawled runs %d and %d, want 1 and 2", runA, runB)
+	}
+
+	// The older run is written, not the latest one
+	dir := t.TempDir()
+	if err := runs.Export(cfg, runA, dir, false); err != nil {
+		t.Fatal(err)
+	}
+	instances, peers := readExport(t, dir, "1")
+	fedtest.Golden(t, "export_instances", instances)
+	fedtest.Golden(t, "export_peers", peers)
+	if _, err := os.Stat(filepath.Join(dir, "run-2-instances.csv")); !os.IsNotExist(err) {
+		t.Errorf("run 2 was exported too")
+	}
+
+	dir = t.TempDir()
+	if err := runs.Export(cfg, runA, dir, true); err != nil {
+		t.Fatal(err)
+	}
+	_, allPeers := readExport(t, dir, "1")
+	fedtest.Golden(t, "export_all_peers", allPeers)
+
+	// An id of 0 writes the pinned baseline
+	if err := runs.Pin(cfg, runA); err != nil {
+		t.Fatal(err)
+	}
+	dir = t.TempDir()
+	if err := runs.Export(cfg, 0, dir, false); err != nil {
+		t.Fatal(err)
+	}
+	gotInstances, gotPeers := readExport(t, dir, "1")
+	if gotInstances != instances || gotPeers != peers {
+		t.Errorf("exporting the pinned baseline wrote different files than exporting run 1")
+	}
+}
+
+func TestPin(t *testing.T) {
+	cfg, runA, runB := twoRuns(t)
+
+	baseline := func() int64 {
+		t.Helper()
+		store, err := storage.Open(cfg.Paths.DB)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer store.Close()
+		run, err := store.RunOrBaseline(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return run.ID
+	}
+
+	if got := baseline(); got != runB {
+		t.Errorf("baseline before pinning is run %d, want the latest run %d", got, runB)
+	}
+	if err := runs.Pin(cfg, runA); err != nil {
+		t.Fatal(err)
+	}
+	if got := baseline(); got != runA {
+		t.Errorf("baseline after pinning is run %d, want the pinned run %d", got, runA)
+	}
+	if err := runs.Unpin(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if got := baseline(); got != runB {
+		t.Errorf("baseline after unpinning is run %d, want the latest run %d", got, runB)
+	}
+}
@@ -0,0 +1,204 @@
+package storage
+
+import "database/sql"
+
+// Address families
+const (
+	FamilyIPv4 = "ipv4"
+	FamilyIPv6 = "ipv6"
+)
+
+// Address is one address an instance resolved to, with where it is hosted
+type Address struct {
+	IP            string
+	Family        string
+	ASN           uint
+	ASOrg         string
+	CountryCode   string
+	CountrySource string
+	ASNSource     string
+}
+
+// addressFlags summarises the addresses of an instance
+type addressFlags struct {
+	ipv4, ipv6             bool
+	multiCountry, multiASN bool
+}
+
+// summarizeAddresses derives the flags stored in geo_facts from the
+// addresses of an instance. Unknown countries and ASes are ignored.
+func summarizeAddresses(addrs []Address) addressFlags {
+	var flags addressFlags
+	countries := map[string]bool{}
+	asns := map[uint]bool{}
+	for _, a := range addrs {
+		switch a.Family {
+		case FamilyIPv4:
+			flags.ipv4 = true
+		case FamilyIPv6:
+			flags.ipv6 = true
+		}
+		if a.CountryCode != "" {
+			countries[a.CountryCode] = true
+		}
+		if a.ASN != 0 {
+			asns[a.ASN] = true
+		}
+	}
+	flags.multiCountry = len(countries) > 1
+	flags.multiASN = len(asns) > 1
+	return flags
+}
+
+// setAddressesTx replaces the addresses of a domain in the run
+func setAddressesTx(tx *sql.Tx, runID int64, domain string, addrs []Address) error {
+	_, err := tx.Exec(`
+		DELETE FROM addresses
+		WHERE run_id = ? AND instance_id = (SELECT id FROM instances WHERE domain = ?)
+	`, runID, domain)
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare(`
+		INSERT OR REPLACE INTO addresses (run_id, instance_id, ip, family, asn, as_org, country_code,
+			country_source, asn_source)
+		SELECT ?, id, ?, ?, ?, ?, ?, ?, ? FROM instances WHERE domain = ?
+	`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, a := range addrs {
+		_, err := stmt.Exec(runID, a.IP, a.Family, nullIfZero(a.ASN), nullIfEmpty(a.ASOrg), nullIfEmpty(a.CountryCode),
+			nullIfEmpty(a.CountrySource), nullIfEmpty(a.ASNSource), domain)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EachAddress calls fn for every address of every instance collected in the
+// run, ordered by domain and address. fn must not use the store.
+func (s *Store) EachAddress(runID int64, fn func(domain string, a Address) error) error {
+	rows, err := s.db.Query(`
+		SELECT i.domain, a.ip, a.family, COALESCE(a.asn, 0), COALESCE(a.as_org, ''),
+			COALESCE(a.country_code, ''), COALESCE(a.country_source, ''), COALESCE(a.asn_source, '')
+		FROM addresses a
+		JOIN instances i ON i.id = a.instance_id
+		WHERE a.run_id = ?
+		ORDER BY i.domain, a.ip
+	`, runID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var domain string
+		var a Address
+		err := rows.Scan(&domain, &a.IP, &a.Family, &a.ASN, &a.ASOrg, &a.CountryCode, &a.CountrySource, &a.ASNSource)
+		if err != nil {
+			return err
+		}
+		if err := fn(domain, a); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// FamilyCount counts instances and how many of them are reachable over IPv6
+type FamilyCount struct {
+	Instances int
+	IPv6      int
+}
+
+// AddressStats summarizes how the instances collected in a run are reachable
+type AddressStats struct {
+	// Instances is the number of instances whose addresses were collected
+	Instances    int
+	IPv4Only     int
+	IPv6Only     int
+	DualStack    int
+	MultiAddress int
+	MultiCountry int
+	MultiASN     int
+	// Users is the number of users of the instances, IPv6Users of the
+	// ones reachable over IPv6
+	Users     int64
+	IPv6Users int64
+	// Software and Countries split the instances by the software they run
+	// and the country of the address requests were made to, "" if unknown
+	Software  map[string]FamilyCount
+	Countries map[string]FamilyCount
+}
+
+// AddressStats summarizes the addresses of every instance collected in the
+// run. Instances collected before every address was kept are left out.
+func (s *Store) AddressStats(runID int64) (AddressStats, error) {
+	stats := AddressStats{
+		Software:  make(map[string]FamilyCount),
+		Countries: make(map[string]FamilyCount),
+	}
+	rows, err := s.db.Query(`
+		SELECT COALESCE(f.software, ''), COALESCE(g.country_code, ''), COALESCE(f.user_count, 0),
+			g.addresses, g.ipv4, g.ipv6, g.multi_country, g.multi_asn
+		FROM geo_facts g
+		LEFT JOIN instance_facts f ON f.run_id = g.run_id AND f.instance_id = g.instance_id
+		WHERE g.run_id = ? AND g.addresses IS NOT NULL
+	`, runID)
+	if err != nil {
+		return stats, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var software, country string
+		var users int64
+		var addresses int
+		var ipv4, ipv6, multiCountry, multiASN bool
+		err := rows.Scan(&software, &country, &users, &addresses, &ipv4, &ipv6, &multiCountry, &multiASN)
+		if err != nil {
+			return stats, err
+		}
+
+		stats.Instances++
+		stats.Users += users
+		switch {
+		case ipv4 && ipv6:
+			stats.DualStack++
+		case ipv6:
+			stats.IPv6Only++
+		case ipv4:
+			stats.IPv4Only++
+		}
+		if ipv6 {
+			stats.IPv6Users += users
+		}
+		if addresses > 1 {
+			stats.MultiAddress++
+		}
+		if multiCountry {
+			stats.MultiCountry++
+		}
+		if multiASN {
+			stats.MultiASN++
+		}
+
+		for _, split := range []struct {
+			counts map[string]FamilyCount
+			key    string
+		}{{stats.Software, software}, {stats.Countries, country}} {
+			c := split.counts[split.key]
+			c.Instances++
+			if ipv6 {
+				c.IPv6++
+			}
+			split.counts[split.key] = c
+		}
+	}
+	return stats, rows.Err()
+}
@@ -0,0 +1,137 @@
+package storage
+
+// ASFacts is what CAIDA's datasets say about an autonomous system; empty
+// fields are unknown
+type ASFacts struct {
+	ASN  uint
+	Name string
+	// Rank is the position of the AS in AS Rank, 1 for the largest
+	// customer cone
+	Rank    int
+	OrgID   string
+	OrgName string
+	// Country is where the organization is registered
+	Country string
+	// Cone is the number of ASes in the customer cone, the AS included
+	Cone int
+	// Source names the dataset files the facts were read from
+	Source string
+}
+
+// ASInstanceCount counts the instances of a run in an AS, split by whether
+// a hosting provider was recognised
+type ASInstanceCount struct {
+	ASN       uint
+	Cloud     bool
+	Instances int
+}
+
+// RunASNs returns every AS an instance collected in the run resolved to an
+// address in, in order
+func (s *Store) RunASNs(runID int64) ([]uint, error) {
+	rows, err := s.db.Query(`
+		SELECT asn FROM geo_facts WHERE run_id = ? AND asn IS NOT NULL
+		UNION
+		SELECT asn FROM addresses WHERE run_id = ? AND asn IS NOT NULL
+		ORDER BY 1
+	`, runID, runID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var asns []uint
+	for rows.Next() {
+		var asn uint
+		if err := rows.Scan(&asn); err != nil {
+			return nil, err
+		}
+		asns = append(asns, asn)
+	}
+	return asns, rows.Err()
+}
+
+// SetASFacts replaces the AS facts of the run
+func (s *Store) SetASFacts(runID int64, facts []ASFacts) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM as_facts WHERE run_id = ?`, runID); err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(`
+		INSERT INTO as_facts (run_id, asn, name, rank, org_id, org_name, country, cone_asns, source)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, f := range facts {
+		_, err := stmt.Exec(runID, f.ASN, nullIfEmpty(f.Name), nullIfZero(uint(f.Rank)), nullIfEmpty(f.OrgID),
+			nullIfEmpty(f.OrgName), nullIfEmpty(f.Country), nullIfZero(uint(f.Cone)), f.Source)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// EachASFacts calls fn with the facts of every AS enriched in the run,
+// ordered by ASN. fn must not use the store.
+func (s *Store) EachASFacts(runID int64, fn func(f ASFacts) error) error {
+	rows, err := s.db.Query(`
+		SELECT asn, COALESCE(name, ''), COALESCE(rank, 0), COALESCE(org_id, ''), COALESCE(org_name, ''),
+			COALESCE(country, ''), COALESCE(cone_asns, 0), source
+		FROM as_facts
+		WHERE run_id = ?
+		ORDER BY asn
+	`, runID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var f ASFacts
+		err := rows.Scan(&f.ASN, &f.Name, &f.Rank, &f.OrgID, &f.OrgName, &f.Country, &f.Cone, &f.Source)
+		if err != nil {
+			return err
+		}
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// ASInstanceCounts counts the instances collected in the run by the AS of
+// the address requests were made to, and by whether their hosting provider
+// is known, largest first
+func (s *Store) ASInstanceCounts(runID int64) ([]ASInstanceCount, error) {
+	rows, err := s.db.Query(`
+		SELECT asn, COALESCE(TRIM(cloud_provider), '') != '' AS cloud, COUNT(*) AS instances
+		FROM geo_facts
+		WHERE run_id = ? AND asn IS NOT NULL
+		GROUP BY asn, cloud
+		ORDER BY instances DESC, asn, cloud
+	`, runID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var counts []ASInstanceCount
+	for rows.Next() {
+		var c ASInstanceCount
+		if err := rows.Scan(&c.ASN, &c.Cloud, &c.Instances); err != nil {
+			return nil, err
+		}
+		counts = append(counts, c)
+	}
+	return counts, rows.Err()
+}
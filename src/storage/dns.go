@@ -0,0 +1,128 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// DNSRecord is one resource record. Names are lower case and fully
+// qualified, without the trailing dot. The Value of an MX record is its
+// preference and exchange, as in "10 mail.example.org".
+type DNSRecord struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	TTL   uint32 `json:"ttl,omitempty"`
+	Value string `json:"value"`
+}
+
+// DNSAnswer is a cached answer to a DNS question
+type DNSAnswer struct {
+	// Rcode is the response code, such as NOERROR or NXDOMAIN
+	Rcode     string
+	Answer    []DNSRecord
+	Authority []DNSRecord
+	FetchedAt time.Time
+	// ExpiresAt is when the lowest TTL of the records runs out
+	ExpiresAt time.Time
+}
+
+// CachedDNS returns the answer last cached for a question, expired or not.
+// The bool is false if the question was never answered.
+func (s *Store) CachedDNS(name, qtype string) (DNSAnswer, bool, error) {
+	var a DNSAnswer
+	var answer, authority string
+	err := s.db.QueryRow(`
+		SELECT rcode, answer, authority, fetched_at, expires_at FROM dns_cache WHERE name = ? AND type = ?
+	`, name, qtype).Scan(&a.Rcode, &answer, &authority, &a.FetchedAt, &a.ExpiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return a, false, nil
+	}
+	if err != nil {
+		return a, false, err
+	}
+	if err := json.Unmarshal([]byte(answer), &a.Answer); err != nil {
+		return a, false, err
+	}
+	if err := json.Unmarshal([]byte(authority), &a.Authority); err != nil {
+		return a, false, err
+	}
+	return a, true, nil
+}
+
+// SaveDNS caches the answer to a question
+func (s *Store) SaveDNS(name, qtype string, a DNSAnswer) error {
+	answer, err := json.Marshal(a.Answer)
+	if err != nil {
+		return err
+	}
+	authority, err := json.Marshal(a.Authority)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`
+		INSERT OR REPLACE INTO dns_cache (name, type, rcode, answer, authority, fetched_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, name, qtype, a.Rcode, string(answer), string(authority), a.FetchedAt.UTC(), a.ExpiresAt.UTC())
+	return err
+}
+
+// setDNSRecordsTx replaces the DNS records of a domain in the run. Records
+// keep their order within each type.
+func setDNSRecordsTx(tx *sql.Tx, runID int64, domain string, records []DNSRecord) error {
+	_, err := tx.Exec(`
+		DELETE FROM dns_records
+		WHERE run_id = ? AND instance_id = (SELECT id FROM instances WHERE domain = ?)
+	`, runID, domain)
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare(`
+		INSERT INTO dns_records (run_id, instance_id, type, position, name, value)
+		SELECT ?, id, ?, ?, ?, ? FROM instances WHERE domain = ?
+	`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	positions := make(map[string]int)
+	for _, r := range records {
+		_, err := stmt.Exec(runID, r.Type, positions[r.Type], r.Name, r.Value, domain)
+		if err != nil {
+			return err
+		}
+		positions[r.Type]++
+	}
+	return nil
+}
+
+// EachDNSRecord calls fn for every DNS record of every instance collected in
+// the run, ordered by domain, type and position. fn must not use the store.
+func (s *Store) EachDNSRecord(runID int64, fn func(domain string, r DNSRecord) error) error {
+	rows, err := s.db.Query(`
+		SELECT i.domain, r.name, r.type, r.value
+		FROM dns_records r
+		JOIN instances i ON i.id = r.instance_id
+		WHERE r.run_id = ?
+		ORDER BY i.domain, r.type, r.position
+	`, runID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var domain string
+		var r DNSRecord
+		if err := rows.Scan(&domain, &r.Name, &r.Type, &r.Value); err != nil {
+			return err
+		}
+		if err := fn(domain, r); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
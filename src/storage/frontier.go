@@ -0,0 +1,130 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+)
+
+// AddToFrontier queues domains for discovery at the given depth, recording
+// the domain they were found on (empty for seeds). Domains already in the
+// run's frontier keep their original depth. It returns how many were new.
+func (s *Store) AddToFrontier(runID int64, domains []string, depth int, from string) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var fromID sql.NullInt64
+	if from != "" {
+		if err := tx.QueryRow(`SELECT id FROM instances WHERE domain = ?`, from).Scan(&fromID); err != nil {
+			return 0, err
+		}
+	}
+
+	instStmt, err := tx.Prepare(`INSERT OR IGNORE INTO instances (domain) VALUES (?)`)
+	if err != nil {
+		return 0, err
+	}
+	defer instStmt.Close()
+
+	frontierStmt, err := tx.Prepare(`
+		INSERT OR IGNORE INTO frontier (run_id, instance_id, depth, discovered_from, status)
+		SELECT ?, id, ?, ?, ? FROM instances WHERE domain = ?
+	`)
+	if err != nil {
+		return 0, err
+	}
+	defer frontierStmt.Close()
+
+	added := 0
+	for _, domain := range domains {
+		if _, err := instStmt.Exec(domain); err != nil {
+			return 0, err
+		}
+		res, err := frontierStmt.Exec(runID, depth, fromID, StatusPending, domain)
+		if err != nil {
+			return 0, err
+		}
+		n, _ := res.RowsAffected()
+		added += int(n)
+	}
+
+	return added, tx.Commit()
+}
+
+// NextFrontierLevel returns the pending domains at the shallowest depth of the
+// run's frontier, or sql.ErrNoRows once the frontier is exhausted
+func (s *Store) NextFrontierLevel(runID int64) (int, []string, error) {
+	var depth sql.NullInt64
+	err := s.db.QueryRow(`SELECT MIN(depth) FROM frontier WHERE run_id = ? AND status = ?`, runID, StatusPending).Scan(&depth)
+	if err != nil {
+		return 0, nil, err
+	}
+	if !depth.Valid {
+		return 0, nil, sql.ErrNoRows
+	}
+
+	domains, err := s.queryDomains(`
+		SELECT i.domain FROM frontier f JOIN instances i ON i.id = f.instance_id
+		WHERE f.run_id = ? AND f.status = ? AND f.depth = ?
+		ORDER BY i.domain
+	`, runID, StatusPending, depth.Int64)
+	return int(depth.Int64), domains, err
+}
+
+// SetFrontierStatus updates the discovery status of a domain in the run's frontier
+func (s *Store) SetFrontierStatus(runID int64, domain, status string) error {
+	_, err := s.db.Exec(`
+		UPDATE frontier SET status = ?
+		WHERE run_id = ? AND instance_id = (SELECT id FROM instances WHERE domain = ?)
+	`, status, runID, domain)
+	return err
+}
+
+// ResetInterruptedFrontier puts frontier entries that were being expanded
+// when the tool stopped back into the pending state
+func (s *Store) ResetInterruptedFrontier(runID int64) error {
+	_, err := s.db.Exec(`UPDATE frontier SET status = ? WHERE run_id = ? AND status = ?`,
+		StatusPending, runID, StatusRunning)
+	return err
+}
+
+// FrontierSize returns the number of domains in the run's frontier
+func (s *Store) FrontierSize(runID int64) (int, error) {
+	var count int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM frontier WHERE run_id = ?`, runID).Scan(&count)
+	return count, err
+}
+
+// FrontierDepths returns how many domains of the run's frontier are at each depth
+func (s *Store) FrontierDepths(runID int64) (map[int]int, error) {
+	rows, err := s.db.Query(`SELECT depth, COUNT(*) FROM frontier WHERE run_id = ? GROUP BY depth`, runID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	depths := make(map[int]int)
+	for rows.Next() {
+		var depth, count int
+		if err := rows.Scan(&depth, &count); err != nil {
+			return nil, err
+		}
+		depths[depth] = count
+	}
+	return depths, rows.Err()
+}
+
+// FrontierDomains returns every domain in the run's frontier
+func (s *Store) FrontierDomains(runID int64) ([]string, error) {
+	domains, err := s.queryDomains(`
+		SELECT i.domain FROM frontier f JOIN instances i ON i.id = f.instance_id
+		WHERE f.run_id = ?
+		ORDER BY i.domain
+	`, runID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return domains, err
+}
@@ -0,0 +1,116 @@
+package storage
+
+import "database/sql"
+
+// Hosting roles: a CDN sits in front of an instance, the origin serves it
+const (
+	RoleCDN    = "cdn"
+	RoleOrigin = "origin"
+)
+
+// HostingEvidence is one sign that a provider hosts an instance or sits in
+// front of it
+type HostingEvidence struct {
+	Role     string
+	Provider string
+	// Source is what the evidence was found in, such as asn or header, and
+	// Detail the value that matched
+	Source     string
+	Detail     string
+	Confidence float64
+}
+
+// Hosting is what was concluded about the hosting of an instance
+type Hosting struct {
+	// Provider hosts the origin and CDN sits in front of it, "" if unknown
+	Provider      string
+	Confidence    float64
+	CDN           string
+	CDNConfidence float64
+}
+
+// setHostingEvidenceTx replaces the hosting evidence of a domain in the run
+func setHostingEvidenceTx(tx *sql.Tx, runID int64, domain string, evidence []HostingEvidence) error {
+	_, err := tx.Exec(`
+		DELETE FROM hosting_evidence
+		WHERE run_id = ? AND instance_id = (SELECT id FROM instances WHERE domain = ?)
+	`, runID, domain)
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare(`
+		INSERT OR REPLACE INTO hosting_evidence (run_id, instance_id, role, provider, source, detail, confidence)
+		SELECT ?, id, ?, ?, ?, ?, ? FROM instances WHERE domain = ?
+	`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, e := range evidence {
+		if _, err := stmt.Exec(runID, e.Role, e.Provider, e.Source, e.Detail, e.Confidence, domain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EachHosting calls fn with the hosting of every instance collected in the
+// run, ordered by domain. Instances collected before hosting was classified
+// are left out. fn must not use the store.
+func (s *Store) EachHosting(runID int64, fn func(domain string, h Hosting) error) error {
+	rows, err := s.db.Query(`
+		SELECT i.domain, COALESCE(g.cloud_provider, ''), g.hosting_confidence,
+			COALESCE(g.cdn, ''), COALESCE(g.cdn_confidence, 0)
+		FROM geo_facts g
+		JOIN instances i ON i.id = g.instance_id
+		WHERE g.run_id = ? AND g.hosting_confidence IS NOT NULL
+		ORDER BY i.domain
+	`, runID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var domain string
+		var h Hosting
+		if err := rows.Scan(&domain, &h.Provider, &h.Confidence, &h.CDN, &h.CDNConfidence); err != nil {
+			return err
+		}
+		if err := fn(domain, h); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// EachHostingEvidence calls fn for every piece of hosting evidence found in
+// the run, ordered by domain, role, provider and source. fn must not use
+// the store.
+func (s *Store) EachHostingEvidence(runID int64, fn func(domain string, e HostingEvidence) error) error {
+	rows, err := s.db.Query(`
+		SELECT i.domain, e.role, e.provider, e.source, e.detail, e.confidence
+		FROM hosting_evidence e
+		JOIN instances i ON i.id = e.instance_id
+		WHERE e.run_id = ?
+		ORDER BY i.domain, e.role, e.provider, e.source, e.detail
+	`, runID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var domain string
+		var e HostingEvidence
+		if err := rows.Scan(&domain, &e.Role, &e.Provider, &e.Source, &e.Detail, &e.Confidence); err != nil {
+			return err
+		}
+		if err := fn(domain, e); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
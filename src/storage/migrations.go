@@ -0,0 +1,445 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// migration upgrades the schema from version-1 to version
+type migration struct {
+	version int
+	name    string
+	up      func(tx *sql.Tx) error
+}
+
+// migrations lists every schema change in order. Never edit a migration that
+// has been released; add a new one instead.
+var migrations = []migration{
+	{1, "create unified schema", migrateUnifiedSchema},
+	{2, "import legacy nodes and node_info tables", migrateLegacyTables},
+	{3, "key probes and facts by crawl run", migrateCrawlRuns},
+	{4, "add discovery frontier", migrateFrontier},
+	{5, "add opt-out signals and robots.txt cache", migrateOptOut},
+	{6, "record the geo database build of every geo fact", migrateGeoSources},
+	{7, "add every resolved address of an instance", migrateAddresses},
+	{8, "add DNS answer cache and the DNS records of instances", migrateDNS},
+	{9, "add CDN, hosting confidence and hosting evidence", migrateHosting},
+	{10, "add the CAIDA facts of the ASes instances are in", migrateASFacts},
+	{11, "add node_info view for scripts written against the legacy table", migrateNodeInfoView},
+}
+
+// migrate applies every migration newer than the current schema version
+func migrate(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL)`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_version table: %w", err)
+	}
+
+	current, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if err := m.up(tx); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d (%s) failed: %w", m.version, m.name, err)
+		}
+		if _, err := tx.Exec(`DELETE FROM schema_version`); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_version (version) VALUES (?)`, m.version); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		fmt.Printf("Migrated database to schema version %d: %s\n", m.version, m.name)
+	}
+
+	return nil
+}
+
+// schemaVersion returns the version of the last applied migration, or 0
+func schemaVersion(db *sql.DB) (int, error) {
+	var version sql.NullInt64
+	err := db.QueryRow(`SELECT MAX(version) FROM schema_version`).Scan(&version)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read schema version: %w", err)
+	}
+	return int(version.Int64), nil
+}
+
+func migrateUnifiedSchema(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE instances (
+			id           INTEGER PRIMARY KEY,
+			domain       TEXT NOT NULL UNIQUE,
+			first_seen   TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+
+		-- One row per instance and stage tracking where the stage got to
+		CREATE TABLE probes (
+			instance_id  INTEGER NOT NULL REFERENCES instances(id),
+			stage        TEXT NOT NULL,
+			status       TEXT NOT NULL,
+			error        TEXT,
+			last_updated TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (instance_id, stage)
+		);
+		CREATE INDEX probes_stage_status ON probes (stage, status);
+
+		CREATE TABLE instance_facts (
+			instance_id  INTEGER PRIMARY KEY REFERENCES instances(id),
+			software     TEXT,
+			user_count   INTEGER,
+			post_count   INTEGER
+		);
+
+		CREATE TABLE geo_facts (
+			instance_id    INTEGER PRIMARY KEY REFERENCES instances(id),
+			ip             TEXT,
+			asn            INTEGER,
+			as_org         TEXT,
+			country_code   TEXT,
+			cloud_provider TEXT
+		);
+
+		CREATE TABLE peers (
+			instance_id  INTEGER NOT NULL REFERENCES instances(id),
+			peer_id      INTEGER NOT NULL REFERENCES instances(id),
+			PRIMARY KEY (instance_id, peer_id)
+		) WITHOUT ROWID;
+
+		-- Separate legacy database files that have already been imported
+		CREATE TABLE legacy_imports (
+			path         TEXT PRIMARY KEY,
+			imported_at  TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+	`)
+	return err
+}
+
+// migrateLegacyTables moves the rows of the nodes (filter) and node_info
+// (collect_data) tables that used to live in node_filter.db into the unified
+// schema and drops them
+func migrateLegacyTables(tx *sql.Tx) error {
+	hasNodes, err := tableExists(tx, "nodes")
+	if err != nil {
+		return err
+	}
+	if hasNodes {
+		_, err = tx.Exec(`
+			INSERT OR IGNORE INTO instances (domain, first_seen)
+			SELECT domain, COALESCE(last_updated, CURRENT_TIMESTAMP) FROM nodes;
+
+			INSERT OR REPLACE INTO probes (instance_id, stage, status, error, last_updated)
+			SELECT i.id, 'filter', ` + legacyStatus("n.status") + `, n.error, COALESCE(n.last_updated, CURRENT_TIMESTAMP)
+			FROM nodes n JOIN instances i ON i.domain = n.domain;
+
+			INSERT INTO instance_facts (instance_id, software)
+			SELECT i.id, n.software
+			FROM nodes n JOIN instances i ON i.domain = n.domain
+			WHERE n.software IS NOT NULL
+			ON CONFLICT (instance_id) DO UPDATE SET software = excluded.software;
+
+			DROP TABLE nodes;
+		`)
+		if err != nil {
+			return fmt.Errorf("failed to import nodes table: %w", err)
+		}
+	}
+
+	hasNodeInfo, err := tableExists(tx, "node_info")
+	if err != nil {
+		return err
+	}
+	if hasNodeInfo {
+		_, err = tx.Exec(`
+			INSERT OR IGNORE INTO instances (domain, first_seen)
+			SELECT domain, COALESCE(last_updated, CURRENT_TIMESTAMP) FROM node_info;
+
+			INSERT OR REPLACE INTO probes (instance_id, stage, status, last_updated)
+			SELECT i.id, 'collect_data', ` + legacyStatus("n.status") + `, COALESCE(n.last_updated, CURRENT_TIMESTAMP)
+			FROM node_info n JOIN instances i ON i.domain = n.domain;
+
+			INSERT INTO instance_facts (instance_id, user_count, post_count)
+			SELECT i.id, n.user_count, n.post_count
+			FROM node_info n JOIN instances i ON i.domain = n.domain
+			WHERE n.status = 'success'
+			ON CONFLICT (instance_id) DO UPDATE SET
+				user_count = excluded.user_count,
+				post_count = excluded.post_count;
+
+			INSERT OR REPLACE INTO geo_facts (instance_id, ip, asn, country_code, cloud_provider)
+			SELECT i.id, NULLIF(n.ip, ''), CAST(NULLIF(NULLIF(n.asn, ''), '0') AS INTEGER),
+				NULLIF(n.country_code, ''), NULLIF(n.cloud_provider, '')
+			FROM node_info n JOIN instances i ON i.domain = n.domain
+			WHERE n.status = 'success';
+
+			DROP TABLE node_info;
+		`)
+		if err != nil {
+			return fmt.Errorf("failed to import node_info table: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// legacyStatus maps the status constants of the old per-stage tables onto
+// the unified ones. Rows that were mid-check when the old tool stopped are
+// pending again.
+func legacyStatus(column string) string {
+	return `CASE ` + column + `
+		WHEN 'completed' THEN '` + StatusSuccess + `'
+		WHEN 'success' THEN '` + StatusSuccess + `'
+		WHEN 'failed' THEN '` + StatusFailed + `'
+		ELSE '` + StatusPending + `' END`
+}
+
+func tableExists(tx *sql.Tx, name string) (bool, error) {
+	var count int
+	err := tx.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?`, name).Scan(&count)
+	return count > 0, err
+}
+
+// migrateCrawlRuns keys every probe and fact by the crawl run that produced
+// it. Existing rows become run 1, left open so the crawl they belong to can
+// be resumed.
+func migrateCrawlRuns(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE runs (
+			id           INTEGER PRIMARY KEY,
+			started_at   TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			finished_at  TIMESTAMP,
+			pinned       INTEGER NOT NULL DEFAULT 0
+		);
+
+		INSERT INTO runs (id, started_at)
+		SELECT 1, MIN(last_updated) FROM probes HAVING COUNT(*) > 0;
+
+		CREATE TABLE probes_v3 (
+			run_id       INTEGER NOT NULL REFERENCES runs(id),
+			instance_id  INTEGER NOT NULL REFERENCES instances(id),
+			stage        TEXT NOT NULL,
+			status       TEXT NOT NULL,
+			error        TEXT,
+			last_updated TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (run_id, instance_id, stage)
+		);
+		INSERT INTO probes_v3 SELECT 1, instance_id, stage, status, error, last_updated FROM probes;
+		DROP TABLE probes;
+		ALTER TABLE probes_v3 RENAME TO probes;
+		CREATE INDEX probes_run_stage_status ON probes (run_id, stage, status);
+
+		CREATE TABLE instance_facts_v3 (
+			run_id       INTEGER NOT NULL REFERENCES runs(id),
+			instance_id  INTEGER NOT NULL REFERENCES instances(id),
+			software     TEXT,
+			user_count   INTEGER,
+			post_count   INTEGER,
+			PRIMARY KEY (run_id, instance_id)
+		);
+		INSERT INTO instance_facts_v3 SELECT 1, instance_id, software, user_count, post_count FROM instance_facts;
+		DROP TABLE instance_facts;
+		ALTER TABLE instance_facts_v3 RENAME TO instance_facts;
+
+		CREATE TABLE geo_facts_v3 (
+			run_id         INTEGER NOT NULL REFERENCES runs(id),
+			instance_id    INTEGER NOT NULL REFERENCES instances(id),
+			ip             TEXT,
+			asn            INTEGER,
+			as_org         TEXT,
+			country_code   TEXT,
+			cloud_provider TEXT,
+			PRIMARY KEY (run_id, instance_id)
+		);
+		INSERT INTO geo_facts_v3 SELECT 1, instance_id, ip, asn, as_org, country_code, cloud_provider FROM geo_facts;
+		DROP TABLE geo_facts;
+		ALTER TABLE geo_facts_v3 RENAME TO geo_facts;
+
+		CREATE TABLE peers_v3 (
+			run_id       INTEGER NOT NULL REFERENCES runs(id),
+			instance_id  INTEGER NOT NULL REFERENCES instances(id),
+			peer_id      INTEGER NOT NULL REFERENCES instances(id),
+			PRIMARY KEY (run_id, instance_id, peer_id)
+		) WITHOUT ROWID;
+		INSERT INTO peers_v3 SELECT 1, instance_id, peer_id FROM peers;
+		DROP TABLE peers;
+		ALTER TABLE peers_v3 RENAME TO peers;
+	`)
+	return err
+}
+
+// migrateFrontier adds the queue the discover crawler expands breadth-first
+func migrateFrontier(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		-- Breadth-first discovery queue; the primary key dedupes domains within a run
+		CREATE TABLE frontier (
+			run_id          INTEGER NOT NULL REFERENCES runs(id),
+			instance_id     INTEGER NOT NULL REFERENCES instances(id),
+			depth           INTEGER NOT NULL,
+			discovered_from INTEGER REFERENCES instances(id),
+			status          TEXT NOT NULL,
+			first_seen      TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (run_id, instance_id)
+		);
+		CREATE INDEX frontier_run_status_depth ON frontier (run_id, status, depth);
+	`)
+	return err
+}
+
+// migrateOptOut records the opt-out an instance advertises in its nodeinfo
+// and caches robots.txt files across stages
+func migrateOptOut(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		ALTER TABLE instance_facts ADD COLUMN opt_out TEXT;
+
+		CREATE TABLE robots (
+			instance_id  INTEGER PRIMARY KEY REFERENCES instances(id),
+			status       INTEGER NOT NULL,
+			body         TEXT NOT NULL,
+			fetched_at   TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+	`)
+	return err
+}
+
+// migrateGeoSources records which database build every country and AS was
+// looked up in
+func migrateGeoSources(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		ALTER TABLE geo_facts ADD COLUMN country_source TEXT;
+		ALTER TABLE geo_facts ADD COLUMN asn_source TEXT;
+	`)
+	return err
+}
+
+// migrateAddresses keeps every address an instance resolves to, and flags
+// summarising them next to the address requests were made to
+func migrateAddresses(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE addresses (
+			run_id         INTEGER NOT NULL REFERENCES runs(id),
+			instance_id    INTEGER NOT NULL REFERENCES instances(id),
+			ip             TEXT NOT NULL,
+			family         TEXT NOT NULL,
+			asn            INTEGER,
+			as_org         TEXT,
+			country_code   TEXT,
+			country_source TEXT,
+			asn_source     TEXT,
+			PRIMARY KEY (run_id, instance_id, ip)
+		) WITHOUT ROWID;
+
+		-- NULL for facts collected before every address was kept
+		ALTER TABLE geo_facts ADD COLUMN addresses INTEGER;
+		ALTER TABLE geo_facts ADD COLUMN ipv4 BOOLEAN;
+		ALTER TABLE geo_facts ADD COLUMN ipv6 BOOLEAN;
+		ALTER TABLE geo_facts ADD COLUMN multi_country BOOLEAN;
+		ALTER TABLE geo_facts ADD COLUMN multi_asn BOOLEAN;
+	`)
+	return err
+}
+
+// migrateDNS caches the answers of the resolver across stages and keeps the
+// CNAME chain, name servers and mail exchangers of every instance
+func migrateDNS(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE dns_cache (
+			name       TEXT NOT NULL,
+			type       TEXT NOT NULL,
+			rcode      TEXT NOT NULL,
+			answer     TEXT NOT NULL,
+			authority  TEXT NOT NULL,
+			fetched_at TIMESTAMP NOT NULL,
+			expires_at TIMESTAMP NOT NULL,
+			PRIMARY KEY (name, type)
+		) WITHOUT ROWID;
+
+		CREATE TABLE dns_records (
+			run_id      INTEGER NOT NULL REFERENCES runs(id),
+			instance_id INTEGER NOT NULL REFERENCES instances(id),
+			type        TEXT NOT NULL,
+			position    INTEGER NOT NULL,
+			name        TEXT NOT NULL,
+			value       TEXT NOT NULL,
+			PRIMARY KEY (run_id, instance_id, type, position)
+		) WITHOUT ROWID;
+	`)
+	return err
+}
+
+// migrateHosting records the CDN in front of an instance next to its hosting
+// provider, how confident both are, and the evidence they were derived from
+func migrateHosting(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		-- NULL for facts collected before hosting was classified
+		ALTER TABLE geo_facts ADD COLUMN cdn TEXT;
+		ALTER TABLE geo_facts ADD COLUMN cdn_confidence REAL;
+		ALTER TABLE geo_facts ADD COLUMN hosting_confidence REAL;
+
+		CREATE TABLE hosting_evidence (
+			run_id      INTEGER NOT NULL REFERENCES runs(id),
+			instance_id INTEGER NOT NULL REFERENCES instances(id),
+			role        TEXT NOT NULL,
+			provider    TEXT NOT NULL,
+			source      TEXT NOT NULL,
+			detail      TEXT NOT NULL,
+			confidence  REAL NOT NULL,
+			PRIMARY KEY (run_id, instance_id, role, provider, source, detail)
+		) WITHOUT ROWID;
+	`)
+	return err
+}
+
+// migrateASFacts adds the rank, organization and customer cone CAIDA's
+// datasets give the ASes seen in a run
+func migrateASFacts(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE as_facts (
+			run_id    INTEGER NOT NULL REFERENCES runs(id),
+			asn       INTEGER NOT NULL,
+			name      TEXT,
+			rank      INTEGER,
+			org_id    TEXT,
+			org_name  TEXT,
+			country   TEXT,
+			cone_asns INTEGER,
+			source    TEXT NOT NULL,
+			PRIMARY KEY (run_id, asn)
+		) WITHOUT ROWID;
+	`)
+	return err
+}
+
+// migrateNodeInfoView shows the collect_data probes and facts of the active
+// run in the layout of the legacy node_info table, which the Python scripts
+// read. The active run is picked as ActiveRun picks it.
+func migrateNodeInfoView(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		CREATE VIEW node_info AS
+		SELECT i.domain, p.status, g.ip, g.asn, g.country_code,
+			f.user_count, f.post_count, g.cloud_provider, p.last_updated
+		FROM probes p
+		JOIN instances i ON i.id = p.instance_id
+		LEFT JOIN instance_facts f ON f.run_id = p.run_id AND f.instance_id = p.instance_id
+		LEFT JOIN geo_facts g ON g.run_id = p.run_id AND g.instance_id = p.instance_id
+		WHERE p.stage = 'collect_data' AND p.run_id = COALESCE(
+			(SELECT MAX(id) FROM runs WHERE finished_at IS NULL),
+			(SELECT id FROM runs WHERE pinned = 1 LIMIT 1),
+			(SELECT MAX(id) FROM runs WHERE finished_at IS NOT NULL));
+	`)
+	return err
+}
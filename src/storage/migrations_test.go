@@ -0,0 +1,189 @@
+package storage_test
+
+import (
+	"database/sql"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/kothavade/mastodon-paper/storage"
+)
+
+// writeLegacyDB creates a database file at path the way older versions of
+// the stages did and runs stmts in it
+func writeLegacyDB(t *testing.T, path string, stmts ...string) {
+	t.Helper()
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, stmt := range stmts {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+}
+
+func TestMigrateLegacyTables(t *testing.T) {
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "node_filter.db")
+	processPath := filepath.Join(dir, "node_process.db")
+
+	writeLegacyDB(t, dbPath, `
+		CREATE TABLE nodes (
+			domain TEXT PRIMARY KEY,
+			status TEXT,
+			software TEXT,
+			error TEXT,
+			last_updated TIMESTAMP
+		)`, `
+		INSERT INTO nodes VALUES
+			('a.test', 'completed', 'mastodon', NULL, '2025-01-01 00:00:00'),
+			('b.test', 'completed', 'pleroma', NULL, NULL),
+			('c.test', 'failed', NULL, 'connection refused', '2025-01-01 00:00:00'),
+			('d.test', 'running', NULL, NULL, NULL)`, `
+		CREATE TABLE node_info (
+			domain       TEXT PRIMARY KEY,
+			status       TEXT,
+			ip           TEXT,
+			asn          TEXT,
+			country_code TEXT,
+			user_count   INTEGER,
+			post_count   INTEGER,
+			cloud_provider TEXT,
+			last_updated TIMESTAMP
+		)`, `
+		INSERT INTO node_info VALUES
+			('a.test', 'success', '192.0.2.1', '24940', 'DE', 10, 100, 'Hetzner', '2025-01-01 00:00:00'),
+			('b.test', 'success', '', '0', '', NULL, NULL, '', NULL),
+			('e.test', 'failed', '192.0.2.5', '13335', 'US', 5, 50, 'Cloudflare', NULL),
+			('f.test', 'processing', NULL, NULL, NULL, NULL, NULL, NULL, NULL)`,
+	)
+	writeLegacyDB(t, processPath, `
+		CREATE TABLE process_nodes (
+			domain TEXT PRIMARY KEY,
+			status TEXT,
+			error TEXT,
+			last_updated TIMESTAMP,
+			peers TEXT
+		)`, `
+		INSERT INTO process_nodes VALUES
+			('a.test', 'completed', NULL, NULL, '["b.test", "g.test"]'),
+			('b.test', 'completed', NULL, NULL, NULL),
+			('c.test', 'failed', 'timeout', NULL, NULL),
+			('d.test', 'pending', NULL, NULL, NULL)`,
+	)
+
+	store, err := storage.Open(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	// Importing twice adds nothing the second time
+	for range 2 {
+		if err := store.ImportLegacyProcessDB(processPath); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	run, err := store.ActiveRun()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if run.ID != 1 || run.FinishedAt != nil {
+		t.Errorf("got run %+v, want the open run 1", run)
+	}
+
+	for _, test := range []struct {
+		stage string
+		want  []storage.Probe
+	}{
+		{storage.StageFilter, []storage.Probe{
+			{Domain: "a.test", Status: storage.StatusSuccess},
+			{Domain: "b.test", Status: storage.StatusSuccess},
+			{Domain: "c.test", Status: storage.StatusFailed, Error: "connection refused"},
+			{Domain: "d.test", Status: storage.StatusPending},
+		}},
+		{storage.StageCollectData, []storage.Probe{
+			{Domain: "a.test", Status: storage.StatusSuccess},
+			{Domain: "b.test", Status: storage.StatusSuccess},
+			{Domain: "e.test", Status: storage.StatusFailed},
+			{Domain: "f.test", Status: storage.StatusPending},
+		}},
+		{storage.StageProcess, []storage.Probe{
+			{Domain: "a.test", Status: storage.StatusSuccess},
+			{Domain: "b.test", Status: storage.StatusSuccess},
+			{Domain: "c.test", Status: storage.StatusFailed, Error: "timeout"},
+			{Domain: "d.test", Status: storage.StatusPending},
+		}},
+	} {
+		got, err := store.Probes(run.ID, test.stage)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s probes: got %+v, want %+v", test.stage, got, test.want)
+		}
+	}
+
+	records, err := store.InstancesWithStatus(run.ID, storage.StageCollectData, storage.StatusSuccess)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("got %d collected instances, want 2", len(records))
+	}
+	a, b := records[0], records[1]
+	if a.Software == nil || *a.Software != "mastodon" || a.IP == nil || *a.IP != "192.0.2.1" ||
+		a.ASN == nil || *a.ASN != 24940 || a.CountryCode == nil || *a.CountryCode != "DE" ||
+		a.UserCount == nil || *a.UserCount != 10 || a.PostCount == nil || *a.PostCount != 100 ||
+		a.CloudProvider == nil || *a.CloudProvider != "Hetzner" {
+		t.Errorf("a.test: got %+v, want every legacy fact", a)
+	}
+	// Empty strings and the ASN 0 the old tool stored for unknown ASes are NULL
+	if b.Software == nil || *b.Software != "pleroma" || b.IP != nil || b.ASN != nil ||
+		b.CountryCode != nil || b.UserCount != nil || b.PostCount != nil || b.CloudProvider != nil {
+		t.Errorf("b.test: got %+v, want only the software", b)
+	}
+
+	var edges [][2]string
+	err = store.EachPeerEdge(run.ID, storage.EdgeFilter{}, func(domain, peer string) error {
+		edges = append(edges, [2]string{domain, peer})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][2]string{{"a.test", "b.test"}, {"a.test", "g.test"}}
+	if !reflect.DeepEqual(edges, want) {
+		t.Errorf("got edges %v, want %v", edges, want)
+	}
+
+	// The scripts still read node_info, now a view of the active run
+	db, err := sql.Open("sqlite3", dbPath+"?mode=ro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	rows, err := db.Query(`SELECT domain, status, COALESCE(country_code, ''), COALESCE(cloud_provider, '') FROM node_info ORDER BY domain`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var nodeInfo []string
+	for rows.Next() {
+		var domain, status, country, cloud string
+		if err := rows.Scan(&domain, &status, &country, &cloud); err != nil {
+			t.Fatal(err)
+		}
+		nodeInfo = append(nodeInfo, domain+" "+status+" "+country+" "+cloud)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	wantInfo := []string{"a.test success DE Hetzner", "b.test success  ", "e.test failed  ", "f.test pending  "}
+	if !reflect.DeepEqual(nodeInfo, wantInfo) {
+		t.Errorf("got node_info %q, want %q", nodeInfo, wantInfo)
+	}
+}
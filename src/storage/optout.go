@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// RobotsFile is a cached robots.txt response
+type RobotsFile struct {
+	Status    int
+	Body      string
+	FetchedAt time.Time
+}
+
+// SetOptOut records the reason an instance advertised for not being crawled
+func (s *Store) SetOptOut(runID int64, domain, reason string) error {
+	_, err := s.db.Exec(`
+		INSERT INTO instance_facts (run_id, instance_id, opt_out)
+		SELECT ?, id, ? FROM instances WHERE domain = ?
+		ON CONFLICT (run_id, instance_id) DO UPDATE SET opt_out = excluded.opt_out
+	`, runID, nullIfEmpty(reason), domain)
+	return err
+}
+
+// OptOut returns the opt-out reason recorded for an instance in the run, or
+// an empty string if it did not opt out
+func (s *Store) OptOut(runID int64, domain string) (string, error) {
+	var reason sql.NullString
+	err := s.db.QueryRow(`
+		SELECT f.opt_out FROM instance_facts f JOIN instances i ON i.id = f.instance_id
+		WHERE f.run_id = ? AND i.domain = ?
+	`, runID, domain).Scan(&reason)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return reason.String, err
+}
+
+// CachedRobots returns the robots.txt last fetched from a domain. The bool is
+// false if it was never fetched.
+func (s *Store) CachedRobots(domain string) (RobotsFile, bool, error) {
+	var r RobotsFile
+	err := s.db.QueryRow(`
+		SELECT r.status, r.body, r.fetched_at FROM robots r JOIN instances i ON i.id = r.instance_id
+		WHERE i.domain = ?
+	`, domain).Scan(&r.Status, &r.Body, &r.FetchedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return r, false, nil
+	}
+	return r, err == nil, err
+}
+
+// SaveRobots caches the robots.txt fetched from a domain
+func (s *Store) SaveRobots(domain string, r RobotsFile) error {
+	_, err := s.db.Exec(`
+		INSERT OR REPLACE INTO robots (instance_id, status, body, fetched_at)
+		SELECT id, ?, ?, ? FROM instances WHERE domain = ?
+	`, r.Status, r.Body, r.FetchedAt.UTC(), domain)
+	return err
+}
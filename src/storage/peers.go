@@ -0,0 +1,104 @@
+package storage
+
+// Classes of peers, by what the run learned about the peer domain
+const (
+	PeerKnown         = "known"          // runs software in the known set
+	PeerOtherSoftware = "other_software" // answered nodeinfo with other software
+	PeerUnreachable   = "unreachable"    // was probed but did not answer nodeinfo
+	PeerUnprobed      = "unprobed"       // was never probed in the run
+)
+
+// PeerClassCount counts the edges pointing at one class of peers and the
+// distinct peers they point at
+type PeerClassCount struct {
+	Edges int
+	Peers int
+}
+
+// PeerStats summarizes the peers reported by the instances of a run
+type PeerStats struct {
+	Edges   int
+	Peers   int
+	Classes map[string]PeerClassCount
+	// OtherSoftware counts the distinct peers running each software outside the known set
+	OtherSoftware map[string]int
+}
+
+// PeerStats classifies every peer reported by an instance whose process probe
+// succeeded in the run. knownSoftware is the set of software considered known.
+func (s *Store) PeerStats(runID int64, knownSoftware []string) (PeerStats, error) {
+	stats := PeerStats{
+		Classes:       make(map[string]PeerClassCount),
+		OtherSoftware: make(map[string]int),
+	}
+
+	// SQLite rejects an empty IN list, so an empty known set becomes a constant
+	known, other := `0`, `1`
+	softwareArgs := make([]any, 0, len(knownSoftware))
+	if len(knownSoftware) > 0 {
+		known = `f.software IN (` + placeholders(len(knownSoftware)) + `)`
+		other = `f.software NOT IN (` + placeholders(len(knownSoftware)) + `)`
+		for _, sw := range knownSoftware {
+			softwareArgs = append(softwareArgs, sw)
+		}
+	}
+
+	rows, err := s.db.Query(`
+		SELECT CASE
+				WHEN `+known+` THEN '`+PeerKnown+`'
+				WHEN f.software IS NOT NULL THEN '`+PeerOtherSoftware+`'
+				WHEN fp.status = ? THEN '`+PeerUnreachable+`'
+				ELSE '`+PeerUnprobed+`'
+			END AS class,
+			COUNT(*), COUNT(DISTINCT e.peer_id)
+		FROM peers e
+		JOIN probes p ON p.run_id = e.run_id AND p.instance_id = e.instance_id AND p.stage = ?
+		LEFT JOIN instance_facts f ON f.run_id = e.run_id AND f.instance_id = e.peer_id
+		LEFT JOIN probes fp ON fp.run_id = e.run_id AND fp.instance_id = e.peer_id AND fp.stage = ?
+		WHERE e.run_id = ? AND p.status = ?
+		GROUP BY class
+	`, append(softwareArgs, StatusFailed, StageProcess, StageFilter, runID, StatusSuccess)...)
+	if err != nil {
+		return stats, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var class string
+		var c PeerClassCount
+		if err := rows.Scan(&class, &c.Edges, &c.Peers); err != nil {
+			return stats, err
+		}
+		stats.Classes[class] = c
+		stats.Edges += c.Edges
+		stats.Peers += c.Peers
+	}
+	if err := rows.Err(); err != nil {
+		return stats, err
+	}
+
+	rows, err = s.db.Query(`
+		SELECT f.software, COUNT(*) FROM instance_facts f
+		WHERE f.run_id = ? AND f.software IS NOT NULL AND `+other+`
+			AND f.instance_id IN (
+				SELECT e.peer_id FROM peers e
+				JOIN probes p ON p.run_id = e.run_id AND p.instance_id = e.instance_id AND p.stage = ?
+				WHERE e.run_id = ? AND p.status = ?
+			)
+		GROUP BY f.software
+	`, append(append([]any{runID}, softwareArgs...), StageProcess, runID, StatusSuccess)...)
+	if err != nil {
+		return stats, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var software string
+		var count int
+		if err := rows.Scan(&software, &count); err != nil {
+			return stats, err
+		}
+		stats.OtherSoftware[software] = count
+	}
+	return stats, rows.Err()
+}
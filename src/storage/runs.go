@@ -0,0 +1,153 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrNoRuns is returned when a run is needed but nothing has been crawled yet
+var ErrNoRuns = errors.New("no crawl runs in the database")
+
+// Run is one crawl of the network. Every probe and fact belongs to exactly one run.
+type Run struct {
+	ID         int64
+	StartedAt  time.Time
+	FinishedAt *time.Time
+	Pinned     bool
+	Instances  int
+}
+
+// StartRun returns the unfinished run, creating a new one if every run has
+// finished. Stages share the unfinished run so an interrupted crawl resumes
+// into the same snapshot.
+func (s *Store) StartRun() (Run, error) {
+	run, err := s.OpenRun()
+	if err == nil || !errors.Is(err, sql.ErrNoRows) {
+		return run, err
+	}
+
+	res, err := s.db.Exec(`INSERT INTO runs (started_at) VALUES (CURRENT_TIMESTAMP)`)
+	if err != nil {
+		return Run{}, fmt.Errorf("failed to create run: %w", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return Run{}, err
+	}
+	fmt.Printf("Started crawl run %d\n", id)
+	return s.GetRun(id)
+}
+
+// OpenRun returns the latest unfinished run, or sql.ErrNoRows if there is none
+func (s *Store) OpenRun() (Run, error) {
+	return s.queryRun(`WHERE r.finished_at IS NULL ORDER BY r.id DESC LIMIT 1`)
+}
+
+// GetRun returns the run with the given ID
+func (s *Store) GetRun(id int64) (Run, error) {
+	run, err := s.queryRun(`WHERE r.id = ?`, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Run{}, fmt.Errorf("run %d does not exist", id)
+	}
+	return run, err
+}
+
+// ActiveRun returns the run readers should use by default: the unfinished run
+// if a crawl is in progress, otherwise the baseline
+func (s *Store) ActiveRun() (Run, error) {
+	run, err := s.OpenRun()
+	if errors.Is(err, sql.ErrNoRows) {
+		return s.BaselineRun()
+	}
+	return run, err
+}
+
+// BaselineRun returns the pinned run, or the latest finished run if none is pinned
+func (s *Store) BaselineRun() (Run, error) {
+	run, err := s.queryRun(`WHERE r.pinned = 1 LIMIT 1`)
+	if errors.Is(err, sql.ErrNoRows) {
+		run, err = s.queryRun(`WHERE r.finished_at IS NOT NULL ORDER BY r.id DESC LIMIT 1`)
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return Run{}, ErrNoRuns
+	}
+	return run, err
+}
+
+// RunOrBaseline returns the run with the given ID, or the baseline run for 0
+func (s *Store) RunOrBaseline(id int64) (Run, error) {
+	if id == 0 {
+		return s.BaselineRun()
+	}
+	return s.GetRun(id)
+}
+
+// FinishRun marks a run as complete so the next crawl starts a new one
+func (s *Store) FinishRun(id int64) error {
+	res, err := s.db.Exec(`UPDATE runs SET finished_at = CURRENT_TIMESTAMP WHERE id = ? AND finished_at IS NULL`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("run %d does not exist or is already finished", id)
+	}
+	return nil
+}
+
+// PinRun makes the run the analysis baseline, unpinning any other run
+func (s *Store) PinRun(id int64) error {
+	if _, err := s.GetRun(id); err != nil {
+		return err
+	}
+	_, err := s.db.Exec(`UPDATE runs SET pinned = (id = ?)`, id)
+	return err
+}
+
+// UnpinRun clears the analysis baseline so the latest finished run is used
+func (s *Store) UnpinRun() error {
+	_, err := s.db.Exec(`UPDATE runs SET pinned = 0`)
+	return err
+}
+
+// ListRuns returns every run, oldest first
+func (s *Store) ListRuns() ([]Run, error) {
+	return s.queryRuns(`ORDER BY r.id`)
+}
+
+func (s *Store) queryRun(where string, args ...any) (Run, error) {
+	runs, err := s.queryRuns(where, args...)
+	if err != nil {
+		return Run{}, err
+	}
+	if len(runs) == 0 {
+		return Run{}, sql.ErrNoRows
+	}
+	return runs[0], nil
+}
+
+func (s *Store) queryRuns(where string, args ...any) ([]Run, error) {
+	rows, err := s.db.Query(`
+		SELECT r.id, r.started_at, r.finished_at, r.pinned,
+			(SELECT COUNT(DISTINCT instance_id) FROM probes p WHERE p.run_id = r.id)
+		FROM runs r `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var runs []Run
+	for rows.Next() {
+		var r Run
+		var finished sql.NullTime
+		if err := rows.Scan(&r.ID, &r.StartedAt, &finished, &r.Pinned, &r.Instances); err != nil {
+			return nil, err
+		}
+		if finished.Valid {
+			r.FinishedAt = &finished.Time
+		}
+		runs = append(runs, r)
+	}
+	return runs, rows.Err()
+}
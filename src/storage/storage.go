@@ -0,0 +1,658 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Probe status constants shared by every stage
+const (
+	StatusPending = "pending"
+	StatusRunning = "running"
+	StatusSuccess = "success"
+	StatusFailed  = "failed"
+	// StatusSkipped marks an instance that opted out of crawling; the probe's
+	// error holds the reason
+	StatusSkipped = "skipped"
+)
+
+// Stage names used to track probe progress
+const (
+	StageFilter      = "filter"
+	StageProcess     = "process"
+	StageCollectData = "collect_data"
+)
+
+// Store is the single SQLite database shared by every stage
+type Store struct {
+	db *sql.DB
+}
+
+// NodeInfo holds the facts collect_data gathers about an instance
+type NodeInfo struct {
+	IP            string
+	ASN           uint
+	ASOrg         string
+	CountryCode   string
+	UserCount     int
+	PostCount     int
+	CloudProvider string
+	// CountrySource and ASNSource name the database build the country and
+	// the AS were looked up in
+	CountrySource string
+	ASNSource     string
+	// Addresses is every address the domain resolved to, the one IP is
+	// first
+	Addresses []Address
+	// DNS is the CNAME chain, name servers and mail exchangers of the
+	// domain, nil if they were not looked up or the lookups failed
+	DNS []DNSRecord
+	// CloudProvider hosts the origin of the instance and CDN sits in front
+	// of it, each with a confidence between 0 and 1 and the evidence for it
+	HostingConfidence float64
+	CDN               string
+	CDNConfidence     float64
+	HostingEvidence   []HostingEvidence
+}
+
+// InstanceRecord is an instance with every fact known about it. Facts that
+// were never collected are nil.
+type InstanceRecord struct {
+	Domain        string
+	Software      *string
+	IP            *string
+	ASN           *int64
+	ASOrg         *string
+	CountryCode   *string
+	UserCount     *int64
+	PostCount     *int64
+	CloudProvider *string
+	CountrySource *string
+	ASNSource     *string
+}
+
+// Open opens the database at path and upgrades its schema to the latest version
+func Open(path string) (*Store, error) {
+	db, err := sql.Open("sqlite3", path+"?_busy_timeout=10000&_journal_mode=WAL&_foreign_keys=on")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	// Writes are serialised on one connection so concurrent workers never hit SQLITE_BUSY
+	db.SetMaxOpenConns(1)
+
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &Store{db: db}, nil
+}
+
+// Close closes the underlying database
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Version returns the schema version of the database
+func (s *Store) Version() (int, error) {
+	return schemaVersion(s.db)
+}
+
+// InitProbes adds the given domains as instances and queues a pending probe
+// for the stage in the run for each one that doesn't have a probe yet
+func (s *Store) InitProbes(runID int64, stage string, domains []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	instStmt, err := tx.Prepare(`INSERT OR IGNORE INTO instances (domain) VALUES (?)`)
+	if err != nil {
+		return err
+	}
+	defer instStmt.Close()
+
+	probeStmt, err := tx.Prepare(`
+		INSERT OR IGNORE INTO probes (run_id, instance_id, stage, status, last_updated)
+		SELECT ?, id, ?, ?, CURRENT_TIMESTAMP FROM instances WHERE domain = ?
+	`)
+	if err != nil {
+		return err
+	}
+	defer probeStmt.Close()
+
+	for _, domain := range domains {
+		if _, err := instStmt.Exec(domain); err != nil {
+			return err
+		}
+		if _, err := probeStmt.Exec(runID, stage, StatusPending, domain); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// ResetInterrupted puts probes of the stage in the run that were running
+// when the tool stopped back into the pending state
+func (s *Store) ResetInterrupted(runID int64, stage string) error {
+	_, err := s.db.Exec(`
+		UPDATE probes
+		SET status = ?, last_updated = CURRENT_TIMESTAMP
+		WHERE run_id = ? AND stage = ? AND status = ?
+	`, StatusPending, runID, stage, StatusRunning)
+	return err
+}
+
+// DomainsWithStatus returns the domains whose probe for the stage in the run
+// has the given status
+func (s *Store) DomainsWithStatus(runID int64, stage, status string) ([]string, error) {
+	return s.queryDomains(`
+		SELECT i.domain FROM probes p JOIN instances i ON i.id = p.instance_id
+		WHERE p.run_id = ? AND p.stage = ? AND p.status = ?
+		ORDER BY i.domain
+	`, runID, stage, status)
+}
+
+// DomainsWithSoftware returns the domains whose filter probe in the run
+// succeeded with one of the given software names
+func (s *Store) DomainsWithSoftware(runID int64, software []string) ([]string, error) {
+	if len(software) == 0 {
+		return nil, nil
+	}
+	args := []any{runID, StageFilter, StatusSuccess}
+	for _, name := range software {
+		args = append(args, name)
+	}
+	return s.queryDomains(`
+		SELECT i.domain FROM probes p
+		JOIN instances i ON i.id = p.instance_id
+		JOIN instance_facts f ON f.run_id = p.run_id AND f.instance_id = p.instance_id
+		WHERE p.run_id = ? AND p.stage = ? AND p.status = ?
+		AND f.software IN (`+placeholders(len(software))+`)
+		ORDER BY i.domain
+	`, args...)
+}
+
+// ProbeCounts returns the number of probes of the stage in the run in each status
+func (s *Store) ProbeCounts(runID int64, stage string) (map[string]int, error) {
+	rows, err := s.db.Query(`SELECT status, COUNT(*) FROM probes WHERE run_id = ? AND stage = ? GROUP BY status`, runID, stage)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var status string
+		var count int
+		if err := rows.Scan(&status, &count); err != nil {
+			return nil, err
+		}
+		counts[status] = count
+	}
+	return counts, rows.Err()
+}
+
+// Probe is the outcome of one stage for one instance
+type Probe struct {
+	Domain string
+	Status string
+	Error  string
+}
+
+// Probes returns every probe of the stage in the run, ordered by domain
+func (s *Store) Probes(runID int64, stage string) ([]Probe, error) {
+	rows, err := s.db.Query(`
+		SELECT i.domain, p.status, COALESCE(p.error, '') FROM probes p
+		JOIN instances i ON i.id = p.instance_id
+		WHERE p.run_id = ? AND p.stage = ?
+		ORDER BY i.domain
+	`, runID, stage)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var probes []Probe
+	for rows.Next() {
+		var p Probe
+		if err := rows.Scan(&p.Domain, &p.Status, &p.Error); err != nil {
+			return nil, err
+		}
+		probes = append(probes, p)
+	}
+	return probes, rows.Err()
+}
+
+// SetStatus updates the probe of a domain for the stage in the run. errorMsg
+// is stored only for failed and skipped probes.
+func (s *Store) SetStatus(runID int64, stage, domain, status, errorMsg string) error {
+	var errValue any
+	if status == StatusFailed || status == StatusSkipped {
+		errValue = errorMsg
+	}
+	_, err := s.db.Exec(`
+		UPDATE probes
+		SET status = ?, error = ?, last_updated = CURRENT_TIMESTAMP
+		WHERE run_id = ? AND stage = ? AND instance_id = (SELECT id FROM instances WHERE domain = ?)
+	`, status, errValue, runID, stage, domain)
+	return err
+}
+
+// SetSoftware records the software a domain runs in the run and marks its
+// filter probe successful
+func (s *Store) SetSoftware(runID int64, domain, software string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO instance_facts (run_id, instance_id, software)
+		SELECT ?, id, ? FROM instances WHERE domain = ?
+		ON CONFLICT (run_id, instance_id) DO UPDATE SET software = excluded.software
+	`, runID, software, domain)
+	if err != nil {
+		return err
+	}
+	if err := setStatusTx(tx, runID, StageFilter, domain, StatusSuccess); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SetPeers replaces the peers of a domain in the run and marks its process
+// probe successful. Peers that aren't known instances yet are added.
+func (s *Store) SetPeers(runID int64, domain string, peers []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var id int64
+	if err := tx.QueryRow(`SELECT id FROM instances WHERE domain = ?`, domain).Scan(&id); err != nil {
+		return fmt.Errorf("unknown instance %s: %w", domain, err)
+	}
+
+	if _, err := tx.Exec(`DELETE FROM peers WHERE run_id = ? AND instance_id = ?`, runID, id); err != nil {
+		return err
+	}
+
+	instStmt, err := tx.Prepare(`INSERT OR IGNORE INTO instances (domain) VALUES (?)`)
+	if err != nil {
+		return err
+	}
+	defer instStmt.Close()
+
+	peerStmt, err := tx.Prepare(`
+		INSERT OR IGNORE INTO peers (run_id, instance_id, peer_id)
+		SELECT ?, ?, id FROM instances WHERE domain = ?
+	`)
+	if err != nil {
+		return err
+	}
+	defer peerStmt.Close()
+
+	for _, peer := range peers {
+		if _, err := instStmt.Exec(peer); err != nil {
+			return err
+		}
+		if _, err := peerStmt.Exec(runID, id, peer); err != nil {
+			return err
+		}
+	}
+
+	if err := setStatusTx(tx, runID, StageProcess, domain, StatusSuccess); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SetNodeInfo records the facts collected about a domain in the run and
+// marks its collect_data probe successful
+func (s *Store) SetNodeInfo(runID int64, domain string, info NodeInfo) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO instance_facts (run_id, instance_id, user_count, post_count)
+		SELECT ?, id, ?, ? FROM instances WHERE domain = ?
+		ON CONFLICT (run_id, instance_id) DO UPDATE SET
+			user_count = excluded.user_count,
+			post_count = excluded.post_count
+	`, runID, info.UserCount, info.PostCount, domain)
+	if err != nil {
+		return err
+	}
+
+	flags := summarizeAddresses(info.Addresses)
+	_, err = tx.Exec(`
+		INSERT OR REPLACE INTO geo_facts (run_id, instance_id, ip, asn, as_org, country_code, cloud_provider,
+			country_source, asn_source, addresses, ipv4, ipv6, multi_country, multi_asn,
+			cdn, cdn_confidence, hosting_confidence)
+		SELECT ?, id, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ? FROM instances WHERE domain = ?
+	`, runID, info.IP, nullIfZero(info.ASN), nullIfEmpty(info.ASOrg), nullIfEmpty(info.CountryCode), nullIfEmpty(info.CloudProvider),
+		nullIfEmpty(info.CountrySource), nullIfEmpty(info.ASNSource),
+		len(info.Addresses), flags.ipv4, flags.ipv6, flags.multiCountry, flags.multiASN,
+		nullIfEmpty(info.CDN), info.CDNConfidence, info.HostingConfidence, domain)
+	if err != nil {
+		return err
+	}
+
+	if err := setAddressesTx(tx, runID, domain, info.Addresses); err != nil {
+		return err
+	}
+	if err := setDNSRecordsTx(tx, runID, domain, info.DNS); err != nil {
+		return err
+	}
+	if err := setHostingEvidenceTx(tx, runID, domain, info.HostingEvidence); err != nil {
+		return err
+	}
+
+	if err := setStatusTx(tx, runID, StageCollectData, domain, StatusSuccess); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// EdgeFilter restricts the peer edges CountPeerEdges and EachPeerEdge visit
+type EdgeFilter struct {
+	// PeerSoftware keeps only peers identified as running one of these names
+	// in the same run; nil keeps every peer, as every reported peer is stored
+	PeerSoftware []string
+	// Reciprocal keeps only edges whose peer also reports the instance
+	Reciprocal bool
+}
+
+// CountPeerEdges returns the number of peer edges EachPeerEdge visits with
+// the same arguments
+func (s *Store) CountPeerEdges(runID int64, filter EdgeFilter) (int, error) {
+	where, args := peerEdgeFilter(runID, filter)
+	var count int
+	err := s.db.QueryRow(`
+		SELECT COUNT(*) FROM peers e
+		JOIN probes p ON p.run_id = e.run_id AND p.instance_id = e.instance_id AND p.stage = ?
+		WHERE `+where, args...).Scan(&count)
+	return count, err
+}
+
+// EachPeerEdge calls fn for every peer edge in the run of every instance whose
+// process probe succeeded that passes filter, grouped by domain. fn must not
+// use the store.
+func (s *Store) EachPeerEdge(runID int64, filter EdgeFilter, fn func(domain, peer string) error) error {
+	where, args := peerEdgeFilter(runID, filter)
+	rows, err := s.db.Query(`
+		SELECT i.domain, pi.domain FROM peers e
+		JOIN probes p ON p.run_id = e.run_id AND p.instance_id = e.instance_id AND p.stage = ?
+		JOIN instances i ON i.id = e.instance_id
+		JOIN instances pi ON pi.id = e.peer_id
+		WHERE `+where+`
+		ORDER BY i.domain, pi.domain
+	`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var domain, peer string
+		if err := rows.Scan(&domain, &peer); err != nil {
+			return err
+		}
+		if err := fn(domain, peer); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// peerEdgeFilter builds the WHERE clause shared by CountPeerEdges,
+// EachPeerEdge and EachEdgeDiff, with the arguments of the whole query
+func peerEdgeFilter(runID int64, filter EdgeFilter) (string, []any) {
+	where := `e.run_id = ? AND p.status = ?`
+	args := []any{StageProcess, runID, StatusSuccess}
+	if len(filter.PeerSoftware) > 0 {
+		where += ` AND e.peer_id IN (
+			SELECT instance_id FROM instance_facts WHERE run_id = e.run_id AND software IN (` + placeholders(len(filter.PeerSoftware)) + `))`
+		for _, sw := range filter.PeerSoftware {
+			args = append(args, sw)
+		}
+	}
+	if filter.Reciprocal {
+		where += ` AND EXISTS (
+			SELECT 1 FROM peers r WHERE r.run_id = e.run_id AND r.instance_id = e.peer_id AND r.peer_id = e.instance_id)`
+	}
+	return where, args
+}
+
+// InstancesWithStatus returns every instance whose probe for the stage in the
+// run has the given status, with all of its facts from that run
+func (s *Store) InstancesWithStatus(runID int64, stage, status string) ([]InstanceRecord, error) {
+	rows, err := s.db.Query(`
+		SELECT i.domain, f.software, g.ip, g.asn, g.as_org, g.country_code,
+			f.user_count, f.post_count, g.cloud_provider, g.country_source, g.asn_source
+		FROM probes p
+		JOIN instances i ON i.id = p.instance_id
+		LEFT JOIN instance_facts f ON f.run_id = p.run_id AND f.instance_id = i.id
+		LEFT JOIN geo_facts g ON g.run_id = p.run_id AND g.instance_id = i.id
+		WHERE p.run_id = ? AND p.stage = ? AND p.status = ?
+		ORDER BY i.domain
+	`, runID, stage, status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []InstanceRecord
+	for rows.Next() {
+		var r InstanceRecord
+		err := rows.Scan(&r.Domain, &r.Software, &r.IP, &r.ASN, &r.ASOrg, &r.CountryCode,
+			&r.UserCount, &r.PostCount, &r.CloudProvider, &r.CountrySource, &r.ASNSource)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
+
+// ImportLegacyProcessDB imports the process_nodes table of a node_process.db
+// file written by older versions of the process stage into the unfinished
+// run. Files that don't exist or were already imported are skipped.
+func (s *Store) ImportLegacyProcessDB(path string) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(abs); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	var imported int
+	err = s.db.QueryRow(`SELECT COUNT(*) FROM legacy_imports WHERE path = ?`, abs).Scan(&imported)
+	if err != nil || imported > 0 {
+		return err
+	}
+
+	legacy, err := sql.Open("sqlite3", abs+"?mode=ro")
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer legacy.Close()
+
+	rows, err := legacy.Query(`SELECT domain, status, error, peers FROM process_nodes`)
+	if err != nil {
+		return fmt.Errorf("failed to read process_nodes from %s: %w", path, err)
+	}
+	type legacyNode struct {
+		domain, status string
+		errorMsg       sql.NullString
+		peers          sql.NullString
+	}
+	var nodes []legacyNode
+	for rows.Next() {
+		var n legacyNode
+		if err := rows.Scan(&n.domain, &n.status, &n.errorMsg, &n.peers); err != nil {
+			rows.Close()
+			return err
+		}
+		nodes = append(nodes, n)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	run, err := s.StartRun()
+	if err != nil {
+		return err
+	}
+	runID := run.ID
+
+	domains := make([]string, 0, len(nodes))
+	for _, n := range nodes {
+		domains = append(domains, n.domain)
+	}
+	if err := s.InitProbes(runID, StageProcess, domains); err != nil {
+		return err
+	}
+
+	for _, n := range nodes {
+		switch n.status {
+		case "completed":
+			var peers []string
+			if n.peers.Valid && n.peers.String != "" {
+				if err := json.Unmarshal([]byte(n.peers.String), &peers); err != nil {
+					return fmt.Errorf("invalid peers for %s: %w", n.domain, err)
+				}
+			}
+			if err := s.SetPeers(runID, n.domain, peers); err != nil {
+				return err
+			}
+		case "failed":
+			if err := s.SetStatus(runID, StageProcess, n.domain, StatusFailed, n.errorMsg.String); err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err = s.db.Exec(`INSERT INTO legacy_imports (path) VALUES (?)`, abs)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Imported %d nodes from legacy process database %s\n", len(nodes), path)
+	return nil
+}
+
+func setStatusTx(tx *sql.Tx, runID int64, stage, domain, status string) error {
+	_, err := tx.Exec(`
+		UPDATE probes
+		SET status = ?, error = NULL, last_updated = CURRENT_TIMESTAMP
+		WHERE run_id = ? AND stage = ? AND instance_id = (SELECT id FROM instances WHERE domain = ?)
+	`, status, runID, stage, domain)
+	return err
+}
+
+func (s *Store) queryDomains(query string, args ...any) ([]string, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	domains := []string{}
+	for rows.Next() {
+		var domain string
+		if err := rows.Scan(&domain); err != nil {
+			return nil, err
+		}
+		domains = append(domains, domain)
+	}
+	return domains, rows.Err()
+}
+
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+func nullIfEmpty(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// nullIfZero stores an unknown number, such as the AS of an address no
+// database covers, as NULL
+func nullIfZero(n uint) any {
+	if n == 0 {
+		return nil
+	}
+	return n
+}
+
+// EachEdgeDiff calls fn for every peer edge passing filter that is in runB
+// but not runA (added) and in runA but not runB (removed). Only edges of
+// instances whose process probe succeeded in both runs are compared, so an
+// instance that failed in one run does not lose or gain all of its edges.
+// fn must not use the store.
+func (s *Store) EachEdgeDiff(runA, runB int64, filter EdgeFilter, fn func(domain, peer string, added bool) error) error {
+	for _, added := range []bool{true, false} {
+		from, to := runA, runB
+		if !added {
+			from, to = runB, runA
+		}
+		toWhere, toArgs := peerEdgeFilter(to, filter)
+		fromWhere, fromArgs := peerEdgeFilter(from, filter)
+		args := append(append(toArgs, fromArgs...), from, StageProcess, StatusSuccess)
+		rows, err := s.db.Query(`
+			SELECT i.domain, pi.domain FROM (
+				SELECT e.instance_id, e.peer_id FROM peers e
+				JOIN probes p ON p.run_id = e.run_id AND p.instance_id = e.instance_id AND p.stage = ?
+				WHERE `+toWhere+`
+				EXCEPT
+				SELECT e.instance_id, e.peer_id FROM peers e
+				JOIN probes p ON p.run_id = e.run_id AND p.instance_id = e.instance_id AND p.stage = ?
+				WHERE `+fromWhere+`
+			) e
+			JOIN instances i ON i.id = e.instance_id
+			JOIN instances pi ON pi.id = e.peer_id
+			WHERE e.instance_id IN (
+				SELECT instance_id FROM probes WHERE run_id = ? AND stage = ? AND status = ?)
+			ORDER BY i.domain, pi.domain
+		`, args...)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var domain, peer string
+			if err := rows.Scan(&domain, &peer); err != nil {
+				rows.Close()
+				return err
+			}
+			if err := fn(domain, peer, added); err != nil {
+				rows.Close()
+				return err
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}